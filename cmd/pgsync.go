@@ -81,7 +81,7 @@ var pgsyncCmd = &cobra.Command{
 			Logger:    logger,
 		}
 
-		err = pgsync.Sync(ctx, options)
+		_, err = pgsync.Sync(ctx, options)
 		if err != nil {
 			if !errors.Is(err, sql.ErrTxDone) {
 				logger.Sugar().Fatal(err)
@@ -0,0 +1,26 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// acquireConn returns a connection from the pool of db, waiting no longer than timeout (if set) for one to be free.
+// name is what db is called in the error returned when it times out
+func acquireConn(ctx context.Context, db *sql.DB, timeout time.Duration, name string) (*sql.Conn, error) {
+	acquireCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		acquireCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	conn, err := db.Conn(acquireCtx)
+	if err != nil && errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, fmt.Errorf("%w: no %s connection was free within %s", ErrAcquireTimeout, name, timeout)
+	}
+	return conn, err
+}
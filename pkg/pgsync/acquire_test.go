@@ -0,0 +1,43 @@
+package pgsync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncAcquireTimeout(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	pg.SetMaxOpenConns(1)
+
+	// the only connection of the pool is taken, and isn't given back until the sync has given up
+	held, err := pg.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	start := time.Now()
+	_, err = Sync(context.Background(), &SyncOptions{
+		Postgres:       pg,
+		AskGit:         newSource(t, commitRows()),
+		TableName:      "commits",
+		Query:          "SELECT hash, additions FROM commits",
+		Logger:         zap.NewNop(),
+		AcquireTimeout: 50 * time.Millisecond,
+	})
+	if !errors.Is(err, ErrAcquireTimeout) {
+		t.Fatalf("expected ErrAcquireTimeout, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the sync to give up after its timeout, took %s", elapsed)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
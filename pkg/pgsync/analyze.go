@@ -0,0 +1,22 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// maxStatisticsTarget is the largest default_statistics_target Postgres accepts
+const maxStatisticsTarget = 10000
+
+// analyzeTable collects the planner statistics of table with default_statistics_target set to target
+// for the rest of the transaction (see SyncOptions.StatisticsTarget)
+func analyzeTable(ctx context.Context, tx *sql.Tx, schema, table string, target int) error {
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL default_statistics_target = %d", target)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("ANALYZE %s", QuoteAlways.qualify(schema, table))); err != nil {
+		return fmt.Errorf("could not analyze %s: %w", QuoteAlways.qualify(schema, table), err)
+	}
+	return nil
+}
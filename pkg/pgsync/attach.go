@@ -0,0 +1,40 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// attachDatabases attaches the database files of databases to conn by their schema names, in order of name
+// (see SyncOptions.AttachDatabases), returning a function that detaches those it attached, to be called
+// whether or not attaching them all succeeded. SQLite quotes identifiers as Postgres does
+func attachDatabases(ctx context.Context, conn *sql.Conn, l *zap.SugaredLogger, databases map[string]string) (func(), error) {
+	names := make([]string, 0, len(databases))
+	for name := range databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var attached []string
+	detach := func() {
+		// the connection goes back to the pool, where an attached database would keep its name taken
+		for _, name := range attached {
+			if _, err := conn.ExecContext(context.Background(), fmt.Sprintf("DETACH DATABASE %s", pq.QuoteIdentifier(name))); err != nil {
+				l.Errorf("could not detach database %s: %v", name, err)
+			}
+		}
+	}
+
+	for _, name := range names {
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf("ATTACH DATABASE ? AS %s", pq.QuoteIdentifier(name)), databases[name]); err != nil {
+			return detach, fmt.Errorf("could not attach database %s: %w", pq.QuoteIdentifier(name), err)
+		}
+		attached = append(attached, name)
+	}
+	return detach, nil
+}
@@ -0,0 +1,76 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// backupLayout is the layout of the time in the name of a backup table (see SyncOptions.KeepBackups), to the microsecond
+// once its point is taken out, which sorts backups by name in the order they were made
+const backupLayout = "20060102150405.000000"
+
+// backupName matches the names of the backups of a table after its name, including those named to the second
+// (by earlier versions), which sort before any made later
+const backupName = `_bak_\d{14}(\d{6})?$`
+
+// backupTable returns the name of the backup of table swapped out at swapped
+func backupTable(table string, swapped time.Time) string {
+	return fmt.Sprintf("%s_bak_%s", table, strings.Replace(swapped.UTC().Format(backupLayout), ".", "", 1))
+}
+
+// nextBackupTable returns the name of the backup of table swapped out at swapped, moved on a microsecond at a time
+// past any backup of that name that already exists, so that one swap never takes the name of another's backup
+func nextBackupTable(ctx context.Context, tx *sql.Tx, table string, swapped time.Time) (string, error) {
+	for {
+		name := backupTable(table, swapped)
+		kind, err := relationKind(ctx, tx, name)
+		if err != nil || kind == "" {
+			return name, err
+		}
+		swapped = swapped.Add(time.Microsecond)
+	}
+}
+
+// pruneBackups drops the backups of table in schema (or the current schema, if empty) but the keep most recent ones,
+// returning the names of those dropped
+func pruneBackups(ctx context.Context, tx *sql.Tx, schema, table string, keep int) ([]string, error) {
+	like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(table) + `\_bak\_%`
+	rows, err := tx.QueryContext(ctx, `SELECT c.relname FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'r' AND n.nspname = coalesce(nullif($1, ''), current_schema()) AND c.relname LIKE $2 ORDER BY 1 DESC`, schema, like)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	backup := regexp.MustCompile(`^` + regexp.QuoteMeta(table) + backupName)
+	var backups []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if backup.MatchString(name) {
+			backups = append(backups, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(backups) <= keep {
+		return nil, nil
+	}
+
+	for _, name := range backups[keep:] {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", QuoteAlways.qualify(schema, name))); err != nil {
+			return nil, fmt.Errorf("could not drop backup %s: %w", pq.QuoteIdentifier(name), err)
+		}
+	}
+	return backups[keep:], nil
+}
@@ -0,0 +1,53 @@
+package pgsync
+
+import (
+	"fmt"
+	"strings"
+)
+
+// booleanStrings are the text values read as booleans, in lower case
+var booleanStrings = map[string]bool{
+	"true": true, "t": true, "yes": true, "y": true, "on": true, "1": true,
+	"false": false, "f": false, "no": false, "n": false, "off": false, "0": false,
+}
+
+// parseBoolean returns the boolean s is the text of, ignoring case and surrounding space, and whether it's one
+func parseBoolean(s string) (bool, bool) {
+	b, ok := booleanStrings[strings.ToLower(strings.TrimSpace(s))]
+	return b, ok
+}
+
+// booleanTransform returns a rowTransform that loads the text values of the boolean columns of defs as booleans,
+// failing on any it can't read as one. It returns nil if there are no such columns
+func booleanTransform(colNames []string, defs []columnDef) rowTransform {
+	var columns []int
+	for c := range colNames {
+		if defs[c].Type == "boolean" {
+			columns = append(columns, c)
+		}
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	return func(values []interface{}) ([]interface{}, error) {
+		for _, c := range columns {
+			var s string
+			switch v := values[c].(type) {
+			case string:
+				s = v
+			case []byte:
+				s = string(v)
+			default:
+				continue
+			}
+
+			b, ok := parseBoolean(s)
+			if !ok {
+				return nil, fmt.Errorf("column %s: %q is not a boolean", colNames[c], s)
+			}
+			values[c] = b
+		}
+		return values, nil
+	}
+}
@@ -0,0 +1,145 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+// errDatabaseLocked is what a lockedSourceDriver query fails with, like SQLite's SQLITE_BUSY
+var errDatabaseLocked = errors.New("database is locked")
+
+// lockedSourceDriver is a database/sql driver for a source database that's locked (by another process) until
+// released. Like SQLite, queries wait for the lock for as long as the connection's busy_timeout, then fail
+type lockedSourceDriver struct {
+	released time.Time
+}
+
+type lockedSourceConn struct {
+	d           *lockedSourceDriver
+	busyTimeout time.Duration
+}
+type lockedSourceStmt struct {
+	c     *lockedSourceConn
+	query string
+}
+
+func (d *lockedSourceDriver) Open(string) (driver.Conn, error) { return &lockedSourceConn{d: d}, nil }
+
+func (c *lockedSourceConn) Prepare(query string) (driver.Stmt, error) {
+	return &lockedSourceStmt{c, query}, nil
+}
+func (c *lockedSourceConn) Close() error              { return nil }
+func (c *lockedSourceConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func (s *lockedSourceStmt) Close() error  { return nil }
+func (s *lockedSourceStmt) NumInput() int { return -1 }
+func (s *lockedSourceStmt) Exec([]driver.Value) (driver.Result, error) {
+	var ms int64
+	if _, err := fmt.Sscanf(s.query, "PRAGMA busy_timeout = %d", &ms); err != nil {
+		return nil, err
+	}
+	s.c.busyTimeout = time.Duration(ms) * time.Millisecond
+	return driver.RowsAffected(0), nil
+}
+func (s *lockedSourceStmt) Query([]driver.Value) (driver.Rows, error) {
+	wait := time.Until(s.c.d.released)
+	if wait > s.c.busyTimeout {
+		time.Sleep(s.c.busyTimeout)
+		return nil, errDatabaseLocked
+	}
+	time.Sleep(wait)
+	return &slowSourceRows{d: &slowSourceDriver{rows: 2}}, nil
+}
+
+func TestSyncSourceBusyTimeout(t *testing.T) {
+	d := &lockedSourceDriver{}
+	sql.Register("pgsync-locked-source", d)
+
+	sync := func(timeout time.Duration) error {
+		pg, mock, _ := sqlmock.New()
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"abc", int64(2)})
+		expectSwap(mock)
+		expectProvenance(mock)
+		mock.ExpectCommit()
+
+		askgit, err := sql.Open("pgsync-locked-source", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer askgit.Close()
+
+		// the lock is held by someone else for the first 50ms of the sync
+		d.released = time.Now().Add(50 * time.Millisecond)
+		_, err = Sync(context.Background(), &SyncOptions{
+			Postgres:          pg,
+			AskGit:            askgit,
+			TableName:         "commits",
+			Query:             "SELECT hash, additions FROM commits",
+			Logger:            zap.NewNop(),
+			SourceBusyTimeout: timeout,
+		})
+		return err
+	}
+
+	if err := sync(time.Second); err != nil {
+		t.Fatalf("expected the sync to wait out the lock, got: %v", err)
+	}
+
+	if err := sync(10 * time.Millisecond); err == nil || !strings.Contains(err.Error(), "database is locked") {
+		t.Fatalf("expected the sync to give up on the lock, got: %v", err)
+	}
+}
+
+func TestSyncSourceRetry(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	// the repository is being updated the first time the query runs
+	source.ExpectQuery("FROM commits").WillReturnError(errDatabaseLocked)
+	source.ExpectQuery("FROM commits").WillReturnRows(commitRows())
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	options := &SyncOptions{
+		Postgres:    pg,
+		AskGit:      askgit,
+		TableName:   "commits",
+		Query:       "SELECT hash, additions FROM commits",
+		Logger:      zap.NewNop(),
+		SourceRetry: &SourceRetry{Backoff: time.Millisecond},
+	}
+	if _, err := Sync(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+
+	// an error that won't go away fails the sync straight away, before anything is done in Postgres
+	missing := errors.New("no such table: commits")
+	source.ExpectQuery("FROM commits").WillReturnError(missing)
+	if _, err := Sync(context.Background(), options); !errors.Is(err, missing) {
+		t.Fatalf("expected the query's error, got: %v", err)
+	}
+
+	for _, m := range []sqlmock.Sqlmock{mock, source} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package pgsync
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// ByteaEncoding is how binary values are encoded in a column of the query's results
+type ByteaEncoding int
+
+const (
+	// ByteaRaw is for columns holding the bytes themselves, as a blob (or text)
+	ByteaRaw ByteaEncoding = iota
+	// ByteaHex is for columns holding the bytes as hex encoded text
+	ByteaHex
+	// ByteaBase64 is for columns holding the bytes as standard base64 encoded text
+	ByteaBase64
+)
+
+// decodeBytea returns the bytes encoded in value
+func decodeBytea(value interface{}, encoding ByteaEncoding) (interface{}, error) {
+	var text []byte
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		text = v
+	case string:
+		text = []byte(v)
+	default:
+		return nil, fmt.Errorf("cannot load %T as bytea", value)
+	}
+
+	switch encoding {
+	case ByteaHex:
+		decoded := make([]byte, hex.DecodedLen(len(text)))
+		_, err := hex.Decode(decoded, text)
+		return decoded, err
+	case ByteaBase64:
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+		n, err := base64.StdEncoding.Decode(decoded, text)
+		return decoded[:n], err
+	default:
+		return text, nil
+	}
+}
+
+// byteaTransform returns a rowTransform that decodes the values of the named bytea columns
+func byteaTransform(colNames []string, columns map[string]ByteaEncoding) (rowTransform, error) {
+	encodings := make(map[int]ByteaEncoding, len(columns))
+	for name, encoding := range columns {
+		i := columnIndex(colNames, name)
+		if i < 0 {
+			return nil, invalidOptions("bytea column is not in the query results: %s", name)
+		}
+		encodings[i] = encoding
+	}
+
+	return func(values []interface{}) ([]interface{}, error) {
+		for i, encoding := range encodings {
+			decoded, err := decodeBytea(values[i], encoding)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", colNames[i], err)
+			}
+			values[i] = decoded
+		}
+		return values, nil
+	}, nil
+}
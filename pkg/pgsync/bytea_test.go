@@ -0,0 +1,74 @@
+package pgsync
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestDecodeBytea(t *testing.T) {
+	original := []byte{0x00, 0xde, 0xad, 0xbe, 0xef, 0xff}
+
+	cases := []struct {
+		value    interface{}
+		encoding ByteaEncoding
+	}{
+		{original, ByteaRaw},
+		{"00deadbeefff", ByteaHex},
+		{base64.StdEncoding.EncodeToString(original), ByteaBase64},
+		{[]byte(base64.StdEncoding.EncodeToString(original)), ByteaBase64},
+	}
+
+	for _, c := range cases {
+		decoded, err := decodeBytea(c.value, c.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded.([]byte), original) {
+			t.Fatalf("%v (encoding %d): expected %x, got %x", c.value, c.encoding, original, decoded)
+		}
+	}
+
+	if _, err := decodeBytea("not base64!", ByteaBase64); err == nil {
+		t.Fatal("expected an error decoding invalid base64")
+	}
+}
+
+func TestSyncByteaColumns(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	original := []byte("\x89PNG\r\n\x1a\n")
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("path").OfType("TEXT", ""),
+		sqlmock.NewColumn("contents").OfType("TEXT", ""),
+	).AddRow("logo.png", base64.StdEncoding.EncodeToString(original))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"contents" bytea`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"files_temp"`, []driver.Value{"logo.png", original})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:     pg,
+		AskGit:       newSource(t, source),
+		TableName:    "files",
+		Query:        "SELECT path, contents FROM files",
+		Logger:       zap.NewNop(),
+		ByteaColumns: map[string]ByteaEncoding{"contents": ByteaBase64},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,72 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// stagingPrefix starts the comment pgsync marks a staging table committed ahead of its sync with, which is followed by
+// the time the table was created
+const stagingPrefix = "askgit-pgsync staging created="
+
+// markStaging sets the comment of table (already quoted) to mark it as a staging table created at created
+func markStaging(ctx context.Context, db *sql.DB, table string, created time.Time) error {
+	comment := stagingPrefix + created.UTC().Format(time.RFC3339Nano)
+	_, err := db.ExecContext(ctx, fmt.Sprintf("COMMENT ON TABLE %s IS %s", table, pq.QuoteLiteral(comment)))
+	return err
+}
+
+// stagingCreated returns when the staging table with comment was created, or false if the comment isn't a staging mark
+func stagingCreated(comment string) (time.Time, bool) {
+	if !strings.HasPrefix(comment, stagingPrefix) {
+		return time.Time{}, false
+	}
+	created, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(comment, stagingPrefix))
+	return created, err == nil
+}
+
+// CleanupStaging drops the staging tables in schema (or the current schema, if empty) that were created more than
+// olderThan ago and left behind by syncs that failed part way. Only the staging tables of parallel loads
+// (see SyncOptions.CopyParallelism) outlive a failed sync, as every other is rolled back with it, and only those pgsync
+// marked as its own are dropped. Returns the number of tables dropped
+func CleanupStaging(ctx context.Context, pg *sql.DB, schema string, olderThan time.Duration) (int, error) {
+	if pg == nil {
+		return 0, invalidOptions("a postgres database is required")
+	}
+
+	rows, err := pg.QueryContext(ctx, `SELECT c.relname, obj_description(c.oid, 'pg_class') FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'r' AND n.nspname = coalesce(nullif($1, ''), current_schema()) ORDER BY 1`, schema)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	cutoff := time.Now().Add(-olderThan)
+	var stale []string
+	for rows.Next() {
+		var name string
+		var comment sql.NullString
+		if err := rows.Scan(&name, &comment); err != nil {
+			return 0, err
+		}
+		if created, ok := stagingCreated(comment.String); ok && created.Before(cutoff) {
+			stale = append(stale, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, name := range stale {
+		if _, err := pg.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", QuoteAlways.qualify(schema, name))); err != nil {
+			return i, fmt.Errorf("could not drop staging table %s: %w", pq.QuoteIdentifier(name), err)
+		}
+	}
+	return len(stale), nil
+}
@@ -0,0 +1,38 @@
+package pgsync
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCleanupStaging(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	stale := stagingPrefix + time.Now().Add(-48*time.Hour).UTC().Format(time.RFC3339Nano)
+	fresh := stagingPrefix + time.Now().UTC().Format(time.RFC3339Nano)
+
+	mock.ExpectQuery("SELECT c.relname, obj_description").WithArgs("git").
+		WillReturnRows(sqlmock.NewRows([]string{"relname", "comment"}).
+			AddRow("commits", "askgit-pgsync version=1 query_sha256=abc").
+			AddRow("commits_temp", stale).
+			AddRow("files_temp", fresh).
+			AddRow("users_temp", nil))
+	// only the stale staging table is dropped, not the fresh one, nor tables pgsync didn't mark as staging
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE IF EXISTS "git"."commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	n, err := CleanupStaging(context.Background(), pg, "git", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 staging table to be dropped, got: %d", n)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
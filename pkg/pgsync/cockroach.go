@@ -0,0 +1,84 @@
+//go:build cockroachdb
+// +build cockroachdb
+
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CockroachOptions are the options of a sync into a CockroachDB cluster
+type CockroachOptions struct {
+	SyncOptions
+	// MaxRetries is the number of times the sync is run again when CockroachDB aborts its transaction
+	// for the client to retry, as it does to keep transactions serializable. Defaults to 5
+	MaxRetries int
+}
+
+// SQLiteTypeToCockroachType maps SQLite column types to CockroachDB column types. It's SQLiteTypeToPostgresType
+// but for integers, which are INT8 (bigint), CockroachDB's native integer type
+func SQLiteTypeToCockroachType(col *sql.ColumnType) string {
+	switch sqliteTypeName(col) {
+	case "INT", "INTEGER":
+		return "bigint"
+	default:
+		return SQLiteTypeToPostgresType(col)
+	}
+}
+
+// cockroachTypeMapper is the TypeMapper used when CockroachOptions.TypeMapper isn't set
+func cockroachTypeMapper(col *sql.ColumnType) (string, error) {
+	return SQLiteTypeToCockroachType(col), nil
+}
+
+// retryableCockroachError returns whether err is CockroachDB asking for the transaction to be retried
+func retryableCockroachError(err error) bool {
+	return serializationFailure(err)
+}
+
+// SyncCockroachDB imports the results of an askgit query into a CockroachDB table, as Sync does into Postgres.
+// CockroachDB loads the results with COPY, as Postgres does, and swaps the table in with renames in the sync transaction.
+// A sync whose transaction CockroachDB aborts to be retried is run again from the start, re-running the query,
+// up to MaxRetries times. Options that rely on Postgres features CockroachDB doesn't have (the write-ahead log
+// position, UNLOGGED tables and column storage) aren't supported
+func SyncCockroachDB(ctx context.Context, options *CockroachOptions) (*SyncResult, error) {
+	switch {
+	case options.CaptureCommitLSN || options.OnCommit != nil:
+		return nil, invalidOptions("CockroachDB has no write-ahead log position to capture")
+	case options.CopyParallelism > 1:
+		return nil, invalidOptions("CockroachDB can't load an UNLOGGED staging table over several connections")
+	case len(options.ColumnStorage) > 0 || len(options.ColumnCompression) > 0:
+		return nil, invalidOptions("CockroachDB has no column storage or compression settings")
+	}
+
+	maxRetries := options.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = 5
+	}
+
+	syncOptions := options.SyncOptions
+	if syncOptions.TypeMapper == nil {
+		syncOptions.TypeMapper = cockroachTypeMapper
+	}
+	l := syncOptions.Logger.Sugar().With(zap.String("cockroachTable", syncOptions.TableName))
+
+	// a Syncer reads a QueryReader only once, so each attempt runs the same query
+	syncer := NewSyncer(&syncOptions)
+	for attempt := 1; ; attempt++ {
+		result, err := syncer.Run(ctx)
+		if !retryableCockroachError(err) || attempt > maxRetries {
+			return result, err
+		}
+
+		l.Warnf("sync transaction aborted for retry (attempt %d of %d): %v", attempt, maxRetries, err)
+		select {
+		case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,132 @@
+//go:build cockroachdb
+// +build cockroachdb
+
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+func TestSyncCockroachDBRetry(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	retry := &pq.Error{Code: "40001", Message: "restart transaction: TransactionRetryWithProtoRefreshError"}
+
+	// the first attempt is aborted at commit, the second goes through, re-running the query
+	for attempt := 0; attempt < 2; attempt++ {
+		source.ExpectQuery(".").WillReturnRows(commitRows())
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`"additions" bigint`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+		expectSwap(mock)
+		expectProvenance(mock)
+		if attempt == 0 {
+			mock.ExpectCommit().WillReturnError(retry)
+		} else {
+			mock.ExpectCommit()
+		}
+	}
+
+	result, err := SyncCockroachDB(context.Background(), &CockroachOptions{
+		SyncOptions: SyncOptions{
+			Postgres:  pg,
+			AskGit:    askgit,
+			TableName: "commits",
+			Query:     "SELECT hash, additions FROM commits",
+			Logger:    zap.NewNop(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 2 {
+		t.Fatalf("expected 2 rows, got %d", result.Rows)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncCockroachDBGivesUp(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	retry := &pq.Error{Code: "40001", Message: "restart transaction"}
+	for attempt := 0; attempt < 2; attempt++ {
+		source.ExpectQuery(".").WillReturnRows(commitRows())
+		mock.ExpectBegin().WillReturnError(retry)
+	}
+
+	_, err := SyncCockroachDB(context.Background(), &CockroachOptions{
+		SyncOptions: SyncOptions{
+			Postgres:  pg,
+			AskGit:    askgit,
+			TableName: "commits",
+			Query:     "SELECT hash, additions FROM commits",
+			Logger:    zap.NewNop(),
+		},
+		MaxRetries: 1,
+	})
+	if !errors.Is(err, retry) {
+		t.Fatalf("expected the retry error once retries ran out, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSyncCockroachDBNode syncs into the CockroachDB node at PGSYNC_COCKROACH_URL
+// (such as postgresql://root@localhost:26257/defaultdb?sslmode=disable), twice so that the second replaces the first
+func TestSyncCockroachDBNode(t *testing.T) {
+	url := os.Getenv("PGSYNC_COCKROACH_URL")
+	if url == "" {
+		t.Skip("PGSYNC_COCKROACH_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	table := fmt.Sprintf("pgsync_test_%d", os.Getpid())
+	defer db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", pq.QuoteIdentifier(table)))
+
+	for _, rows := range []*sqlmock.Rows{commitRows(), manyCommitRows(10)} {
+		result, err := SyncCockroachDB(context.Background(), &CockroachOptions{
+			SyncOptions: SyncOptions{
+				Postgres:  db,
+				AskGit:    newSource(t, rows),
+				TableName: table,
+				Query:     "SELECT hash, additions FROM commits",
+				Logger:    zap.NewNop(),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var count int64
+		if err := db.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", pq.QuoteIdentifier(table))).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != result.Rows {
+			t.Fatalf("expected the table to have the %d rows synced, has %d", result.Rows, count)
+		}
+	}
+}
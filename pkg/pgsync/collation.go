@@ -0,0 +1,68 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// applyCollations sets the collation of each of defs named in collations, checking that they're text columns
+// and that the collations are installed
+func applyCollations(ctx context.Context, tx *sql.Tx, defs []columnDef, collations map[string]string) error {
+	if len(collations) == 0 {
+		return nil
+	}
+
+	wanted := make([]string, 0, len(collations))
+	for name, collation := range collations {
+		found := false
+		for i := range defs {
+			if defs[i].Name != name {
+				continue
+			}
+			if defs[i].Type != "text" {
+				return invalidOptions("column %s is %s, only text columns can have a collation", name, defs[i].Type)
+			}
+			defs[i].Collation = collation
+			found = true
+		}
+		if !found {
+			return invalidOptions("column with a collation is not in the table: %s", name)
+		}
+		wanted = append(wanted, collation)
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT collname FROM pg_collation WHERE collname = ANY($1)", pq.Array(wanted))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	installed := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		installed[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, collation := range wanted {
+		if !installed[collation] {
+			missing = append(missing, collation)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return invalidOptions("collations are not installed in the target database: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
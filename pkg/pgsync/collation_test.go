@@ -0,0 +1,81 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncCollations(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("FROM pg_collation").WillReturnRows(sqlmock.NewRows([]string{"collname"}).AddRow("und-x-icu"))
+	mock.ExpectExec(regexp.QuoteMeta(`"hash" text COLLATE "und-x-icu",`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:   pg,
+		AskGit:     newSource(t, commitRows()),
+		TableName:  "commits",
+		Query:      "SELECT hash, additions FROM commits",
+		Logger:     zap.NewNop(),
+		Collations: map[string]string{"hash": "und-x-icu"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncCollationsInvalid(t *testing.T) {
+	cases := map[string]struct {
+		collations map[string]string
+		installed  bool
+		mentions   string
+	}{
+		"not installed":  {map[string]string{"hash": "tlh-x-icu"}, true, "tlh-x-icu"},
+		"not text":       {map[string]string{"additions": "C"}, false, "only text columns"},
+		"unknown column": {map[string]string{"author": "C"}, false, "author"},
+	}
+
+	for name, c := range cases {
+		pg, mock, _ := sqlmock.New()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		if c.installed {
+			mock.ExpectQuery("FROM pg_collation").WillReturnRows(sqlmock.NewRows([]string{"collname"}))
+		}
+		mock.ExpectRollback()
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:   pg,
+			AskGit:     newSource(t, commitRows()),
+			TableName:  "commits",
+			Query:      "SELECT hash, additions FROM commits",
+			Logger:     zap.NewNop(),
+			Collations: c.collations,
+		})
+		if !errors.Is(err, ErrInvalidOptions) || !strings.Contains(err.Error(), c.mentions) {
+			t.Fatalf("%s: expected an invalid options error mentioning %q, got: %v", name, c.mentions, err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncOnCommit(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT pg_current_wal_lsn()").WillReturnRows(sqlmock.NewRows([]string{"pg_current_wal_lsn"}).AddRow("0/16B3748"))
+
+	var calls []string
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		OnCommit:  func(lsn string) { calls = append(calls, lsn) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) != 1 || calls[0] != "0/16B3748" {
+		t.Fatalf("expected the hook to be called once with the commit LSN, got: %v", calls)
+	}
+
+	if result.CommitLSN != "0/16B3748" {
+		t.Fatalf("expected the commit LSN in the result, got: %q", result.CommitLSN)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncOnCommitCaptureFails(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT pg_current_wal_lsn()").WillReturnError(errors.New("recovery is in progress"))
+
+	called := false
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		OnCommit:  func(string) { called = true },
+	})
+	if err != nil {
+		t.Fatalf("expected the committed sync to succeed, got: %v", err)
+	}
+
+	if called {
+		t.Fatal("expected the hook not to be called without an LSN")
+	}
+}
+
+func TestSyncOnComplete(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	type completion struct {
+		result *SyncResult
+		err    error
+	}
+	var calls []completion
+	options := &SyncOptions{
+		Postgres:   pg,
+		AskGit:     newSource(t, commitRows()),
+		TableName:  "commits",
+		Query:      "SELECT hash, additions FROM commits",
+		Logger:     zap.NewNop(),
+		OnComplete: func(result *SyncResult, err error) { calls = append(calls, completion{result, err}) },
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0].result != result || calls[0].err != nil {
+		t.Fatalf("expected the hook to be called once with the result, got: %+v", calls)
+	}
+
+	// a failure before anything is written
+	failed := errors.New("connection refused")
+	mock.ExpectBegin().WillReturnError(failed)
+
+	options.AskGit = newSource(t, commitRows())
+	if _, err := Sync(context.Background(), options); !errors.Is(err, failed) {
+		t.Fatalf("expected the sync to fail, got: %v", err)
+	}
+	if len(calls) != 2 || calls[1].result != nil || !errors.Is(calls[1].err, failed) {
+		t.Fatalf("expected the hook to be called with the error, got: %+v", calls)
+	}
+
+	// and one caught by validation, before the sync starts
+	options.TableName = ""
+	if _, err := Sync(context.Background(), options); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected invalid options, got: %v", err)
+	}
+	if len(calls) != 3 || !errors.Is(calls[2].err, ErrInvalidOptions) {
+		t.Fatalf("expected the hook to be called with the validation error, got: %+v", calls)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,108 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ConflictPolicy is what an append does with rows that violate a unique constraint of the table (see SyncOptions.OnConflict)
+type ConflictPolicy int
+
+const (
+	// ConflictError fails the sync on the first row that violates a unique constraint (the default). The results are
+	// loaded straight into the table, as COPY can't skip rows
+	ConflictError ConflictPolicy = iota
+	// ConflictSkip leaves the row already in the table as it is and skips the appended one (ON CONFLICT DO NOTHING).
+	// With ConflictColumns, only rows that violate the unique constraint on them are skipped. Rows repeated in the
+	// results are skipped after the first of them
+	ConflictSkip
+	// ConflictUpdate updates the row already in the table on ConflictColumns with the appended one's values
+	// (ON CONFLICT DO UPDATE), setting UpdateColumns or every column that isn't a conflict column. Rows that don't
+	// change are left alone. Rows repeated in the results are handled as DuplicateKeys says
+	ConflictUpdate
+)
+
+// appendOnConflictStatement returns the INSERT that appends the rows of staging to table, handling those that violate
+// a unique constraint (the one on keys, if there are any) as policy says
+func appendOnConflictStatement(table, staging string, columns, keys, updates []string, policy ConflictPolicy) string {
+	var target string
+	if len(keys) > 0 {
+		target = fmt.Sprintf(" (%s)", quoteAll("", keys))
+	}
+
+	action := "DO NOTHING"
+	if policy == ConflictUpdate {
+		values := updates
+		if len(values) == 0 {
+			for _, col := range columns {
+				if !contains(keys, col) {
+					values = append(values, col)
+				}
+			}
+		}
+
+		// a row whose every column is a key has nothing to update
+		if len(values) > 0 {
+			set := make([]string, len(values))
+			for i, col := range values {
+				set[i] = fmt.Sprintf("%s = EXCLUDED.%s", pq.QuoteIdentifier(col), pq.QuoteIdentifier(col))
+			}
+			action = fmt.Sprintf("DO UPDATE SET %s WHERE (%s) IS DISTINCT FROM (%s)",
+				strings.Join(set, ", "), quoteAll("t", values), quoteAll("EXCLUDED", values))
+		}
+	}
+
+	return fmt.Sprintf("INSERT INTO %s AS t (%s) SELECT %s FROM %s ON CONFLICT%s %s",
+		pq.QuoteIdentifier(table), quoteAll("", columns), quoteAll("", columns), pq.QuoteIdentifier(staging), target, action)
+}
+
+// appendOnConflict appends the rows of the loaded staging table to the table of options, skipping or updating with them
+// the rows they conflict with as OnConflict says, and records how many rows were appended or updated on result. If the
+// table doesn't exist yet, it's created along with a unique index on ConflictColumns, for later appends to conflict on.
+// With ConflictUpdate, keys repeated in the staging table are handled as DuplicateKeys says first (see dedupeKeys).
+// The staging table is dropped afterwards
+func appendOnConflict(ctx context.Context, tx *sql.Tx, options *SyncOptions, staging string, columns []string, result *SyncResult) error {
+	table, keys, policy := options.TableName, options.ConflictColumns, options.OnConflict
+
+	var err error
+	if policy == ConflictUpdate {
+		// Postgres can't update the same row twice in one INSERT, nor would updating it with either row be right
+		if result.Deduplicated, err = dedupeKeys(ctx, tx, staging, keys, false, options.DuplicateKeys); err != nil {
+			return err
+		}
+	}
+
+	kind, err := relationKind(ctx, tx, table)
+	if err != nil {
+		return err
+	}
+
+	if kind == "" {
+		t := pq.QuoteIdentifier(table)
+		statements := []string{fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS)", t, pq.QuoteIdentifier(staging))}
+		if len(keys) > 0 {
+			statements = append(statements, fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s)",
+				pq.QuoteIdentifier(table+"_"+strings.Join(keys, "_")+"_key"), t, quoteAll("", keys)))
+		}
+		for _, stmt := range statements {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, appendOnConflictStatement(table, staging, columns, keys, options.UpdateColumns, policy))
+	if err != nil {
+		return schemaMismatch(table, err)
+	}
+	if result.Inserted, err = res.RowsAffected(); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", pq.QuoteIdentifier(staging)))
+	return err
+}
@@ -0,0 +1,202 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+func TestAppendOnConflictStatement(t *testing.T) {
+	cases := []struct {
+		keys, updates []string
+		policy        ConflictPolicy
+		expected      string
+	}{
+		{nil, nil, ConflictSkip, `INSERT INTO "commits" AS t ("hash", "additions") SELECT "hash", "additions" FROM "commits_temp" ON CONFLICT DO NOTHING`},
+		{[]string{"hash"}, nil, ConflictSkip, `INSERT INTO "commits" AS t ("hash", "additions") SELECT "hash", "additions" FROM "commits_temp" ON CONFLICT ("hash") DO NOTHING`},
+		{[]string{"hash"}, nil, ConflictUpdate, `INSERT INTO "commits" AS t ("hash", "additions") SELECT "hash", "additions" FROM "commits_temp" ON CONFLICT ("hash") DO UPDATE SET "additions" = EXCLUDED."additions" WHERE (t."additions") IS DISTINCT FROM (EXCLUDED."additions")`},
+		// with every column a key, there's nothing to update
+		{[]string{"hash", "additions"}, nil, ConflictUpdate, `INSERT INTO "commits" AS t ("hash", "additions") SELECT "hash", "additions" FROM "commits_temp" ON CONFLICT ("hash", "additions") DO NOTHING`},
+	}
+
+	for _, c := range cases {
+		if stmt := appendOnConflictStatement("commits", "commits_temp", []string{"hash", "additions"}, c.keys, c.updates, c.policy); stmt != c.expected {
+			t.Fatalf("expected %s, got %s", c.expected, stmt)
+		}
+	}
+}
+
+func TestSyncOnConflict(t *testing.T) {
+	// abc is already in the table, with a different number of additions
+	sync := func(policy ConflictPolicy, expect func(mock sqlmock.Sqlmock)) (*SyncResult, error) {
+		pg, mock, _ := sqlmock.New()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectTableColumns(mock, "hash", "text", "additions", "integer")
+		expectGeneratedColumns(mock)
+		expect(mock)
+
+		result, err := Sync(context.Background(), &SyncOptions{
+			Postgres:        pg,
+			AskGit:          newSource(t, commitRows()),
+			TableName:       "commits",
+			Query:           "SELECT hash, additions FROM commits",
+			Logger:          zap.NewNop(),
+			Mode:            ModeEnsureAndAppend,
+			ConflictColumns: []string{"hash"},
+			OnConflict:      policy,
+		})
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+		return result, err
+	}
+
+	// staged appends let Postgres' unique index decide what's inserted, which the mock stands in for with the rows affected.
+	// Updates are only made once the staging table is known to have no repeated keys
+	staged := func(action string, affected int64, update bool) func(mock sqlmock.Sqlmock) {
+		return func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+			expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+			if update {
+				expectNoDuplicateKeys(mock)
+			}
+			mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+			mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits" AS t ("hash", "additions") SELECT "hash", "additions" FROM "commits_temp" ON CONFLICT ("hash") ` + action)).
+				WillReturnResult(sqlmock.NewResult(0, affected))
+			mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+			expectProvenance(mock)
+			mock.ExpectCommit()
+		}
+	}
+
+	// the COPY straight into the table fails on abc
+	duplicate := &pq.Error{Code: "23505", Message: `duplicate key value violates unique constraint "commits_pkey"`}
+	_, err := sync(ConflictError, func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+		prep := mock.ExpectPrepare(regexp.QuoteMeta(`COPY "commits"`))
+		prep.ExpectExec().WithArgs("abc", int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+		prep.ExpectExec().WithArgs("def", int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+		prep.ExpectExec().WithArgs().WillReturnError(duplicate)
+		mock.ExpectRollback()
+	})
+	if !errors.Is(err, duplicate) {
+		t.Fatalf("expected the unique violation, got: %v", err)
+	}
+
+	// only def is appended
+	result, err := sync(ConflictSkip, staged("DO NOTHING", 1, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 2 || result.Inserted != 1 {
+		t.Fatalf("expected 2 rows loaded and 1 appended, got %d and %d", result.Rows, result.Inserted)
+	}
+
+	// def is appended and abc updated
+	result, err = sync(ConflictUpdate, staged(`DO UPDATE SET "additions" = EXCLUDED."additions" WHERE (t."additions") IS DISTINCT FROM (EXCLUDED."additions")`, 2, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 2 || result.Inserted != 2 {
+		t.Fatalf("expected 2 rows loaded and 2 appended or updated, got %d and %d", result.Rows, result.Inserted)
+	}
+}
+
+func TestSyncOnConflictCreatesTable(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// a table that doesn't exist yet is created with a unique index for later appends to conflict on
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock)
+	expectGeneratedColumns(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectNoDuplicateKeys(mock)
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits" (LIKE "commits_temp" INCLUDING DEFAULTS)`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE UNIQUE INDEX "commits_hash_key" ON "commits" ("hash")`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits" AS t`)).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, commitRows()),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		Mode:            ModeEnsureAndAppend,
+		ConflictColumns: []string{"hash"},
+		OnConflict:      ConflictUpdate,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Inserted != 2 {
+		t.Fatalf("expected 2 rows to be appended, got %d", result.Inserted)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncOnConflictDuplicateKeys(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// abc is in the source twice, which Postgres can't update the same row with in one statement,
+	// so only the first of them is kept
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+	).AddRow("abc", int64(1)).AddRow("def", int64(2)).AddRow("abc", int64(3))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "additions", "integer")
+	expectGeneratedColumns(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)}, []driver.Value{"abc", int64(3)})
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "commits_temp" AS a USING "commits_temp" AS b WHERE a."hash" = b."hash" AND a.ctid > b.ctid`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits" AS t ("hash", "additions") SELECT "hash", "additions" FROM "commits_temp" ON CONFLICT ("hash") DO UPDATE`)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, source),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		Mode:            ModeEnsureAndAppend,
+		ConflictColumns: []string{"hash"},
+		OnConflict:      ConflictUpdate,
+		DuplicateKeys:   DuplicateKeysKeepFirst,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rows != 3 || result.Deduplicated != 1 || result.Inserted != 2 {
+		t.Fatalf("expected 3 rows loaded, 1 dropped and one appended or updated per key, got: %+v", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,80 @@
+package pgsync
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ControlCharacterPolicy is what a sync does with the control characters of text values, NUL in particular, which
+// Postgres can't store in text (as some commit messages have). Tabs, line feeds and carriage returns are left alone
+type ControlCharacterPolicy int
+
+const (
+	// ControlCharactersKeep loads text as it is, so a NUL fails the COPY (the default)
+	ControlCharactersKeep ControlCharacterPolicy = iota
+	// ControlCharactersStrip removes control characters from text
+	ControlCharactersStrip
+	// ControlCharactersReplace replaces each control character of text with U+FFFD, the replacement character
+	ControlCharactersReplace
+	// ControlCharactersError fails the sync, naming the column, on text with a control character
+	ControlCharactersError
+)
+
+// controlCharacter reports whether r is a C0 control character (or DEL) that's not whitespace Postgres keeps the meaning of
+func controlCharacter(r rune) bool {
+	return (r < 0x20 && r != '\t' && r != '\n' && r != '\r') || r == 0x7f
+}
+
+// controlCharactersTransform returns a rowTransform that applies policy to the text values of the text columns
+// of defs, or nil if there are none. Text read as bytes comes out as a string
+func controlCharactersTransform(colNames []string, defs []columnDef, policy ControlCharacterPolicy) rowTransform {
+	var text []int
+	for c, def := range defs {
+		if def.Type == "text" || strings.HasPrefix(def.Type, "character") {
+			text = append(text, c)
+		}
+	}
+	if len(text) == 0 {
+		return nil
+	}
+
+	return func(values []interface{}) ([]interface{}, error) {
+		for _, c := range text {
+			var s string
+			switch v := values[c].(type) {
+			case string:
+				s = v
+			case []byte:
+				s = string(v)
+			default:
+				continue
+			}
+			first := strings.IndexFunc(s, controlCharacter)
+			if first < 0 {
+				continue
+			}
+
+			switch policy {
+			case ControlCharactersError:
+				r, _ := utf8.DecodeRuneInString(s[first:])
+				return nil, fmt.Errorf("column %s: text has the control character %U", colNames[c], r)
+			case ControlCharactersStrip:
+				values[c] = strings.Map(func(r rune) rune {
+					if controlCharacter(r) {
+						return -1
+					}
+					return r
+				}, s)
+			case ControlCharactersReplace:
+				values[c] = strings.Map(func(r rune) rune {
+					if controlCharacter(r) {
+						return utf8.RuneError
+					}
+					return r
+				}, s)
+			}
+		}
+		return values, nil
+	}
+}
@@ -0,0 +1,61 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncControlCharacters(t *testing.T) {
+	cases := map[ControlCharacterPolicy]string{
+		ControlCharactersStrip:   "fix\tparser",
+		ControlCharactersReplace: "fix�\tparser",
+		ControlCharactersError:   "",
+	}
+
+	for policy, expected := range cases {
+		pg, mock, _ := sqlmock.New()
+
+		// a commit message with a NUL, which Postgres rejects in text, alongside a tab it keeps
+		source := sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("hash").OfType("TEXT", ""),
+			sqlmock.NewColumn("message").OfType("TEXT", ""),
+		).AddRow("abc", []byte("fix\x00\tparser"))
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		if expected != "" {
+			expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", expected})
+			expectSwap(mock)
+			expectProvenance(mock)
+			mock.ExpectCommit()
+		} else {
+			mock.ExpectPrepare("COPY")
+			mock.ExpectRollback()
+		}
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:          pg,
+			AskGit:            newSource(t, source),
+			TableName:         "commits",
+			Query:             "SELECT hash, message FROM commits",
+			Logger:            zap.NewNop(),
+			ControlCharacters: policy,
+		})
+		if expected != "" && err != nil {
+			t.Fatal(err)
+		}
+		if expected == "" && (err == nil || !strings.Contains(err.Error(), "U+0000")) {
+			t.Fatalf("expected the NUL to fail the sync, got: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("policy %d: %v", policy, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/lib/pq"
+)
+
+// copyIn returns the COPY statement for columns of table, qualified with schema if it's set.
+// The schema and table are quoted separately, a dotted name given to pq.CopyIn would be quoted as a single identifier
+func copyIn(schema, table string, columns []string) string {
+	if schema == "" {
+		return pq.CopyIn(table, columns...)
+	}
+	return pq.CopyInSchema(schema, table, columns...)
+}
+
+// copyLine matches the line (and column) of the COPY data Postgres reports an error on, in the error's context
+var copyLine = regexp.MustCompile(`line (\d+)(?:, column ([^:]+))?`)
+
+// copyError adds the row (and the column, if Postgres names it) the COPY failed on to err. Postgres reports the line of
+// the COPY data that failed, which is the row named if it's there. Otherwise it's the row that was being written, if any,
+// although an error can surface a few rows after the one that caused it
+func copyError(err error, writing int64) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		if m := copyLine.FindStringSubmatch(pqErr.Where); m != nil {
+			if m[2] != "" {
+				return fmt.Errorf("row %s, column %s: %w", m[1], m[2], err)
+			}
+			return fmt.Errorf("row %s: %w", m[1], err)
+		}
+	}
+	if writing == 0 {
+		return err
+	}
+	return fmt.Errorf("row %d: %w", writing, err)
+}
+
+// rowTransform turns the values scanned from a source row into the values COPY'd for it.
+// The returned slice may be the same one on every call
+type rowTransform func(values []interface{}) ([]interface{}, error)
+
+// copyRows streams rows into the prepared COPY statement stmt (passing each through transform, if set), completes the COPY and returns the number of rows copied.
+//
+// lib/pq's COPY statement doesn't take a context, so database/sql can only check for cancellation between writes,
+// and a single write (or the final flush) can block for as long as the connection's send buffer stays full.
+// To keep cancellation timely, the copy runs in its own goroutine and copyRows returns as soon as ctx is done,
+// whether or not the driver has let go. database/sql rolls back the transaction (discarding its connection)
+// once the blocked call returns.
+func copyRows(ctx context.Context, rows rowSource, stmt *sql.Stmt, numColumns int, transform rowTransform) (int64, error) {
+	return untilDone(ctx, func() (int64, error) {
+		return copyRowsBlocking(ctx, rows, stmt, numColumns, transform)
+	})
+}
+
+// untilDone runs copy in its own goroutine, returning its outcome or, as soon as ctx is done, ctx's error
+func untilDone(ctx context.Context, copy func() (int64, error)) (int64, error) {
+	type outcome struct {
+		rows int64
+		err  error
+	}
+
+	done := make(chan outcome, 1)
+	go func() {
+		n, err := copy()
+		done <- outcome{n, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.rows, o.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// copyRowsBlocking does the work of copyRows, returning only once the driver does
+func copyRowsBlocking(ctx context.Context, rows rowSource, stmt *sql.Stmt, numColumns int, transform rowTransform) (int64, error) {
+	// values and pointers are allocated once and overwritten by every scan, so anything
+	// that needs to hold on to a row's values beyond the COPY of that row must copy them
+	values := make([]interface{}, numColumns)
+	pointers := make([]interface{}, numColumns)
+
+	for i := 0; i < len(values); i++ {
+		pointers[i] = &values[i]
+	}
+
+	var n int64
+	for rows.Next() {
+		select {
+		default:
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return n, fmt.Errorf("could not read row %d of the query results: %w", n+1, err)
+		}
+
+		copied := values
+		if transform != nil {
+			var err error
+			if copied, err = transform(values); err != nil {
+				return n, err
+			}
+		}
+
+		if _, err := stmt.ExecContext(ctx, copied...); err != nil {
+			return n, copyError(err, n+1)
+		}
+
+		n++
+	}
+
+	// an error partway through the results ends the loop above just as the end of them does
+	if err := rows.Err(); err != nil {
+		return n, fmt.Errorf("could not read the query results after %d rows: %w", n, err)
+	}
+
+	select {
+	default:
+	case <-ctx.Done():
+		return n, ctx.Err()
+	}
+
+	// an Exec with no values flushes the COPY and waits for the server to complete it
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return n, copyError(err, 0)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,267 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// stuckCopyDriver is a database/sql driver whose COPY statements block on every write until released,
+// ignoring any context (the way a lib/pq COPY does when the connection's send buffer is full)
+type stuckCopyDriver struct {
+	release chan struct{}
+}
+
+type stuckCopyConn struct{ d *stuckCopyDriver }
+type stuckCopyStmt struct {
+	d    *stuckCopyDriver
+	copy bool
+}
+
+func (d *stuckCopyDriver) Open(string) (driver.Conn, error) { return &stuckCopyConn{d}, nil }
+
+func (c *stuckCopyConn) Prepare(query string) (driver.Stmt, error) {
+	return &stuckCopyStmt{c.d, strings.HasPrefix(query, "COPY")}, nil
+}
+func (c *stuckCopyConn) Close() error              { return nil }
+func (c *stuckCopyConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *stuckCopyConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return c, nil
+}
+func (c *stuckCopyConn) Commit() error   { return nil }
+func (c *stuckCopyConn) Rollback() error { return nil }
+
+func (s *stuckCopyStmt) Close() error  { return nil }
+func (s *stuckCopyStmt) NumInput() int { return -1 }
+func (s *stuckCopyStmt) Exec([]driver.Value) (driver.Result, error) {
+	if s.copy {
+		<-s.d.release
+	}
+	return driver.RowsAffected(0), nil
+}
+func (s *stuckCopyStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestSyncCancelDuringStuckCopy(t *testing.T) {
+	d := &stuckCopyDriver{release: make(chan struct{})}
+	defer close(d.release)
+
+	sql.Register("pgsync-stuck-copy", d)
+	pg, err := sql.Open("pgsync-stuck-copy", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = Sync(ctx, &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the sync to stop with the context's error, got: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected sync to return promptly after cancellation, took %s", elapsed)
+	}
+}
+
+func TestSyncSourceErrorMidResults(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	gitErr := errors.New("object not found")
+	source := commitRows().AddRow("ghi", int64(3)).RowError(2, gitErr)
+
+	// the two rows read before the error are copied, but the staging table is never swapped in or committed
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	prep := mock.ExpectPrepare(regexp.QuoteMeta(`COPY "commits_temp"`))
+	prep.ExpectExec().WithArgs("abc", int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs("def", int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, source),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+	})
+	if !errors.Is(err, gitErr) {
+		t.Fatalf("expected the source's error, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "after 2 rows") {
+		t.Fatalf("expected the error to say where the results failed, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncCopyErrorContext(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	badValue := &pq.Error{
+		Code:    "22P02",
+		Message: `invalid input syntax for type integer: "x"`,
+		Where:   `COPY commits_temp, line 2, column additions: "x"`,
+	}
+
+	// the error only surfaces when the COPY is flushed, Postgres says which row it was
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	prep := mock.ExpectPrepare(regexp.QuoteMeta(`COPY "commits_temp"`))
+	prep.ExpectExec().WithArgs("abc", int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs("def", int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs().WillReturnError(badValue)
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+	})
+	if !errors.Is(err, badValue) || !strings.Contains(err.Error(), `row 2, column additions: pq: invalid input syntax for type integer: "x"`) {
+		t.Fatalf("expected the error to name the row and column, got: %v", err)
+	}
+
+	// without a context from Postgres, the row being written is named
+	if err := copyError(errors.New("connection reset"), 3); err.Error() != "row 3: connection reset" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyIn(t *testing.T) {
+	if stmt := copyIn("", "commits_temp", []string{"hash"}); stmt != `COPY "commits_temp" ("hash") FROM STDIN` {
+		t.Fatalf("unexpected COPY statement: %s", stmt)
+	}
+	if stmt := copyIn("git", "commits_temp", []string{"hash"}); stmt != `COPY "git"."commits_temp" ("hash") FROM STDIN` {
+		t.Fatalf("unexpected COPY statement: %s", stmt)
+	}
+}
+
+func TestSyncCopyFreeze(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the staging table is created by the sync's own transaction, which is what makes FREEZE legal
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp" ("hash", "additions") FROM STDIN WITH (FREEZE)`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:   pg,
+		AskGit:     newSource(t, commitRows()),
+		TableName:  "commits",
+		Query:      "SELECT hash, additions FROM commits",
+		Logger:     zap.NewNop(),
+		CopyFreeze: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 2 {
+		t.Fatalf("expected 2 rows to be loaded, got %d", result.Rows)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncBulkInsertFallback(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the COPY is refused as a server (or pooler) without it does, so the same rows are loaded with a single INSERT
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("^SAVEPOINT " + bulkInsertSavepoint + "$").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectPrepare("COPY").WillReturnError(&pq.Error{Code: "0A000", Message: "COPY is not supported"})
+	mock.ExpectExec("^ROLLBACK TO SAVEPOINT " + bulkInsertSavepoint + "$").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO "commits_temp" ("hash", "additions") VALUES ($1, $2), ($3, $4), `))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits_temp" ("hash", "additions") VALUES ($1, $2), ($3, $4)`)+"$").
+		WithArgs("abc", int64(1), "def", int64(2)).WillReturnResult(sqlmock.NewResult(0, 2))
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:           pg,
+		AskGit:             newSource(t, commitRows()),
+		TableName:          "commits",
+		Query:              "SELECT hash, additions FROM commits",
+		Logger:             zap.NewNop(),
+		BulkInsertFallback: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 2 {
+		t.Fatalf("expected 2 rows inserted, got: %d", result.Rows)
+	}
+	if w := result.Warnings; len(w) == 0 || !strings.Contains(w[len(w)-1], "loaded the results with INSERTs") {
+		t.Fatalf("expected a warning that the fallback was used, got: %v", result.Warnings)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncBulkInsertFallbackProtocolViolation(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// a protocol violation usually ends the connection, so there's no falling back on it, the sync fails
+	violation := &pq.Error{Code: "08P01", Message: "unsupported pkt type: 100"}
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("^SAVEPOINT " + bulkInsertSavepoint + "$").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectPrepare("COPY").WillReturnError(violation)
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:           pg,
+		AskGit:             newSource(t, commitRows()),
+		TableName:          "commits",
+		Query:              "SELECT hash, additions FROM commits",
+		Logger:             zap.NewNop(),
+		BulkInsertFallback: true,
+	})
+	if !errors.Is(err, violation) {
+		t.Fatalf("expected the protocol violation, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
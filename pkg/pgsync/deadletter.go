@@ -0,0 +1,124 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// deadLetterSavepoint is the savepoint made before each COPY of a load with a dead letter table
+	deadLetterSavepoint = "pgsync_dead_letter"
+	// deadLetterRowSavepoint is the savepoint made before each row is retried on its own
+	deadLetterRowSavepoint = "pgsync_dead_letter_row"
+)
+
+// createDeadLetterTable creates the dead letter table, if it doesn't already exist
+func createDeadLetterTable(ctx context.Context, tx *sql.Tx, table string) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		table_name text NOT NULL,
+		row_number bigint NOT NULL,
+		row_values jsonb,
+		error text NOT NULL,
+		failed_at timestamp with time zone NOT NULL DEFAULT now()
+	)`, pq.QuoteIdentifier(table)))
+	return err
+}
+
+// deadLetterValues returns the JSON object of a row's values by column name, as recorded in the dead letter table
+func deadLetterValues(columns []string, row []interface{}) (string, error) {
+	values := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		// text read as bytes is far more readable as a string than base64
+		if b, ok := row[i].([]byte); ok && utf8.Valid(b) {
+			values[column] = string(b)
+		} else {
+			values[column] = row[i]
+		}
+	}
+
+	b, err := json.Marshal(values)
+	return string(b), err
+}
+
+// copyDeadLetter is copyRows for loads that shouldn't fail on rows Postgres rejects. When a COPY into table fails,
+// it's rolled back, and the rows it had been sent are retried one at a time. Rows that fail again are recorded in
+// the deadLetters table (against target, the table being synced), the others are kept, and a new COPY picks up with
+// the rows that follow. Returns the number of rows loaded and the number dead lettered.
+//
+// Like DebugCopy, every row of a COPY is kept in memory until the COPY completes, to be able to retry them.
+// Errors that don't come from Postgres, reading the query's results for instance, still fail the load
+func copyDeadLetter(ctx context.Context, tx *sql.Tx, rows rowSource, table string, columns []string, numColumns int, transform rowTransform, deadLetters, target string) (int64, int64, error) {
+	if err := createDeadLetterTable(ctx, tx, deadLetters); err != nil {
+		return 0, 0, err
+	}
+
+	insert := insertStatement(table, columns)
+	insertDeadLetter := fmt.Sprintf("INSERT INTO %s (table_name, row_number, row_values, error) VALUES ($1, $2, $3, $4)", pq.QuoteIdentifier(deadLetters))
+
+	var loaded, failed, offset int64
+	for {
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT "+deadLetterSavepoint); err != nil {
+			return loaded, failed, err
+		}
+
+		copied := &copyRecorder{}
+		record := copied.record
+		if transform != nil {
+			record = chainTransforms(transform, copied.record)
+		}
+
+		stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+		if err != nil {
+			return loaded, failed, err
+		}
+		n, copyErr := copyRows(ctx, rows, stmt, numColumns, record)
+		if copyErr == nil {
+			return loaded + n, failed, stmt.Close()
+		}
+		_ = stmt.Close()
+
+		// a COPY that fails with no rows to blame can't be made to succeed by retrying them
+		var pqErr *pq.Error
+		if ctx.Err() != nil || !errors.As(copyErr, &pqErr) || len(copied.rows) == 0 {
+			return loaded, failed, copyErr
+		}
+
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+deadLetterSavepoint); err != nil {
+			return loaded, failed, err
+		}
+
+		for i, row := range copied.rows {
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT "+deadLetterRowSavepoint); err != nil {
+				return loaded, failed, err
+			}
+
+			_, rowErr := tx.ExecContext(ctx, insert, row...)
+			if rowErr == nil {
+				if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT "+deadLetterRowSavepoint); err != nil {
+					return loaded, failed, err
+				}
+				loaded++
+				continue
+			}
+
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+deadLetterRowSavepoint); err != nil {
+				return loaded, failed, err
+			}
+			values, err := deadLetterValues(columns, row)
+			if err != nil {
+				return loaded, failed, err
+			}
+			if _, err := tx.ExecContext(ctx, insertDeadLetter, target, offset+int64(i)+1, values, rowErr.Error()); err != nil {
+				return loaded, failed, err
+			}
+			failed++
+		}
+		offset += int64(len(copied.rows))
+	}
+}
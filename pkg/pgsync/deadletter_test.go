@@ -0,0 +1,90 @@
+package pgsync
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+func TestSyncDeadLetterTable(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := commitRows().AddRow("ghi", int64(-1)).AddRow("jkl", int64(3)).AddRow("mno", int64(-2))
+	rejected := &pq.Error{Code: "23514", Message: `new row for relation "commits_temp" violates check constraint "additions_positive"`}
+
+	savepoint := func(name string) {
+		mock.ExpectExec("^SAVEPOINT " + name + "$").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	rollbackTo := func(name string) {
+		mock.ExpectExec("^ROLLBACK TO SAVEPOINT " + name + "$").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	insert := regexp.QuoteMeta(`INSERT INTO "commits_temp" ("hash", "additions") VALUES ($1, $2)`)
+	good := func(hash string, additions int64) {
+		savepoint(deadLetterRowSavepoint)
+		mock.ExpectExec(insert).WithArgs(hash, additions).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("^RELEASE SAVEPOINT " + deadLetterRowSavepoint).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	bad := func(row int64, hash string, additions int64, values string) {
+		savepoint(deadLetterRowSavepoint)
+		mock.ExpectExec(insert).WithArgs(hash, additions).WillReturnError(rejected)
+		rollbackTo(deadLetterRowSavepoint)
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commit_errors" (table_name, row_number, row_values, error)`)).
+			WithArgs("commits", row, values, rejected.Error()).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "commit_errors"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// the first COPY fails on the third row, so the three rows sent are retried on their own
+	savepoint(deadLetterSavepoint)
+	mock.ExpectPrepare("COPY")
+	mock.ExpectExec("COPY").WithArgs("abc", int64(1)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COPY").WithArgs("def", int64(2)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COPY").WithArgs("ghi", int64(-1)).WillReturnError(rejected)
+	rollbackTo(deadLetterSavepoint)
+	good("abc", 1)
+	good("def", 2)
+	bad(3, "ghi", -1, `{"additions":-1,"hash":"ghi"}`)
+
+	// the second picks up from the fourth row, and fails on the fifth
+	savepoint(deadLetterSavepoint)
+	mock.ExpectPrepare("COPY")
+	mock.ExpectExec("COPY").WithArgs("jkl", int64(3)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COPY").WithArgs("mno", int64(-2)).WillReturnError(rejected)
+	rollbackTo(deadLetterSavepoint)
+	good("jkl", 3)
+	bad(5, "mno", -2, `{"additions":-2,"hash":"mno"}`)
+
+	// and the third has nothing left to copy
+	savepoint(deadLetterSavepoint)
+	expectCopy(mock, `"commits_temp"`)
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, source),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		DeadLetterTable: "commit_errors",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rows != 3 || result.DeadLettered != 2 {
+		t.Fatalf("expected 3 rows loaded and 2 dead lettered, got: %+v", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
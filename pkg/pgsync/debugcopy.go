@@ -0,0 +1,96 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// copySavepoint is the savepoint made before a COPY that may need diagnosing
+const copySavepoint = "pgsync_copy"
+
+// CopyError is the error returned by a sync with DebugCopy set, when the row (and column) that made the COPY fail
+// has been found
+type CopyError struct {
+	// Row is the (1-based) position of the row in the query results
+	Row int64
+	// Column is the name of the column Postgres rejected the value of, or empty if no single column was at fault
+	Column string
+	// Err is the error Postgres reported for the row
+	Err error
+}
+
+func (e *CopyError) Error() string {
+	if e.Column == "" {
+		return fmt.Sprintf("could not copy row %d: %v", e.Row, e.Err)
+	}
+	return fmt.Sprintf("could not copy row %d, column %s: %v", e.Row, pq.QuoteIdentifier(e.Column), e.Err)
+}
+
+func (e *CopyError) Unwrap() error { return e.Err }
+
+// copyRecorder keeps a copy of every row that passes through it, for retrying a failed COPY
+type copyRecorder struct {
+	rows [][]interface{}
+}
+
+// record is a rowTransform that keeps a copy of values
+func (r *copyRecorder) record(values []interface{}) ([]interface{}, error) {
+	r.rows = append(r.rows, append([]interface{}(nil), values...))
+	return values, nil
+}
+
+// insertStatement returns an INSERT of a single row of values for columns into table
+func insertStatement(table string, columns []string) string {
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", pq.QuoteIdentifier(table), quoteAll("", columns), strings.Join(placeholders, ", "))
+}
+
+// diagnoseCopy finds the row (and column) behind copyErr, the error a COPY of rows into table failed with,
+// by rolling back to the savepoint made before the COPY and inserting the rows one at a time. Once a row fails,
+// each of its values is inserted on its own to find the column at fault. Returns a *CopyError if the row is found,
+// or otherwise copyErr
+func diagnoseCopy(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]interface{}, copyErr error) error {
+	rollback := func() error {
+		_, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+copySavepoint)
+		return err
+	}
+
+	if err := rollback(); err != nil {
+		return copyErr
+	}
+
+	insert := insertStatement(table, columns)
+
+	for r, row := range rows {
+		_, rowErr := tx.ExecContext(ctx, insert, row...)
+		if rowErr == nil {
+			continue
+		}
+		if err := rollback(); err != nil {
+			return copyErr
+		}
+
+		copyError := &CopyError{Row: int64(r + 1), Err: rowErr}
+		for c, column := range columns {
+			_, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) VALUES ($1)", pq.QuoteIdentifier(table), pq.QuoteIdentifier(column)), row[c])
+			if err == nil {
+				continue
+			}
+			if err := rollback(); err != nil {
+				return copyError
+			}
+			copyError.Column, copyError.Err = column, err
+			break
+		}
+		return copyError
+	}
+
+	return copyErr
+}
@@ -0,0 +1,74 @@
+package pgsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+func TestSyncDebugCopy(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the third of five rows has an additions value Postgres rejects
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+	)
+	for i := 1; i <= 5; i++ {
+		additions := interface{}(int64(i))
+		if i == 3 {
+			additions = "many"
+		}
+		source.AddRow(fmt.Sprintf("%03d", i), additions)
+	}
+
+	invalid := &pq.Error{Code: "22P02", Message: `invalid input syntax for type integer: "many"`}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SAVEPOINT pgsync_copy").WillReturnResult(sqlmock.NewResult(0, 0))
+	prep := mock.ExpectPrepare("COPY")
+	for i := 0; i < 5; i++ {
+		prep.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	prep.ExpectExec().WithArgs().WillReturnError(invalid)
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT pgsync_copy").WillReturnResult(sqlmock.NewResult(0, 0))
+	insertRow := regexp.QuoteMeta(`INSERT INTO "commits_temp" ("hash", "additions") VALUES ($1, $2)`)
+	mock.ExpectExec(insertRow).WithArgs("001", int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertRow).WithArgs("002", int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertRow).WithArgs("003", "many").WillReturnError(invalid)
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT pgsync_copy").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits_temp" ("hash") VALUES ($1)`)).WithArgs("003").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits_temp" ("additions") VALUES ($1)`)).WithArgs("many").WillReturnError(invalid)
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT pgsync_copy").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, source),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		DebugCopy: true,
+	})
+
+	var copyErr *CopyError
+	if !errors.As(err, &copyErr) || copyErr.Row != 3 || copyErr.Column != "additions" {
+		t.Fatalf("expected the error to name row 3, column additions, got: %v", err)
+	}
+	if !errors.Is(err, invalid) || !strings.Contains(err.Error(), `row 3, column "additions"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
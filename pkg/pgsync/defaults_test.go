@@ -0,0 +1,94 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncDefaults(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`"additions" integer DEFAULT 0,`) + `\s*` + regexp.QuoteMeta(`"content_hash" text DEFAULT 'unknown'`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`)
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:             pg,
+		AskGit:               newSource(t, sqlmock.NewRowsWithColumnDefinition(sqlmock.NewColumn("hash").OfType("TEXT", ""), sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)))),
+		TableName:            "commits",
+		Query:                "SELECT hash, additions FROM commits",
+		Logger:               zap.NewNop(),
+		AddContentHashColumn: true,
+		Defaults:             map[string]string{"additions": "0", "content_hash": "'unknown'"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncDefaultsUnknownColumn(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		Defaults:  map[string]string{"status": "'active'"},
+	})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected ErrInvalidOptions, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncRewriteDDL(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE "commits_temp" \(.*\) WITH \(fillfactor=70\)$`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:   pg,
+		AskGit:     newSource(t, commitRows()),
+		TableName:  "commits",
+		Query:      "SELECT hash, additions FROM commits",
+		Logger:     zap.NewNop(),
+		RewriteDDL: func(sql string) (string, error) { return sql + " WITH (fillfactor=70)", nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
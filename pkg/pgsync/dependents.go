@@ -0,0 +1,117 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// dependentView is a view or materialized view that (directly or through other views) depends on a table
+type dependentView struct {
+	name       string
+	kind       string
+	definition string
+}
+
+// create returns the statement that recreates the view from its recorded definition
+func (v *dependentView) create() string {
+	if v.kind == "m" {
+		return fmt.Sprintf("CREATE MATERIALIZED VIEW %s AS %s", v.name, v.definition)
+	}
+	return fmt.Sprintf("CREATE VIEW %s AS %s", v.name, v.definition)
+}
+
+// dependentViews returns the views that depend on table, in an order they can be recreated in
+// (views that depend on other dependent views come after them)
+func dependentViews(ctx context.Context, tx *sql.Tx, table string) ([]*dependentView, error) {
+	const query = `
+		WITH RECURSIVE dependents(oid, depth) AS (
+			SELECT r.ev_class, 1
+			FROM pg_depend d JOIN pg_rewrite r ON r.oid = d.objid
+			WHERE d.classid = 'pg_rewrite'::regclass AND d.refobjid = to_regclass($1) AND r.ev_class <> d.refobjid
+			UNION
+			SELECT r.ev_class, dependents.depth + 1
+			FROM dependents
+				JOIN pg_depend d ON d.refobjid = dependents.oid
+				JOIN pg_rewrite r ON r.oid = d.objid
+			WHERE d.classid = 'pg_rewrite'::regclass AND r.ev_class <> d.refobjid
+		)
+		SELECT c.oid::regclass::text, c.relkind, pg_get_viewdef(c.oid)
+		FROM dependents JOIN pg_class c ON c.oid = dependents.oid
+		GROUP BY c.oid, c.relkind
+		ORDER BY max(dependents.depth)`
+
+	rows, err := tx.QueryContext(ctx, query, pq.QuoteIdentifier(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var views []*dependentView
+	for rows.Next() {
+		var v dependentView
+		if err := rows.Scan(&v.name, &v.kind, &v.definition); err != nil {
+			return nil, err
+		}
+		views = append(views, &v)
+	}
+
+	return views, rows.Err()
+}
+
+// dependentConstraints returns the foreign keys (on other tables) that reference table
+func dependentConstraints(ctx context.Context, tx *sql.Tx, table string) ([]string, error) {
+	const query = `
+		SELECT format('constraint %I on %s', conname, conrelid::regclass)
+		FROM pg_constraint
+		WHERE contype = 'f' AND confrelid = to_regclass($1)`
+
+	rows, err := tx.QueryContext(ctx, query, pq.QuoteIdentifier(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var constraints []string
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		constraints = append(constraints, c)
+	}
+
+	return constraints, rows.Err()
+}
+
+// checkDependents looks for objects that would prevent table from being dropped once it's been swapped out.
+// Dependent views are returned so they can be recreated if cascade is set, otherwise (and for any
+// foreign keys, which can't be recreated against the new table) an error naming every blocking object is returned.
+func checkDependents(ctx context.Context, tx *sql.Tx, table string, cascade bool) ([]*dependentView, error) {
+	views, err := dependentViews(ctx, tx, table)
+	if err != nil {
+		return nil, err
+	}
+
+	constraints, err := dependentConstraints(ctx, tx, table)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocking []string
+	if !cascade {
+		for _, v := range views {
+			blocking = append(blocking, fmt.Sprintf("view %s", v.name))
+		}
+	}
+	blocking = append(blocking, constraints...)
+
+	if len(blocking) > 0 {
+		return nil, fmt.Errorf("%w: cannot replace table %s, other objects depend on it: %s", ErrDestructiveBlocked, pq.QuoteIdentifier(table), strings.Join(blocking, ", "))
+	}
+
+	return views, nil
+}
@@ -0,0 +1,88 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncDependentViewBlocks(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	mock.ExpectQuery("pg_rewrite").WithArgs(`"commits"`).WillReturnRows(
+		sqlmock.NewRows([]string{"name", "relkind", "definition"}).AddRow("recent_commits", "v", " SELECT hash FROM commits;"),
+	)
+	mock.ExpectQuery("pg_constraint").WithArgs(`"commits"`).WillReturnRows(
+		sqlmock.NewRows([]string{"constraint"}).AddRow("constraint commit_fk on reviews"),
+	)
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+	})
+	if !errors.Is(err, ErrDestructiveBlocked) {
+		t.Fatalf("expected replacing a table with dependents to be blocked, got: %v", err)
+	}
+
+	for _, blocker := range []string{"view recent_commits", "constraint commit_fk on reviews"} {
+		if !strings.Contains(err.Error(), blocker) {
+			t.Fatalf("expected error to mention %q, got: %v", blocker, err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncCascadeDependents(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	mock.ExpectQuery("pg_rewrite").WillReturnRows(
+		sqlmock.NewRows([]string{"name", "relkind", "definition"}).
+			AddRow("recent_commits", "v", " SELECT hash FROM commits;").
+			AddRow("commit_counts", "m", " SELECT count(*) FROM recent_commits;"),
+	)
+	mock.ExpectQuery("pg_constraint").WillReturnRows(sqlmock.NewRows([]string{"constraint"}))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE IF EXISTS "commits_drop" CASCADE`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE VIEW recent_commits AS  SELECT hash FROM commits;")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE MATERIALIZED VIEW commit_counts AS  SELECT count(*) FROM recent_commits;")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:          pg,
+		AskGit:            newSource(t, commitRows()),
+		TableName:         "commits",
+		Query:             "SELECT hash, additions FROM commits",
+		Logger:            zap.NewNop(),
+		CascadeDependents: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,41 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+)
+
+// ColumnInfo describes a column of the results of an askgit query (see DescribeColumns)
+type ColumnInfo struct {
+	// Name is the name of the column
+	Name string
+	// SQLiteType is the SQLite type name of the column, empty for expressions with no type affinity
+	SQLiteType string
+	// PostgresType is the type the built-in mapping (SQLiteTypeToPostgresType) gives the column
+	PostgresType string
+}
+
+// DescribeColumns returns the columns the results of query have, in order, without reading any of its rows,
+// for showing the table a sync of it would create. As with GenerateGoStruct, the query is run to discover its
+// column types, so a query with a LIMIT 0 is enough. Options that change the types of columns aren't applied
+func DescribeColumns(ctx context.Context, askgit *sql.DB, query string) ([]ColumnInfo, error) {
+	rows, err := askgit.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	if len(colTypes) == 0 {
+		return nil, ErrNoColumns
+	}
+
+	columns := make([]ColumnInfo, len(colTypes))
+	for i, col := range colTypes {
+		columns[i] = ColumnInfo{Name: col.Name(), SQLiteType: col.DatabaseTypeName(), PostgresType: SQLiteTypeToPostgresType(col)}
+	}
+	return columns, nil
+}
@@ -0,0 +1,39 @@
+package pgsync
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestDescribeColumns(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+
+	mock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+		sqlmock.NewColumn("author_when").OfType("DATETIME", ""),
+		sqlmock.NewColumn("churn").OfType("", ""),
+	))
+
+	columns, err := DescribeColumns(context.Background(), db, "SELECT hash, additions, author_when, additions + deletions AS churn FROM commits LIMIT 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ColumnInfo{
+		{Name: "hash", SQLiteType: "TEXT", PostgresType: "text"},
+		{Name: "additions", SQLiteType: "INTEGER", PostgresType: "integer"},
+		{Name: "author_when", SQLiteType: "DATETIME", PostgresType: "timestamp with time zone"},
+		{Name: "churn", SQLiteType: "", PostgresType: "text"},
+	}
+	if !reflect.DeepEqual(columns, expected) {
+		t.Fatalf("unexpected columns: %+v", columns)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
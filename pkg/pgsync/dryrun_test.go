@@ -0,0 +1,117 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncDryRunValidate(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectRollback()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:       pg,
+		AskGit:         newSource(t, commitRows()),
+		TableName:      "commits",
+		Query:          "SELECT hash, additions FROM commits",
+		Logger:         zap.NewNop(),
+		DryRunValidate: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 2 {
+		t.Fatalf("expected the dry run to report 2 rows, got %d", result.Rows)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncDryRunValidateDependentView(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	mock.ExpectQuery("pg_rewrite").WillReturnRows(
+		sqlmock.NewRows([]string{"name", "relkind", "definition"}).AddRow("recent_commits", "v", " SELECT hash FROM commits;"),
+	)
+	mock.ExpectQuery("pg_constraint").WillReturnRows(sqlmock.NewRows([]string{"constraint"}))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:       pg,
+		AskGit:         newSource(t, commitRows()),
+		TableName:      "commits",
+		Query:          "SELECT hash, additions FROM commits",
+		Logger:         zap.NewNop(),
+		DryRunValidate: true,
+	})
+	if !errors.Is(err, ErrDestructiveBlocked) || !strings.Contains(err.Error(), "view recent_commits") {
+		t.Fatalf("expected the dependent view to block the dry run, got: %v", err)
+	}
+
+	// nothing past the rollback, so nothing was committed
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncPreviewChanges(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the live table has abc (changed), and xyz, which isn't in the results: the rows are counted, none are changed
+	count := func(n int64) *sqlmock.Rows { return sqlmock.NewRows([]string{"count"}).AddRow(n) }
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "additions", "integer")
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectNoDuplicateKeys(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "commits" AS t WHERE NOT EXISTS`)).WillReturnRows(count(1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "commits" AS t WHERE EXISTS (SELECT 1 FROM "commits_temp" AS s WHERE s."hash" = t."hash" AND ((t."additions") IS DISTINCT FROM (s."additions")))`)).WillReturnRows(count(1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "commits_temp" AS s WHERE NOT EXISTS`)).WillReturnRows(count(1))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectRollback()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, commitRows()),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		Mode:            ModeMerge,
+		ConflictColumns: []string{"hash"},
+		PreviewChanges:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Inserted != 1 || result.Updated != 1 || result.Deleted != 1 {
+		t.Fatalf("expected one insert, update and delete to be previewed, got: %+v", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
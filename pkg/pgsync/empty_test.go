@@ -0,0 +1,58 @@
+package pgsync
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncOnEmpty(t *testing.T) {
+	for _, policy := range []EmptyPolicy{EmptyReplace, EmptySkip, EmptyError} {
+		pg, mock, _ := sqlmock.New()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`)
+		if policy == EmptyReplace {
+			// the populated table is swapped out for the empty one
+			expectSwap(mock)
+			expectProvenance(mock)
+			mock.ExpectCommit()
+		} else {
+			// the populated table is left alone
+			mock.ExpectRollback()
+		}
+
+		result, err := Sync(context.Background(), &SyncOptions{
+			Postgres:  pg,
+			AskGit:    newSource(t, sqlmock.NewRowsWithColumnDefinition(sqlmock.NewColumn("hash").OfType("TEXT", ""))),
+			TableName: "commits",
+			Query:     "SELECT hash FROM commits WHERE false",
+			Logger:    zap.NewNop(),
+			OnEmpty:   policy,
+		})
+
+		switch policy {
+		case EmptyReplace:
+			if err != nil || result.Skipped {
+				t.Fatalf("expected the empty results to replace the table, got %+v (%v)", result, err)
+			}
+		case EmptySkip:
+			if err != nil || !result.Skipped {
+				t.Fatalf("expected the sync to be skipped, got %+v (%v)", result, err)
+			}
+		case EmptyError:
+			if !errors.Is(err, ErrEmptyResults) {
+				t.Fatalf("expected ErrEmptyResults, got: %v", err)
+			}
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("policy %d: %v", policy, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package pgsync
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+)
+
+// envParameters are the libpq environment variables OpenFromEnv reads, and the connection parameters they set
+var envParameters = []struct{ variable, parameter string }{
+	{"PGHOST", "host"},
+	{"PGPORT", "port"},
+	{"PGUSER", "user"},
+	{"PGPASSWORD", "password"},
+	{"PGDATABASE", "dbname"},
+	{"PGSSLMODE", "sslmode"},
+}
+
+// connectionValueEscaper escapes the characters that are significant in a quoted connection string value
+var connectionValueEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// envDSN returns the key/value connection string for the libpq environment variables, as looked up by getenv.
+// Variables that aren't set are left out, so they get the driver's defaults
+func envDSN(getenv func(string) string) string {
+	var parameters []string
+	for _, p := range envParameters {
+		if value := getenv(p.variable); value != "" {
+			parameters = append(parameters, p.parameter+"='"+connectionValueEscaper.Replace(value)+"'")
+		}
+	}
+	return strings.Join(parameters, " ")
+}
+
+// OpenFromEnv opens a connection to Postgres configured by the standard libpq environment variables
+// (PGHOST, PGPORT, PGUSER, PGPASSWORD, PGDATABASE and PGSSLMODE), and checks that it works
+func OpenFromEnv() (*sql.DB, error) {
+	db, err := sql.Open("postgres", envDSN(os.Getenv))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
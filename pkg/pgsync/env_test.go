@@ -0,0 +1,28 @@
+package pgsync
+
+import "testing"
+
+func TestEnvDSN(t *testing.T) {
+	env := map[string]string{
+		"PGHOST":     "db.internal",
+		"PGPORT":     "6432",
+		"PGUSER":     "askgit",
+		"PGPASSWORD": `it's a \secret`,
+		"PGDATABASE": "git",
+		"PGSSLMODE":  "verify-full",
+		"PGAPPNAME":  "ignored",
+	}
+
+	expected := `host='db.internal' port='6432' user='askgit' password='it\'s a \\secret' dbname='git' sslmode='verify-full'`
+	if dsn := envDSN(func(name string) string { return env[name] }); dsn != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, dsn)
+	}
+
+	// unset variables are left to the driver's defaults
+	delete(env, "PGPORT")
+	delete(env, "PGPASSWORD")
+	expected = `host='db.internal' user='askgit' dbname='git' sslmode='verify-full'`
+	if dsn := envDSN(func(name string) string { return env[name] }); dsn != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, dsn)
+	}
+}
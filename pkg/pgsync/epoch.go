@@ -0,0 +1,94 @@
+package pgsync
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// EpochUnit is the unit of a column holding times since the Unix epoch
+type EpochUnit int
+
+const (
+	// EpochSeconds is for columns holding the number of seconds since the Unix epoch
+	EpochSeconds EpochUnit = iota
+	// EpochMilliseconds is for columns holding the number of milliseconds since the Unix epoch
+	EpochMilliseconds
+	// EpochDays is for columns holding the number of days since the Unix epoch, which are loaded as dates
+	EpochDays
+)
+
+// postgresType returns the type of columns of the unit
+func (u EpochUnit) postgresType() string {
+	if u == EpochDays {
+		return "date"
+	}
+	return "timestamp with time zone"
+}
+
+// epochDate returns the date, as COPY text, that is value days after the Unix epoch. A fraction of a day is dropped
+func epochDate(value interface{}) (interface{}, error) {
+	var days int64
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		days = v
+	case float64:
+		days = int64(math.Floor(v))
+	default:
+		return nil, fmt.Errorf("cannot convert %T to a number of days since the epoch", value)
+	}
+	return time.Unix(0, 0).UTC().AddDate(0, 0, int(days)).Format("2006-01-02"), nil
+}
+
+// epochTime returns the time that is value units since the Unix epoch, or the date for EpochDays
+func epochTime(value interface{}, unit EpochUnit) (interface{}, error) {
+	if unit == EpochDays {
+		return epochDate(value)
+	}
+
+	var seconds float64
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		if unit == EpochMilliseconds {
+			return time.Unix(v/1000, (v%1000)*int64(time.Millisecond)).UTC(), nil
+		}
+		return time.Unix(v, 0).UTC(), nil
+	case float64:
+		seconds = v
+	default:
+		return nil, fmt.Errorf("cannot convert %T to a time since the epoch", value)
+	}
+
+	if unit == EpochMilliseconds {
+		seconds /= 1000
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*float64(time.Second))).UTC(), nil
+}
+
+// epochTransform returns a rowTransform that converts the values of the named epoch columns to times
+func epochTransform(colNames []string, epochs map[string]EpochUnit) (rowTransform, error) {
+	units := make(map[int]EpochUnit, len(epochs))
+	for name, unit := range epochs {
+		i := columnIndex(colNames, name)
+		if i < 0 {
+			return nil, invalidOptions("epoch column is not in the query results: %s", name)
+		}
+		units[i] = unit
+	}
+
+	return func(values []interface{}) ([]interface{}, error) {
+		for i, unit := range units {
+			t, err := epochTime(values[i], unit)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", colNames[i], err)
+			}
+			values[i] = t
+		}
+		return values, nil
+	}, nil
+}
@@ -0,0 +1,117 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestEpochTime(t *testing.T) {
+	expected := time.Date(2021, 8, 3, 7, 2, 8, 500000000, time.UTC)
+
+	cases := []struct {
+		value interface{}
+		unit  EpochUnit
+		want  time.Time
+	}{
+		{int64(1627974128), EpochSeconds, expected.Truncate(time.Second)},
+		{int64(1627974128500), EpochMilliseconds, expected},
+		{1627974128.5, EpochSeconds, expected},
+		{1627974128500.0, EpochMilliseconds, expected},
+	}
+
+	for _, c := range cases {
+		got, err := epochTime(c.value, c.unit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.(time.Time).Equal(c.want) {
+			t.Fatalf("%v (unit %d): expected %s, got %s", c.value, c.unit, c.want, got)
+		}
+	}
+
+	// days are dates, before the epoch as well as after it
+	for value, want := range map[interface{}]string{int64(18842): "2021-08-03", 18842.75: "2021-08-03", int64(-1): "1969-12-31"} {
+		if got, err := epochTime(value, EpochDays); err != nil || got != want {
+			t.Fatalf("%v days: expected %s, got %v (%v)", value, want, got, err)
+		}
+	}
+
+	if got, err := epochTime(nil, EpochSeconds); err != nil || got != nil {
+		t.Fatalf("expected NULL to stay NULL, got %v (%v)", got, err)
+	}
+
+	if _, err := epochTime("yesterday", EpochSeconds); err == nil {
+		t.Fatal("expected an error converting text")
+	}
+}
+
+func TestSyncEpochColumns(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("author_when").OfType("INTEGER", int64(0)),
+		sqlmock.NewColumn("committer_when").OfType("INTEGER", int64(0)),
+		sqlmock.NewColumn("released_on").OfType("INTEGER", int64(0)),
+	).AddRow("abc", int64(1627974128), int64(1627974128500), int64(18842))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"author_when" timestamp with time zone,\s*"committer_when" timestamp with time zone,\s*"released_on" date`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{
+		"abc",
+		time.Date(2021, 8, 3, 7, 2, 8, 0, time.UTC),
+		time.Date(2021, 8, 3, 7, 2, 8, 500000000, time.UTC),
+		"2021-08-03",
+	})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:     pg,
+		AskGit:       newSource(t, source),
+		TableName:    "commits",
+		Query:        "SELECT hash, author_when, committer_when, released_on FROM commits",
+		Logger:       zap.NewNop(),
+		EpochColumns: map[string]EpochUnit{"author_when": EpochSeconds, "committer_when": EpochMilliseconds, "released_on": EpochDays},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncEpochColumnMissing(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the transaction is already open by the time the epoch columns are checked, so it must be rolled back
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:     pg,
+		AskGit:       newSource(t, commitRows()),
+		TableName:    "commits",
+		Query:        "SELECT hash, additions FROM commits",
+		Logger:       zap.NewNop(),
+		EpochColumns: map[string]EpochUnit{"author_when": EpochSeconds},
+	})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected ErrInvalidOptions, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,293 @@
+package pgsync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrInvalidOptions is returned when a sync's options are incomplete or contradict each other
+	ErrInvalidOptions = errors.New("invalid sync options")
+	// ErrNoColumns is returned when the query doesn't produce any columns to sync
+	ErrNoColumns = errors.New("query produced no columns")
+	// ErrEmptyResults is returned when the query produces no rows and SyncOptions.OnEmpty is EmptyError
+	ErrEmptyResults = errors.New("query produced no rows")
+	// ErrDestructiveBlocked is returned when replacing the table would destroy other objects that depend on it
+	ErrDestructiveBlocked = errors.New("destructive change blocked")
+	// ErrSchemaMismatch is returned when the results of the query don't fit an existing table.
+	// It's matched by a *SchemaMismatchError, which carries the underlying driver error
+	ErrSchemaMismatch = errors.New("schema mismatch")
+	// ErrLongIdentifier is returned when the name of a column is longer than Postgres keeps (see SyncOptions.LongIdentifiers)
+	ErrLongIdentifier = errors.New("identifier too long")
+	// ErrPreconditionFailed is returned when the table exists, or doesn't, contrary to SyncOptions.Require
+	ErrPreconditionFailed = errors.New("table precondition failed")
+	// ErrInsufficientSpace is returned when the table's tablespace doesn't have the free space SyncOptions.SpaceCheck requires
+	ErrInsufficientSpace = errors.New("insufficient space")
+	// ErrAcquireTimeout is returned when no connection is free within SyncOptions.AcquireTimeout
+	ErrAcquireTimeout = errors.New("timed out waiting for a connection")
+	// ErrPoolTooSmall is returned when the pool of SyncOptions.Postgres can't open the connections a sync needs (see CheckPool)
+	ErrPoolTooSmall = errors.New("connection pool too small")
+	// ErrValidationFailed is returned when the loaded results don't pass SyncOptions.ValidationQuery
+	ErrValidationFailed = errors.New("validation failed")
+	// ErrBreakingSchemaChange is returned when a column was removed or changed type since the last sync and
+	// SyncOptions.RejectBreakingSchemaChanges is set
+	ErrBreakingSchemaChange = errors.New("breaking schema change")
+	// ErrDuplicateKeys is returned when more than one row of the results of a merge (or an append with ConflictUpdate) has
+	// the same SyncOptions.ConflictColumns, and SyncOptions.DuplicateKeys is DuplicateKeysError
+	ErrDuplicateKeys = errors.New("duplicate conflict keys")
+)
+
+// The stages of a sync, as named by a StageError
+const (
+	// StageOptions is checking the sync's options
+	StageOptions = "options"
+	// StageQuery is running the askgit query and working out the columns of its results
+	StageQuery = "query"
+	// StageCreate is setting up the sync transaction and creating the table the results are loaded into
+	StageCreate = "create"
+	// StageCopy is loading the results
+	StageCopy = "copy"
+	// StageSwap is swapping (or merging) the loaded results into the table
+	StageSwap = "swap"
+	// StageCommit is committing the sync, and whatever's done once it's committed
+	StageCommit = "commit"
+)
+
+// StageError is the error returned when a sync fails, naming the stage it failed in, one of StageOptions, StageQuery,
+// StageCreate, StageCopy, StageSwap and StageCommit
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string { return fmt.Sprintf("pgsync: %s stage: %v", e.Stage, e.Err) }
+
+func (e *StageError) Unwrap() error { return e.Err }
+
+// SchemaMismatchError is the error returned when Postgres rejects the results of the query because they don't fit
+// the columns of an existing table
+type SchemaMismatchError struct {
+	// Table is the table the results didn't fit
+	Table string
+	// Columns are the columns found to differ when comparing the results with the table before loading them
+	Columns []ColumnMismatch
+	// Err is the error reported by Postgres, when it was Postgres that rejected the results
+	Err error
+}
+
+func (e *SchemaMismatchError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: results do not fit table %s: %v", ErrSchemaMismatch, pq.QuoteIdentifier(e.Table), e.Err)
+	}
+
+	differences := make([]string, len(e.Columns))
+	for i, c := range e.Columns {
+		switch {
+		case c.Actual == "":
+			differences[i] = fmt.Sprintf("column %s (%s) is missing", pq.QuoteIdentifier(c.Column), c.Expected)
+		case c.Expected == "":
+			differences[i] = fmt.Sprintf("column %s (%s) is not one of the query's columns", pq.QuoteIdentifier(c.Column), c.Actual)
+		default:
+			differences[i] = fmt.Sprintf("column %s is %s, expected %s", pq.QuoteIdentifier(c.Column), c.Actual, c.Expected)
+		}
+	}
+	return fmt.Sprintf("%s: results do not fit table %s: %s", ErrSchemaMismatch, pq.QuoteIdentifier(e.Table), strings.Join(differences, ", "))
+}
+
+func (e *SchemaMismatchError) Unwrap() error { return e.Err }
+
+// Is makes a SchemaMismatchError match ErrSchemaMismatch
+func (e *SchemaMismatchError) Is(target error) bool { return target == ErrSchemaMismatch }
+
+// schemaMismatchCodes are the Postgres error codes that mean a statement referred to columns a table doesn't have,
+// or to columns of the wrong type
+var schemaMismatchCodes = map[pq.ErrorCode]bool{
+	"42703": true, // undefined_column
+	"42804": true, // datatype_mismatch
+	"42846": true, // cannot_coerce
+}
+
+// schemaMismatch returns err as a *SchemaMismatchError if it's a Postgres error that means the results of the query
+// don't fit table, or otherwise returns err unchanged
+func schemaMismatch(table string, err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && schemaMismatchCodes[pqErr.Code] {
+		return &SchemaMismatchError{Table: table, Err: err}
+	}
+	return err
+}
+
+// invalidOptions returns an error wrapping ErrInvalidOptions with the given explanation
+func invalidOptions(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidOptions, fmt.Sprintf(format, args...))
+}
+
+// validateOptions checks that options has everything a sync needs
+func validateOptions(options *SyncOptions) error {
+	switch {
+	case options.Postgres == nil:
+		return invalidOptions("a postgres database is required")
+	case options.AskGit == nil:
+		return invalidOptions("an askgit database is required")
+	case options.TableName == "":
+		return invalidOptions("a table name is required")
+	case len(options.TableName) > maxIdentifierLength-len("_temp") && !options.loadsInPlace():
+		return invalidOptions("table name is too long for the names of its staging tables to fit in %d bytes: %s", maxIdentifierLength, options.TableName)
+	case len(options.TableName) > maxIdentifierLength:
+		return invalidOptions("table name is longer than the %d bytes Postgres keeps: %s", maxIdentifierLength, options.TableName)
+	case options.EstimatedRows < 0:
+		return invalidOptions("estimated rows must not be negative")
+	case options.EstimatedRows > 0 && options.CountRows:
+		return invalidOptions("only one of EstimatedRows and CountRows may be set")
+	case options.AcquireTimeout < 0:
+		return invalidOptions("acquire timeout must not be negative")
+	case options.SourceBusyTimeout < 0:
+		return invalidOptions("source busy timeout must not be negative")
+	case options.MaxRowBytes < 0:
+		return invalidOptions("maximum row size must not be negative")
+	case options.MaxValueSize < 0:
+		return invalidOptions("maximum value size must not be negative")
+	case options.KeepBackups < 0:
+		return invalidOptions("the number of backups to keep must not be negative")
+	case options.KeepBackups > 0 && (options.Mode != ModeReplace || options.loadsInPlace() || options.ShadowTable != "" || options.CascadeDependents):
+		return invalidOptions("backups are only kept of tables replaced by ModeReplace, without a shadow table or CascadeDependents")
+	case options.KeepBackups > 0 && len(backupTable(options.TableName, time.Time{})) > maxIdentifierLength:
+		return invalidOptions("table name %s is too long to name backups of it after", pq.QuoteIdentifier(options.TableName))
+	case options.BulkInsertFallback && (options.CopyParallelism > 1 || options.DeadLetterTable != "" || options.HeartbeatInterval > 0):
+		return invalidOptions("the bulk insert fallback can't be combined with CopyParallelism, a dead letter table or HeartbeatInterval")
+	case options.BulkInsertFallback && options.CopyFreeze:
+		return invalidOptions("the bulk insert fallback tries the COPY in a savepoint, which COPY FREEZE can't be run in")
+	case options.Paginate != nil && (options.Paginate.Key == "" || options.Paginate.PageSize <= 0):
+		return invalidOptions("a page key and a positive page size are required to paginate")
+	case options.SourceOffset < 0 || options.SourceLimit < 0:
+		return invalidOptions("source offset and limit must not be negative")
+	case (options.SourceOffset > 0 || options.SourceLimit > 0) && (options.Paginate != nil || len(options.Queries) > 1):
+		return invalidOptions("only a single query that isn't paginated can be limited to a range of rows")
+	case options.Paginate != nil && len(options.Queries) > 1:
+		return invalidOptions("only a single query can be paginated")
+	case options.SpaceCheck != nil && options.SpaceCheck.Available == nil:
+		return invalidOptions("a space check needs a way to find the available space")
+	case options.StatisticsTarget < 0 || options.StatisticsTarget > maxStatisticsTarget:
+		return invalidOptions("statistics target must be from 1 to %d", maxStatisticsTarget)
+	case options.CopyParallelism < 0:
+		return invalidOptions("copy parallelism must not be negative")
+	case options.CopyFreeze && (options.Mode == ModeEnsureAndAppend || options.CopyParallelism > 1 || options.DebugCopy ||
+		options.DeadLetterTable != "" || options.HeartbeatInterval > 0):
+		return invalidOptions("COPY FREEZE needs a table created or truncated by the sync's transaction, loaded by a single COPY outside a savepoint")
+	case options.DefaultColumnType != "" && options.TypeMapper != nil:
+		return invalidOptions("a default column type only applies to the built-in type mapping, not a TypeMapper")
+	case options.CopyBufferRows < 0:
+		return invalidOptions("copy buffer rows must not be negative")
+	case options.CopyBufferRows > 0 && options.CopyParallelism <= 1:
+		return invalidOptions("rows are only buffered when the COPY is split over several connections")
+	case options.CreatePartitions && (options.Mode != ModeEnsureAndAppend || options.PartitionKey == "" || options.SkipDuplicateContent || options.Temporary):
+		return invalidOptions("creating partitions needs ModeEnsureAndAppend and a partition key, and can't be combined with SkipDuplicateContent or Temporary")
+	case options.SkipDuplicateContent && (options.Mode != ModeEnsureAndAppend || !options.AddContentHashColumn || options.Temporary):
+		return invalidOptions("skipping duplicate content needs ModeEnsureAndAppend and a content hash column, and can't be combined with Temporary")
+	case (options.Mode == ModeAppendWindow) != (options.WindowColumn != ""):
+		return invalidOptions("a window column is required to append with a window, and only applies to it")
+	case options.Mode == ModeReplacePartitions && options.PartitionKey == "":
+		return invalidOptions("a partition key is required to replace partitions")
+	case options.Mode == ModeRoute && (options.RouteColumn == "" || (len(options.Routes) == 0 && options.RouteFunc == nil)):
+		return invalidOptions("a route column, and routes or a route function, are required to route rows")
+	case options.Mode == ModeRoute && (len(options.Indexes) > 0 || options.RollupTable != "" || options.StatisticsTarget > 0 ||
+		options.StateTable != "" || options.NotifyChannel != "" || options.VerifySchema || options.Manifest != nil):
+		return invalidOptions("rows are routed to several tables, Indexes, RollupTable, StatisticsTarget, StateTable, NotifyChannel, VerifySchema and Manifest only apply to one")
+	case options.ShadowTable != "" && (options.Mode != ModeReplace || options.Temporary):
+		return invalidOptions("a shadow table is swapped in for the table later, it can only be loaded by a replace that isn't temporary")
+	case options.ShadowTable == options.TableName && options.ShadowTable != "":
+		return invalidOptions("the shadow table must not be the table itself")
+	case options.ShadowTable != "" && len(options.Indexes) > 0:
+		return invalidOptions("indexes are named after the table they're created on, which a shadow table isn't until it's promoted")
+	case options.InferNotNull && options.MixedTypes == MixedTypesNull:
+		return invalidOptions("columns inferred to be NOT NULL can't have values that don't fit them loaded as NULL")
+	case (options.RollupTable == "") != (options.RollupQuery == ""):
+		return invalidOptions("a rollup needs both a table and a query")
+	case options.RollupTable != "" && (options.Temporary || options.ShadowTable != ""):
+		return invalidOptions("a rollup is of the table that's committed, which a temporary or shadow table isn't")
+	case options.RollupTable != "" && options.RollupTable == options.TableName:
+		return invalidOptions("the rollup table must not be the table itself")
+	case options.NotifyChannel == "" && options.NotifyPayload != nil:
+		return invalidOptions("a notification payload needs a channel to be sent on")
+	case options.StateTable == "" && (options.StateSchema != "" || options.SkipCreateStateTable || options.TrackSchemaChanges):
+		return invalidOptions("a state schema, SkipCreateStateTable and TrackSchemaChanges only apply to a state table")
+	case options.StateTable == "" && options.IdempotencyKey != "":
+		return invalidOptions("an idempotency key is recorded in the state table, which is required for it")
+	case options.ForceRerun && options.IdempotencyKey == "":
+		return invalidOptions("ForceRerun only applies to syncs with an idempotency key")
+	case options.RejectBreakingSchemaChanges && !options.TrackSchemaChanges:
+		return invalidOptions("breaking schema changes can only be rejected when schema changes are tracked")
+	case options.StateTable != "" && options.Temporary:
+		return invalidOptions("a temporary table is gone once its session ends, there's no state of its sync to record")
+	case (options.CreatedAtColumn != "" || options.UpdatedAtColumn != "") && options.Mode != ModeMerge:
+		return invalidOptions("created and updated timestamp columns only apply to a merge")
+	case options.CreatedAtColumn != "" && (options.CreatedAtColumn == options.UpdatedAtColumn || options.CreatedAtColumn == options.SoftDeleteColumn) ||
+		options.UpdatedAtColumn != "" && options.UpdatedAtColumn == options.SoftDeleteColumn:
+		return invalidOptions("the created, updated and soft delete timestamp columns must be different columns")
+	case len(options.UpdateColumns) > 0 && options.Mode != ModeMerge && options.OnConflict != ConflictUpdate:
+		return invalidOptions("update columns only apply to a merge or ConflictUpdate")
+	case options.OnConflict != ConflictError && (options.Mode != ModeEnsureAndAppend || options.SkipDuplicateContent || options.CreatePartitions):
+		return invalidOptions("OnConflict only applies to ModeEnsureAndAppend, and can't be combined with SkipDuplicateContent or CreatePartitions")
+	case options.StrictColumns && options.Mode != ModeEnsureAndAppend:
+		return invalidOptions("strict columns only apply to an append")
+	case options.DuplicateKeys != DuplicateKeysError && options.Mode != ModeMerge && options.OnConflict != ConflictUpdate:
+		return invalidOptions("duplicate keys are only dropped by a merge or ConflictUpdate")
+	case options.DuplicateKeys != DuplicateKeysError && len(options.ColumnExpressions) > 0:
+		return invalidOptions("the order of duplicate keys is lost when column expressions update the staging table")
+	case options.AutoWiden && options.Mode != ModeEnsureAndAppend && options.Mode != ModeAppendWindow:
+		return invalidOptions("columns are only widened when appending")
+	case options.Retry != nil && options.Mode != ModeReplace:
+		return invalidOptions("only a replace can be retried")
+	case options.Temporary && options.Mode != ModeReplace:
+		return invalidOptions("a temporary table is always loaded from scratch, it can't be merged into or replaced in place")
+	case options.CopyParallelism > 1 && options.DebugCopy:
+		return invalidOptions("a COPY can't be debugged when it's split over several connections")
+	case options.ValidationQuery == "" && options.ValidationCheck != nil:
+		return invalidOptions("a validation check needs a validation query to check the results of")
+	case options.ValidationQuery != "" && options.loadsInPlace():
+		return invalidOptions("a validation query runs against the staging table, which a table loaded in place doesn't have")
+	case len(options.ColumnExpressions) > 0 && options.loadsInPlace():
+		return invalidOptions("column expressions are applied to the staging table, which a table loaded in place doesn't have")
+	case options.CopyParallelism > 1 && options.loadsInPlace():
+		return invalidOptions("a table loaded in place can't be loaded over several connections")
+	case options.CopyParallelism > 1 && options.Mode != ModeReplace:
+		return invalidOptions("only a replace can be loaded over several connections")
+	case options.HeartbeatInterval < 0:
+		return invalidOptions("heartbeat interval must not be negative")
+	case options.HeartbeatInterval > 0 && options.CopyParallelism > 1:
+		return invalidOptions("a heartbeat can't be kept when the COPY is split over several connections")
+	case options.StageAsText && options.DeadLetterTable == "":
+		return invalidOptions("staging as text needs a dead letter table for the rows that can't be cast")
+	case options.DeadLetterTable != "" && (options.DebugCopy || options.CopyParallelism > 1 || options.HeartbeatInterval > 0):
+		return invalidOptions("a dead letter table can't be combined with DebugCopy, CopyParallelism or HeartbeatInterval")
+	case options.Checksum && (options.CopyParallelism > 1 || options.DeadLetterTable != ""):
+		return invalidOptions("a checksum needs every row to be copied, in order, on a single connection")
+	case options.PreviewChanges && options.Mode != ModeMerge:
+		return invalidOptions("only the changes of a merge can be previewed")
+	case (options.DryRunValidate || options.PreviewChanges) && options.CopyParallelism > 1:
+		return invalidOptions("a dry run can't load the staging table over several connections, each commits its share")
+	case len(options.SearchPath) > 0 && (options.CopyParallelism > 1 || options.VerifySchema):
+		return invalidOptions("a search path only applies to the sync transaction, the staging table and the committed table are looked up outside it")
+	case options.Schema != "" && (len(options.SearchPath) > 0 || options.SessionSettings["search_path"] != ""):
+		return invalidOptions("a schema sets the search path of the sync, it can't be combined with SearchPath or a search_path session setting")
+	case options.IndexesBeforeSwap && (len(options.Indexes) == 0 || options.IndexesConcurrent):
+		return invalidOptions("IndexesBeforeSwap builds Indexes in the sync transaction, it needs Indexes and can't be combined with IndexesConcurrent")
+	case options.IndexesBeforeSwap && (options.Mode != ModeReplace || options.ShadowTable != ""):
+		return invalidOptions("only a staging table that's swapped in (with ModeReplace) can be indexed before the swap")
+	case options.IndexesConcurrent && options.Temporary:
+		return invalidOptions("a temporary table can't be indexed from another connection")
+	case options.Schema != "" && options.Temporary:
+		return invalidOptions("a temporary table always lives in its own schema")
+	case options.BypassRowSecurity && options.SessionSettings["row_security"] != "":
+		return invalidOptions("only one of BypassRowSecurity and a row_security session setting may be set")
+	case len(options.SearchPath) > 0 && options.SessionSettings["search_path"] != "":
+		return invalidOptions("only one of SearchPath and a search_path session setting may be set")
+	case options.VerifySchema && options.Temporary:
+		return invalidOptions("a temporary table can only be seen by the connection that created it, so its schema can't be verified")
+	}
+	return nil
+}
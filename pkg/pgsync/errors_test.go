@@ -0,0 +1,227 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+func TestSyncInvalidOptions(t *testing.T) {
+	cases := map[string]func(*SyncOptions){
+		"no table name":              func(o *SyncOptions) { o.TableName = "" },
+		"no postgres database":       func(o *SyncOptions) { o.Postgres = nil },
+		"query and query reader":     func(o *SyncOptions) { o.QueryReader = strings.NewReader(o.Query) },
+		"query and queries":          func(o *SyncOptions) { o.Queries = []string{o.Query} },
+		"merge without conflict":     func(o *SyncOptions) { o.Mode = ModeMerge },
+		"window without column":      func(o *SyncOptions) { o.Mode, o.ConflictColumns = ModeAppendWindow, []string{"hash"} },
+		"partitions without key":     func(o *SyncOptions) { o.Mode = ModeReplacePartitions },
+		"unknown partition key":      func(o *SyncOptions) { o.Mode, o.PartitionKey = ModeReplacePartitions, "author_when" },
+		"unknown column order":       func(o *SyncOptions) { o.ColumnOrder = []string{"deletions"} },
+		"negative copy parallelism":  func(o *SyncOptions) { o.CopyParallelism = -1 },
+		"copy buffer of single copy": func(o *SyncOptions) { o.CopyBufferRows = 10 },
+		"freeze of append":           func(o *SyncOptions) { o.CopyFreeze, o.Mode = true, ModeEnsureAndAppend },
+		"merge into temporary":       func(o *SyncOptions) { o.Temporary, o.Mode, o.ConflictColumns = true, ModeMerge, []string{"hash"} },
+		"heartbeat in parallel":      func(o *SyncOptions) { o.HeartbeatInterval, o.CopyParallelism = time.Second, 2 },
+		"checksum in parallel":       func(o *SyncOptions) { o.Checksum, o.CopyParallelism = true, 2 },
+		"search path in parallel":    func(o *SyncOptions) { o.SearchPath, o.CopyParallelism = []string{"git"}, 2 },
+		"merge in parallel":          func(o *SyncOptions) { o.Mode, o.ConflictColumns, o.CopyParallelism = ModeMerge, []string{"hash"}, 2 },
+		"update columns of replace":  func(o *SyncOptions) { o.UpdateColumns = []string{"additions"} },
+		"state schema without table": func(o *SyncOptions) { o.StateSchema = "ops" },
+		"preview of replace":         func(o *SyncOptions) { o.PreviewChanges = true },
+		"dedupe of replace":          func(o *SyncOptions) { o.DuplicateKeys = DuplicateKeysKeepLast },
+		"dedupe of expressions": func(o *SyncOptions) {
+			o.Mode, o.ConflictColumns, o.DuplicateKeys = ModeMerge, []string{"hash"}, DuplicateKeysKeepFirst
+			o.ColumnExpressions = map[string]string{"hash": "lower(hash)"}
+		},
+		"widening of replace":               func(o *SyncOptions) { o.AutoWiden = true },
+		"strict columns of replace":         func(o *SyncOptions) { o.StrictColumns = true },
+		"route without routes":              func(o *SyncOptions) { o.Mode, o.RouteColumn = ModeRoute, "hash" },
+		"validation in place":               func(o *SyncOptions) { o.ValidationQuery, o.Mode = "SELECT true", ModeReplaceInPlace },
+		"indexes before swap, none":         func(o *SyncOptions) { o.IndexesBeforeSwap = true },
+		"text staging, no dead letters":     func(o *SyncOptions) { o.StageAsText = true },
+		"breaking changes untracked":        func(o *SyncOptions) { o.RejectBreakingSchemaChanges = true },
+		"range of queries":                  func(o *SyncOptions) { o.SourceLimit, o.Queries, o.Query = 10, []string{o.Query, o.Query}, "" },
+		"updated at of replace":             func(o *SyncOptions) { o.UpdatedAtColumn = "updated_at" },
+		"duplicate content of replace":      func(o *SyncOptions) { o.SkipDuplicateContent, o.AddContentHashColumn = true, true },
+		"partitions without key, appending": func(o *SyncOptions) { o.CreatePartitions, o.Mode = true, ModeEnsureAndAppend },
+		"idempotency without state":         func(o *SyncOptions) { o.IdempotencyKey = "run-1" },
+		"forced rerun without key":          func(o *SyncOptions) { o.ForceRerun = true },
+		"retried merge":                     func(o *SyncOptions) { o.Retry, o.Mode, o.ConflictColumns = &RetryPolicy{}, ModeMerge, []string{"hash"} },
+		"table name too long":               func(o *SyncOptions) { o.TableName = strings.Repeat("t", 60) },
+		"schema and search path":            func(o *SyncOptions) { o.Schema, o.SearchPath = "git", []string{"public"} },
+		"schema of temporary table":         func(o *SyncOptions) { o.Schema, o.Temporary = "git", true },
+		"default type and mapper": func(o *SyncOptions) {
+			o.DefaultColumnType, o.TypeMapper = "jsonb", func(*sql.ColumnType) (string, error) { return "text", nil }
+		},
+		"backups of merge":            func(o *SyncOptions) { o.KeepBackups, o.Mode, o.ConflictColumns = 1, ModeMerge, []string{"hash"} },
+		"bulk insert of frozen copy":  func(o *SyncOptions) { o.BulkInsertFallback, o.CopyFreeze = true, true },
+		"bulk insert in parallel":     func(o *SyncOptions) { o.BulkInsertFallback, o.CopyParallelism = true, 2 },
+		"on conflict of replace":      func(o *SyncOptions) { o.OnConflict = ConflictSkip },
+		"update on conflict, no keys": func(o *SyncOptions) { o.Mode, o.OnConflict = ModeEnsureAndAppend, ConflictUpdate },
+		"two search paths": func(o *SyncOptions) {
+			o.SearchPath, o.SessionSettings = []string{"git"}, map[string]string{"search_path": "public"}
+		},
+	}
+
+	for name, modify := range cases {
+		pg, _, _ := sqlmock.New()
+
+		options := &SyncOptions{
+			Postgres:  pg,
+			AskGit:    newSource(t, commitRows()),
+			TableName: "commits",
+			Query:     "SELECT hash, additions FROM commits",
+			Logger:    zap.NewNop(),
+		}
+		modify(options)
+
+		if _, err := Sync(context.Background(), options); !errors.Is(err, ErrInvalidOptions) {
+			t.Fatalf("%s: expected ErrInvalidOptions, got: %v", name, err)
+		}
+	}
+}
+
+func TestSyncNoColumns(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, sqlmock.NewRows(nil)),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+	})
+	if !errors.Is(err, ErrNoColumns) {
+		t.Fatalf("expected ErrNoColumns, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncMergeSchemaMismatch(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	undefinedColumn := &pq.Error{Code: "42703", Message: `column "additions" of relation "commits" does not exist`}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock)
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectNoDuplicateKeys(mock)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE").WillReturnError(undefinedColumn)
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, commitRows()),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		Mode:            ModeMerge,
+		ConflictColumns: []string{"hash"},
+	})
+	if !errors.Is(err, ErrSchemaMismatch) {
+		t.Fatalf("expected ErrSchemaMismatch, got: %v", err)
+	}
+
+	var mismatch *SchemaMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Table != "commits" {
+		t.Fatalf("expected a SchemaMismatchError for commits, got: %v", err)
+	}
+
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "42703" {
+		t.Fatalf("expected the driver error to be preserved, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncStageError(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	failed := errors.New("relation is locked")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnError(failed)
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+	})
+
+	var stageErr *StageError
+	if !errors.As(err, &stageErr) || stageErr.Stage != StageSwap || !strings.Contains(err.Error(), "swap") {
+		t.Fatalf("expected the sync to fail in the swap stage, got: %v", err)
+	}
+	if !errors.Is(err, failed) {
+		t.Fatalf("expected the swap's error to be wrapped, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncInjectedFailure(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	injected := errors.New("injected")
+
+	// the staging table was created in the sync transaction, so rolling it back is all the cleanup there is
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectRollback()
+
+	var reached []string
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		failAt: func(stage string) error {
+			reached = append(reached, stage)
+			if stage == StageSwap {
+				return injected
+			}
+			return nil
+		},
+	})
+
+	var stageErr *StageError
+	if !errors.As(err, &stageErr) || stageErr.Stage != StageSwap || !errors.Is(err, injected) {
+		t.Fatalf("expected the injected failure in the swap stage, got: %v", err)
+	}
+	if strings.Join(reached, ",") != "query,create,copy,swap" {
+		t.Fatalf("expected the failure points of the stages up to the swap, got: %v", reached)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,58 @@
+package pgsync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// explainQuery returns SQLite's plan for query, one step per line, each indented under the step it's part of
+func explainQuery(ctx context.Context, db queryer, query string, args []interface{}) (string, error) {
+	rows, err := db.QueryContext(ctx, "EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return "", fmt.Errorf("could not explain the query: %w", err)
+	}
+	defer rows.Close()
+
+	depth := map[int64]int{0: -1}
+	var plan strings.Builder
+	for rows.Next() {
+		var id, parent, unused int64
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			return "", fmt.Errorf("could not read the query plan: %w", err)
+		}
+
+		depth[id] = depth[parent] + 1
+		plan.WriteString(strings.Repeat("  ", depth[id]))
+		plan.WriteString(detail)
+		plan.WriteString("\n")
+	}
+
+	return plan.String(), rows.Err()
+}
+
+// countRows returns the number of rows the queries produce between them, counting the rows of each with count(*)
+func countRows(ctx context.Context, db queryer, queries []string, args []interface{}) (int64, error) {
+	var total int64
+	for _, query := range queries {
+		query = strings.TrimRight(strings.TrimSpace(query), ";")
+		rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT count(*) FROM (%s)", query), args...)
+		if err != nil {
+			return 0, fmt.Errorf("could not count the rows of the query: %w", err)
+		}
+
+		var n int64
+		if rows.Next() {
+			err = rows.Scan(&n)
+		} else {
+			err = rows.Err()
+		}
+		rows.Close()
+		if err != nil {
+			return 0, fmt.Errorf("could not count the rows of the query: %w", err)
+		}
+		total += n
+	}
+	return total, nil
+}
@@ -0,0 +1,96 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncExplainQuery(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	const query = "SELECT c.hash, s.additions FROM commits c JOIN stats s ON s.commit_hash = c.hash"
+	source.ExpectQuery(regexp.QuoteMeta("EXPLAIN QUERY PLAN " + query)).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "parent", "notused", "detail"}).
+			AddRow(int64(2), int64(0), int64(0), "SCAN c VIRTUAL TABLE INDEX 0:").
+			AddRow(int64(5), int64(0), int64(0), "SCAN s VIRTUAL TABLE INDEX 1:").
+			AddRow(int64(9), int64(5), int64(0), "USE TEMP B-TREE FOR ORDER BY"),
+	)
+	source.ExpectQuery(regexp.QuoteMeta(query)).WillReturnRows(commitRows())
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:     pg,
+		AskGit:       askgit,
+		TableName:    "commits",
+		Query:        query,
+		Logger:       zap.NewNop(),
+		ExplainQuery: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "SCAN c VIRTUAL TABLE INDEX 0:\nSCAN s VIRTUAL TABLE INDEX 1:\n  USE TEMP B-TREE FOR ORDER BY\n"
+	if result.QueryPlan != expected {
+		t.Fatalf("expected plan:\n%s\ngot:\n%s", expected, result.QueryPlan)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncCountRows(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	const query = "SELECT hash, additions FROM commits;"
+	source.ExpectQuery(regexp.QuoteMeta("SELECT count(*) FROM (SELECT hash, additions FROM commits)")).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(2)))
+	source.ExpectQuery(regexp.QuoteMeta(query)).WillReturnRows(commitRows())
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    askgit,
+		TableName: "commits",
+		Query:     query,
+		Logger:    zap.NewNop(),
+		CountRows: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.EstimatedRows != 2 || result.Rows != 2 {
+		t.Fatalf("expected an estimate of 2 rows matching the 2 synced, got %d and %d", result.EstimatedRows, result.Rows)
+	}
+
+	for _, m := range []sqlmock.Sqlmock{mock, source} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package pgsync
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// copyTextEscaper escapes the characters that are significant in the Postgres COPY text format
+var copyTextEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"\t", `\t`,
+	"\n", `\n`,
+	"\r", `\r`,
+)
+
+// ExportCopyText runs query against askgit and writes the results to w in the Postgres COPY text format
+// (tab delimited, \N for NULL), so that the output can be fed directly to `COPY table FROM STDIN`.
+// Column types are discovered the same way Sync discovers them, so values are encoded to match the table Sync would create.
+func ExportCopyText(ctx context.Context, askgit *sql.DB, query string, w io.Writer) (*SyncResult, error) {
+	buf := bufio.NewWriter(w)
+	result, err := exportRows(ctx, askgit, query, func(values []interface{}, pgTypes []string) error {
+		for i, value := range values {
+			if i > 0 {
+				if err := buf.WriteByte('\t'); err != nil {
+					return err
+				}
+			}
+			if _, err := buf.WriteString(encodeCopyText(value, pgTypes[i])); err != nil {
+				return err
+			}
+		}
+		return buf.WriteByte('\n')
+	})
+	if err != nil {
+		return result, err
+	}
+
+	return result, buf.Flush()
+}
+
+// copyBinarySignature starts every file in the Postgres binary COPY format
+const copyBinarySignature = "PGCOPY\n\377\r\n\000"
+
+// postgresEpoch is the instant Postgres counts binary timestamps from
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ExportCopyBinary runs query against askgit and writes the results to w in the Postgres binary COPY format,
+// so that the output can be fed directly to `COPY table FROM STDIN WITH (FORMAT binary)` of the table Sync would create.
+// Values are encoded for the column types Sync discovers; columns of types without a binary encoding here
+// (numeric, time) fail the export, for which ExportCopyText can be used instead.
+func ExportCopyBinary(ctx context.Context, askgit *sql.DB, query string, w io.Writer) (*SyncResult, error) {
+	buf := bufio.NewWriter(w)
+	// the signature is followed by the header's flags and the length of its extension area, both 0
+	header := make([]byte, 0, len(copyBinarySignature)+8)
+	header = append(header, copyBinarySignature...)
+	header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+	if _, err := buf.Write(header); err != nil {
+		return nil, err
+	}
+
+	var field [4]byte
+	var row int64
+	result, err := exportRows(ctx, askgit, query, func(values []interface{}, pgTypes []string) error {
+		row++
+		binary.BigEndian.PutUint16(field[:2], uint16(len(values)))
+		if _, err := buf.Write(field[:2]); err != nil {
+			return err
+		}
+		for i, value := range values {
+			if value == nil {
+				// a field length of -1 is a NULL
+				binary.BigEndian.PutUint32(field[:], math.MaxUint32)
+				if _, err := buf.Write(field[:]); err != nil {
+					return err
+				}
+				continue
+			}
+
+			b, err := encodeCopyBinary(value, pgTypes[i])
+			if err != nil {
+				return fmt.Errorf("could not encode row %d, column %d: %w", row, i+1, err)
+			}
+			binary.BigEndian.PutUint32(field[:], uint32(len(b)))
+			if _, err := buf.Write(field[:]); err != nil {
+				return err
+			}
+			if _, err := buf.Write(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	// the trailer is a field count of -1
+	if _, err := buf.Write([]byte{0xff, 0xff}); err != nil {
+		return result, err
+	}
+	return result, buf.Flush()
+}
+
+// exportRows runs query against askgit and calls write with the values of each row, and the Postgres types
+// of their columns, returning the columns and the number of rows written
+func exportRows(ctx context.Context, askgit *sql.DB, query string, write func(values []interface{}, pgTypes []string) error) (*SyncResult, error) {
+	rows, err := askgit.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SyncResult{Columns: make([]string, len(colTypes))}
+	pgTypes := make([]string, len(colTypes))
+	for c := 0; c < len(colTypes); c++ {
+		result.Columns[c] = colTypes[c].Name()
+		pgTypes[c] = SQLiteTypeToPostgresType(colTypes[c])
+	}
+
+	values := make([]interface{}, len(colTypes))
+	pointers := make([]interface{}, len(colTypes))
+	for i := 0; i < len(values); i++ {
+		pointers[i] = &values[i]
+	}
+
+	for rows.Next() {
+		select {
+		default:
+		case <-ctx.Done():
+			return result, ctx.Err()
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return result, err
+		}
+		if err := write(values, pgTypes); err != nil {
+			return result, err
+		}
+		result.Rows++
+	}
+
+	return result, rows.Err()
+}
+
+// encodeCopyText encodes a single value scanned from SQLite as a field in the Postgres COPY text format,
+// where pgType is the Postgres type of the column the value is destined for
+func encodeCopyText(value interface{}, pgType string) string {
+	switch v := value.(type) {
+	case nil:
+		return `\N`
+	case bool:
+		if v {
+			return "t"
+		}
+		return "f"
+	case int64:
+		if pgType == "boolean" {
+			return encodeCopyText(v != 0, pgType)
+		}
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999999Z07:00")
+	case []byte:
+		if pgType == "bytea" {
+			return `\\x` + hex.EncodeToString(v)
+		}
+		return copyTextEscaper.Replace(string(v))
+	case string:
+		return copyTextEscaper.Replace(v)
+	default:
+		return copyTextEscaper.Replace(fmt.Sprint(v))
+	}
+}
+
+// encodeCopyBinary encodes a single non-NULL value scanned from SQLite as a field in the Postgres binary COPY format,
+// where pgType is the Postgres type of the column the value is destined for
+func encodeCopyBinary(value interface{}, pgType string) ([]byte, error) {
+	switch {
+	case pgType == "smallint", pgType == "integer", pgType == "bigint":
+		var n int64
+		switch v := value.(type) {
+		case int64:
+			n = v
+		case bool:
+			if v {
+				n = 1
+			}
+		case float64:
+			if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+				return nil, fmt.Errorf("%v is not a valid %s", v, pgType)
+			}
+			n = int64(v)
+		default:
+			return nil, fmt.Errorf("cannot encode %T as %s", value, pgType)
+		}
+
+		switch pgType {
+		case "smallint":
+			if n < math.MinInt16 || n > math.MaxInt16 {
+				return nil, fmt.Errorf("%d is out of range for %s", n, pgType)
+			}
+			b := make([]byte, 2)
+			binary.BigEndian.PutUint16(b, uint16(n))
+			return b, nil
+		case "integer":
+			if n < math.MinInt32 || n > math.MaxInt32 {
+				return nil, fmt.Errorf("%d is out of range for %s", n, pgType)
+			}
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, uint32(n))
+			return b, nil
+		default:
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, uint64(n))
+			return b, nil
+		}
+
+	case pgType == "double precision":
+		var f float64
+		switch v := value.(type) {
+		case float64:
+			f = v
+		case int64:
+			f = float64(v)
+		default:
+			return nil, fmt.Errorf("cannot encode %T as %s", value, pgType)
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(f))
+		return b, nil
+
+	case pgType == "boolean":
+		switch v := value.(type) {
+		case bool:
+			if v {
+				return []byte{1}, nil
+			}
+			return []byte{0}, nil
+		case int64:
+			return encodeCopyBinary(v != 0, pgType)
+		default:
+			return nil, fmt.Errorf("cannot encode %T as %s", value, pgType)
+		}
+
+	case pgType == "timestamp with time zone":
+		t, ok := value.(time.Time)
+		if s, isString := value.(string); isString {
+			for _, layout := range inferTimeLayouts {
+				if parsed, err := time.Parse(layout, s); err == nil {
+					t, ok = parsed, true
+					break
+				}
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("cannot encode %v as %s", value, pgType)
+		}
+		// microseconds since the Postgres epoch, computed without time.Duration's range of about 292 years
+		micros := (t.Unix()-postgresEpoch.Unix())*1e6 + int64(t.Nanosecond())/1e3
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(micros))
+		return b, nil
+
+	case pgType == "text", pgType == "bytea", strings.HasPrefix(pgType, "character"):
+		switch v := value.(type) {
+		case []byte:
+			return v, nil
+		case string:
+			return []byte(v), nil
+		}
+		if pgType == "bytea" {
+			return nil, fmt.Errorf("cannot encode %T as %s", value, pgType)
+		}
+		// other values take their text encoding, which has nothing to escape
+		return []byte(encodeCopyText(value, pgType)), nil
+
+	default:
+		return nil, fmt.Errorf("columns of type %s are not supported in the binary COPY format", pgType)
+	}
+}
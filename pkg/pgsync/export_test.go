@@ -0,0 +1,428 @@
+package pgsync
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestExportCopyText(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+
+	mockRows := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("id").OfType("INTEGER", int64(0)),
+		sqlmock.NewColumn("message").OfType("TEXT", ""),
+		sqlmock.NewColumn("merged").OfType("BOOLEAN", false),
+		sqlmock.NewColumn("when").OfType("DATETIME", time.Time{}),
+	).
+		AddRow(int64(1), "hello world", true, time.Date(2021, 8, 1, 12, 30, 0, 0, time.UTC)).
+		AddRow(int64(2), "tab\there\nnewline \\ backslash", int64(0), nil).
+		AddRow(nil, nil, nil, "2021-08-02 00:00:00")
+
+	mock.ExpectQuery("SELECT").WillReturnRows(mockRows)
+
+	var b bytes.Buffer
+	result, err := ExportCopyText(context.Background(), db, "SELECT * FROM commits", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "1\thello world\tt\t2021-08-01 12:30:00Z\n" +
+		"2\ttab\\there\\nnewline \\\\ backslash\tf\t\\N\n" +
+		"\\N\t\\N\t\\N\t2021-08-02 00:00:00\n"
+	if b.String() != expected {
+		t.Fatalf("unexpected COPY output:\n%q\nwanted:\n%q", b.String(), expected)
+	}
+
+	if result.Rows != 3 {
+		t.Fatalf("expected 3 rows, got: %d", result.Rows)
+	}
+
+	if len(result.Columns) != 4 || result.Columns[3] != "when" {
+		t.Fatalf("unexpected columns: %v", result.Columns)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// decodeCopyText parses data in the Postgres COPY text format the way COPY FROM does, returning nil for NULL fields
+func decodeCopyText(data string) ([][]*string, error) {
+	if !strings.HasSuffix(data, "\n") {
+		return nil, errors.New("the last row is not terminated")
+	}
+
+	var rows [][]*string
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		var row []*string
+		for _, raw := range strings.Split(line, "\t") {
+			if raw == `\N` {
+				row = append(row, nil)
+				continue
+			}
+
+			var field strings.Builder
+			for i := 0; i < len(raw); i++ {
+				if raw[i] != '\\' {
+					field.WriteByte(raw[i])
+					continue
+				}
+				if i++; i == len(raw) {
+					return nil, fmt.Errorf("field ends in a backslash: %q", raw)
+				}
+				switch raw[i] {
+				case 'b':
+					field.WriteByte('\b')
+				case 'f':
+					field.WriteByte('\f')
+				case 'n':
+					field.WriteByte('\n')
+				case 'r':
+					field.WriteByte('\r')
+				case 't':
+					field.WriteByte('\t')
+				case 'v':
+					field.WriteByte('\v')
+				default:
+					// any other character stands for itself, including a backslash
+					field.WriteByte(raw[i])
+				}
+			}
+			f := field.String()
+			row = append(row, &f)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// decodeCopyBinary parses data in the Postgres binary COPY format the way COPY FROM does, for columns of pgTypes,
+// returning nil for NULL fields
+func decodeCopyBinary(data []byte, pgTypes []string) ([][]interface{}, error) {
+	r := bytes.NewReader(data)
+	signature := make([]byte, len(copyBinarySignature))
+	if _, err := r.Read(signature); err != nil || string(signature) != copyBinarySignature {
+		return nil, fmt.Errorf("missing the binary COPY signature: %q", signature)
+	}
+	var flags, extension int32
+	if err := binary.Read(r, binary.BigEndian, &flags); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &extension); err != nil {
+		return nil, err
+	}
+	if flags != 0 {
+		return nil, fmt.Errorf("unexpected header flags: %x", flags)
+	}
+	if _, err := r.Seek(int64(extension), 1); err != nil {
+		return nil, err
+	}
+
+	var rows [][]interface{}
+	for {
+		var fields int16
+		if err := binary.Read(r, binary.BigEndian, &fields); err != nil {
+			return nil, fmt.Errorf("missing the trailer: %w", err)
+		}
+		if fields == -1 {
+			if r.Len() != 0 {
+				return nil, fmt.Errorf("%d bytes after the trailer", r.Len())
+			}
+			return rows, nil
+		}
+		if int(fields) != len(pgTypes) {
+			return nil, fmt.Errorf("row %d has %d fields, expected %d", len(rows)+1, fields, len(pgTypes))
+		}
+
+		row := make([]interface{}, fields)
+		for i := range row {
+			var length int32
+			if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+				return nil, err
+			}
+			if length == -1 {
+				continue
+			}
+			b := make([]byte, length)
+			if _, err := r.Read(b); err != nil && length > 0 {
+				return nil, err
+			}
+
+			size := map[string]int{"smallint": 2, "integer": 4, "bigint": 8, "double precision": 8, "boolean": 1, "timestamp with time zone": 8}
+			if n, fixed := size[pgTypes[i]]; fixed && n != len(b) {
+				return nil, fmt.Errorf("a %s field is %d bytes long, expected %d", pgTypes[i], len(b), n)
+			}
+			switch pgTypes[i] {
+			case "smallint":
+				row[i] = int64(int16(binary.BigEndian.Uint16(b)))
+			case "integer":
+				row[i] = int64(int32(binary.BigEndian.Uint32(b)))
+			case "bigint":
+				row[i] = int64(binary.BigEndian.Uint64(b))
+			case "double precision":
+				row[i] = math.Float64frombits(binary.BigEndian.Uint64(b))
+			case "boolean":
+				row[i] = b[0] != 0
+			case "timestamp with time zone":
+				micros := int64(binary.BigEndian.Uint64(b))
+				row[i] = postgresEpoch.Add(time.Duration(micros) * time.Microsecond)
+			case "bytea":
+				row[i] = b
+			default:
+				row[i] = string(b)
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestExportCopyTextRoundTrip(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+
+	when := time.Date(2021, 8, 1, 12, 30, 0, 250000000, time.FixedZone("CEST", 2*60*60))
+	source := [][]driver.Value{
+		{int64(1), "tab\tnewline\ncarriage\rbackslash\\", []byte{0, '\t', '\\', 0xff}, true, when},
+		// a text value spelling the NULL marker must stay text, and an empty one must not become NULL
+		{int64(-2), `\N`, []byte{}, false, "2021-08-02 00:00:00"},
+		{nil, "", nil, nil, nil},
+	}
+	mockRows := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("id").OfType("INTEGER", int64(0)),
+		sqlmock.NewColumn("message").OfType("TEXT", ""),
+		sqlmock.NewColumn("blob").OfType("BLOB", []byte{}),
+		sqlmock.NewColumn("merged").OfType("BOOLEAN", false),
+		sqlmock.NewColumn("when").OfType("DATETIME", time.Time{}),
+	)
+	for _, row := range source {
+		mockRows.AddRow(row...)
+	}
+	mock.ExpectQuery("SELECT").WillReturnRows(mockRows)
+
+	var b bytes.Buffer
+	if _, err := ExportCopyText(context.Background(), db, "SELECT * FROM commits", &b); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := decodeCopyText(b.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(source) {
+		t.Fatalf("expected %d rows, decoded %d", len(source), len(rows))
+	}
+
+	// each field is read back as the column's type reads its text input
+	for r, row := range rows {
+		if len(row) != 5 {
+			t.Fatalf("row %d: expected 5 fields, decoded %d", r+1, len(row))
+		}
+		if source[r][0] == nil {
+			if row[0] != nil || row[2] != nil || row[3] != nil || row[4] != nil {
+				t.Fatalf("row %d: expected NULLs, decoded %v", r+1, row)
+			}
+			if row[1] == nil || *row[1] != "" {
+				t.Fatalf("row %d: expected an empty string rather than NULL", r+1)
+			}
+			continue
+		}
+
+		id, err := strconv.ParseInt(*row[0], 10, 64)
+		if err != nil || id != source[r][0] {
+			t.Fatalf("row %d: expected id %v, decoded %q", r+1, source[r][0], *row[0])
+		}
+		if *row[1] != source[r][1] {
+			t.Fatalf("row %d: expected message %q, decoded %q", r+1, source[r][1], *row[1])
+		}
+		blob, err := hex.DecodeString(strings.TrimPrefix(*row[2], `\x`))
+		if err != nil || !strings.HasPrefix(*row[2], `\x`) || !bytes.Equal(blob, source[r][2].([]byte)) {
+			t.Fatalf("row %d: expected blob %x, decoded %q", r+1, source[r][2], *row[2])
+		}
+		if merged := *row[3] == "t"; merged != source[r][3] || (*row[3] != "t" && *row[3] != "f") {
+			t.Fatalf("row %d: expected merged %v, decoded %q", r+1, source[r][3], *row[3])
+		}
+		expected, ok := source[r][4].(time.Time)
+		if !ok {
+			expected, _ = time.Parse("2006-01-02 15:04:05", source[r][4].(string))
+		}
+		decoded, err := time.Parse("2006-01-02 15:04:05.999999999Z07:00", *row[4])
+		if !ok {
+			decoded, err = time.Parse("2006-01-02 15:04:05", *row[4])
+		}
+		if err != nil || !decoded.Equal(expected) {
+			t.Fatalf("row %d: expected when %s, decoded %q", r+1, expected, *row[4])
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodeCopyText(t *testing.T) {
+	cases := []struct {
+		value    interface{}
+		pgType   string
+		expected string
+	}{
+		{nil, "text", `\N`},
+		{int64(42), "integer", "42"},
+		{int64(1), "boolean", "t"},
+		{0.30000000000000004, "double precision", "0.30000000000000004"},
+		{[]byte{0xde, 0xad}, "bytea", `\\xdead`},
+		{[]byte("raw\ttext"), "text", `raw\ttext`},
+		{"carriage\rreturn", "text", `carriage\rreturn`},
+	}
+
+	for _, c := range cases {
+		if got := encodeCopyText(c.value, c.pgType); got != c.expected {
+			t.Fatalf("encoding %v as %s: expected %q, got %q", c.value, c.pgType, c.expected, got)
+		}
+	}
+}
+
+func TestExportCopyBinary(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+
+	mockRows := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("id").OfType("INTEGER", int64(0)),
+		sqlmock.NewColumn("size").OfType("BIGINT", int64(0)),
+		sqlmock.NewColumn("message").OfType("TEXT", ""),
+		sqlmock.NewColumn("blob").OfType("BLOB", []byte{}),
+		sqlmock.NewColumn("merged").OfType("BOOLEAN", false),
+		sqlmock.NewColumn("when").OfType("DATETIME", time.Time{}),
+	).
+		AddRow(int64(1), int64(1)<<40, "tab\there", []byte{0xde, 0xad}, true, time.Date(2000, 1, 1, 0, 0, 1, 500000000, time.UTC)).
+		AddRow(nil, nil, nil, nil, int64(0), "1999-12-31 23:59:59")
+
+	mock.ExpectQuery("SELECT").WillReturnRows(mockRows)
+
+	var b bytes.Buffer
+	result, err := ExportCopyBinary(context.Background(), db, "SELECT * FROM commits", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected bytes.Buffer
+	write := func(v interface{}) { _ = binary.Write(&expected, binary.BigEndian, v) }
+	field := func(data []byte) { write(int32(len(data))); expected.Write(data) }
+
+	expected.WriteString("PGCOPY\n\xff\r\n\x00")
+	write(int32(0))
+	write(int32(0))
+
+	write(int16(6))
+	write(int32(4))
+	write(int32(1))
+	write(int32(8))
+	write(int64(1) << 40)
+	field([]byte("tab\there"))
+	field([]byte{0xde, 0xad})
+	field([]byte{1})
+	write(int32(8))
+	write(int64(1500000))
+
+	write(int16(6))
+	for i := 0; i < 4; i++ {
+		write(int32(-1))
+	}
+	field([]byte{0})
+	write(int32(8))
+	write(int64(-1000000))
+
+	write(int16(-1))
+
+	if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+		t.Fatalf("unexpected COPY output:\n%x\nwanted:\n%x", b.Bytes(), expected.Bytes())
+	}
+
+	if result.Rows != 2 {
+		t.Fatalf("expected 2 rows, got: %d", result.Rows)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportCopyBinaryRoundTrip(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+
+	when := time.Date(2021, 8, 1, 12, 30, 0, 250000000, time.FixedZone("CEST", 2*60*60))
+	source := [][]driver.Value{
+		{int64(-1), int64(-1) << 40, "tab\there", []byte{0, 0xff}, true, when},
+		{int64(1<<31 - 1), int64(0), "", []byte{}, int64(0), "1999-12-31 23:59:59"},
+		{nil, nil, nil, nil, nil, nil},
+	}
+	mockRows := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("id").OfType("INTEGER", int64(0)),
+		sqlmock.NewColumn("size").OfType("BIGINT", int64(0)),
+		sqlmock.NewColumn("message").OfType("TEXT", ""),
+		sqlmock.NewColumn("blob").OfType("BLOB", []byte{}),
+		sqlmock.NewColumn("merged").OfType("BOOLEAN", false),
+		sqlmock.NewColumn("when").OfType("DATETIME", time.Time{}),
+	)
+	for _, row := range source {
+		mockRows.AddRow(row...)
+	}
+	mock.ExpectQuery("SELECT").WillReturnRows(mockRows)
+
+	var b bytes.Buffer
+	result, err := ExportCopyBinary(context.Background(), db, "SELECT * FROM commits", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pgTypes := []string{"integer", "bigint", "text", "bytea", "boolean", "timestamp with time zone"}
+	rows, err := decodeCopyBinary(b.Bytes(), pgTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]interface{}{
+		{int64(-1), int64(-1) << 40, "tab\there", []byte{0, 0xff}, true, when.UTC()},
+		{int64(1<<31 - 1), int64(0), "", []byte{}, false, time.Date(1999, 12, 31, 23, 59, 59, 0, time.UTC)},
+		{nil, nil, nil, nil, nil, nil},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("decoded rows don't match the source:\n%v\nwanted:\n%v", rows, expected)
+	}
+	if result.Rows != int64(len(expected)) {
+		t.Fatalf("expected %d rows, got: %d", len(expected), result.Rows)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodeCopyBinaryErrors(t *testing.T) {
+	cases := []struct {
+		value  interface{}
+		pgType string
+	}{
+		{int64(1) << 31, "integer"},
+		{1.5, "bigint"},
+		{"yesterday", "timestamp with time zone"},
+		{int64(1), "bytea"},
+		{"1.50", "numeric(10,2)"},
+	}
+
+	for _, c := range cases {
+		if _, err := encodeCopyBinary(c.value, c.pgType); err == nil {
+			t.Fatalf("expected encoding %v as %s to fail", c.value, c.pgType)
+		}
+	}
+}
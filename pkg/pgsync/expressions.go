@@ -0,0 +1,41 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// validateColumnExpressions checks that each column of expressions is one of the query's columns
+func validateColumnExpressions(expressions map[string]string, columns []string) error {
+	for name := range expressions {
+		if !contains(columns, name) {
+			return invalidOptions("column with an expression is not one of the query's columns: %s", pq.QuoteIdentifier(name))
+		}
+	}
+	return nil
+}
+
+// applyColumnExpressions sets each column of expressions to its expression in every row of the staging table
+// (see SyncOptions.ColumnExpressions), in a single UPDATE
+func applyColumnExpressions(ctx context.Context, tx *sql.Tx, schema, staging string, expressions map[string]string) error {
+	names := make([]string, 0, len(expressions))
+	for name := range expressions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	set := make([]string, len(names))
+	for i, name := range names {
+		set[i] = fmt.Sprintf("%s = %s", pq.QuoteIdentifier(name), expressions[name])
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s", QuoteAlways.qualify(schema, staging), strings.Join(set, ", "))); err != nil {
+		return fmt.Errorf("could not apply the column expressions: %w", err)
+	}
+	return nil
+}
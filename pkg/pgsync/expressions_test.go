@@ -0,0 +1,54 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncColumnExpressions(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("author_email").OfType("TEXT", ""),
+	).AddRow("abc", "Someone@Example.COM")
+
+	// the staging table is loaded as the query produced it, and fixed up before it's swapped in
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", "Someone@Example.COM"})
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "commits_temp" SET "author_email" = lower(trim(author_email)), "hash" = upper(hash)`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	options := &SyncOptions{
+		Postgres:          pg,
+		AskGit:            newSource(t, source),
+		TableName:         "commits",
+		Query:             "SELECT hash, author_email FROM commits",
+		Logger:            zap.NewNop(),
+		ColumnExpressions: map[string]string{"author_email": "lower(trim(author_email))", "hash": "upper(hash)"},
+	}
+	if _, err := Sync(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	options.AskGit = newSource(t, commitRows())
+	options.ColumnExpressions = map[string]string{"author_email": "lower(author_email)"}
+	if _, err := Sync(context.Background(), options); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected ErrInvalidOptions for an expression of a column the query doesn't produce, got: %v", err)
+	}
+}
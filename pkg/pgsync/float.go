@@ -0,0 +1,16 @@
+package pgsync
+
+import (
+	"strconv"
+)
+
+// formatFloats is a rowTransform that formats floating point values as the shortest text that parses back to exactly
+// the same value, so that a double precision column gets every bit of them whatever the driver would make of a float64
+func formatFloats(values []interface{}) ([]interface{}, error) {
+	for i, v := range values {
+		if f, ok := v.(float64); ok {
+			values[i] = strconv.FormatFloat(f, 'g', -1, 64)
+		}
+	}
+	return values, nil
+}
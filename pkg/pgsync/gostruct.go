@@ -0,0 +1,101 @@
+package pgsync
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"go/format"
+	"go/token"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// SQLiteTypeToGoType maps SQLite column types to the Go types their values scan into
+func SQLiteTypeToGoType(col *sql.ColumnType) string {
+	switch sqliteTypeName(col) {
+	case "INT", "INTEGER":
+		return "int64"
+	case "REAL":
+		return "float64"
+	case "BLOB":
+		return "[]byte"
+	case "BOOLEAN":
+		return "bool"
+	case "DATETIME":
+		return "time.Time"
+	default:
+		return "string"
+	}
+}
+
+// goFieldName returns an exported Go identifier for a column name, such as AuthorEmail for author_email
+func goFieldName(column string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range column {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+
+	name := b.String()
+	if name == "" || unicode.IsDigit([]rune(name)[0]) {
+		name = "Column" + name
+	}
+	return name
+}
+
+// GenerateGoStruct returns the source of a Go struct named typeName with a field (tagged with the column name) for
+// each column of the results of query, for typed access to the table Sync creates from them.
+// The query is run to discover its column types, so a query with a LIMIT 0 is enough.
+func GenerateGoStruct(ctx context.Context, askgit *sql.DB, query, typeName string) (string, error) {
+	if !token.IsIdentifier(typeName) {
+		return "", fmt.Errorf("invalid Go type name: %q", typeName)
+	}
+
+	rows, err := askgit.QueryContext(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return "", err
+	}
+	if len(colTypes) == 0 {
+		return "", ErrNoColumns
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "type %s struct {\n", typeName)
+
+	// distinct columns can map to the same field name (a_b and a__b), the later ones are numbered
+	seen := make(map[string]int)
+	for _, col := range colTypes {
+		name := goFieldName(col.Name())
+		if n := seen[name]; n > 0 {
+			seen[name] = n + 1
+			name = fmt.Sprintf("%s%d", name, n+1)
+		} else {
+			seen[name] = 1
+		}
+
+		fmt.Fprintf(&b, "%s %s `db:%s`\n", name, SQLiteTypeToGoType(col), strconv.Quote(col.Name()))
+	}
+	b.WriteString("}\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return string(src), nil
+}
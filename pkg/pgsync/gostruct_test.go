@@ -0,0 +1,85 @@
+package pgsync
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGenerateGoStruct(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+
+	mock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+		sqlmock.NewColumn("churn_ratio").OfType("REAL", float64(0)),
+		sqlmock.NewColumn("contents").OfType("BLOB", []byte(nil)),
+		sqlmock.NewColumn("is_merge").OfType("BOOLEAN", false),
+		sqlmock.NewColumn("author_when").OfType("DATETIME", ""),
+		sqlmock.NewColumn("2fa").OfType("", ""),
+		sqlmock.NewColumn("is merge").OfType("BOOLEAN", false),
+	))
+
+	src, err := GenerateGoStruct(context.Background(), db, "SELECT * FROM commits LIMIT 0", "Commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := parser.ParseFile(token.NewFileSet(), "commit.go", "package models\n\nimport \"time\"\n\n"+src+"\nvar _ time.Time\n", 0)
+	if err != nil {
+		t.Fatalf("generated struct does not parse: %v\n%s", err, src)
+	}
+
+	var fields [][3]string
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.TypeSpec)
+		if !ok {
+			return true
+		}
+		if spec.Name.Name != "Commit" {
+			t.Fatalf("unexpected type name: %s", spec.Name.Name)
+		}
+		for _, f := range spec.Type.(*ast.StructType).Fields.List {
+			tag := reflect.StructTag(f.Tag.Value[1 : len(f.Tag.Value)-1]).Get("db")
+			fields = append(fields, [3]string{f.Names[0].Name, render(f.Type), tag})
+		}
+		return false
+	})
+
+	expected := [][3]string{
+		{"Hash", "string", "hash"},
+		{"Additions", "int64", "additions"},
+		{"ChurnRatio", "float64", "churn_ratio"},
+		{"Contents", "[]byte", "contents"},
+		{"IsMerge", "bool", "is_merge"},
+		{"AuthorWhen", "time.Time", "author_when"},
+		{"Column2fa", "string", "2fa"},
+		{"IsMerge2", "bool", "is merge"},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("expected fields:\n%v\ngot:\n%v\n%s", expected, fields, src)
+	}
+
+	if _, err := GenerateGoStruct(context.Background(), db, "SELECT 1", "not a type"); err == nil {
+		t.Fatal("expected an error for an invalid type name")
+	}
+}
+
+// render returns the source of a field type expression
+func render(expr ast.Expr) string {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		return e.Name
+	case *ast.SelectorExpr:
+		return render(e.X) + "." + e.Sel.Name
+	case *ast.ArrayType:
+		return "[]" + render(e.Elt)
+	default:
+		return ""
+	}
+}
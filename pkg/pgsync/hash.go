@@ -0,0 +1,129 @@
+package pgsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// contentHash returns the hex encoded SHA-256 of a row's values. Each value, in column order, is written to the hash as
+// a single 0 byte if it's NULL, or otherwise as a 1 byte followed by the length of its text form as a big endian
+// uint64 and then the text form itself. The text form of an integer is its base 10 representation, of a float the shortest
+// representation that round-trips (strconv 'g' format), of a boolean "t" or "f", of a timestamp its RFC 3339 representation
+// in UTC with nanoseconds, and of text or a blob its raw bytes. Length prefixing keeps ("ab", "c") and ("a", "bc") distinct.
+func contentHash(h hash.Hash, values []interface{}) string {
+	h.Reset()
+	writeHashed(h, values)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeHashed writes a row's values to h as contentHash describes
+func writeHashed(h hash.Hash, values []interface{}) {
+	var length [8]byte
+	for _, value := range values {
+		if value == nil {
+			h.Write([]byte{0})
+			continue
+		}
+
+		text := hashText(value)
+		binary.BigEndian.PutUint64(length[:], uint64(len(text)))
+
+		h.Write([]byte{1})
+		h.Write(length[:])
+		h.Write(text)
+	}
+}
+
+// hashText returns the text form of a (non-NULL) value as described by contentHash
+func hashText(value interface{}) []byte {
+	switch v := value.(type) {
+	case int64:
+		return []byte(strconv.FormatInt(v, 10))
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'g', -1, 64))
+	case bool:
+		if v {
+			return []byte("t")
+		}
+		return []byte("f")
+	case time.Time:
+		return []byte(v.UTC().Format(time.RFC3339Nano))
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	default:
+		return []byte(fmt.Sprint(v))
+	}
+}
+
+// appendContentHash returns a rowTransform that appends the content hash of a row with numColumns columns to its values
+func appendContentHash(numColumns int) rowTransform {
+	h := sha256.New()
+	out := make([]interface{}, numColumns+1)
+
+	return func(values []interface{}) ([]interface{}, error) {
+		copy(out, values)
+		out[numColumns] = contentHash(h, values)
+		return out, nil
+	}
+}
+
+// rowChecksum is the running checksum of the rows copied by a sync (see SyncOptions.Checksum)
+type rowChecksum struct {
+	h hash.Hash32
+}
+
+func newRowChecksum() *rowChecksum {
+	return &rowChecksum{h: crc32.NewIEEE()}
+}
+
+// add is a rowTransform that adds a row to the checksum, leaving its values as they are
+func (c *rowChecksum) add(values []interface{}) ([]interface{}, error) {
+	writeHashed(c.h, values)
+	return values, nil
+}
+
+// sum returns the checksum of the rows added so far, as 8 hex digits
+func (c *rowChecksum) sum() string {
+	return fmt.Sprintf("%08x", c.h.Sum32())
+}
+
+// appendDistinct appends the rows of the loaded staging table whose content hash isn't in table already
+// (see SyncOptions.SkipDuplicateContent), creating table and the unique index on its content hash column if they don't exist
+// yet, and records how many rows were inserted on result. The staging table is dropped afterwards
+func appendDistinct(ctx context.Context, tx *sql.Tx, table, staging string, columns []string, hashColumn string, result *SyncResult) error {
+	t, s, h := pq.QuoteIdentifier(table), pq.QuoteIdentifier(staging), pq.QuoteIdentifier(hashColumn)
+	statements := []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (LIKE %s INCLUDING DEFAULTS)", t, s),
+		fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s)", pq.QuoteIdentifier(table+"_"+hashColumn+"_key"), t, h),
+	}
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	// rows repeated within the staging table are skipped by the index as well, after the first of them
+	res, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT (%s) DO NOTHING",
+		t, quoteAll("", columns), quoteAll("", columns), s, h))
+	if err != nil {
+		return schemaMismatch(table, err)
+	}
+	if result.Inserted, err = res.RowsAffected(); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", s))
+	return err
+}
@@ -0,0 +1,181 @@
+package pgsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"fmt"
+	"hash/crc32"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestContentHash(t *testing.T) {
+	h := sha256.New()
+
+	a := contentHash(h, []interface{}{"abc", int64(1), nil})
+	b := contentHash(h, []interface{}{"abc", int64(1), nil})
+	if a != b {
+		t.Fatalf("expected identical rows to hash the same, got %s and %s", a, b)
+	}
+
+	distinct := [][]interface{}{
+		{"abc", int64(2), nil},
+		{"abc", int64(1), ""},
+		{"ab", "c1", nil},
+	}
+	for _, row := range distinct {
+		if contentHash(h, row) == a {
+			t.Fatalf("expected %v to hash differently from the original row", row)
+		}
+	}
+}
+
+func TestSyncContentHashColumn(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	h := sha256.New()
+	first := contentHash(h, []interface{}{"abc", int64(1)})
+	second := contentHash(h, []interface{}{"def", int64(2)})
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"row_hash" text\s*\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+	prep := mock.ExpectPrepare(regexp.QuoteMeta(`COPY "commits_temp" ("hash", "additions", "row_hash")`))
+	prep.ExpectExec().WithArgs("abc", int64(1), first).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs("def", int64(2), second).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(0, 2))
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:             pg,
+		AskGit:               newSource(t, commitRows()),
+		TableName:            "commits",
+		Query:                "SELECT hash, additions FROM commits",
+		Logger:               zap.NewNop(),
+		AddContentHashColumn: true,
+		ContentHashColumn:    "row_hash",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncSkipDuplicateContent(t *testing.T) {
+	h := sha256.New()
+	abc, def, ghi := contentHash(h, []interface{}{"abc", int64(1)}), contentHash(h, []interface{}{"def", int64(2)}), contentHash(h, []interface{}{"ghi", int64(3)})
+
+	// Postgres' index on the hash column decides what's appended, which the mock stands in for with the rows inserted
+	sync := func(source *sqlmock.Rows, hashes []string, inserted int64) {
+		pg, mock, _ := sqlmock.New()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectTableColumns(mock, "hash", "text", "additions", "integer", "content_hash", "text")
+		expectGeneratedColumns(mock)
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		prep := mock.ExpectPrepare(regexp.QuoteMeta(`COPY "commits_temp" ("hash", "additions", "content_hash")`))
+		for _, hash := range hashes {
+			prep.ExpectExec().WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), hash).WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+		prep.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(0, int64(len(hashes))))
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "commits" (LIKE "commits_temp" INCLUDING DEFAULTS)`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE UNIQUE INDEX IF NOT EXISTS "commits_content_hash_key" ON "commits" ("content_hash")`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits" ("hash", "additions", "content_hash") SELECT "hash", "additions", "content_hash" FROM "commits_temp" ON CONFLICT ("content_hash") DO NOTHING`)).
+			WillReturnResult(sqlmock.NewResult(0, inserted))
+		mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectProvenance(mock)
+		mock.ExpectCommit()
+
+		result, err := Sync(context.Background(), &SyncOptions{
+			Postgres:             pg,
+			AskGit:               newSource(t, source),
+			TableName:            "commits",
+			Query:                "SELECT hash, additions FROM commits",
+			Logger:               zap.NewNop(),
+			Mode:                 ModeEnsureAndAppend,
+			AddContentHashColumn: true,
+			SkipDuplicateContent: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Rows != int64(len(hashes)) || result.Inserted != inserted {
+			t.Fatalf("expected %d rows loaded and %d appended, got %d and %d", len(hashes), inserted, result.Rows, result.Inserted)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sync(commitRows(), []string{abc, def}, 2)
+	// re-appending the same rows adds nothing
+	sync(commitRows(), []string{abc, def}, 0)
+	// while a new row is appended alongside one seen before
+	sync(sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+	).AddRow("abc", int64(1)).AddRow("ghi", int64(3)), []string{abc, ghi}, 1)
+}
+
+func TestSyncChecksum(t *testing.T) {
+	sync := func(second int64) string {
+		pg, mock, _ := sqlmock.New()
+
+		source := sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("hash").OfType("TEXT", ""),
+			sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+		).AddRow("abc", int64(1)).AddRow("def", second)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", second})
+		expectSwap(mock)
+		expectProvenance(mock)
+		mock.ExpectCommit()
+
+		result, err := Sync(context.Background(), &SyncOptions{
+			Postgres:  pg,
+			AskGit:    newSource(t, source),
+			TableName: "commits",
+			Query:     "SELECT hash, additions FROM commits",
+			Logger:    zap.NewNop(),
+			Checksum:  true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+		return result.Checksum
+	}
+
+	// the checksum can be recomputed from the rows as documented
+	expected := crc32.NewIEEE()
+	writeHashed(expected, []interface{}{"abc", int64(1)})
+	writeHashed(expected, []interface{}{"def", int64(2)})
+
+	first, again, changed := sync(2), sync(2), sync(3)
+	if first != fmt.Sprintf("%08x", expected.Sum32()) {
+		t.Fatalf("expected checksum %08x, got %s", expected.Sum32(), first)
+	}
+	if first != again {
+		t.Fatalf("expected identical syncs to have the same checksum, got %s and %s", first, again)
+	}
+	if first == changed {
+		t.Fatalf("expected a changed row to change the checksum, got %s for both", first)
+	}
+}
@@ -0,0 +1,155 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// heartbeatQuery is run on the sync transaction when a heartbeat is due and there's no COPY to complete
+const heartbeatQuery = "SELECT 1"
+
+// fetchedRow is a row read from the source, or the error that ended the reading
+type fetchedRow struct {
+	values []interface{}
+	err    error
+}
+
+// fetchRows reads rows in its own goroutine, sending each (in a slice of its own) on the returned channel,
+// which is closed once they're exhausted. Reading stops early when stop is closed
+func fetchRows(rows rowSource, numColumns int, stop <-chan struct{}) <-chan fetchedRow {
+	fetched := make(chan fetchedRow)
+
+	go func() {
+		defer close(fetched)
+
+		send := func(row fetchedRow) bool {
+			select {
+			case fetched <- row:
+				return true
+			case <-stop:
+				return false
+			}
+		}
+
+		var n int64
+		for rows.Next() {
+			values := make([]interface{}, numColumns)
+			pointers := make([]interface{}, numColumns)
+			for i := 0; i < len(values); i++ {
+				pointers[i] = &values[i]
+			}
+
+			if err := rows.Scan(pointers...); err != nil {
+				send(fetchedRow{err: fmt.Errorf("could not read row %d of the query results: %w", n+1, err)})
+				return
+			}
+			n++
+
+			if !send(fetchedRow{values: values}) {
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			send(fetchedRow{err: fmt.Errorf("could not read the query results after %d rows: %w", n, err)})
+		}
+	}()
+
+	return fetched
+}
+
+// copyRowsHeartbeat is copyRows for connections that are cut by poolers or firewalls when they look idle.
+// lib/pq buffers the rows of a COPY and only sends them once enough have built up, so rows that trickle in
+// from a slow query can leave the connection silent for a long time. Instead, whenever interval has passed,
+// the COPY in progress is completed (a round trip to the server) and rows that follow go into a new COPY of table.
+// If no rows arrived since the last COPY was completed, a trivial query is run on tx instead.
+func copyRowsHeartbeat(ctx context.Context, tx *sql.Tx, rows rowSource, table string, columns []string, numColumns int, transform rowTransform, interval time.Duration) (int64, error) {
+	return untilDone(ctx, func() (int64, error) {
+		return copyRowsHeartbeatBlocking(ctx, tx, rows, table, columns, numColumns, transform, interval)
+	})
+}
+
+// copyRowsHeartbeatBlocking does the work of copyRowsHeartbeat, returning only once the driver does
+func copyRowsHeartbeatBlocking(ctx context.Context, tx *sql.Tx, rows rowSource, table string, columns []string, numColumns int, transform rowTransform, interval time.Duration) (int64, error) {
+	stop := make(chan struct{})
+	defer close(stop)
+	fetched := fetchRows(rows, numColumns, stop)
+
+	heartbeat := time.NewTicker(interval)
+	defer heartbeat.Stop()
+
+	// stmt is the COPY in progress, if any
+	var stmt *sql.Stmt
+	defer func() {
+		if stmt != nil {
+			_ = stmt.Close()
+		}
+	}()
+
+	// complete finishes the COPY in progress, if any
+	complete := func() error {
+		if stmt == nil {
+			return nil
+		}
+		s := stmt
+		stmt = nil
+
+		// an Exec with no values flushes the COPY and waits for the server to complete it
+		if _, err := s.ExecContext(ctx); err != nil {
+			_ = s.Close()
+			return err
+		}
+		return s.Close()
+	}
+
+	var n int64
+	for {
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+
+		case <-heartbeat.C:
+			var err error
+			if stmt != nil {
+				err = complete()
+			} else {
+				_, err = tx.ExecContext(ctx, heartbeatQuery)
+			}
+			if err != nil {
+				return n, err
+			}
+
+		case row, ok := <-fetched:
+			if !ok {
+				return n, complete()
+			}
+			if row.err != nil {
+				return n, row.err
+			}
+
+			copied := row.values
+			if transform != nil {
+				var err error
+				if copied, err = transform(row.values); err != nil {
+					return n, err
+				}
+			}
+
+			if stmt == nil {
+				var err error
+				if stmt, err = tx.PrepareContext(ctx, pq.CopyIn(table, columns...)); err != nil {
+					return n, err
+				}
+			}
+
+			if _, err := stmt.ExecContext(ctx, copied...); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errReaped is returned by an idleTimeoutDriver connection that has been idle for too long
+var errReaped = errors.New("connection reaped by pooler")
+
+// idleTimeoutDriver is a database/sql driver whose connections are cut, like by a connection pooler, once no
+// round trip has been made on them for longer than timeout. Rows written to a COPY are buffered rather than sent,
+// so they don't count as a round trip. Every statement otherwise succeeds, and every query returns no rows
+type idleTimeoutDriver struct {
+	timeout time.Duration
+}
+
+type idleTimeoutConn struct {
+	mu     sync.Mutex
+	d      *idleTimeoutDriver
+	last   time.Time
+	reaped bool
+}
+type idleTimeoutStmt struct {
+	c    *idleTimeoutConn
+	copy bool
+}
+
+func (d *idleTimeoutDriver) Open(string) (driver.Conn, error) {
+	return &idleTimeoutConn{d: d, last: time.Now()}, nil
+}
+
+// activity checks the connection hasn't been reaped, and resets its idle time for a round trip
+func (c *idleTimeoutConn) activity(roundTrip bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reaped || time.Since(c.last) > c.d.timeout {
+		c.reaped = true
+		return errReaped
+	}
+	if roundTrip {
+		c.last = time.Now()
+	}
+	return nil
+}
+
+func (c *idleTimeoutConn) Prepare(query string) (driver.Stmt, error) {
+	if err := c.activity(true); err != nil {
+		return nil, err
+	}
+	return &idleTimeoutStmt{c, strings.HasPrefix(query, "COPY")}, nil
+}
+func (c *idleTimeoutConn) Close() error { return nil }
+func (c *idleTimeoutConn) Begin() (driver.Tx, error) {
+	return c, c.activity(true)
+}
+func (c *idleTimeoutConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return c, c.activity(true)
+}
+func (c *idleTimeoutConn) Commit() error   { return c.activity(true) }
+func (c *idleTimeoutConn) Rollback() error { return nil }
+
+func (s *idleTimeoutStmt) Close() error  { return nil }
+func (s *idleTimeoutStmt) NumInput() int { return -1 }
+func (s *idleTimeoutStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), s.c.activity(!s.copy || len(args) == 0)
+}
+func (s *idleTimeoutStmt) Query([]driver.Value) (driver.Rows, error) {
+	return recordingRows{}, s.c.activity(true)
+}
+
+// slowSourceDriver is a database/sql driver whose queries produce rows (hash TEXT, additions INTEGER) one every delay
+type slowSourceDriver struct {
+	rows  int
+	delay time.Duration
+}
+
+type slowSourceConn struct{ d *slowSourceDriver }
+type slowSourceRows struct {
+	d *slowSourceDriver
+	n int
+}
+
+func (d *slowSourceDriver) Open(string) (driver.Conn, error) { return slowSourceConn{d}, nil }
+
+func (c slowSourceConn) Prepare(string) (driver.Stmt, error) { return c, nil }
+func (c slowSourceConn) Close() error                        { return nil }
+func (c slowSourceConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+func (c slowSourceConn) NumInput() int                       { return -1 }
+func (c slowSourceConn) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (c slowSourceConn) Query([]driver.Value) (driver.Rows, error) {
+	return &slowSourceRows{d: c.d}, nil
+}
+
+func (r *slowSourceRows) Columns() []string { return []string{"hash", "additions"} }
+func (r *slowSourceRows) ColumnTypeDatabaseTypeName(index int) string {
+	return []string{"TEXT", "INTEGER"}[index]
+}
+func (r *slowSourceRows) Close() error { return nil }
+func (r *slowSourceRows) Next(dest []driver.Value) error {
+	if r.n == r.d.rows {
+		return io.EOF
+	}
+	time.Sleep(r.d.delay)
+	r.n++
+	dest[0], dest[1] = "abc", int64(r.n)
+	return nil
+}
+
+func TestSyncHeartbeat(t *testing.T) {
+	sql.Register("pgsync-idle-timeout", &idleTimeoutDriver{timeout: 100 * time.Millisecond})
+	sql.Register("pgsync-slow-source", &slowSourceDriver{rows: 5, delay: 40 * time.Millisecond})
+
+	sync := func(heartbeat time.Duration) (*SyncResult, error) {
+		pg, err := sql.Open("pgsync-idle-timeout", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pg.Close()
+
+		askgit, err := sql.Open("pgsync-slow-source", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer askgit.Close()
+
+		return Sync(context.Background(), &SyncOptions{
+			Postgres:          pg,
+			AskGit:            askgit,
+			TableName:         "commits",
+			Query:             "SELECT hash, additions FROM commits",
+			Logger:            zap.NewNop(),
+			HeartbeatInterval: heartbeat,
+		})
+	}
+
+	// the rows take twice the idle timeout to arrive, so a single COPY leaves the connection silent for too long
+	if _, err := sync(0); !errors.Is(err, errReaped) {
+		t.Fatalf("expected the connection to be reaped without a heartbeat, got: %v", err)
+	}
+
+	result, err := sync(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 5 {
+		t.Fatalf("expected 5 rows, got %d", result.Rows)
+	}
+}
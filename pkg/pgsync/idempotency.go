@@ -0,0 +1,73 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// completedRun returns the result of the sync of table recorded in the state table of options (by recordRun), if it was
+// made with options.IdempotencyKey, or else nil. A state table that doesn't exist yet, or has no idempotency_key column,
+// has no syncs recorded
+func completedRun(ctx context.Context, options *SyncOptions, table string) (*SyncResult, error) {
+	var key sql.NullString
+	var recorded []byte
+	err := options.Postgres.QueryRowContext(ctx, fmt.Sprintf("SELECT idempotency_key, sync_result FROM %s WHERE table_name = $1", stateTable(options)),
+		QuoteAlways.qualify(options.Schema, table)).Scan(&key, &recorded)
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, sql.ErrNoRows), errors.As(err, &pqErr) && (pqErr.Code == "42P01" || pqErr.Code == "42703"):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	case !key.Valid || key.String != options.IdempotencyKey || recorded == nil:
+		return nil, nil
+	}
+
+	var result SyncResult
+	if err := json.Unmarshal(recorded, &result); err != nil {
+		return nil, fmt.Errorf("could not read the result recorded in state table %s: %w", stateTable(options), err)
+	}
+	return &result, nil
+}
+
+// errAlreadyRun is returned by recordRun when the sync of table was recorded with the same idempotency key by
+// another sync since completedRun found it wasn't
+var errAlreadyRun = errors.New("already synced with the idempotency key")
+
+// recordRun records options.IdempotencyKey and result against the sync of table in the state table of options,
+// in idempotency_key and sync_result columns that are added to it if they're missing. The sync's state must already
+// have been recorded, which holds the row of table until the sync commits. If the row already has the key (without
+// ForceRerun), another sync with the key committed after completedRun looked, and errAlreadyRun is returned
+func recordRun(ctx context.Context, tx *sql.Tx, options *SyncOptions, table string, result *SyncResult) error {
+	state := stateTable(options)
+	if !options.SkipCreateStateTable {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS idempotency_key text, ADD COLUMN IF NOT EXISTS sync_result jsonb", state))
+		if err != nil {
+			return fmt.Errorf("could not add idempotency_key to state table %s: %w", state, err)
+		}
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	update := fmt.Sprintf("UPDATE %s SET idempotency_key = $2, sync_result = $3 WHERE table_name = $1", state)
+	if !options.ForceRerun {
+		update += " AND idempotency_key IS DISTINCT FROM $2"
+	}
+	res, err := tx.ExecContext(ctx, update, QuoteAlways.qualify(options.Schema, table), options.IdempotencyKey, string(b))
+	if err != nil {
+		return fmt.Errorf("could not record the idempotency key in state table %s: %w", state, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errAlreadyRun
+	}
+	return nil
+}
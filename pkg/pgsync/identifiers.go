@@ -0,0 +1,58 @@
+package pgsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"unicode/utf8"
+)
+
+// maxIdentifierLength is the number of bytes of an identifier Postgres keeps (NAMEDATALEN - 1), silently dropping the rest
+const maxIdentifierLength = 63
+
+// LongIdentifierPolicy is what to do with columns whose names are longer than Postgres keeps
+type LongIdentifierPolicy int
+
+const (
+	// LongIdentifiersError fails the sync with ErrLongIdentifier (the default), rather than let Postgres truncate
+	// the names, which can make two columns the same
+	LongIdentifiersError LongIdentifierPolicy = iota
+	// LongIdentifiersHash shortens the names to fit, replacing their ends with a hash of the full name so that
+	// they stay distinct. The same name is always shortened the same way
+	LongIdentifiersHash
+)
+
+// shortenIdentifier returns name cut down to maxIdentifierLength bytes, ending in an underscore and the first 8 hex digits
+// of the SHA-256 of name
+func shortenIdentifier(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	suffix := "_" + hex.EncodeToString(sum[:])[:8]
+
+	n := maxIdentifierLength - len(suffix)
+	for n > 0 && !utf8.RuneStart(name[n]) {
+		n--
+	}
+	return name[:n] + suffix
+}
+
+// fitIdentifiers returns names with any that are too long for Postgres handled according to policy
+func fitIdentifiers(names []string, policy LongIdentifierPolicy) ([]string, error) {
+	fitted := make([]string, len(names))
+	seen := make(map[string]string, len(names))
+	for i, name := range names {
+		fitted[i] = name
+		if len(name) > maxIdentifierLength {
+			if policy != LongIdentifiersHash {
+				return nil, fmt.Errorf("%w: column name is %d bytes, Postgres only keeps %d: %s", ErrLongIdentifier, len(name), maxIdentifierLength, name)
+			}
+			fitted[i] = shortenIdentifier(name)
+		}
+
+		// columns that simply have the same name are left for Postgres to reject, as they always have been
+		if other, ok := seen[fitted[i]]; ok && (other != fitted[i] || name != fitted[i]) {
+			return nil, fmt.Errorf("%w: columns %s and %s would both be named %s", ErrLongIdentifier, other, name, fitted[i])
+		}
+		seen[fitted[i]] = name
+	}
+	return fitted, nil
+}
@@ -0,0 +1,83 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+// longColumnRows returns mock source rows with two columns whose names only differ after the first 63 bytes
+func longColumnRows() *sqlmock.Rows {
+	prefix := strings.Repeat("number_of_lines_added_to_files_in_the_commit_", 2)
+	return sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn(prefix+"excluding_tests").OfType("INTEGER", int64(0)),
+		sqlmock.NewColumn(prefix+"including_tests").OfType("INTEGER", int64(0)),
+	).AddRow(int64(1), int64(2))
+}
+
+func TestSyncLongIdentifiersError(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, longColumnRows()),
+		TableName: "commits",
+		Query:     "SELECT * FROM commit_stats",
+		Logger:    zap.NewNop(),
+	})
+	if !errors.Is(err, ErrLongIdentifier) {
+		t.Fatalf("expected ErrLongIdentifier, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncLongIdentifiersHash(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	names, err := fitIdentifiers([]string{
+		strings.Repeat("number_of_lines_added_to_files_in_the_commit_", 2) + "excluding_tests",
+		strings.Repeat("number_of_lines_added_to_files_in_the_commit_", 2) + "including_tests",
+	}, LongIdentifiersHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names[0] == names[1] || len(names[0]) > maxIdentifierLength || len(names[1]) > maxIdentifierLength {
+		t.Fatalf("expected two distinct names of at most %d bytes, got: %q", maxIdentifierLength, names)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`"`+names[0]+`" integer`) + `,\s*` + regexp.QuoteMeta(`"`+names[1]+`" integer`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp" ("`+names[0]+`", "`+names[1]+`")`, []driver.Value{int64(1), int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, longColumnRows()),
+		TableName:       "commits",
+		Query:           "SELECT * FROM commit_stats",
+		Logger:          zap.NewNop(),
+		LongIdentifiers: LongIdentifiersHash,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Columns[0] != names[0] || result.Columns[1] != names[1] {
+		t.Fatalf("expected the shortened names to be reported, got: %q", result.Columns)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
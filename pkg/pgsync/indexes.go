@@ -0,0 +1,94 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Index is an index created on the table (see SyncOptions.Indexes)
+type Index struct {
+	// Name is the name of the index. Defaults to <table>_<columns>_idx
+	Name string
+	// Columns are the columns indexed, in order
+	Columns []string
+	// Unique makes it a unique index
+	Unique bool
+}
+
+// name returns the name of the index, on table
+func (i Index) name(table string) string {
+	if i.Name != "" {
+		return i.Name
+	}
+	return fmt.Sprintf("%s_%s_idx", table, strings.Join(i.Columns, "_"))
+}
+
+// createIndex returns the CREATE INDEX statement for index on table (in schema, if set), CONCURRENTLY if concurrent.
+// An index of the same name that already exists is left as it is
+func createIndex(schema, table string, index Index, concurrent bool) string {
+	var b strings.Builder
+	b.WriteString("CREATE ")
+	if index.Unique {
+		b.WriteString("UNIQUE ")
+	}
+	b.WriteString("INDEX ")
+	if concurrent {
+		b.WriteString("CONCURRENTLY ")
+	}
+	fmt.Fprintf(&b, "IF NOT EXISTS %s ON %s (%s)", pq.QuoteIdentifier(index.name(table)), QuoteAlways.qualify(schema, table), quoteAll("", index.Columns))
+	return b.String()
+}
+
+// createIndexesConcurrently creates each of indexes on table (in schema, if set) with CREATE INDEX CONCURRENTLY,
+// which can't run in a transaction. All of them are attempted, the error returned names any that failed
+func createIndexesConcurrently(ctx context.Context, db *sql.DB, schema, table string, indexes []Index) error {
+	var failed []string
+	var first error
+	for _, index := range indexes {
+		if _, err := db.ExecContext(ctx, createIndex(schema, table, index, true)); err != nil {
+			failed = append(failed, pq.QuoteIdentifier(index.name(table)))
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	if first != nil {
+		return fmt.Errorf("could not create indexes %s concurrently, the synced data is committed: %w", strings.Join(failed, ", "), first)
+	}
+	return nil
+}
+
+// stagingIndex returns index as it's built on the staging table ahead of the swap (see SyncOptions.IndexesBeforeSwap),
+// under a name of its own, as the table being replaced still has its indexes
+func stagingIndex(table string, index Index) Index {
+	index.Name = index.name(table) + "_new"
+	return index
+}
+
+// createStagingIndexes builds each of indexes of table on the loaded staging table
+func createStagingIndexes(ctx context.Context, tx *sql.Tx, table, staging string, indexes []Index) error {
+	for _, index := range indexes {
+		if _, err := tx.ExecContext(ctx, createIndex("", staging, stagingIndex(table, index), false)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameStagingIndexes gives the indexes built by createStagingIndexes the names of indexes on table, once the
+// staging table has been swapped in and the indexes of the table it replaced are gone
+func renameStagingIndexes(ctx context.Context, tx *sql.Tx, table string, indexes []Index) error {
+	for _, index := range indexes {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER INDEX %s RENAME TO %s",
+			pq.QuoteIdentifier(stagingIndex(table, index).Name), pq.QuoteIdentifier(index.name(table))))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
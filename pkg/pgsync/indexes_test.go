@@ -0,0 +1,120 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncIndexes(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE UNIQUE INDEX IF NOT EXISTS "commits_hash_idx" ON "commits" ("hash")`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		Indexes:   []Index{{Columns: []string{"hash"}, Unique: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncIndexesBeforeSwap(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the indexes are built on the loaded staging table, and take their names once the old table is gone
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("SET LOCAL max_parallel_maintenance_workers = '4'")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE UNIQUE INDEX IF NOT EXISTS "commits_hash_idx_new" ON "commits_temp" ("hash")`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE INDEX IF NOT EXISTS "by_additions_new" ON "commits_temp" ("additions")`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectSwap(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER INDEX "commits_hash_idx_new" RENAME TO "commits_hash_idx"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER INDEX "by_additions_new" RENAME TO "by_additions"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		Indexes: []Index{
+			{Columns: []string{"hash"}, Unique: true},
+			{Name: "by_additions", Columns: []string{"additions"}},
+		},
+		IndexesBeforeSwap: true,
+		SessionSettings:   map[string]string{"max_parallel_maintenance_workers": "4"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncIndexesConcurrent(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	duplicate := errors.New(`could not create unique index "commits_additions_idx"`)
+
+	// the indexes are only built once the data is committed, and one failing doesn't stop the other
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS "commits_additions_idx" ON "commits" ("additions")`)).WillReturnError(duplicate)
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE INDEX CONCURRENTLY IF NOT EXISTS "by_hash" ON "commits" ("hash")`)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		Indexes: []Index{
+			{Columns: []string{"additions"}, Unique: true},
+			{Name: "by_hash", Columns: []string{"hash"}},
+		},
+		IndexesConcurrent: true,
+	})
+	if !errors.Is(err, duplicate) {
+		t.Fatalf("expected the index failure to be reported, got: %v", err)
+	}
+	if result == nil || result.Rows != 2 {
+		t.Fatalf("expected the result of the committed sync along with the error, got: %+v", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
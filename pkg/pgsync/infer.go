@@ -0,0 +1,172 @@
+package pgsync
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	// inferSampleSize is the number of non-null values of each untyped column InferFromData decides its type from
+	inferSampleSize = 100
+	// inferSampleRows is the most rows InferFromData reads ahead, however few non-null values they have
+	inferSampleRows = 1000
+)
+
+// inferTimeLayouts are the layouts of the text values InferFromData takes to be timestamps, the first being that of SQLite's datetime()
+var inferTimeLayouts = []string{"2006-01-02 15:04:05", "2006-01-02 15:04:05.999999999", "2006-01-02T15:04:05", time.RFC3339Nano}
+
+// sampledRows is a rowSource that replays the rows already read from a rowSource, before reading on from it
+type sampledRows struct {
+	rowSource
+	sample  [][]interface{}
+	current []interface{}
+}
+
+func (s *sampledRows) Next() bool {
+	if len(s.sample) > 0 {
+		s.current, s.sample = s.sample[0], s.sample[1:]
+		return true
+	}
+	s.current = nil
+	return s.rowSource.Next()
+}
+
+func (s *sampledRows) Scan(dest ...interface{}) error {
+	if s.current == nil {
+		return s.rowSource.Scan(dest...)
+	}
+
+	if len(dest) != len(s.current) {
+		return fmt.Errorf("expected %d destination arguments in Scan, not %d", len(s.current), len(dest))
+	}
+	for i, d := range dest {
+		p, ok := d.(*interface{})
+		if !ok {
+			return fmt.Errorf("cannot scan a sampled value into %T", d)
+		}
+		*p = s.current[i]
+	}
+	return nil
+}
+
+// columnSample is what's been seen of the values of a column so far
+type columnSample struct {
+	values              int
+	ints, floats, times bool
+}
+
+// add records a non-null value of the column
+func (c *columnSample) add(v interface{}) {
+	c.values++
+
+	var isInt, isFloat, isTime bool
+	switch v := v.(type) {
+	case int64:
+		isInt = true
+	case float64:
+		isFloat = true
+	case time.Time:
+		isTime = true
+	case []byte:
+		isInt, isFloat, isTime = classifyText(string(v))
+	case string:
+		isInt, isFloat, isTime = classifyText(v)
+	}
+
+	c.ints = c.ints && isInt
+	c.floats = c.floats && (isInt || isFloat)
+	c.times = c.times && isTime
+}
+
+// postgresType returns the type of the column, or an empty string if no values were seen or they have no type in common
+func (c *columnSample) postgresType() string {
+	switch {
+	case c.values == 0:
+		return ""
+	case c.ints:
+		return "bigint"
+	case c.floats:
+		return "double precision"
+	case c.times:
+		return "timestamp with time zone"
+	default:
+		return ""
+	}
+}
+
+// classifyText returns whether s reads as an integer, a (finite) floating point number and a timestamp
+func classifyText(s string) (isInt, isFloat, isTime bool) {
+	if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return true, false, false
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return false, true, false
+	}
+	for _, layout := range inferTimeLayouts {
+		if _, err := time.Parse(layout, s); err == nil {
+			return false, false, true
+		}
+	}
+	return false, false, false
+}
+
+// inferTypes reads ahead in rows to decide the Postgres types of the columns of colTypes with no SQLite type (see SyncOptions.InferFromData),
+// returning them by column name along with a rowSource that produces every row of rows, the ones read ahead included
+func inferTypes(rows rowSource, colTypes []*sql.ColumnType) (rowSource, map[string]string, error) {
+	samples := make(map[int]*columnSample)
+	for c, col := range colTypes {
+		if col.DatabaseTypeName() == "" {
+			samples[c] = &columnSample{ints: true, floats: true, times: true}
+		}
+	}
+	if len(samples) == 0 {
+		return rows, nil, nil
+	}
+
+	values := make([]interface{}, len(colTypes))
+	pointers := make([]interface{}, len(colTypes))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	sampled := &sampledRows{rowSource: rows}
+	for len(sampled.sample) < inferSampleRows && !sampledEnough(samples) && rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, nil, fmt.Errorf("could not read row %d of the query results: %w", len(sampled.sample)+1, err)
+		}
+
+		row := make([]interface{}, len(values))
+		copy(row, values)
+		sampled.sample = append(sampled.sample, row)
+
+		for c, sample := range samples {
+			if row[c] != nil && sample.values < inferSampleSize {
+				sample.add(row[c])
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("could not read the query results after %d rows: %w", len(sampled.sample), err)
+	}
+
+	inferred := make(map[string]string)
+	for c, sample := range samples {
+		if t := sample.postgresType(); t != "" {
+			inferred[colTypes[c].Name()] = t
+		}
+	}
+	return sampled, inferred, nil
+}
+
+// sampledEnough returns whether every column of samples has had inferSampleSize values
+func sampledEnough(samples map[int]*columnSample) bool {
+	for _, sample := range samples {
+		if sample.values < inferSampleSize {
+			return false
+		}
+	}
+	return true
+}
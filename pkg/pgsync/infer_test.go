@@ -0,0 +1,56 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncInferFromData(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// neither expression column has a type, one holds integers and the other a mix
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("parents").OfType("", ""),
+		sqlmock.NewColumn("label").OfType("", ""),
+	).
+		AddRow("abc", "1", "1").
+		AddRow("def", nil, "merge").
+		AddRow("ghi", int64(12), nil)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"hash" text,\s*"parents" bigint,\s*"label" text`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`,
+		[]driver.Value{"abc", "1", "1"},
+		[]driver.Value{"def", nil, "merge"},
+		[]driver.Value{"ghi", int64(12), nil},
+	)
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:      pg,
+		AskGit:        newSource(t, source),
+		TableName:     "commits",
+		Query:         "SELECT hash, count(*) AS parents, label FROM commits",
+		Logger:        zap.NewNop(),
+		InferFromData: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rows != 3 {
+		t.Fatalf("expected the rows read ahead to be copied too, got %d rows", result.Rows)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,36 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// truncateOrCreate readies table for a load in place, by emptying it if it exists or otherwise creating it with createSQL
+func truncateOrCreate(ctx context.Context, tx *sql.Tx, table, createSQL string) error {
+	kind, err := relationKind(ctx, tx, table)
+	if err != nil {
+		return err
+	}
+
+	if kind == "" {
+		_, err = tx.ExecContext(ctx, createSQL)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("TRUNCATE %s", pq.QuoteIdentifier(table)))
+	return err
+}
+
+// createIfMissing readies table for an append, by creating it with createSQL unless it exists
+func createIfMissing(ctx context.Context, tx *sql.Tx, table, createSQL string) error {
+	kind, err := relationKind(ctx, tx, table)
+	if err != nil || kind != "" {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, createSQL)
+	return err
+}
@@ -0,0 +1,304 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncReplaceInPlace(t *testing.T) {
+	for _, exists := range []bool{true, false} {
+		pg, mock, _ := sqlmock.New()
+
+		// the table is only ever truncated (or created), never dropped or renamed, so its dependents and grants are left alone
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		if exists {
+			expectTableColumns(mock, "hash", "text", "additions", "integer")
+		} else {
+			expectTableColumns(mock)
+		}
+		relkind := sqlmock.NewRows([]string{"relkind"})
+		if exists {
+			relkind.AddRow("r")
+		}
+		mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(relkind)
+		if exists {
+			mock.ExpectExec(regexp.QuoteMeta(`TRUNCATE "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		} else {
+			mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits" (`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		expectCopy(mock, `"commits"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+		expectProvenance(mock)
+		mock.ExpectCommit()
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:  pg,
+			AskGit:    newSource(t, commitRows()),
+			TableName: "commits",
+			Query:     "SELECT hash, additions FROM commits",
+			Logger:    zap.NewNop(),
+			Mode:      ModeReplaceInPlace,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncEnsureAndAppend(t *testing.T) {
+	// the first sync creates the table, the second appends to it
+	for _, exists := range []bool{false, true} {
+		pg, mock, _ := sqlmock.New()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		relkind := sqlmock.NewRows([]string{"relkind"})
+		if exists {
+			expectTableColumns(mock, "hash", "text", "additions", "integer")
+			relkind.AddRow("r")
+		} else {
+			expectTableColumns(mock)
+		}
+		expectGeneratedColumns(mock)
+		mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(relkind)
+		if !exists {
+			mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits" (`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		expectCopy(mock, `"commits"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+		expectProvenance(mock)
+		mock.ExpectCommit()
+
+		result, err := Sync(context.Background(), &SyncOptions{
+			Postgres:  pg,
+			AskGit:    newSource(t, commitRows()),
+			TableName: "commits",
+			Query:     "SELECT hash, additions FROM commits",
+			Logger:    zap.NewNop(),
+			Mode:      ModeEnsureAndAppend,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Rows != 2 {
+			t.Fatalf("expected 2 rows to be appended, got %d", result.Rows)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncDeferConstraints(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("parent").OfType("TEXT", ""),
+	).
+		AddRow("def", "abc").
+		AddRow("abc", nil)
+
+	// the first row references the second, which a foreign key on parent checked as each row is copied would reject
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("SET CONSTRAINTS ALL DEFERRED")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "parent", "text")
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	mock.ExpectExec(regexp.QuoteMeta(`TRUNCATE "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits"`, []driver.Value{"def", "abc"}, []driver.Value{"abc", nil})
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:         pg,
+		AskGit:           newSource(t, source),
+		TableName:        "commits",
+		Query:            "SELECT hash, parent FROM commits",
+		Logger:           zap.NewNop(),
+		Mode:             ModeReplaceInPlace,
+		DeferConstraints: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncBypassRowSecurity(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the table's policies would hide rows from the sync, row_security is turned off before it's touched
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("SET LOCAL row_security = off")).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "additions", "integer")
+	expectGeneratedColumns(mock)
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	expectCopy(mock, `"commits"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:          pg,
+		AskGit:            newSource(t, commitRows()),
+		TableName:         "commits",
+		Query:             "SELECT hash, additions FROM commits",
+		Logger:            zap.NewNop(),
+		Mode:              ModeEnsureAndAppend,
+		BypassRowSecurity: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 2 {
+		t.Fatalf("expected all 2 rows to be loaded, got %d", result.Rows)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncEnsureAndAppendColumnOrder(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the table's columns are in a different order from the query's, which the COPY's column list takes care of
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "additions", "integer", "hash", "text")
+	expectGeneratedColumns(mock)
+	mock.ExpectQuery("NOT a.atthasdef").
+		WillReturnRows(sqlmock.NewRows([]string{"attname", "format_type"}).AddRow("additions", "integer").AddRow("hash", "text"))
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	expectCopy(mock, `"commits" ("hash", "additions") FROM STDIN`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:      pg,
+		AskGit:        newSource(t, commitRows()),
+		TableName:     "commits",
+		Query:         "SELECT hash, additions FROM commits",
+		Logger:        zap.NewNop(),
+		Mode:          ModeEnsureAndAppend,
+		StrictColumns: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncEnsureAndAppendIdentity(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the table's primary key is an identity column the query leaves to Postgres, so it's left out of the COPY
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "id", "bigint", "hash", "text", "additions", "integer")
+	expectGeneratedColumns(mock, "id", false)
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	expectCopy(mock, `"commits" ("hash", "additions") FROM STDIN`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		Mode:      ModeEnsureAndAppend,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncEnsureAndAppendGeneratedColumn(t *testing.T) {
+	// additions is computed by Postgres, or the table's identity, neither of which the query can load
+	for _, generated := range []bool{false, true} {
+		pg, mock, _ := sqlmock.New()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectTableColumns(mock, "hash", "text", "additions", "integer")
+		expectGeneratedColumns(mock, "additions", generated)
+		mock.ExpectRollback()
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:  pg,
+			AskGit:    newSource(t, commitRows()),
+			TableName: "commits",
+			Query:     "SELECT hash, additions FROM commits",
+			Logger:    zap.NewNop(),
+			Mode:      ModeEnsureAndAppend,
+		})
+
+		expected := `schema mismatch: results do not fit table "commits": column "additions" is an identity column GENERATED ALWAYS, which Postgres fills in, it must be left out of the query`
+		if generated {
+			expected = `schema mismatch: results do not fit table "commits": column "additions" is a generated column, which Postgres fills in, it must be left out of the query`
+		}
+		var mismatch *SchemaMismatchError
+		if !errors.As(err, &mismatch) || mismatch.Error() != expected {
+			t.Fatalf("expected %s, got: %v", expected, err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncEnsureAndAppendStrictColumns(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// deletions was added to the table, and has no default, but the query was never updated
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "additions", "integer", "deletions", "integer")
+	expectGeneratedColumns(mock)
+	mock.ExpectQuery("NOT a.atthasdef").
+		WillReturnRows(sqlmock.NewRows([]string{"attname", "format_type"}).AddRow("hash", "text").AddRow("additions", "integer").AddRow("deletions", "integer"))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:      pg,
+		AskGit:        newSource(t, commitRows()),
+		TableName:     "commits",
+		Query:         "SELECT hash, additions FROM commits",
+		Logger:        zap.NewNop(),
+		Mode:          ModeEnsureAndAppend,
+		StrictColumns: true,
+	})
+
+	var mismatch *SchemaMismatchError
+	if !errors.As(err, &mismatch) || len(mismatch.Columns) != 1 || mismatch.Columns[0].Column != "deletions" || mismatch.Columns[0].Expected != "" {
+		t.Fatalf("expected deletions to be reported as missing from the query, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,103 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// bulkInsertSavepoint is the savepoint made before a COPY that may fall back to INSERTs (see SyncOptions.BulkInsertFallback)
+const bulkInsertSavepoint = "pgsync_bulk_insert"
+
+// insertBatchRows is how many rows each INSERT of a bulk insert holds, unless that's more parameters than Postgres allows
+const insertBatchRows = 500
+
+// maxParameters is the most parameters Postgres allows a statement
+const maxParameters = 65535
+
+// copyUnavailable returns whether err, the error starting a COPY failed with, means the connection can't COPY at all,
+// as with a server or pooler that reports it as an unsupported feature. A protocol violation (08P01) isn't one, as
+// Postgres usually ends the connection after it, taking the transaction with it
+func copyUnavailable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "0A000"
+}
+
+// multiRowInsert returns an INSERT of rows rows of values for columns into table, in schema if set
+func multiRowInsert(schema, table string, columns []string, rows int) string {
+	tuples := make([]string, rows)
+	placeholders := make([]string, len(columns))
+	for r := range tuples {
+		for c := range columns {
+			placeholders[c] = fmt.Sprintf("$%d", r*len(columns)+c+1)
+		}
+		tuples[r] = "(" + strings.Join(placeholders, ", ") + ")"
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", QuoteAlways.qualify(schema, table), quoteAll("", columns), strings.Join(tuples, ", "))
+}
+
+// insertRows loads rows into table, in schema if set, with multi-row INSERTs rather than a COPY, for connections that
+// can't COPY. Returns the number of rows inserted
+func insertRows(ctx context.Context, tx *sql.Tx, rows rowSource, schema, table string, columns []string, numColumns int, transform rowTransform) (int64, error) {
+	batch := insertBatchRows
+	if batch*len(columns) > maxParameters {
+		batch = maxParameters / len(columns)
+	}
+
+	insert, err := tx.PrepareContext(ctx, multiRowInsert(schema, table, columns, batch))
+	if err != nil {
+		return 0, err
+	}
+	defer insert.Close()
+
+	values := make([]interface{}, numColumns)
+	pointers := make([]interface{}, numColumns)
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	var n int64
+	args := make([]interface{}, 0, batch*len(columns))
+	for rows.Next() {
+		select {
+		default:
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return n, fmt.Errorf("could not read row %d of the query results: %w", n+1, err)
+		}
+
+		inserted := values
+		if transform != nil {
+			if inserted, err = transform(values); err != nil {
+				return n, err
+			}
+		}
+		args = append(args, inserted...)
+		n++
+
+		if len(args) == cap(args) {
+			if _, err := insert.ExecContext(ctx, args...); err != nil {
+				return n, fmt.Errorf("could not insert rows %d to %d: %w", n-int64(batch)+1, n, err)
+			}
+			args = args[:0]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return n, fmt.Errorf("could not read the query results after %d rows: %w", n, err)
+	}
+
+	if len(args) > 0 {
+		last := len(args) / len(columns)
+		if _, err := tx.ExecContext(ctx, multiRowInsert(schema, table, columns, last), args...); err != nil {
+			return n, fmt.Errorf("could not insert rows %d to %d: %w", n-int64(last)+1, n, err)
+		}
+	}
+	return n, nil
+}
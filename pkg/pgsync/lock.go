@@ -0,0 +1,16 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// lockTable waits for the advisory lock of table (see SyncOptions.SerializeSyncs), which tx holds until it ends
+func lockTable(ctx context.Context, tx *sql.Tx, schema, table string) error {
+	name := QuoteAlways.qualify(schema, table)
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", name); err != nil {
+		return fmt.Errorf("could not lock table %s: %w", name, err)
+	}
+	return nil
+}
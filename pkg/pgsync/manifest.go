@@ -0,0 +1,47 @@
+package pgsync
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// manifest is the JSON description of a synced table written to SyncOptions.Manifest
+type manifest struct {
+	Table    string           `json:"table"`
+	Schema   string           `json:"schema,omitempty"`
+	Columns  []manifestColumn `json:"columns"`
+	Rows     int64            `json:"rows"`
+	Query    string           `json:"query"`
+	SyncedAt time.Time        `json:"synced_at"`
+}
+
+// manifestColumn is a column of the table in a manifest
+type manifestColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// SQLiteType is the SQLite type name of the query column, empty for expressions and columns pgsync adds
+	SQLiteType string `json:"sqlite_type,omitempty"`
+}
+
+// writeManifest writes the manifest of a sync that loaded the table with the columns of defs, from query, to w
+func writeManifest(w io.Writer, options *SyncOptions, query string, defs []columnDef, result *SyncResult) error {
+	m := manifest{
+		Table:    options.TableName,
+		Schema:   options.Schema,
+		Columns:  make([]manifestColumn, len(defs)),
+		Rows:     result.Rows,
+		Query:    query,
+		SyncedAt: options.now().UTC(),
+	}
+	for i, def := range defs {
+		m.Columns[i] = manifestColumn{Name: def.Name, Type: def.Type}
+		if i < len(result.Types) {
+			m.Columns[i].SQLiteType = result.Types[i].DatabaseType
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m)
+}
@@ -0,0 +1,62 @@
+package pgsync
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncManifest(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	var out bytes.Buffer
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		Manifest:  &out,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(out.Bytes(), &m); err != nil {
+		t.Fatalf("could not parse the manifest: %v\n%s", err, out.String())
+	}
+
+	if m.Table != "commits" || m.Rows != 2 || m.Query != "SELECT hash, additions FROM commits" || m.SyncedAt.IsZero() {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+	expected := []manifestColumn{
+		{Name: "hash", Type: "text", SQLiteType: "TEXT"},
+		{Name: "additions", Type: "integer", SQLiteType: "INTEGER"},
+	}
+	if len(m.Columns) != len(expected) {
+		t.Fatalf("expected %d columns, got: %+v", len(expected), m.Columns)
+	}
+	for i, c := range expected {
+		if m.Columns[i] != c {
+			t.Fatalf("expected %+v, got %+v", c, m.Columns[i])
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
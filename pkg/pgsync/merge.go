@@ -0,0 +1,323 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// DuplicateKeyPolicy is what a merge (or an append with ConflictUpdate) does with rows of the results that have the
+// same ConflictColumns, which it can't both insert, or update the same row with
+type DuplicateKeyPolicy int
+
+const (
+	// DuplicateKeysError fails the sync with ErrDuplicateKeys (the default)
+	DuplicateKeysError DuplicateKeyPolicy = iota
+	// DuplicateKeysKeepLast keeps only the last of the rows with the same keys, in the order the query produced them
+	DuplicateKeysKeepLast
+	// DuplicateKeysKeepFirst keeps only the first of the rows with the same keys, in the order the query produced them
+	DuplicateKeysKeepFirst
+)
+
+// validateConflictColumns checks that keys is a non-empty subset of the query's columns
+func validateConflictColumns(keys, columns []string) error {
+	if len(keys) == 0 {
+		return invalidOptions("merging, appending with a window or updating on conflict requires at least one conflict column")
+	}
+
+	for _, key := range keys {
+		if !contains(columns, key) {
+			return invalidOptions("conflict column %s is not one of the query's columns", pq.QuoteIdentifier(key))
+		}
+	}
+
+	return nil
+}
+
+// validateUpdateColumns checks that updates are all query columns that aren't one of the conflict columns keys
+func validateUpdateColumns(updates, keys, columns []string) error {
+	for _, col := range updates {
+		switch {
+		case !contains(columns, col):
+			return invalidOptions("update column %s is not one of the query's columns", pq.QuoteIdentifier(col))
+		case contains(keys, col):
+			return invalidOptions("update column %s is a conflict column, which can't change", pq.QuoteIdentifier(col))
+		}
+	}
+	return nil
+}
+
+// contains reports whether s is one of values
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// keysMatch returns an expression that's true when the rows aliased a and b have the same keys.
+// If nullSafe, NULL keys match each other (with IS NOT DISTINCT FROM), otherwise a NULL key matches nothing
+func keysMatch(a, b string, keys []string, nullSafe bool) string {
+	op := "="
+	if nullSafe {
+		op = "IS NOT DISTINCT FROM"
+	}
+
+	conditions := make([]string, len(keys))
+	for i, key := range keys {
+		key = pq.QuoteIdentifier(key)
+		conditions[i] = fmt.Sprintf("%s.%s %s %s.%s", a, key, op, b, key)
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// quoteAll quotes every identifier in names and joins them into a comma separated list, with each one
+// prefixed by alias (if it's not empty)
+func quoteAll(alias string, names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = pq.QuoteIdentifier(name)
+		if alias != "" {
+			quoted[i] = alias + "." + quoted[i]
+		}
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// mergeStatements returns the DELETE, UPDATE and INSERT statements that make table match staging.
+// When softDelete is set, rows missing from staging get that column set to the time given as del's $1 instead of being
+// deleted (so del is an UPDATE), and soft deleted rows that reappear have it cleared.
+// Only updates are set on rows that are already in table, or every column that isn't a key if updates is empty.
+// update is empty when every column is a key and nothing is soft deleted, as there's then nothing that can change in place.
+// When createdAt is set, inserted rows have it set to the time given as insert's $1, and when updatedAt is set, both
+// inserted and updated rows have it set to that time (update's $1).
+// Rows are matched on their keys as keysMatch does.
+func mergeStatements(table, staging string, columns, keys, updates []string, softDelete, createdAt, updatedAt string, nullSafe bool) (del, update, insert string) {
+	t, s := pq.QuoteIdentifier(table), pq.QuoteIdentifier(staging)
+	deleted, set, changed := mergeConditions(staging, columns, keys, updates, softDelete, nullSafe)
+
+	if softDelete == "" {
+		del = fmt.Sprintf("DELETE FROM %s AS t WHERE %s", t, deleted)
+	} else {
+		d := pq.QuoteIdentifier(softDelete)
+		del = fmt.Sprintf("UPDATE %s AS t SET %s = $1 WHERE %s", t, d, deleted)
+	}
+
+	if len(set) > 0 {
+		if updatedAt != "" {
+			set = append(set, fmt.Sprintf("%s = $1", pq.QuoteIdentifier(updatedAt)))
+		}
+		update = fmt.Sprintf("UPDATE %s AS t SET %s FROM %s AS s WHERE %s AND (%s)",
+			t, strings.Join(set, ", "), s, keysMatch("s", "t", keys, nullSafe), changed)
+	}
+
+	into, values := quoteAll("", columns), quoteAll("s", columns)
+	for _, stamp := range []string{createdAt, updatedAt} {
+		if stamp != "" {
+			into += ", " + pq.QuoteIdentifier(stamp)
+			values += ", $1"
+		}
+	}
+	insert = fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s AS s WHERE NOT EXISTS (SELECT 1 FROM %s AS t WHERE %s)",
+		t, into, values, s, t, keysMatch("s", "t", keys, nullSafe))
+
+	return del, update, insert
+}
+
+// previewStatements returns queries counting the rows each of the statements of mergeStatements would change,
+// without changing them (see SyncOptions.PreviewChanges). update is empty when mergeStatements' is
+func previewStatements(table, staging string, columns, keys, updates []string, softDelete string, nullSafe bool) (del, update, insert string) {
+	t, s := pq.QuoteIdentifier(table), pq.QuoteIdentifier(staging)
+	deleted, set, changed := mergeConditions(staging, columns, keys, updates, softDelete, nullSafe)
+
+	del = fmt.Sprintf("SELECT count(*) FROM %s AS t WHERE %s", t, deleted)
+	if len(set) > 0 {
+		update = fmt.Sprintf("SELECT count(*) FROM %s AS t WHERE EXISTS (SELECT 1 FROM %s AS s WHERE %s AND (%s))",
+			t, s, keysMatch("s", "t", keys, nullSafe), changed)
+	}
+	insert = fmt.Sprintf("SELECT count(*) FROM %s AS s WHERE NOT EXISTS (SELECT 1 FROM %s AS t WHERE %s)",
+		s, t, keysMatch("s", "t", keys, nullSafe))
+
+	return del, update, insert
+}
+
+// mergeConditions returns the condition on rows of the table (aliased t) that are deleted (or soft deleted) by a merge
+// of staging, the assignments that update the rows that are kept, and the condition on them (and the matching rows of
+// staging, aliased s) that they have anything to update, as described by mergeStatements
+func mergeConditions(staging string, columns, keys, updates []string, softDelete string, nullSafe bool) (deleted string, set []string, changed string) {
+	deleted = fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s AS s WHERE %s)", pq.QuoteIdentifier(staging), keysMatch("s", "t", keys, nullSafe))
+	if softDelete != "" {
+		deleted = fmt.Sprintf("t.%s IS NULL AND %s", pq.QuoteIdentifier(softDelete), deleted)
+	}
+
+	values := updates
+	if len(values) == 0 {
+		for _, col := range columns {
+			if !contains(keys, col) {
+				values = append(values, col)
+			}
+		}
+	}
+
+	var differences []string
+	for _, col := range values {
+		set = append(set, fmt.Sprintf("%s = s.%s", pq.QuoteIdentifier(col), pq.QuoteIdentifier(col)))
+	}
+	if len(values) > 0 {
+		// only touch rows with a value that's actually different
+		differences = append(differences, fmt.Sprintf("(%s) IS DISTINCT FROM (%s)", quoteAll("t", values), quoteAll("s", values)))
+	}
+	if softDelete != "" {
+		d := pq.QuoteIdentifier(softDelete)
+		set = append(set, fmt.Sprintf("%s = NULL", d))
+		differences = append(differences, fmt.Sprintf("t.%s IS NOT NULL", d))
+	}
+
+	return deleted, set, strings.Join(differences, " OR ")
+}
+
+// checkDuplicateKeys returns ErrDuplicateKeys, naming the keys, if more than one row of the loaded staging table has the
+// same keys, which would make a merge insert all of them, or update the row they match with any one of them.
+// Rows with a NULL key only count when nullSafe, as they otherwise match nothing
+func checkDuplicateKeys(ctx context.Context, tx *sql.Tx, staging string, keys []string, nullSafe bool) error {
+	values := make([]string, len(keys))
+	var where string
+	if !nullSafe {
+		notNull := make([]string, len(keys))
+		for i, key := range keys {
+			notNull[i] = pq.QuoteIdentifier(key) + " IS NOT NULL"
+		}
+		where = " WHERE " + strings.Join(notNull, " AND ")
+	}
+	for i, key := range keys {
+		values[i] = pq.QuoteIdentifier(key) + "::text"
+	}
+
+	duplicate := make([]sql.NullString, len(keys))
+	dest := make([]interface{}, len(keys))
+	for i := range duplicate {
+		dest[i] = &duplicate[i]
+	}
+	err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT %s FROM %s%s GROUP BY %s HAVING count(*) > 1 LIMIT 1",
+		strings.Join(values, ", "), pq.QuoteIdentifier(staging), where, quoteAll("", keys))).Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	shown := make([]string, len(keys))
+	for i, value := range duplicate {
+		shown[i] = "NULL"
+		if value.Valid {
+			shown[i] = pq.QuoteLiteral(value.String)
+		}
+	}
+	return fmt.Errorf("%w: more than one row of the results has (%s) = (%s)", ErrDuplicateKeys, quoteAll("", keys), strings.Join(shown, ", "))
+}
+
+// dedupeKeys handles the rows of the loaded staging table that have the same keys as policy says, either failing with
+// checkDuplicateKeys or deleting all but the first or last of them, and returns how many rows it deleted.
+// The staging table is created and loaded by the sync, in its transaction, so the physical order of its rows (by ctid)
+// is the order they were loaded in, that of the query's results, as long as none of them have been updated since
+// (hence no ColumnExpressions with DuplicateKeys). Rows with a NULL key are matched as keysMatch does
+func dedupeKeys(ctx context.Context, tx *sql.Tx, staging string, keys []string, nullSafe bool, policy DuplicateKeyPolicy) (int64, error) {
+	if policy == DuplicateKeysError {
+		return 0, checkDuplicateKeys(ctx, tx, staging, keys, nullSafe)
+	}
+
+	// a row is deleted if another with the same keys comes after it (to keep the last) or before it (to keep the first)
+	later := "<"
+	if policy == DuplicateKeysKeepFirst {
+		later = ">"
+	}
+	s := pq.QuoteIdentifier(staging)
+	res, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s AS a USING %s AS b WHERE %s AND a.ctid %s b.ctid",
+		s, s, keysMatch("a", "b", keys, nullSafe), later))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// merge applies the changes needed to make the table of options match the loaded staging table, creating the table if
+// it doesn't exist yet, and records how many rows were changed on result. Rows are soft deleted, and stamped with
+// CreatedAtColumn and UpdatedAtColumn (see mergeStatements), at the time of options.Clock. The staging table is dropped
+// afterwards. With PreviewChanges, the rows that would be changed are only counted. Keys repeated in the staging table
+// are handled as DuplicateKeys says first (see dedupeKeys)
+func merge(ctx context.Context, tx *sql.Tx, options *SyncOptions, staging string, columns []string, result *SyncResult) error {
+	table, keys, updates := options.TableName, options.ConflictColumns, options.UpdateColumns
+	softDelete, createdAt, updatedAt := options.SoftDeleteColumn, options.CreatedAtColumn, options.UpdatedAtColumn
+	nullSafe, preview, now := options.NullSafeConflictColumns, options.PreviewChanges, options.now()
+
+	var err error
+	if result.Deduplicated, err = dedupeKeys(ctx, tx, staging, keys, nullSafe, options.DuplicateKeys); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (LIKE %s INCLUDING DEFAULTS)", pq.QuoteIdentifier(table), pq.QuoteIdentifier(staging)))
+	if err != nil {
+		return err
+	}
+
+	for _, col := range []string{softDelete, createdAt, updatedAt} {
+		if col == "" {
+			continue
+		}
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s timestamp with time zone",
+			pq.QuoteIdentifier(table), pq.QuoteIdentifier(col)))
+		if err != nil {
+			return err
+		}
+	}
+
+	del, update, insert := mergeStatements(table, staging, columns, keys, updates, softDelete, createdAt, updatedAt, nullSafe)
+	if preview {
+		del, update, insert = previewStatements(table, staging, columns, keys, updates, softDelete, nullSafe)
+	}
+
+	exec := func(stmt string, affected *int64, args ...interface{}) error {
+		if stmt == "" {
+			return nil
+		}
+		if preview {
+			return tx.QueryRowContext(ctx, stmt).Scan(affected)
+		}
+		res, err := tx.ExecContext(ctx, stmt, args...)
+		if err != nil {
+			return schemaMismatch(table, err)
+		}
+		*affected, err = res.RowsAffected()
+		return err
+	}
+
+	var delArgs, updateArgs, insertArgs []interface{}
+	if softDelete != "" {
+		delArgs = append(delArgs, now)
+	}
+	if updatedAt != "" {
+		updateArgs = append(updateArgs, now)
+	}
+	if createdAt != "" || updatedAt != "" {
+		insertArgs = append(insertArgs, now)
+	}
+	if err := exec(del, &result.Deleted, delArgs...); err != nil {
+		return err
+	}
+	if err := exec(update, &result.Updated, updateArgs...); err != nil {
+		return err
+	}
+	if err := exec(insert, &result.Inserted, insertArgs...); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", pq.QuoteIdentifier(staging)))
+	return err
+}
@@ -0,0 +1,438 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestMergeStatements(t *testing.T) {
+	del, update, insert := mergeStatements("commits", "commits_temp", []string{"hash", "additions"}, []string{"hash"}, nil, "", "", "", false)
+
+	expectedDelete := `DELETE FROM "commits" AS t WHERE NOT EXISTS (SELECT 1 FROM "commits_temp" AS s WHERE s."hash" = t."hash")`
+	if del != expectedDelete {
+		t.Fatalf("unexpected delete:\n%s", del)
+	}
+
+	expectedUpdate := `UPDATE "commits" AS t SET "additions" = s."additions" FROM "commits_temp" AS s WHERE s."hash" = t."hash" AND ((t."additions") IS DISTINCT FROM (s."additions"))`
+	if update != expectedUpdate {
+		t.Fatalf("unexpected update:\n%s", update)
+	}
+
+	expectedInsert := `INSERT INTO "commits" ("hash", "additions") SELECT s."hash", s."additions" FROM "commits_temp" AS s WHERE NOT EXISTS (SELECT 1 FROM "commits" AS t WHERE s."hash" = t."hash")`
+	if insert != expectedInsert {
+		t.Fatalf("unexpected insert:\n%s", insert)
+	}
+
+	if _, update, _ := mergeStatements("commits", "commits_temp", []string{"hash"}, []string{"hash"}, nil, "", "", "", false); update != "" {
+		t.Fatalf("expected no update when every column is a key, got:\n%s", update)
+	}
+}
+
+func TestMergeStatementsSoftDelete(t *testing.T) {
+	del, update, _ := mergeStatements("commits", "commits_temp", []string{"hash", "additions"}, []string{"hash"}, nil, "deleted_at", "", "", false)
+
+	expectedDelete := `UPDATE "commits" AS t SET "deleted_at" = $1 WHERE t."deleted_at" IS NULL AND NOT EXISTS (SELECT 1 FROM "commits_temp" AS s WHERE s."hash" = t."hash")`
+	if del != expectedDelete {
+		t.Fatalf("unexpected soft delete:\n%s", del)
+	}
+
+	expectedUpdate := `UPDATE "commits" AS t SET "additions" = s."additions", "deleted_at" = NULL FROM "commits_temp" AS s WHERE s."hash" = t."hash" AND ((t."additions") IS DISTINCT FROM (s."additions") OR t."deleted_at" IS NOT NULL)`
+	if update != expectedUpdate {
+		t.Fatalf("unexpected update:\n%s", update)
+	}
+
+	// with only key columns, reappearing rows still need to be undeleted
+	_, update, _ = mergeStatements("commits", "commits_temp", []string{"hash"}, []string{"hash"}, nil, "deleted_at", "", "", false)
+	expectedUpdate = `UPDATE "commits" AS t SET "deleted_at" = NULL FROM "commits_temp" AS s WHERE s."hash" = t."hash" AND (t."deleted_at" IS NOT NULL)`
+	if update != expectedUpdate {
+		t.Fatalf("unexpected update:\n%s", update)
+	}
+}
+
+func TestValidateConflictColumns(t *testing.T) {
+	if err := validateConflictColumns(nil, []string{"hash"}); err == nil {
+		t.Fatal("expected an error without conflict columns")
+	}
+
+	if err := validateConflictColumns([]string{"sha"}, []string{"hash"}); err == nil {
+		t.Fatal("expected an error for a conflict column the query doesn't produce")
+	}
+
+	if err := validateConflictColumns([]string{"hash"}, []string{"hash", "additions"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncMerge(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the live table holds abc (with 5 additions) and xyz, the source has abc (now 1 addition) and def,
+	// so the merge should delete xyz, update abc and insert def
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "additions", "integer")
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectNoDuplicateKeys(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "commits" (LIKE "commits_temp" INCLUDING DEFAULTS)`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "commits"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "commits"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, commitRows()),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		Mode:            ModeMerge,
+		ConflictColumns: []string{"hash"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Inserted != 1 || result.Updated != 1 || result.Deleted != 1 {
+		t.Fatalf("expected one insert, update and delete, got: %+v", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncMergeSoftDeleteLifecycle(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	options := &SyncOptions{
+		Postgres:         pg,
+		AskGit:           askgit,
+		TableName:        "commits",
+		Query:            "SELECT hash, additions FROM commits",
+		Logger:           zap.NewNop(),
+		Mode:             ModeMerge,
+		ConflictColumns:  []string{"hash"},
+		SoftDeleteColumn: "deleted_at",
+	}
+
+	// each sync reports the given number of rows inserted, soft deleted and updated (undeleted)
+	sync := func(inserted, deleted, updated int64, rows ...[]driver.Value) *SyncResult {
+		sourceRows := sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("hash").OfType("TEXT", ""),
+			sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+		)
+		for _, row := range rows {
+			sourceRows.AddRow(row...)
+		}
+		source.ExpectQuery(".").WillReturnRows(sourceRows)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectTableColumns(mock)
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, rows...)
+		expectNoDuplicateKeys(mock)
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits" ADD COLUMN IF NOT EXISTS "deleted_at" timestamp with time zone`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE "commits" AS t SET "deleted_at" = $1`)).WithArgs(sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, deleted))
+		mock.ExpectExec(regexp.QuoteMeta(`"deleted_at" = NULL`)).WillReturnResult(sqlmock.NewResult(0, updated))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits"`)).WillReturnResult(sqlmock.NewResult(0, inserted))
+		mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectProvenance(mock)
+		mock.ExpectCommit()
+
+		result, err := Sync(context.Background(), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// insert, then disappear (soft delete), then reappear (undelete)
+	if r := sync(2, 0, 0, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)}); r.Inserted != 2 {
+		t.Fatalf("expected 2 inserts, got: %+v", r)
+	}
+	if r := sync(0, 1, 0, []driver.Value{"abc", int64(1)}); r.Deleted != 1 {
+		t.Fatalf("expected 1 soft delete, got: %+v", r)
+	}
+	if r := sync(0, 0, 1, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)}); r.Updated != 1 || r.Inserted != 0 {
+		t.Fatalf("expected 1 undelete and no inserts, got: %+v", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncMergeTimestamps(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	options := &SyncOptions{
+		Postgres:        pg,
+		AskGit:          askgit,
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		Mode:            ModeMerge,
+		ConflictColumns: []string{"hash"},
+		CreatedAtColumn: "created_at",
+		UpdatedAtColumn: "updated_at",
+		Clock:           func() time.Time { return now },
+	}
+
+	// each sync reports the given number of rows inserted and updated, with the time of the sync
+	sync := func(inserted, updated int64, additions int64) *SyncResult {
+		source.ExpectQuery(".").WillReturnRows(sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("hash").OfType("TEXT", ""),
+			sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+		).AddRow("abc", additions))
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectTableColumns(mock)
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", additions})
+		expectNoDuplicateKeys(mock)
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits" ADD COLUMN IF NOT EXISTS "created_at" timestamp with time zone`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits" ADD COLUMN IF NOT EXISTS "updated_at" timestamp with time zone`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE "commits" AS t SET "additions" = s."additions", "updated_at" = $1 FROM`)).
+			WithArgs(now).WillReturnResult(sqlmock.NewResult(0, updated))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits" ("hash", "additions", "created_at", "updated_at") SELECT s."hash", s."additions", $1, $1 FROM`)).
+			WithArgs(now).WillReturnResult(sqlmock.NewResult(0, inserted))
+		mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectProvenance(mock)
+		mock.ExpectCommit()
+
+		result, err := Sync(context.Background(), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// the first sync inserts the row with both stamps, the second only sets updated_at, when the row changes
+	if r := sync(1, 0, 1); r.Inserted != 1 {
+		t.Fatalf("expected 1 insert, got: %+v", r)
+	}
+	now = now.Add(time.Hour)
+	if r := sync(0, 1, 2); r.Updated != 1 || r.Inserted != 0 {
+		t.Fatalf("expected 1 update and no inserts, got: %+v", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeStatementsNullSafe(t *testing.T) {
+	del, update, insert := mergeStatements("commits", "commits_temp", []string{"repo", "hash", "additions"}, []string{"repo", "hash"}, nil, "", "", "", true)
+
+	match := `s."repo" IS NOT DISTINCT FROM t."repo" AND s."hash" IS NOT DISTINCT FROM t."hash"`
+	for _, stmt := range []string{del, update, insert} {
+		if !strings.Contains(stmt, match) || strings.Contains(stmt, `"hash" = `) {
+			t.Fatalf("expected rows to be matched NULL safely:\n%s", stmt)
+		}
+	}
+}
+
+func TestSyncMergeNullSafeConflictColumns(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the second row has a NULL hash, which (when it's already in the table) shouldn't be deleted and inserted again
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("repo").OfType("TEXT", ""),
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+	).AddRow("askgit", "abc").AddRow("askgit", nil)
+
+	match := regexp.QuoteMeta(`s."repo" IS NOT DISTINCT FROM t."repo" AND s."hash" IS NOT DISTINCT FROM t."hash"`)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "repo", "text", "hash", "text")
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"askgit", "abc"}, []driver.Value{"askgit", nil})
+	expectNoDuplicateKeys(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM "commits" .*` + match).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO "commits" .*` + match).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:                pg,
+		AskGit:                  newSource(t, source),
+		TableName:               "commits",
+		Query:                   "SELECT repo, hash FROM commits",
+		Logger:                  zap.NewNop(),
+		Mode:                    ModeMerge,
+		ConflictColumns:         []string{"repo", "hash"},
+		NullSafeConflictColumns: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Inserted != 0 || result.Deleted != 0 {
+		t.Fatalf("expected no rows to be deleted or inserted again, got: %+v", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncMergeUpdateColumns(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	rows := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+		sqlmock.NewColumn("deletions").OfType("INTEGER", int64(0)),
+	).AddRow("abc", int64(1), int64(3))
+
+	// deletions are only written when a commit is first inserted
+	update := `UPDATE "commits" AS t SET "additions" = s."additions" FROM "commits_temp" AS s WHERE s."hash" = t."hash" AND ((t."additions") IS DISTINCT FROM (s."additions"))`
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "additions", "integer", "deletions", "integer")
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1), int64(3)})
+	expectNoDuplicateKeys(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(update)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits" ("hash", "additions", "deletions")`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	options := &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, rows),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions, deletions FROM commits",
+		Logger:          zap.NewNop(),
+		Mode:            ModeMerge,
+		ConflictColumns: []string{"hash"},
+		UpdateColumns:   []string{"additions"},
+	}
+	result, err := Sync(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Updated != 1 {
+		t.Fatalf("expected one update, got: %+v", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a conflict column identifies the row, it can't be updated
+	if err := validateUpdateColumns([]string{"hash"}, []string{"hash"}, []string{"hash", "additions"}); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected ErrInvalidOptions for updating a conflict column, got: %v", err)
+	}
+	if err := validateUpdateColumns([]string{"author_when"}, []string{"hash"}, []string{"hash", "additions"}); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected ErrInvalidOptions for updating a column the query doesn't produce, got: %v", err)
+	}
+}
+
+func TestSyncMergeDuplicateKeys(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// abc is in the source twice, which the merge would insert twice, or update abc with either of
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+	).AddRow("abc", int64(1)).AddRow("def", int64(2)).AddRow("abc", int64(3))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "additions", "integer")
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)}, []driver.Value{"abc", int64(3)})
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT "hash"::text FROM "commits_temp" WHERE "hash" IS NOT NULL GROUP BY "hash" HAVING count(*) > 1 LIMIT 1`)).
+		WillReturnRows(sqlmock.NewRows([]string{"hash"}).AddRow("abc"))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, source),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		Mode:            ModeMerge,
+		ConflictColumns: []string{"hash"},
+	})
+	if !errors.Is(err, ErrDuplicateKeys) || !strings.HasSuffix(err.Error(), `duplicate conflict keys: more than one row of the results has ("hash") = ('abc')`) {
+		t.Fatalf("expected the duplicated key to be named, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncMergeDuplicateKeysKeepLast(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// abc is in the source twice, only the second of which (with 3 additions) is merged
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+	).AddRow("abc", int64(1)).AddRow("def", int64(2)).AddRow("abc", int64(3))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "additions", "integer")
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)}, []driver.Value{"abc", int64(3)})
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "commits_temp" AS a USING "commits_temp" AS b WHERE a."hash" = b."hash" AND a.ctid < b.ctid`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits"`)).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, source),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		Mode:            ModeMerge,
+		ConflictColumns: []string{"hash"},
+		DuplicateKeys:   DuplicateKeysKeepLast,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rows != 3 || result.Deduplicated != 1 || result.Inserted != 2 {
+		t.Fatalf("expected 3 rows loaded, 1 dropped and one inserted per key, got: %+v", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,181 @@
+package pgsync
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MixedTypePolicy is what a sync does with a value that's not of its column's type, which SQLite's dynamic typing
+// allows (as in a text value among the integers of a column). Only columns of integer, floating point, boolean and
+// timestamp types are checked, as anything can be loaded as text
+type MixedTypePolicy int
+
+const (
+	// MixedTypesIgnore leaves values as they are, for Postgres to read as the column's type or reject (the default)
+	MixedTypesIgnore MixedTypePolicy = iota
+	// MixedTypesCoerce converts values that can be read as the column's type (such as the text "42" in an integer column),
+	// and fails the sync on those that can't
+	MixedTypesCoerce
+	// MixedTypesNull converts values that can be read as the column's type, and loads those that can't as NULL
+	MixedTypesNull
+	// MixedTypesError fails the sync on any value that's not of the column's type
+	MixedTypesError
+)
+
+// maxMixedTypeValues is the most values SyncResult.MixedTypes lists
+const maxMixedTypeValues = 100
+
+// MixedTypeValue is a value found not to be of its column's type (see SyncOptions.MixedTypes)
+type MixedTypeValue struct {
+	// Row is the number of the row in the query's results, from 1
+	Row int64
+	// Column is the name of the column
+	Column string
+	// Value is the value, as the query produced it
+	Value interface{}
+	// Nulled is set when the value was loaded as NULL
+	Nulled bool
+}
+
+// columnKind is the kind of Postgres type values are checked against
+type columnKind int
+
+const (
+	kindOther columnKind = iota
+	kindInteger
+	kindFloat
+	kindBoolean
+	kindTimestamp
+)
+
+// kindOf returns the kind of the Postgres type pgType
+func kindOf(pgType string) columnKind {
+	switch {
+	case pgType == "integer", pgType == "bigint", pgType == "smallint":
+		return kindInteger
+	case pgType == "double precision", pgType == "real", strings.HasPrefix(pgType, "numeric"):
+		return kindFloat
+	case pgType == "boolean":
+		return kindBoolean
+	case strings.HasPrefix(pgType, "timestamp"):
+		return kindTimestamp
+	default:
+		return kindOther
+	}
+}
+
+// fits returns whether v is already of the kind k
+func (k columnKind) fits(v interface{}) bool {
+	switch v.(type) {
+	case int64:
+		return k == kindInteger || k == kindFloat
+	case float64:
+		return k == kindFloat
+	case bool:
+		return k == kindBoolean
+	case time.Time:
+		return k == kindTimestamp
+	default:
+		return false
+	}
+}
+
+// coerce returns v converted to the kind k, if it can be read as one
+func (k columnKind) coerce(v interface{}) (interface{}, bool) {
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+
+	switch k {
+	case kindInteger:
+		switch v := v.(type) {
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < math.MaxInt64 {
+				return int64(v), true
+			}
+		case bool:
+			if v {
+				return int64(1), true
+			}
+			return int64(0), true
+		case string:
+			if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				return i, true
+			}
+		}
+	case kindFloat:
+		if s, ok := v.(string); ok {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+				return f, true
+			}
+		}
+	case kindBoolean:
+		switch v := v.(type) {
+		case int64:
+			if v == 0 || v == 1 {
+				return v == 1, true
+			}
+		case string:
+			if b, ok := parseBoolean(v); ok {
+				return b, true
+			}
+		}
+	case kindTimestamp:
+		if s, ok := v.(string); ok {
+			for _, layout := range inferTimeLayouts {
+				if t, err := time.Parse(layout, s); err == nil {
+					return t, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// mixedTypesTransform returns a rowTransform that applies policy to the values of the columns of defs (named as in colNames)
+// that aren't of their column's type, recording the first of them in found
+func mixedTypesTransform(colNames []string, defs []columnDef, policy MixedTypePolicy, found *[]MixedTypeValue) rowTransform {
+	kinds := make(map[int]columnKind)
+	for c := range colNames {
+		if k := kindOf(defs[c].Type); k != kindOther {
+			kinds[c] = k
+		}
+	}
+
+	var row int64
+	return func(values []interface{}) ([]interface{}, error) {
+		row++
+		for c, k := range kinds {
+			v := values[c]
+			if v == nil || k.fits(v) {
+				continue
+			}
+
+			mixed := MixedTypeValue{Row: row, Column: colNames[c], Value: v}
+			if policy == MixedTypesError {
+				return nil, fmt.Errorf("row %d, column %s: %v (%T) is not of the column's type, %s", row, pq.QuoteIdentifier(colNames[c]), v, v, defs[c].Type)
+			}
+
+			coerced, ok := k.coerce(v)
+			switch {
+			case ok:
+				values[c] = coerced
+			case policy == MixedTypesNull:
+				values[c] = nil
+				mixed.Nulled = true
+			default:
+				return nil, fmt.Errorf("row %d, column %s: %v (%T) can't be read as the column's type, %s", row, pq.QuoteIdentifier(colNames[c]), v, v, defs[c].Type)
+			}
+
+			if len(*found) < maxMixedTypeValues {
+				*found = append(*found, mixed)
+			}
+		}
+		return values, nil
+	}
+}
@@ -0,0 +1,89 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncMixedTypes(t *testing.T) {
+	for _, c := range []struct {
+		policy MixedTypePolicy
+		// copied are the values of the additions column copied before the sync finishes,
+		// failedRow the row it fails on (if it does)
+		copied    []driver.Value
+		failedRow string
+	}{
+		{MixedTypesCoerce, []driver.Value{int64(1), int64(2)}, "row 3"},
+		{MixedTypesNull, []driver.Value{int64(1), int64(2), nil}, ""},
+		{MixedTypesError, []driver.Value{int64(1)}, "row 2"},
+	} {
+		pg, mock, _ := sqlmock.New()
+
+		// SQLite lets an INTEGER column hold text
+		source := sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("hash").OfType("TEXT", ""),
+			sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+		).
+			AddRow("abc", int64(1)).
+			AddRow("def", "2").
+			AddRow("ghi", "many")
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		prep := mock.ExpectPrepare(regexp.QuoteMeta(`COPY "commits_temp"`))
+		hashes := []string{"abc", "def", "ghi"}
+		for i, v := range c.copied {
+			prep.ExpectExec().WithArgs(hashes[i], v).WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+		if c.failedRow == "" {
+			prep.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(0, 3))
+			expectSwap(mock)
+			expectProvenance(mock)
+			mock.ExpectCommit()
+		} else {
+			mock.ExpectRollback()
+		}
+
+		result, err := Sync(context.Background(), &SyncOptions{
+			Postgres:   pg,
+			AskGit:     newSource(t, source),
+			TableName:  "commits",
+			Query:      "SELECT hash, additions FROM commits",
+			Logger:     zap.NewNop(),
+			MixedTypes: c.policy,
+		})
+
+		if c.failedRow != "" {
+			if err == nil || !strings.Contains(err.Error(), c.failedRow) || !strings.Contains(err.Error(), `"additions"`) {
+				t.Fatalf("policy %d: expected the sync to fail on %s, got: %v", c.policy, c.failedRow, err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("policy %d: %v", c.policy, err)
+			}
+			expected := []MixedTypeValue{
+				{Row: 2, Column: "additions", Value: "2"},
+				{Row: 3, Column: "additions", Value: "many", Nulled: true},
+			}
+			if len(result.MixedTypes) != len(expected) {
+				t.Fatalf("policy %d: expected %d mixed type values, got: %+v", c.policy, len(expected), result.MixedTypes)
+			}
+			for i, v := range expected {
+				if result.MixedTypes[i] != v {
+					t.Fatalf("policy %d: expected %+v, got %+v", c.policy, v, result.MixedTypes[i])
+				}
+			}
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("policy %d: %v", c.policy, err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package pgsync
+
+import (
+	"database/sql"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// OpenWithNotices opens a connection to Postgres that logs the NOTICE and WARNING messages Postgres sends
+// (such as `table "commits_drop" does not exist, skipping`) to logger, which are otherwise discarded.
+// Notices are logged against the connection rather than a sync, so pass a logger tagged with the table
+// (as SyncOptions.Logger is with pgTable) when the connection is used for a single table
+func OpenWithNotices(dsn string, logger *zap.Logger) (*sql.DB, error) {
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(pq.ConnectorWithNoticeHandler(connector, logNotice(logger.Sugar()))), nil
+}
+
+// logNotice returns a lib/pq notice handler that logs notices to l, at the level matching their severity
+func logNotice(l *zap.SugaredLogger) func(*pq.Error) {
+	return func(notice *pq.Error) {
+		fields := []interface{}{"severity", notice.Severity, "code", string(notice.Code)}
+		if notice.Table != "" {
+			fields = append(fields, "noticeTable", notice.Table)
+		}
+		if notice.Detail != "" {
+			fields = append(fields, "detail", notice.Detail)
+		}
+
+		switch notice.Severity {
+		case "WARNING":
+			l.Warnw(notice.Message, fields...)
+		case "DEBUG", "LOG":
+			l.Debugw(notice.Message, fields...)
+		default:
+			l.Infow(notice.Message, fields...)
+		}
+	}
+}
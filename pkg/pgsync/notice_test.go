@@ -0,0 +1,31 @@
+package pgsync
+
+import (
+	"testing"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogNotice(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	handler := logNotice(zap.New(core).Sugar().With("pgTable", "commits"))
+
+	handler(&pq.Error{Severity: "NOTICE", Code: "00000", Message: `table "commits_drop" does not exist, skipping`})
+	handler(&pq.Error{Severity: "WARNING", Code: "01000", Message: "there is no transaction in progress"})
+
+	entries := logs.All()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 logged notices, got %d", len(entries))
+	}
+
+	if e := entries[0]; e.Level != zapcore.InfoLevel || e.Message != `table "commits_drop" does not exist, skipping` ||
+		e.ContextMap()["pgTable"] != "commits" || e.ContextMap()["severity"] != "NOTICE" {
+		t.Fatalf("unexpected entry for the notice: %+v", e)
+	}
+	if e := entries[1]; e.Level != zapcore.WarnLevel {
+		t.Fatalf("expected the warning to be logged as one, got: %+v", e)
+	}
+}
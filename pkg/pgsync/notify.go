@@ -0,0 +1,66 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// maxNotifyPayload is the longest payload Postgres sends with a notification (in its default configuration)
+const maxNotifyPayload = 7999
+
+// OversizedPayloadPolicy is what's done with a notification payload that's longer than Postgres allows
+// (see SyncOptions.NotifyPayload)
+type OversizedPayloadPolicy int
+
+const (
+	// PayloadTruncate sends as much of the payload as fits (the default)
+	PayloadTruncate OversizedPayloadPolicy = iota
+	// PayloadSummarize sends the default payload instead, naming the table and the number of rows synced
+	PayloadSummarize
+	// PayloadSkip sends no notification
+	PayloadSkip
+)
+
+// notifySummary is the default payload of the notification of a sync
+type notifySummary struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+}
+
+// summaryPayload returns the default payload of the notification of a sync of table
+func summaryPayload(table string, result *SyncResult) string {
+	b, _ := json.Marshal(notifySummary{Table: table, Rows: result.Rows})
+	return string(b)
+}
+
+// notifySync sends the notification of a sync of table on options.NotifyChannel, which Postgres delivers once tx commits.
+// An oversized payload is dealt with as options.NotifyOversized says, rather than failing the sync
+func notifySync(ctx context.Context, tx *sql.Tx, l *zap.SugaredLogger, options *SyncOptions, table string, result *SyncResult) error {
+	payload := summaryPayload(table, result)
+	if options.NotifyPayload != nil {
+		payload = options.NotifyPayload(result)
+	}
+
+	if len(payload) > maxNotifyPayload {
+		switch options.NotifyOversized {
+		case PayloadSkip:
+			l.Warnf("notification payload of %d bytes is longer than the %d Postgres allows, not notifying %s", len(payload), maxNotifyPayload, options.NotifyChannel)
+			return nil
+		case PayloadSummarize:
+			l.Warnf("notification payload of %d bytes is longer than the %d Postgres allows, sending a summary instead", len(payload), maxNotifyPayload)
+			payload = summaryPayload(table, result)
+		default:
+			l.Warnf("notification payload of %d bytes is longer than the %d Postgres allows, truncating it", len(payload), maxNotifyPayload)
+			payload = truncateUTF8(payload, maxNotifyPayload)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_notify($1, $2)", options.NotifyChannel, payload); err != nil {
+		return fmt.Errorf("could not notify %s: %w", options.NotifyChannel, err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncNotify(t *testing.T) {
+	oversized := strings.Repeat("é", 5000)
+	cases := map[OversizedPayloadPolicy]driver.Value{
+		PayloadTruncate:  strings.Repeat("é", 3999),
+		PayloadSummarize: `{"table":"commits","rows":2}`,
+		PayloadSkip:      nil,
+	}
+
+	for policy, payload := range cases {
+		pg, mock, _ := sqlmock.New()
+
+		// an oversized payload is dealt with before it's sent, so the sync still commits
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+		expectSwap(mock)
+		expectProvenance(mock)
+		if payload != nil {
+			mock.ExpectExec(regexp.QuoteMeta("SELECT pg_notify($1, $2)")).WithArgs("commits_synced", payload).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectCommit()
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:        pg,
+			AskGit:          newSource(t, commitRows()),
+			TableName:       "commits",
+			Query:           "SELECT hash, additions FROM commits",
+			Logger:          zap.NewNop(),
+			NotifyChannel:   "commits_synced",
+			NotifyPayload:   func(*SyncResult) string { return oversized },
+			NotifyOversized: policy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("policy %d: %v", policy, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package pgsync
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NumberFormat is how the text values of numeric and floating point columns write their numbers
+// (see SyncOptions.NumberFormat)
+type NumberFormat int
+
+const (
+	// NumberFormatPlain leaves text values as they are, for Postgres to read (the default)
+	NumberFormatPlain NumberFormat = iota
+	// NumberFormatPoint reads numbers with a point as their decimal separator and commas between thousands, as in 1,234.56
+	NumberFormatPoint
+	// NumberFormatComma reads numbers with a comma as their decimal separator and points between thousands, as in 1.234,56
+	NumberFormatComma
+)
+
+// separators returns the decimal and thousands separators of f
+func (f NumberFormat) separators() (decimal, thousands byte) {
+	if f == NumberFormatComma {
+		return ',', '.'
+	}
+	return '.', ','
+}
+
+// normalize returns the number s, written in format f, with no thousands separators and a point as its decimal separator.
+// Thousands must be separated in groups of three digits, so a number that could be read in the other format
+// (such as 1.234 in NumberFormatComma, unless it's a thousand and 234) is read as f says or not at all
+func (f NumberFormat) normalize(s string) (string, bool) {
+	decimal, thousands := f.separators()
+
+	n := strings.TrimSpace(s)
+	sign := ""
+	if n != "" && (n[0] == '-' || n[0] == '+') {
+		sign, n = n[:1], n[1:]
+	}
+
+	whole, fraction := n, ""
+	if i := strings.IndexByte(n, decimal); i >= 0 {
+		whole, fraction = n[:i], n[i+1:]
+		if !digits(fraction) {
+			return "", false
+		}
+	}
+
+	groups := strings.Split(whole, string(thousands))
+	for i, g := range groups {
+		if !digits(g) || len(groups) > 1 && (i == 0 && len(g) > 3 || i > 0 && len(g) != 3) {
+			return "", false
+		}
+	}
+
+	normalized := sign + strings.Join(groups, "")
+	if fraction != "" {
+		normalized += "." + fraction
+	}
+	return normalized, true
+}
+
+// digits returns whether s is one or more decimal digits
+func digits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// numberFormatTransform returns a rowTransform that normalizes the text values of the numeric and floating point
+// columns of defs from format, failing on any it can't read. It returns nil if there are no such columns
+func numberFormatTransform(colNames []string, defs []columnDef, format NumberFormat) rowTransform {
+	var columns []int
+	for c := range colNames {
+		if kindOf(defs[c].Type) == kindFloat {
+			columns = append(columns, c)
+		}
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	return func(values []interface{}) ([]interface{}, error) {
+		for _, c := range columns {
+			var s string
+			switch v := values[c].(type) {
+			case string:
+				s = v
+			case []byte:
+				s = string(v)
+			default:
+				continue
+			}
+
+			n, ok := format.normalize(s)
+			if !ok {
+				return nil, fmt.Errorf("column %s: %q is not a number written as the number format says", colNames[c], s)
+			}
+			values[c] = n
+		}
+		return values, nil
+	}
+}
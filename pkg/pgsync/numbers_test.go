@@ -0,0 +1,58 @@
+package pgsync
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestNumberFormatNormalize(t *testing.T) {
+	cases := map[NumberFormat]map[string]string{
+		NumberFormatComma: {"1.234,56": "1234.56", "-1.234.567": "-1234567", "0,5": "0.5", " 12 ": "12", "1.5": "", "1,234.56": "", "12.34": "", "1,": ""},
+		NumberFormatPoint: {"1,234.56": "1234.56", "+1,234": "+1234", "1.5": "1.5", "1.234,56": "", "1,2": "", "": ""},
+	}
+	for format, numbers := range cases {
+		for s, expected := range numbers {
+			n, ok := format.normalize(s)
+			if ok != (expected != "") || n != expected {
+				t.Fatalf("expected %q to be normalized to %q, got %q (%t)", s, expected, n, ok)
+			}
+		}
+	}
+}
+
+func TestSyncNumberFormat(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("amount").OfType("DECIMAL(10,2)", ""),
+	).AddRow("abc", "1.234,56").AddRow("def", "1,234.56")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"amount" numeric\(10,2\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+	prep := mock.ExpectPrepare(`COPY "commits_temp"`)
+	prep.ExpectExec().WithArgs("abc", "1234.56").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:     pg,
+		AskGit:       newSource(t, source),
+		TableName:    "commits",
+		Query:        "SELECT hash, amount FROM commits",
+		Logger:       zap.NewNop(),
+		NumberFormat: NumberFormatComma,
+	})
+	// a number written with a decimal point isn't read as one written with a decimal comma
+	if err == nil || !strings.Contains(err.Error(), `column amount: "1,234.56"`) {
+		t.Fatalf("expected the second amount to fail the sync, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+package pgsync
+
+import (
+	"database/sql"
+)
+
+// columnOrder returns, for each column of the output, the index of the query column it comes from. Columns named in
+// order come first, in that order, followed by any others in the order the query produced them
+func columnOrder(colNames []string, order []string) ([]int, error) {
+	index := make(map[string]int, len(colNames))
+	for i, name := range colNames {
+		index[name] = i
+	}
+
+	positions := make([]int, 0, len(colNames))
+	placed := make([]bool, len(colNames))
+	for _, name := range order {
+		i, ok := index[name]
+		if !ok {
+			return nil, invalidOptions("column in column order is not in the query results: %s", name)
+		}
+		if placed[i] {
+			return nil, invalidOptions("column is repeated in column order: %s", name)
+		}
+		placed[i] = true
+		positions = append(positions, i)
+	}
+
+	for i := range colNames {
+		if !placed[i] {
+			positions = append(positions, i)
+		}
+	}
+
+	return positions, nil
+}
+
+// reorderColumns returns colTypes and colNames rearranged by positions (see columnOrder)
+func reorderColumns(colTypes []*sql.ColumnType, colNames []string, positions []int) ([]*sql.ColumnType, []string) {
+	types := make([]*sql.ColumnType, len(positions))
+	names := make([]string, len(positions))
+	for i, p := range positions {
+		types[i] = colTypes[p]
+		names[i] = colNames[p]
+	}
+	return types, names
+}
+
+// reorderValues returns a rowTransform that rearranges a row's values by positions (see columnOrder)
+func reorderValues(positions []int) rowTransform {
+	out := make([]interface{}, len(positions))
+
+	return func(values []interface{}) ([]interface{}, error) {
+		for i, p := range positions {
+			out[i] = values[p]
+		}
+		return out, nil
+	}
+}
+
+// chainTransforms returns a rowTransform that applies each of transforms in turn, or nil if there are none
+func chainTransforms(transforms ...rowTransform) rowTransform {
+	switch len(transforms) {
+	case 0:
+		return nil
+	case 1:
+		return transforms[0]
+	}
+
+	return func(values []interface{}) ([]interface{}, error) {
+		var err error
+		for _, t := range transforms {
+			if values, err = t(values); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+}
+
+// columnIndex returns the index of the column named name, or -1 if there's no such column
+func columnIndex(colNames []string, name string) int {
+	for i, col := range colNames {
+		if col == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,63 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncColumnOrder(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE "commits_temp" \(\s*"additions" integer,\s*"hash" text\s*\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp" ("additions", "hash")`, []driver.Value{int64(1), "abc"}, []driver.Value{int64(2), "def"})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:    pg,
+		AskGit:      newSource(t, commitRows()),
+		TableName:   "commits",
+		Query:       "SELECT hash, additions FROM commits",
+		Logger:      zap.NewNop(),
+		ColumnOrder: []string{"additions"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Columns[0] != "additions" || result.Columns[1] != "hash" {
+		t.Fatalf("unexpected columns: %v", result.Columns)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncColumnOrderMissingColumn(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:    pg,
+		AskGit:      newSource(t, commitRows()),
+		TableName:   "commits",
+		Query:       "SELECT hash, additions FROM commits",
+		Logger:      zap.NewNop(),
+		ColumnOrder: []string{"hash", "deletions"},
+	})
+	if err == nil || !regexp.MustCompile("deletions").MatchString(err.Error()) {
+		t.Fatalf("expected an error naming the missing column, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,87 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Pagination is how a query is run in pages, see SyncOptions.Paginate
+type Pagination struct {
+	// Key is a column of the query's results that uniquely identifies a row, and that the query is ordered by
+	Key string
+	// PageSize is the most rows each page of the query produces
+	PageSize int
+}
+
+// pageQuery returns query limited to the page of its results after a key value, or its first page if after is false
+func pageQuery(query string, p *Pagination, after bool) string {
+	key := QuoteAlways.quote(p.Key)
+	where := ""
+	if after {
+		where = fmt.Sprintf(" WHERE %s > ?", key)
+	}
+	return fmt.Sprintf("SELECT * FROM (%s)%s ORDER BY %s LIMIT %d", query, where, key, p.PageSize)
+}
+
+// pagedRows reads the results of a query a page at a time, each page picking up after the largest key of the one before.
+// The first page has already been run (producing rows)
+type pagedRows struct {
+	ctx   context.Context
+	db    queryer
+	query string
+	args  []interface{}
+	page  *Pagination
+	key   int
+
+	rows *sql.Rows
+	// n is the number of rows read from the current page
+	n    int
+	last interface{}
+	err  error
+}
+
+func (p *pagedRows) Next() bool {
+	for {
+		if p.rows.Next() {
+			p.n++
+			return true
+		}
+		if p.err = p.rows.Err(); p.err != nil {
+			return false
+		}
+		// a page that isn't full is the last
+		if p.n < p.page.PageSize {
+			return false
+		}
+		if p.err = p.rows.Close(); p.err != nil {
+			return false
+		}
+
+		// a page that fails to start leaves rows the (closed) page before it, for Close
+		args := append(p.args[:len(p.args):len(p.args)], p.last)
+		rows, err := p.db.QueryContext(p.ctx, pageQuery(p.query, p.page, true), args...)
+		if err != nil {
+			p.err = err
+			return false
+		}
+		p.rows, p.n = rows, 0
+	}
+}
+
+func (p *pagedRows) Scan(dest ...interface{}) error {
+	if err := p.rows.Scan(dest...); err != nil {
+		return err
+	}
+
+	key, ok := dest[p.key].(*interface{})
+	if !ok {
+		return fmt.Errorf("cannot keep track of the page key when scanning into %T", dest[p.key])
+	}
+	p.last = *key
+	return nil
+}
+
+func (p *pagedRows) Err() error { return p.err }
+
+func (p *pagedRows) Close() error { return p.rows.Close() }
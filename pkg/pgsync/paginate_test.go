@@ -0,0 +1,105 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncPaginate(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	page := func(hashes ...string) *sqlmock.Rows {
+		rows := sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("hash").OfType("TEXT", ""),
+			sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+		)
+		for i, hash := range hashes {
+			rows.AddRow(hash, int64(i))
+		}
+		return rows
+	}
+
+	// each page picks up after the last key of the one before, and a page that isn't full is the last
+	const query = "SELECT hash, additions FROM commits"
+	source.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM (` + query + `) ORDER BY "hash" LIMIT 2`)).WillReturnRows(page("a", "b"))
+	source.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM (` + query + `) WHERE "hash" > ? ORDER BY "hash" LIMIT 2`)).WithArgs("b").WillReturnRows(page("c", "d"))
+	source.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM (` + query + `) WHERE "hash" > ? ORDER BY "hash" LIMIT 2`)).WithArgs("d").WillReturnRows(page("e"))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`,
+		[]driver.Value{"a", int64(0)}, []driver.Value{"b", int64(1)},
+		[]driver.Value{"c", int64(0)}, []driver.Value{"d", int64(1)},
+		[]driver.Value{"e", int64(0)},
+	)
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    askgit,
+		TableName: "commits",
+		Query:     query,
+		Logger:    zap.NewNop(),
+		Paginate:  &Pagination{Key: "hash", PageSize: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 5 {
+		t.Fatalf("expected 5 rows, got %d", result.Rows)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncPaginatePageError(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	// the second page fails to start once the first's rows have been copied
+	const query = "SELECT hash, additions FROM commits"
+	busy := errors.New("database is locked")
+	source.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM (` + query + `) ORDER BY "hash" LIMIT 2`)).WillReturnRows(commitRows())
+	source.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM (` + query + `) WHERE "hash" > ?`)).WithArgs("def").WillReturnError(busy)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	prep := mock.ExpectPrepare("COPY")
+	prep.ExpectExec().WithArgs("abc", int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs("def", int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    askgit,
+		TableName: "commits",
+		Query:     query,
+		Logger:    zap.NewNop(),
+		Paginate:  &Pagination{Key: "hash", PageSize: 2},
+	})
+	if !errors.Is(err, busy) {
+		t.Fatalf("expected the second page's error, got: %v", err)
+	}
+
+	for _, m := range []sqlmock.Sqlmock{mock, source} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
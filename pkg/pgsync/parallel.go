@@ -0,0 +1,149 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultCopyBufferRows is how many rows each connection of a parallel load holds, unless SyncOptions.CopyBufferRows is set
+const DefaultCopyBufferRows = 64
+
+// copyParallel loads rows into the staging table over parallelism connections of its own, with the rows dealt out
+// round-robin, each connection COPYing its share in a transaction of its own. As those connections have to be able to see
+// the staging table, it's created (from createSQL) and committed up front, UNLOGGED to keep the load cheap. That also means
+// it's left behind if the sync fails, until the next parallel sync of the same table drops it (or CleanupStaging does, for
+// which it's marked as created at created, unless that's zero). The staging table is in schema, if set. Each connection
+// holds up to buffer rows (or DefaultCopyBufferRows) waiting to be copied. Returns the number of rows copied.
+func copyParallel(ctx context.Context, db *sql.DB, schema, staging, createSQL string, columns []string, rows rowSource,
+	numColumns int, transform rowTransform, parallelism, buffer int, created time.Time) (int64, error) {
+	table := QuoteAlways.qualify(schema, staging)
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", table)); err != nil {
+		return 0, err
+	}
+	if _, err := db.ExecContext(ctx, createSQL); err != nil {
+		return 0, err
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s SET UNLOGGED", table)); err != nil {
+		return 0, err
+	}
+	if !created.IsZero() {
+		if err := markStaging(ctx, db, table, created); err != nil {
+			return 0, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if buffer == 0 {
+		buffer = DefaultCopyBufferRows
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, parallelism)
+	streams := make([]chan []interface{}, parallelism)
+	for i := range streams {
+		streams[i] = make(chan []interface{}, buffer)
+
+		wg.Add(1)
+		go func(stream <-chan []interface{}) {
+			defer wg.Done()
+			if err := copyStream(ctx, db, schema, staging, columns, stream); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(streams[i])
+	}
+
+	n, err := dealRows(ctx, rows, numColumns, transform, streams)
+	for _, stream := range streams {
+		close(stream)
+	}
+	wg.Wait()
+	close(errs)
+
+	// an error from a stream is the cause of any cancellation the dealer saw
+	if streamErr := <-errs; streamErr != nil {
+		return n, streamErr
+	}
+	return n, err
+}
+
+// dealRows scans rows (passing each through transform, if set) and sends them to streams in turn, waiting for a stream
+// that's full
+func dealRows(ctx context.Context, rows rowSource, numColumns int, transform rowTransform, streams []chan []interface{}) (int64, error) {
+	values := make([]interface{}, numColumns)
+	pointers := make([]interface{}, numColumns)
+
+	for i := 0; i < len(values); i++ {
+		pointers[i] = &values[i]
+	}
+
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return n, fmt.Errorf("could not read row %d of the query results: %w", n+1, err)
+		}
+
+		copied := values
+		if transform != nil {
+			var err error
+			if copied, err = transform(values); err != nil {
+				return n, err
+			}
+		}
+
+		// the scan buffer (and a transform's output) is reused for the next row, but the stream holds on to this one
+		row := make([]interface{}, len(copied))
+		copy(row, copied)
+
+		select {
+		case streams[n%int64(len(streams))] <- row:
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+
+		n++
+	}
+
+	if err := rows.Err(); err != nil {
+		return n, fmt.Errorf("could not read the query results after %d rows: %w", n, err)
+	}
+	return n, nil
+}
+
+// copyStream COPYs every row received from stream into the staging table, in a transaction of its own that's committed
+// once stream is closed
+func copyStream(ctx context.Context, db *sql.DB, schema, staging string, columns []string, stream <-chan []interface{}) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// once the transaction is committed, this is a no-op
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, copyIn(schema, staging, columns))
+	if err != nil {
+		return err
+	}
+
+	for row := range stream {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return err
+		}
+	}
+
+	// an Exec with no values flushes the COPY and waits for the server to complete it
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return err
+	}
+
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,304 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+// recordingDriver is a database/sql driver that records the rows written by COPY statements, along with
+// the connection that wrote them. Every other statement succeeds, and every query returns no rows. It also records,
+// for every REPEATABLE READ transaction, how many of the transactions that copied rows had committed when its snapshot
+// was taken (by its first statement other than a SET), as the rows of those that hadn't are hidden from it
+type recordingDriver struct {
+	mu        sync.Mutex
+	conns     int
+	copied    map[string]int
+	byConn    map[int]int
+	loaded    int
+	snapshots []int
+}
+
+type recordingConn struct {
+	d         *recordingDriver
+	id        int
+	isolation driver.IsolationLevel
+	copying   bool
+	snapshot  bool
+}
+type recordingStmt struct {
+	c     *recordingConn
+	query string
+}
+type recordingRows struct{}
+
+func newRecordingDriver() *recordingDriver {
+	return &recordingDriver{copied: make(map[string]int), byConn: make(map[int]int)}
+}
+
+func (d *recordingDriver) Open(string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conns++
+	return &recordingConn{d: d, id: d.conns}, nil
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{c, query}, nil
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *recordingConn) BeginTx(_ context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.isolation, c.copying, c.snapshot = opts.Isolation, false, false
+	return c, nil
+}
+func (c *recordingConn) Commit() error {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	if c.copying {
+		c.d.loaded++
+	}
+	c.isolation, c.copying, c.snapshot = 0, false, false
+	return nil
+}
+func (c *recordingConn) Rollback() error {
+	c.isolation, c.copying, c.snapshot = 0, false, false
+	return nil
+}
+
+// run records the snapshot taken by query, if it's the first statement of a REPEATABLE READ transaction to take one
+func (c *recordingConn) run(query string) {
+	if c.snapshot || c.isolation < driver.IsolationLevel(sql.LevelRepeatableRead) || strings.HasPrefix(query, "SET ") {
+		return
+	}
+	c.snapshot = true
+	c.d.mu.Lock()
+	c.d.snapshots = append(c.d.snapshots, c.d.loaded)
+	c.d.mu.Unlock()
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if !strings.HasPrefix(s.query, "COPY") {
+		s.c.run(s.query)
+	} else if len(args) > 0 {
+		s.c.copying = true
+		s.c.d.mu.Lock()
+		s.c.d.copied[fmt.Sprint(args)]++
+		s.c.d.byConn[s.c.id]++
+		s.c.d.mu.Unlock()
+	}
+	return driver.RowsAffected(0), nil
+}
+func (s *recordingStmt) Query([]driver.Value) (driver.Rows, error) {
+	s.c.run(s.query)
+	return recordingRows{}, nil
+}
+
+func (recordingRows) Columns() []string         { return []string{"value"} }
+func (recordingRows) Close() error              { return nil }
+func (recordingRows) Next([]driver.Value) error { return io.EOF }
+
+// manyCommitRows returns n mock source rows, each with a distinct hash
+func manyCommitRows(n int) *sqlmock.Rows {
+	rows := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+	)
+	for i := 0; i < n; i++ {
+		rows.AddRow(fmt.Sprintf("%040d", i), int64(i))
+	}
+	return rows
+}
+
+func TestSyncCopyParallelism(t *testing.T) {
+	d := newRecordingDriver()
+	sql.Register("pgsync-recording-parallel", d)
+	pg, err := sql.Open("pgsync-recording-parallel", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 1000
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, manyCommitRows(n)),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		CopyParallelism: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rows != n {
+		t.Fatalf("expected %d rows, got %d", n, result.Rows)
+	}
+
+	if len(d.copied) != n {
+		t.Fatalf("expected %d distinct rows to be copied, got %d", n, len(d.copied))
+	}
+	for row, count := range d.copied {
+		if count != 1 {
+			t.Fatalf("expected row %s to be copied once, was copied %d times", row, count)
+		}
+	}
+
+	if len(d.byConn) != 4 {
+		t.Fatalf("expected rows to be copied over 4 connections, were copied over %d", len(d.byConn))
+	}
+}
+
+func TestSyncCopyParallelismSnapshot(t *testing.T) {
+	d := newRecordingDriver()
+	sql.Register("pgsync-recording-snapshot", d)
+	pg, err := sql.Open("pgsync-recording-snapshot", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the lock is queried before the parallel COPYs, which the sync transaction must still see the rows of
+	_, err = Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, manyCommitRows(100)),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		CopyParallelism: 4,
+		SerializeSyncs:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.loaded != 4 {
+		t.Fatalf("expected 4 connections to commit the rows they copied, %d did", d.loaded)
+	}
+	for _, loaded := range d.snapshots {
+		if loaded != d.loaded {
+			t.Fatalf("expected no snapshot to be taken before the parallel COPYs commit, one was taken after %d of %d", loaded, d.loaded)
+		}
+	}
+}
+
+func TestSyncCopyParallelismStreamError(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	mock.MatchExpectationsInOrder(false)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DROP TABLE IF EXISTS").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SET UNLOGGED").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMENT ON TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin().WillReturnError(errors.New("too many connections"))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, commitRows()),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		CopyParallelism: 2,
+	})
+	if err == nil || !strings.Contains(err.Error(), "too many connections") {
+		t.Fatalf("expected the stream's error, got: %v", err)
+	}
+}
+
+// bufferedRows is a rowSource of n rows of a single value that records the most rows streams held each time
+// a row was read
+type bufferedRows struct {
+	n, read  int
+	streams  []chan []interface{}
+	buffered int
+}
+
+func (r *bufferedRows) Next() bool {
+	held := 0
+	for _, stream := range r.streams {
+		held += len(stream)
+	}
+	if held > r.buffered {
+		r.buffered = held
+	}
+	r.read++
+	return r.read <= r.n
+}
+func (r *bufferedRows) Scan(dest ...interface{}) error {
+	*dest[0].(*interface{}) = r.read
+	return nil
+}
+func (r *bufferedRows) Err() error { return nil }
+
+func TestDealRowsBackpressure(t *testing.T) {
+	const buffer = 8
+	streams := []chan []interface{}{make(chan []interface{}, buffer), make(chan []interface{}, buffer)}
+	rows := &bufferedRows{n: 200, streams: streams}
+
+	// the consumers are far slower than the rows are read, so without the wait for a full stream they'd all be held
+	var wg sync.WaitGroup
+	for _, stream := range streams {
+		wg.Add(1)
+		go func(stream <-chan []interface{}) {
+			defer wg.Done()
+			for range stream {
+				time.Sleep(time.Millisecond)
+			}
+		}(stream)
+	}
+
+	n, err := dealRows(context.Background(), rows, 1, nil, streams)
+	for _, stream := range streams {
+		close(stream)
+	}
+	wg.Wait()
+	if err != nil || n != 200 {
+		t.Fatalf("expected 200 rows to be dealt, got %d, %v", n, err)
+	}
+	if rows.buffered > len(streams)*buffer || rows.buffered == 0 {
+		t.Fatalf("expected at most %d rows to be held, %d were", len(streams)*buffer, rows.buffered)
+	}
+}
+
+func BenchmarkSyncCopyParallelism(b *testing.B) {
+	sql.Register("pgsync-recording-bench", newRecordingDriver())
+	pg, err := sql.Open("pgsync-recording-bench", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, parallelism := range []int{1, 4} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				askgit, mock, _ := sqlmock.New()
+				mock.ExpectQuery(".").WillReturnRows(manyCommitRows(10000))
+
+				_, err := Sync(context.Background(), &SyncOptions{
+					Postgres:        pg,
+					AskGit:          askgit,
+					TableName:       "commits",
+					Query:           "SELECT hash, additions FROM commits",
+					Logger:          zap.NewNop(),
+					CopyParallelism: parallelism,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
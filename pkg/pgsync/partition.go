@@ -0,0 +1,203 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PartitionInterval is the range of values of the partition key each partition of a table holds (see ModeReplacePartitions)
+type PartitionInterval int
+
+const (
+	// PartitionMonthly partitions hold a calendar month each, and are named <table>_YYYY_MM (the default)
+	PartitionMonthly PartitionInterval = iota
+	// PartitionDaily partitions hold a day each, and are named <table>_YYYY_MM_DD
+	PartitionDaily
+	// PartitionYearly partitions hold a year each, and are named <table>_YYYY
+	PartitionYearly
+)
+
+// unit returns the date_trunc field of the interval
+func (i PartitionInterval) unit() string {
+	switch i {
+	case PartitionDaily:
+		return "day"
+	case PartitionYearly:
+		return "year"
+	default:
+		return "month"
+	}
+}
+
+// partition returns the name and upper bound of the partition of table starting at from
+func (i PartitionInterval) partition(table string, from time.Time) (string, time.Time) {
+	switch i {
+	case PartitionDaily:
+		return fmt.Sprintf("%s_%s", table, from.Format("2006_01_02")), from.AddDate(0, 0, 1)
+	case PartitionYearly:
+		return fmt.Sprintf("%s_%s", table, from.Format("2006")), from.AddDate(1, 0, 0)
+	default:
+		return fmt.Sprintf("%s_%s", table, from.Format("2006_01")), from.AddDate(0, 1, 0)
+	}
+}
+
+// partitionBound returns the literal of a partition bound
+func partitionBound(t time.Time) string {
+	return pq.QuoteLiteral(t.Format("2006-01-02 15:04:05.999999-07:00"))
+}
+
+// activePartitions returns the start of each partition the rows of staging fall in, in order
+func activePartitions(ctx context.Context, tx *sql.Tx, staging, key string, interval PartitionInterval) ([]time.Time, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT DISTINCT date_trunc('%s', %s) FROM %s ORDER BY 1",
+		interval.unit(), pq.QuoteIdentifier(key), pq.QuoteIdentifier(staging)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var starts []time.Time
+	for rows.Next() {
+		var start sql.NullTime
+		if err := rows.Scan(&start); err != nil {
+			return nil, err
+		}
+		if !start.Valid {
+			return nil, fmt.Errorf("partition key %s is NULL in some rows, which fit no partition", pq.QuoteIdentifier(key))
+		}
+		starts = append(starts, start.Time)
+	}
+	return starts, rows.Err()
+}
+
+// replacePartitions replaces the partitions of the partitioned table that the rows of staging fall in with new ones
+// holding those rows, leaving its other partitions alone, and drops staging. Each new partition is built alongside
+// the one it replaces, which is then detached and dropped for the new one to be attached in its place.
+// It returns the names of the partitions replaced (or created)
+func replacePartitions(ctx context.Context, tx *sql.Tx, table, staging string, columns []string, key string, interval PartitionInterval) ([]string, error) {
+	kind, err := relationKind(ctx, tx, table)
+	if err != nil {
+		return nil, err
+	}
+	if kind != "p" {
+		return nil, fmt.Errorf("%w: table %s is not a partitioned table", ErrPreconditionFailed, pq.QuoteIdentifier(table))
+	}
+
+	starts, err := activePartitions(ctx, tx, staging, key, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	t, k, cols := pq.QuoteIdentifier(table), pq.QuoteIdentifier(key), quoteAll("", columns)
+	names := make([]string, len(starts))
+	for i, from := range starts {
+		name, to := interval.partition(table, from)
+		building := name + "_new"
+		if len(building) > maxIdentifierLength {
+			return nil, fmt.Errorf("%w: the name of partition %s is too long to build it alongside the one it replaces", ErrLongIdentifier, name)
+		}
+
+		existing, err := relationKind(ctx, tx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		p, b := pq.QuoteIdentifier(name), pq.QuoteIdentifier(building)
+		statements := []string{
+			fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS INCLUDING CONSTRAINTS)", b, t),
+			fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s WHERE %s >= %s AND %s < %s",
+				b, cols, cols, pq.QuoteIdentifier(staging), k, partitionBound(from), k, partitionBound(to)),
+		}
+		if existing != "" {
+			statements = append(statements,
+				fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", t, p),
+				fmt.Sprintf("DROP TABLE %s", p))
+		}
+		statements = append(statements,
+			fmt.Sprintf("ALTER TABLE %s RENAME TO %s", b, p),
+			fmt.Sprintf("ALTER TABLE %s ATTACH PARTITION %s FOR VALUES FROM (%s) TO (%s)", t, p, partitionBound(from), partitionBound(to)))
+
+		for _, stmt := range statements {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return nil, fmt.Errorf("could not replace partition %s: %w", p, schemaMismatch(table, err))
+			}
+		}
+		names[i] = name
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", pq.QuoteIdentifier(staging)))
+	return names, err
+}
+
+// checkPartitionKey returns ErrPreconditionFailed unless table is range partitioned by the single column key
+func checkPartitionKey(ctx context.Context, tx *sql.Tx, table, key string) error {
+	var strategy string
+	var columns int
+	var column sql.NullString
+	err := tx.QueryRowContext(ctx, `SELECT p.partstrat, p.partnatts, a.attname FROM pg_partitioned_table AS p
+		LEFT JOIN pg_attribute AS a ON a.attrelid = p.partrelid AND a.attnum = p.partattrs[0]
+		WHERE p.partrelid = to_regclass($1)`, pq.QuoteIdentifier(table)).Scan(&strategy, &columns, &column)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: table %s is not a partitioned table", ErrPreconditionFailed, pq.QuoteIdentifier(table))
+	}
+	if err != nil {
+		return err
+	}
+
+	if strategy != "r" || columns != 1 || column.String != key {
+		return fmt.Errorf("%w: table %s is not range partitioned by %s alone", ErrPreconditionFailed, pq.QuoteIdentifier(table), pq.QuoteIdentifier(key))
+	}
+	return nil
+}
+
+// appendPartitions appends the rows of staging to the partitioned table (see SyncOptions.CreatePartitions), first creating
+// the partitions those rows fall in that it doesn't have, and drops staging. It records how many rows were inserted on result,
+// and returns the names of the partitions created
+func appendPartitions(ctx context.Context, tx *sql.Tx, table, staging string, columns []string, key string, interval PartitionInterval, result *SyncResult) ([]string, error) {
+	if err := checkPartitionKey(ctx, tx, table, key); err != nil {
+		return nil, err
+	}
+
+	starts, err := activePartitions(ctx, tx, staging, key, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	t := pq.QuoteIdentifier(table)
+	var created []string
+	for _, from := range starts {
+		name, to := interval.partition(table, from)
+		existing, err := relationKind(ctx, tx, name)
+		if err != nil {
+			return nil, err
+		}
+		if existing != "" {
+			continue
+		}
+
+		p := pq.QuoteIdentifier(name)
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s PARTITION OF %s FOR VALUES FROM (%s) TO (%s)",
+			p, t, partitionBound(from), partitionBound(to)))
+		if err != nil {
+			return nil, fmt.Errorf("could not create partition %s: %w", p, err)
+		}
+		created = append(created, name)
+	}
+
+	// Postgres routes each row to its partition
+	cols := quoteAll("", columns)
+	res, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", t, cols, cols, pq.QuoteIdentifier(staging)))
+	if err != nil {
+		return nil, schemaMismatch(table, err)
+	}
+	if result.Inserted, err = res.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", pq.QuoteIdentifier(staging)))
+	return created, err
+}
@@ -0,0 +1,204 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncReplacePartitions(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	march := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	april := time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("author_when").OfType("DATETIME", time.Time{}),
+	).
+		AddRow("abc", march.Add(36*time.Hour)).
+		AddRow("def", april.Add(12*time.Hour))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "author_when", "timestamp with time zone")
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", march.Add(36 * time.Hour)}, []driver.Value{"def", april.Add(12 * time.Hour)})
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("p"))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT DISTINCT date_trunc('month', "author_when") FROM "commits_temp"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"date_trunc"}).AddRow(march).AddRow(april))
+
+	// March already has a partition, which is swapped out; April's is new
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits_2021_03"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_2021_03_new" (LIKE "commits" INCLUDING DEFAULTS INCLUDING CONSTRAINTS)`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits_2021_03_new" ("hash", "author_when") SELECT "hash", "author_when" FROM "commits_temp" WHERE "author_when" >= '2021-03-01 00:00:00+00:00' AND "author_when" < '2021-04-01 00:00:00+00:00'`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits" DETACH PARTITION "commits_2021_03"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_2021_03"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits_2021_03_new" RENAME TO "commits_2021_03"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits" ATTACH PARTITION "commits_2021_03" FOR VALUES FROM ('2021-03-01 00:00:00+00:00') TO ('2021-04-01 00:00:00+00:00')`)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits_2021_04"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_2021_04_new"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits_2021_04_new"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits_2021_04_new" RENAME TO "commits_2021_04"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ATTACH PARTITION "commits_2021_04" FOR VALUES FROM ('2021-04-01 00:00:00+00:00') TO ('2021-05-01 00:00:00+00:00')`)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("p"))
+	mock.ExpectExec("COMMENT ON TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:     pg,
+		AskGit:       newSource(t, source),
+		TableName:    "commits",
+		Query:        "SELECT hash, author_when FROM commits",
+		Logger:       zap.NewNop(),
+		Mode:         ModeReplacePartitions,
+		PartitionKey: "author_when",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Partitions) != 2 || result.Partitions[0] != "commits_2021_03" || result.Partitions[1] != "commits_2021_04" {
+		t.Fatalf("expected the March and April partitions to be rebuilt, got: %v", result.Partitions)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncReplacePartitionsNotPartitioned(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "additions", "integer")
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:     pg,
+		AskGit:       newSource(t, commitRows()),
+		TableName:    "commits",
+		Query:        "SELECT hash, additions FROM commits",
+		Logger:       zap.NewNop(),
+		Mode:         ModeReplacePartitions,
+		PartitionKey: "additions",
+	})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("expected ErrPreconditionFailed, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncCreatePartitions(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	march := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	april := time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)
+	may := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("author_when").OfType("DATETIME", time.Time{}),
+	).
+		AddRow("abc", march.Add(36*time.Hour)).
+		AddRow("def", april.Add(12*time.Hour)).
+		AddRow("ghi", may.Add(time.Hour))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "author_when", "timestamp with time zone")
+	expectGeneratedColumns(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", march.Add(36 * time.Hour)}, []driver.Value{"def", april.Add(12 * time.Hour)}, []driver.Value{"ghi", may.Add(time.Hour)})
+	mock.ExpectQuery("FROM pg_partitioned_table").WithArgs(`"commits"`).
+		WillReturnRows(sqlmock.NewRows([]string{"partstrat", "partnatts", "attname"}).AddRow("r", 1, "author_when"))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT DISTINCT date_trunc('month', "author_when") FROM "commits_temp"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"date_trunc"}).AddRow(march).AddRow(april).AddRow(may))
+
+	// none of the three months has a partition yet
+	for _, p := range []struct{ name, from, to string }{
+		{"commits_2021_03", "2021-03-01", "2021-04-01"},
+		{"commits_2021_04", "2021-04-01", "2021-05-01"},
+		{"commits_2021_05", "2021-05-01", "2021-06-01"},
+	} {
+		mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"` + p.name + `"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}))
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "` + p.name + `" PARTITION OF "commits" FOR VALUES FROM ('` + p.from + ` 00:00:00+00:00') TO ('` + p.to + ` 00:00:00+00:00')`)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits" ("hash", "author_when") SELECT "hash", "author_when" FROM "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("p"))
+	mock.ExpectExec("COMMENT ON TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:         pg,
+		AskGit:           newSource(t, source),
+		TableName:        "commits",
+		Query:            "SELECT hash, author_when FROM commits",
+		Logger:           zap.NewNop(),
+		Mode:             ModeEnsureAndAppend,
+		PartitionKey:     "author_when",
+		CreatePartitions: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Partitions) != 3 || result.Partitions[0] != "commits_2021_03" || result.Partitions[2] != "commits_2021_05" {
+		t.Fatalf("expected the March, April and May partitions to be created, got: %v", result.Partitions)
+	}
+	if result.Inserted != 3 {
+		t.Fatalf("expected 3 rows appended, got: %d", result.Inserted)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncCreatePartitionsWrongKey(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "additions", "integer")
+	expectGeneratedColumns(mock)
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	// partitioned by list of hash, not range of additions
+	mock.ExpectQuery("FROM pg_partitioned_table").WillReturnRows(sqlmock.NewRows([]string{"partstrat", "partnatts", "attname"}).AddRow("l", 1, "hash"))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:         pg,
+		AskGit:           newSource(t, commitRows()),
+		TableName:        "commits",
+		Query:            "SELECT hash, additions FROM commits",
+		Logger:           zap.NewNop(),
+		Mode:             ModeEnsureAndAppend,
+		PartitionKey:     "additions",
+		CreatePartitions: true,
+	})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("expected ErrPreconditionFailed, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
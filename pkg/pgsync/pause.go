@@ -0,0 +1,76 @@
+package pgsync
+
+import (
+	"context"
+	"sync"
+)
+
+// pauseGate holds up the reading of the query's results of the syncs that share it while it's paused
+// (see Syncer.Pause)
+type pauseGate struct {
+	mu sync.Mutex
+	// resumed is closed when the gate is resumed, and nil while it isn't paused
+	resumed chan struct{}
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+func (g *pauseGate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed != nil
+}
+
+// wait returns once the gate isn't paused, or with ctx's error if it's done first
+func (g *pauseGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pausableRows is a rowSource that waits for its gate before reading each row
+type pausableRows struct {
+	rowSource
+	ctx  context.Context
+	gate *pauseGate
+	err  error
+}
+
+func (r *pausableRows) Next() bool {
+	if r.err = r.gate.wait(r.ctx); r.err != nil {
+		return false
+	}
+	return r.rowSource.Next()
+}
+
+func (r *pausableRows) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.rowSource.Err()
+}
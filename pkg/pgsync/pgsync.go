@@ -4,8 +4,15 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/lib/pq"
 	"go.uber.org/zap"
@@ -14,34 +21,792 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Mode is how a sync writes the results of its query into the target table
+type Mode int
+
+const (
+	// ModeReplace loads the results into a new table and swaps it in place of the target (the default)
+	ModeReplace Mode = iota
+	// ModeMerge loads the results into a staging table, then applies only the inserts, updates and deletes
+	// needed to make the target match it, with rows identified by ConflictColumns. Rows that don't change are left alone,
+	// which preserves their identity for triggers and change data capture. The target is created if it doesn't exist.
+	// Results with more than one row with the same ConflictColumns fail the sync with ErrDuplicateKeys, see DuplicateKeys
+	ModeMerge
+	// ModeReplaceInPlace empties the target with TRUNCATE and loads the results straight into it, in a single transaction,
+	// instead of swapping in a new table. Dependent views, grants, triggers and the like are untouched, but readers of the table
+	// are blocked for the length of the load. The target is created if it doesn't exist
+	ModeReplaceInPlace
+	// ModeReplacePartitions rebuilds only the partitions of a range partitioned target that the results fall in,
+	// by PartitionKey and PartitionInterval, leaving its other partitions (and the rows in them) untouched.
+	// The results are loaded into a staging table, from which each partition is built and swapped in for the old one,
+	// all in the sync's transaction. The target must already exist
+	ModeReplacePartitions
+	// ModeEnsureAndAppend loads the results straight into the target, adding them to the rows it already has,
+	// or creates it first if it doesn't exist, all in a single transaction. Only the query's columns are loaded, so columns
+	// of the target it doesn't produce, such as an identity primary key or a generated column, are filled in by Postgres.
+	// A query that produces one of the target's GENERATED ALWAYS identity or generated columns fails the sync
+	ModeEnsureAndAppend
+	// ModeRoute loads the results into a staging table, then replaces each of the tables rows are routed to by their
+	// value of RouteColumn (see Routes and RouteFunc) with a new table of those rows, without the route column.
+	// TableName only names the staging table. Nothing that applies to the table itself, such as Indexes, does here
+	ModeRoute
+	// ModeAppendWindow appends the results to the target like ModeEnsureAndAppend, for queries that overlap the previous
+	// sync by a safety margin. Rows in the overlap window, from the lowest value of WindowColumn in the results up, that
+	// have the same ConflictColumns as a row already in the target are skipped rather than appended again.
+	// The results are loaded into a staging table first. The target is created if it doesn't exist
+	ModeAppendWindow
+)
+
+// EmptyPolicy is what a sync does when the query produces no rows
+type EmptyPolicy int
+
+const (
+	// EmptyReplace writes the empty results as it would any others, emptying the table (the default)
+	EmptyReplace EmptyPolicy = iota
+	// EmptySkip leaves the table as it is, and reports the sync as skipped in SyncResult.Skipped
+	EmptySkip
+	// EmptyError leaves the table as it is, and fails the sync with ErrEmptyResults
+	EmptyError
+)
+
+// TablePrecondition is whether the table must already exist for a sync to go ahead
+type TablePrecondition int
+
+const (
+	// RequireNothing syncs whether or not the table exists (the default)
+	RequireNothing TablePrecondition = iota
+	// RequireExisting only syncs into a table that already exists, failing with ErrPreconditionFailed otherwise
+	RequireExisting
+	// RequireAbsent only syncs if the table doesn't exist yet, failing with ErrPreconditionFailed otherwise
+	RequireAbsent
+)
+
 type SyncOptions struct {
 	Postgres  *sql.DB
 	AskGit    *sql.DB
 	TableName string
 	Query     string
-	Logger    *zap.Logger
+	// QueryReader is an alternative to Query, for queries that are generated or stored in a file.
+	// It's read in full before the sync starts. Only one of Query and QueryReader may be set
+	QueryReader io.Reader
+	// Queries is an alternative to Query, for syncing the combined results of several queries into one table.
+	// Every query must produce the same columns, with the same types. Only one of Query, QueryReader and Queries may be set
+	Queries []string
+	// Preamble is run against AskGit before the query, for setting up the temporary tables or views it reads from.
+	// It can hold several statements. The preamble and the query (or queries) run on the same connection
+	Preamble string
+	// AttachDatabases are SQLite database files attached to the AskGit connection (with ATTACH DATABASE) before the
+	// preamble and the query run, by the schema name the query refers to their tables by, as in otherdb.table.
+	// They're detached again once the sync is done with the connection
+	AttachDatabases map[string]string
+	// ReadOnlySource runs the query (or queries) with PRAGMA query_only set, so that SQLite fails any statement in them
+	// that would change a database, for queries that come from users. The preamble is run before it's set
+	ReadOnlySource bool
+	// SourceBusyTimeout, if set, is how long the askgit query waits for a lock held by another connection
+	// (or process) on a SQLite database it reads, before failing with SQLITE_BUSY. Set with PRAGMA busy_timeout
+	SourceBusyTimeout time.Duration
+	// SourceRetry, if set, retries the askgit query when it fails to start with an error that may not happen again,
+	// such as a repository's database being locked while it's updated
+	SourceRetry *SourceRetry
+	// AcquireTimeout, if set, is how long the sync waits for a free connection from the pool of either database
+	// before failing with ErrAcquireTimeout, rather than waiting as long as it takes
+	AcquireTimeout time.Duration
+	// Paginate, if set, runs the query a page at a time rather than all at once, so that a query over a huge repository
+	// holds SQLite's memory and locks for no more than a page's worth of rows. Pages are found by their key (keyset
+	// pagination), which must uniquely identify a row; rows added while the pages are read may or may not be included.
+	// Only a single query can be paginated
+	Paginate *Pagination
+	// SourceOffset and SourceLimit load only the range of the query's rows after the first SourceOffset, up to
+	// SourceLimit of them (or all the rest, if it's 0), by wrapping the query in SELECT * FROM (<query>) LIMIT ... OFFSET,
+	// for loading a large table in shards without editing the query. The query should be ordered for the ranges
+	// to be stable. Only a single query can be limited, and not with Paginate
+	SourceOffset int
+	SourceLimit  int
+	// ExplainQuery runs EXPLAIN QUERY PLAN for the query before running it, returning SQLite's plan in SyncResult.QueryPlan
+	ExplainQuery bool
+	// EstimatedRows is the number of rows the query is expected to produce, as a caller showing the progress of the sync
+	// may know, reported in SyncResult.EstimatedRows alongside the number of rows synced
+	EstimatedRows int64
+	// CountRows counts the rows of the query (with a count(*) of it) before running it, for SyncResult.EstimatedRows,
+	// instead of taking EstimatedRows. It runs the query twice, so it's only worth it for a query that's cheap to count
+	CountRows bool
+	// Args are bound to placeholders (such as ?) in the query (or in each of the queries)
+	Args   []interface{}
+	Logger *zap.Logger
+	// ApplicationName is set as the application_name of the sync transaction, so that syncs
+	// are identifiable in pg_stat_activity. Defaults to askgit-pgsync/<TableName>, or askgit-pgsync/<TableName>/<RunID>.
+	// The statements of the swap start with a comment of it too. A swap that's stuck waiting on a lock, and what
+	// it's waiting on, can be found with
+	//
+	//	SELECT pid, query, pg_blocking_pids(pid) FROM pg_stat_activity
+	//	WHERE application_name LIKE 'askgit-pgsync/%' AND wait_event_type = 'Lock'
+	ApplicationName string
+	// RunID, if set, identifies the run of the sync in the default ApplicationName
+	RunID string
+	// SessionSettings are run-time parameters (such as work_mem or maintenance_work_mem) set with SET LOCAL
+	// at the start of the sync transaction, so they only apply to the sync
+	SessionSettings map[string]string
+	// DeferConstraints checks deferrable constraints on the table (such as a foreign key from a column to another row
+	// of it) when the sync commits, rather than as each row is loaded, so rows can be loaded in any order.
+	// Constraints that aren't DEFERRABLE are still checked immediately
+	DeferConstraints bool
+	// BypassRowSecurity sets row_security off for the sync transaction, so that row level security policies on a table
+	// that's loaded in place don't stop any of the results being loaded. It needs a role that bypasses row level
+	// security (a superuser, the table's owner or one with BYPASSRLS), Postgres otherwise fails the sync rather than
+	// load some of the rows. Policies still apply to other transactions
+	BypassRowSecurity bool
+	// SerializeSyncs takes a transaction level advisory lock keyed on the table before staging the results, so that
+	// concurrent syncs of the same table wait for each other and each one replaces the table as a whole, the last to
+	// commit winning. Only syncs that set it take the lock. A lock_timeout session setting limits how long they wait
+	SerializeSyncs bool
+	// SearchPath, if set, is the search_path of the sync transaction (with SET LOCAL), so that the table and any other
+	// unqualified names resolve to the first of these schemas they're found in, whatever the server's default.
+	// Not compatible with CopyParallelism or VerifySchema, which work outside the transaction, or with a search_path in SessionSettings
+	SearchPath []string
+	// Schema, if set, is the schema the table is synced into. The staging and _drop tables live there too and the
+	// search_path of the sync transaction is that schema alone, so no other schema's tables are touched; column types
+	// must resolve from it or pg_catalog. Not compatible with SearchPath or Temporary
+	Schema string
+	// CascadeDependents drops any views that depend on the table being replaced and recreates them,
+	// from their recorded definitions, on top of the new table. Grants and comments on those views are not kept.
+	// Without it, replacing a table other objects depend on fails with an error listing those objects.
+	CascadeDependents bool
+	// KeepBackups, if set, keeps that many of the tables swapped out by ModeReplace as backups, for putting one back if a
+	// sync turns out to be bad. Rather than being dropped, the table swapped out is renamed to <table>_bak_<time>, the time
+	// of the swap (by Clock, in UTC, to the microsecond), and the oldest backups beyond KeepBackups are dropped.
+	// Not compatible with CascadeDependents, whose views would stay with the backup
+	KeepBackups int
+	// ShadowTable, if set, is the table the results are loaded into in place of the staging table, which is committed
+	// without being swapped in for the table, so that it can be checked (with any queries) before Promote swaps it in.
+	// A shadow table left by an earlier sync is replaced. Only with ModeReplace, and not with Temporary or Indexes
+	// (which are named after the table they're created on)
+	ShadowTable string
+	// AddContentHashColumn adds a column holding a hash of each row's values (see contentHash for exactly how it's computed),
+	// so that downstream consumers can cheaply detect which rows changed between syncs
+	AddContentHashColumn bool
+	// ContentHashColumn is the name of the content hash column. Defaults to content_hash
+	ContentHashColumn string
+	// SkipDuplicateContent appends only the rows whose content hash isn't in the table already, for sources that re-emit
+	// rows they've produced before but have no key to tell them apart by. The results are staged, and appended with a
+	// unique index on the content hash column, which is created if the table doesn't have it. Only with ModeEnsureAndAppend
+	// and AddContentHashColumn
+	SkipDuplicateContent bool
+	// Checksum computes a checksum of the rows copied, returned in SyncResult.Checksum, for downstream consumers to
+	// check the table against. It's the CRC-32 (IEEE) of every row in the order they were copied, each written as
+	// contentHash writes a row (of the query's columns, without the content hash column) to its hash, and printed as
+	// 8 hex digits. Not compatible with CopyParallelism or DeadLetterTable
+	Checksum bool
+	// Mode is how the results are written into the table, see ModeReplace and ModeMerge
+	Mode Mode
+	// Retry, if set, runs a replace again from the start, in a fresh transaction, when Postgres aborts it with a
+	// serialization failure (40001). Only with ModeReplace
+	Retry *RetryPolicy
+	// ConflictColumns are the columns that uniquely identify a row when merging. Required by ModeMerge and ModeAppendWindow
+	ConflictColumns []string
+	// WindowColumn is the timestamp or sequence column whose range in the results is the window they overlap the
+	// previous sync in. Required by ModeAppendWindow
+	WindowColumn string
+	// SoftDeleteColumn, when merging, is a timestamp column (added to the target if it's missing) that's set to the
+	// time of the sync on rows that are no longer in the results, rather than deleting them. Rows that reappear
+	// in a later sync have it set back to NULL. Soft deleted rows are included in SyncResult.Deleted
+	SoftDeleteColumn string
+	// CreatedAtColumn and UpdatedAtColumn, when merging, are timestamp columns (added to the target if they're missing)
+	// set to the time of the sync, by Clock: CreatedAtColumn on rows as they're inserted, and UpdatedAtColumn on rows
+	// as they're inserted and whenever they're updated. Rows that don't change are left alone. Neither may be a query column
+	CreatedAtColumn string
+	UpdatedAtColumn string
+	// NullSafeConflictColumns, when merging (or appending with ModeAppendWindow), treats NULL conflict column values as
+	// equal to each other, so that rows with NULL keys are matched (and updated or left alone) rather than deleted and
+	// inserted again on every sync. It compares keys with IS NOT DISTINCT FROM, which Postgres can't use an index for,
+	// so it's slower on large tables
+	NullSafeConflictColumns bool
+	// UpdateColumns, when merging (or updating with ConflictUpdate), are the only columns set on rows that are already in
+	// the table, leaving the rest of their columns as they are (new rows are still inserted with every column). Changes to
+	// other columns alone don't update a row. Defaults to every column that isn't a conflict column
+	UpdateColumns []string
+	// OnConflict, when appending with ModeEnsureAndAppend, is what to do with rows that violate a unique constraint of
+	// the table, see ConflictError. With ConflictSkip or ConflictUpdate, the results are staged and appended with
+	// INSERT ... ON CONFLICT, and ConflictUpdate requires ConflictColumns to match a unique constraint of the table on
+	OnConflict ConflictPolicy
+	// DuplicateKeys, when merging (or updating with ConflictUpdate), is what to do with rows of the results that have the
+	// same ConflictColumns, see DuplicateKeysError. Rows dropped for it are counted in SyncResult.Deduplicated.
+	// Not compatible with ColumnExpressions, which move the rows they update out of the order they were loaded in
+	DuplicateKeys DuplicateKeyPolicy
+	// AutoWiden, when appending (with ModeEnsureAndAppend or ModeAppendWindow), changes the type of columns of the table
+	// that are narrower than the results' to theirs before anything is loaded, where that can't lose a value: to a wider
+	// integer type, from real to double precision, or from varchar to a longer varchar or text. Columns are never narrowed,
+	// one already wider than the results' is loaded as it is. Changing a column's type rewrites the table
+	AutoWiden bool
+	// StrictColumns, when appending, fails the sync with a *SchemaMismatchError before anything is loaded if the table
+	// has a column without a default that the query doesn't produce, which would be left NULL, to catch the query and
+	// the table drifting apart. Query columns the table doesn't have always fail the sync. Only with ModeEnsureAndAppend
+	StrictColumns bool
+	// RouteColumn is the column whose value decides which table a row goes to. Required by ModeRoute
+	RouteColumn string
+	// Routes are the tables rows go to by their value of RouteColumn, as text
+	Routes map[string]string
+	// RouteFunc, if set, returns the table rows go to with a value of RouteColumn that isn't one of Routes, or empty
+	// if there's none. A row with no table to go to fails the sync
+	RouteFunc func(value string) string
+	// PartitionKey is the date or timestamp column the target is range partitioned by. Required by ModeReplacePartitions
+	// and CreatePartitions
+	PartitionKey string
+	// PartitionInterval is the range of PartitionKey each partition holds, which decides how partitions are named.
+	// Defaults to PartitionMonthly
+	PartitionInterval PartitionInterval
+	// CreatePartitions appends to a target range partitioned by PartitionKey alone, creating the partitions (of
+	// PartitionInterval) that the results fall in and it doesn't have yet, in the sync transaction. The results are staged,
+	// and the partitions created are returned in SyncResult.Partitions. Only with ModeEnsureAndAppend
+	CreatePartitions bool
+	// LongIdentifiers is what to do with columns whose names are longer than the 63 bytes Postgres keeps, see
+	// LongIdentifiersError and LongIdentifiersHash. Other options refer to such columns by the names they're given
+	LongIdentifiers LongIdentifierPolicy
+	// ColumnOrder fixes the order of the table's columns, regardless of the order the query produces them in.
+	// Columns named here come first, in this order, followed by any others. Naming a column the query doesn't produce is an error
+	ColumnOrder []string
+	// SkipProvenance stops the table's comment being set to record the version of pgsync and the hash of the query
+	// that produced it (see ReadProvenance). Any existing comment is otherwise overwritten
+	SkipProvenance bool
+	// StateTable, if set, is the table each sync records the time, number of rows and query hash of in its transaction,
+	// one row per synced table (see ReadState). Not compatible with Temporary
+	StateTable string
+	// StateSchema is the schema of StateTable, so that it can be kept apart from the data it describes.
+	// Defaults to the search path of the sync
+	StateSchema string
+	// SkipCreateStateTable stops StateTable (and StateSchema) being created when they don't exist,
+	// for a role that can't create them
+	SkipCreateStateTable bool
+	// TrackSchemaChanges records the columns of the table and their types in StateTable (which it requires), in a
+	// column_types column that's added to it if it's missing, and reports how they changed since the last sync in
+	// SyncResult.SchemaChanges
+	TrackSchemaChanges bool
+	// RejectBreakingSchemaChanges fails the sync with ErrBreakingSchemaChange if a column was removed or changed type
+	// since the last sync. Only with TrackSchemaChanges
+	RejectBreakingSchemaChanges bool
+	// IdempotencyKey, if set, identifies the run of a pipeline step the sync is made for, so that a step a scheduler runs
+	// more than once (delivering it at least once) syncs only once. It's recorded in StateTable (which it requires, in
+	// idempotency_key and sync_result columns that are added to it if they're missing) along with the sync's result, and
+	// a sync with the key of the last sync of the table returns that sync's result instead of running again. Of two
+	// syncs with the same key running at once, only the first to record its state commits: the other is rolled back,
+	// returning the first's result or, in a REPEATABLE READ transaction, failing to serialize (40001). Results read back
+	// lose the Go types of MixedTypes values
+	IdempotencyKey string
+	// ForceRerun runs a sync with an IdempotencyKey even if the last sync of the table was made with the same key
+	ForceRerun bool
+	// CopyParallelism, when greater than 1, splits the load of the staging table across that many connections,
+	// each COPYing a share of the rows, for loads where a single COPY is the bottleneck (see copyParallel for the caveats).
+	// Only a ModeReplace can be loaded in parallel, and its sync transaction is READ COMMITTED rather than REPEATABLE READ
+	// so that it sees the rows the other connections commit. Postgres must allow that many connections on top of the one
+	// held by the sync transaction, as must the pool of Postgres, or the sync fails with ErrPoolTooSmall rather than
+	// waiting forever for a connection (see CheckPool)
+	CopyParallelism int
+	// BulkInsertFallback loads the results with multi-row INSERTs when the COPY can't be started because the connection
+	// doesn't support it (reported as an unsupported feature, 0A000), which is logged and returned in SyncResult.Warnings.
+	// The COPY is tried in a savepoint, so it's not compatible with CopyFreeze, nor with CopyParallelism, DeadLetterTable
+	// or HeartbeatInterval
+	BulkInsertFallback bool
+	// CopyBufferRows is how many rows each of the connections of CopyParallelism holds while it's waiting for Postgres,
+	// after which reading the query's results waits for it. The rows held in memory are at most CopyParallelism times
+	// that. Defaults to DefaultCopyBufferRows
+	CopyBufferRows int
+	// CopyFreeze loads the rows already frozen (with COPY FREEZE), sparing a large table that won't change the vacuum
+	// that would otherwise freeze them later. Postgres only allows it into a table created (or truncated) in the same
+	// transaction, not in a subtransaction, so it's not compatible with ModeEnsureAndAppend, CopyParallelism, DebugCopy,
+	// BulkInsertFallback, DeadLetterTable or HeartbeatInterval
+	CopyFreeze bool
+	// Temporary loads the results straight into a TEMP table named TableName, which is dropped by Postgres when
+	// the session ends, instead of replacing or merging into a persisted table. The table belongs to the connection
+	// the sync ran on, so it can only be queried afterwards through the same connection, for instance with a Postgres
+	// *sql.DB limited to a single open connection. Not compatible with ModeMerge or CopyParallelism
+	Temporary bool
+	// EpochColumns are integer (or real) columns holding times as a number of seconds or milliseconds since the Unix epoch,
+	// which are loaded as timestamp with time zone columns instead, or dates as a number of days, loaded as date columns
+	EpochColumns map[string]EpochUnit
+	// SpatialColumns are text columns of WKT geometries that are loaded as PostGIS geometry or geography columns.
+	// PostGIS must be installed in the target database
+	SpatialColumns map[string]SpatialColumn
+	// ByteaColumns are columns loaded as bytea, by how their values are encoded in the results
+	ByteaColumns map[string]ByteaEncoding
+	// VarcharColumns are text columns loaded as varchar columns of a bounded length, for targets that need one.
+	// Values that are too long fail the sync, unless the column is set to truncate them
+	VarcharColumns map[string]VarcharColumn
+	// TimesWithTimeZone creates SQLite TIME columns as time with time zone, rather than time without time zone
+	TimesWithTimeZone bool
+	// InferNotNull creates columns the askgit driver reports can't be NULL as NOT NULL. Columns it doesn't know about
+	// (as is usual with SQLite, which only knows for some columns of tables) are left nullable.
+	// Not compatible with MixedTypesNull, which loads NULLs into any column
+	InferNotNull bool
+	// ColumnExpressions are SQL expressions (such as lower(email)) that columns are set to in Postgres once the results
+	// are loaded into the staging table, before it's swapped or merged into the table. They can refer to any of the
+	// loaded columns by name, and are written into the statement as they are. Not for a table loaded in place, nor
+	// with DuplicateKeys
+	ColumnExpressions map[string]string
+	// TypeHints reads a column named with a __pgtype_ suffix, as a query can alias it, as hinting at its Postgres type:
+	// authored__pgtype_timestamptz is created as a timestamptz column named authored. Other options refer to the
+	// column by the name it's left with. Only a type's name can be hinted at, not one with a length or precision
+	TypeHints bool
+	// NumberFormat, if set, is how the text values of numeric and floating point columns write their numbers, for those
+	// written with thousands separators or a decimal comma. Values that aren't written that way fail the sync
+	NumberFormat NumberFormat
+	// MixedTypes is what's done with values that aren't of their column's type, see MixedTypePolicy
+	MixedTypes MixedTypePolicy
+	// MaxRowBytes, if set, is the largest row (in bytes, of the text form of its values) the sync will load. A larger row
+	// fails the sync or, with SkipOversizedRows, is left out, and recorded in DeadLetterTable if it's set
+	MaxRowBytes int
+	// SkipOversizedRows leaves out rows larger than MaxRowBytes, rather than failing the sync
+	SkipOversizedRows bool
+	// MaxValueSize, if set, is the largest text or binary value (in bytes) the sync will load. Larger values fail the sync,
+	// or with TruncateOversizedValues, are cut down to size. Each row is read from askgit in full before it's checked,
+	// so this doesn't bound the memory taken by a single row, but it keeps huge values (whole file contents, say) out of
+	// the COPY and out of the rows held in memory by DebugCopy and DeadLetterTable
+	MaxValueSize            int
+	TruncateOversizedValues bool
+	// ControlCharacters is what to do with the control characters of text values, such as the NUL bytes Postgres
+	// rejects in text, see ControlCharactersStrip, ControlCharactersReplace and ControlCharactersError
+	ControlCharacters ControlCharacterPolicy
+	// Collations are the collations of text columns of the table pgsync creates, by column name.
+	// Each must be installed in the target database (listed in pg_collation)
+	Collations map[string]string
+	// ColumnStorage and ColumnCompression are the storage strategies and compression methods (such as pglz or lz4)
+	// of columns of the table pgsync creates, by column name, for cutting the size of tables with large text values.
+	// Compression methods need Postgres 14 or later. When merging, they apply to the staging table only
+	ColumnStorage     map[string]ColumnStorage
+	ColumnCompression map[string]string
+	// StorageParameters are the storage parameters (such as fillfactor, autovacuum_vacuum_scale_factor or
+	// toast.autovacuum_enabled) of the table pgsync creates, by name, set in the WITH clause of its CREATE TABLE.
+	// When merging, they apply to the staging table only
+	StorageParameters map[string]string
+	// DebugCopy, when the COPY fails, retries the rows one at a time to find the row and column at fault,
+	// and reports them in a *CopyError. It keeps every row in memory for the length of the COPY, so it's for debugging only
+	DebugCopy bool
+	// DeadLetterTable, if set, is a table (created if it doesn't exist) that rows Postgres rejects are written to,
+	// along with the error, instead of failing the sync. The sync completes with the rest of the rows.
+	// See copyDeadLetter for how rejected rows are found. Not compatible with DebugCopy, CopyParallelism or HeartbeatInterval
+	DeadLetterTable string
+	// StageAsText copies the values into a temporary table of text columns, then casts them into the table's types
+	// with an INSERT ... SELECT, so that rows with values of the wrong type are found by the cast rather than failing
+	// the COPY, and are recorded in DeadLetterTable (which it requires) with the errors casting them.
+	// See copyAsText. Needs Postgres 16 or later. Not compatible with CopyParallelism, DebugCopy or HeartbeatInterval
+	StageAsText bool
+	// CaptureCommitLSN records the write-ahead log position just after the sync commits in SyncResult.CommitLSN,
+	// for coordinating with consumers of logical replication. Failing to capture it is logged, but doesn't fail the sync
+	CaptureCommitLSN bool
+	// OnCommit, if set, is called with the captured commit LSN once the sync has committed. It implies CaptureCommitLSN
+	OnCommit func(lsn string)
+	// NotifyChannel, if set, is sent a notification (with pg_notify) in the sync's transaction, which Postgres delivers
+	// to its listeners once the sync commits
+	NotifyChannel string
+	// NotifyPayload, if set, returns the payload of the NotifyChannel notification. Defaults to a JSON object with
+	// the table and the number of rows synced
+	NotifyPayload func(result *SyncResult) string
+	// NotifyOversized is what's done with a payload longer than the 7999 bytes Postgres allows, see OversizedPayloadPolicy
+	NotifyOversized OversizedPayloadPolicy
+	// Defaults are SQL expressions set as the DEFAULT of columns of the table pgsync creates, by column name.
+	// They can name any of the query's columns, or the content hash column. The expressions are not escaped in any way
+	Defaults map[string]string
+	// Indexes are created on the table once it's loaded (if they don't already exist), in the sync transaction
+	Indexes []Index
+	// IndexesConcurrent creates Indexes with CREATE INDEX CONCURRENTLY once the sync has committed instead, so building
+	// them doesn't block the table, which goes without them until they're built. An index that fails is reported with
+	// an error, along with the SyncResult of the (committed) sync, and is left behind INVALID, to be dropped before it can
+	// be created again. Not compatible with Temporary
+	IndexesConcurrent bool
+	// IndexesBeforeSwap builds Indexes on the staging table once it's loaded, before the swap, rather than on the table
+	// after it, so the table being replaced stays readable while they're built. Index builds can be given parallel
+	// workers with SessionSettings such as max_parallel_maintenance_workers. Only with ModeReplace, and not with
+	// IndexesConcurrent
+	IndexesBeforeSwap bool
+	// RewriteDDL, if set, is passed the CREATE TABLE statement for the table and returns the statement to run instead,
+	// for changes no option covers (such as storage parameters). Both forms are logged
+	RewriteDDL func(sql string) (string, error)
+	// QuoteStrategy is how identifiers are quoted in the CREATE TABLE statement for the table, see QuoteAlways and QuoteWhenNecessary
+	QuoteStrategy QuoteStrategy
+	// TypeMapper, if set, replaces the built-in mapping of columns to Postgres types (SQLiteTypeToPostgresType)
+	TypeMapper TypeMapper
+	// DefaultColumnType, if set, is the type the built-in mapping gives the columns it doesn't know the SQLite type of
+	// (such as expressions without one), in place of text. Columns of SQLite's TEXT affinity are still text.
+	// Not compatible with TypeMapper, which decides the types of every column
+	DefaultColumnType string
+	// InferFromData types the columns SQLite gives no type (expressions, mostly) from their first 100 non-null values,
+	// read ahead of the copy from at most the first 1000 rows: bigint if they're all integers, double precision if they're
+	// all numbers and timestamp with time zone if they're all timestamps, otherwise the type they'd have without it.
+	// A value past the sample that doesn't fit the type fails the sync, so the sample should be representative
+	InferFromData bool
+	// Require is whether the table must (or must not) already exist, checked before anything is loaded,
+	// see RequireExisting and RequireAbsent
+	Require TablePrecondition
+	// SpaceCheck, if set, fails the sync with ErrInsufficientSpace before anything is loaded if the table's tablespace
+	// doesn't look to have room for it, rather than have the disk fill up part way through a long load
+	SpaceCheck *SpaceCheck
+	// OnEmpty is what to do when the query produces no rows, for instance because of a transient problem upstream.
+	// See EmptyReplace, EmptySkip and EmptyError
+	OnEmpty EmptyPolicy
+	// HeartbeatInterval, if set, is the longest the sync's connection goes without a round trip to Postgres while the results
+	// are loaded, for connection poolers and firewalls that cut connections that look idle. The load is split into a
+	// new COPY at every interval (see copyRowsHeartbeat). Not compatible with CopyParallelism
+	HeartbeatInterval time.Duration
+	// VerifySchema checks, once the sync has committed, that the table has the columns and types pgsync gave it,
+	// to catch concurrent changes to it. A difference is reported as a *SchemaMismatchError, along with the SyncResult
+	// of the (committed) sync. Not compatible with Temporary
+	VerifySchema bool
+	// Manifest, if set, has a JSON description of the table written to it once the sync has committed, for data catalogs:
+	// its columns and their types, the number of rows, the source query and when it was synced
+	Manifest io.Writer
+	// CollectColumnStats computes statistics of each column once the results are loaded (the number of NULLs, and
+	// the smallest and largest values of numeric and time columns), returning them in SyncResult.ColumnStats and
+	// recording them in ColumnStatsTable, for monitoring the quality of the data. It costs a scan of the loaded rows
+	CollectColumnStats bool
+	// ColumnStatsTable is the table column statistics are recorded in, created if it doesn't exist. Defaults to DefaultColumnStatsTable
+	ColumnStatsTable string
+	// ReportNulls notes which columns had a NULL in any of the rows copied, returning it in SyncResult.NullColumns,
+	// for deciding which columns could be NOT NULL. Unlike CollectColumnStats it's worked out as the rows are copied,
+	// without a scan of the loaded rows
+	ReportNulls bool
+	// RollupTable, if set, is rebuilt from the results of RollupQuery, a Postgres query (such as an aggregate of the
+	// table) run once the table is loaded, in the sync's transaction, so that the two are always consistent.
+	// Not compatible with Temporary or ShadowTable, as the rollup is of the table that's committed
+	RollupTable string
+	// RollupQuery is the query RollupTable is rebuilt from, written into a CREATE TABLE AS as it is
+	RollupQuery string
+	// StatisticsTarget, if set, ANALYZEs the table once it's loaded, in the sync's transaction, with
+	// default_statistics_target set to it (from 1 to 10000, Postgres' default is 100). A lower target trades
+	// how accurate the planner's statistics are for how long they take to collect on a large table
+	StatisticsTarget int
+	// ValidationQuery, if set, is a Postgres query run against the staging table once it's loaded, with {{table}}
+	// replaced by its name, such as one checking a key column has no NULLs. The sync fails with ErrValidationFailed,
+	// leaving the table as it was, unless ValidationCheck accepts the first row of its results (or, without a check,
+	// that row is a single true). Not compatible with the modes that load the table in place, which have no staging table
+	ValidationQuery string
+	// ValidationCheck returns why the values of the first row of ValidationQuery's results (nil if there's none)
+	// fail the validation, or nil if they pass
+	ValidationCheck func(values []interface{}) error
+	// DryRunValidate runs the whole sync, including the swap or merge, and then rolls it back instead of committing,
+	// to find out whether it would succeed against the live table (permissions, locks, dependent objects and so on)
+	// without changing anything. Not compatible with CopyParallelism, which loads the staging table outside the transaction
+	DryRunValidate bool
+	// PreviewChanges, when merging, counts the rows the merge would insert, update and delete (in SyncResult.Inserted,
+	// Updated and Deleted) against the live table without changing any of them, then rolls the sync back as
+	// DryRunValidate does. Not compatible with CopyParallelism
+	PreviewChanges bool
+	// Tracer, if set, traces the sync with a span of its own (pgsync.sync), and child spans for running the query,
+	// copying its results and swapping (or merging) them into the table. Spans carry the table name and number of rows
+	Tracer Tracer
+	// Clock, if set, is used instead of time.Now for the timestamps pgsync records: when the table was synced (in the
+	// state table and manifest), when rows were soft deleted and when column statistics were collected.
+	// For tests and backfills that need those to be a known time
+	Clock func() time.Time
+	// OnComplete, if set, is called once Sync is done, however it ends: with the result on success, or with the error
+	// (and the result, if there is one, as when VerifySchema finds a difference) on failure
+	OnComplete func(result *SyncResult, err error)
+
+	// pause, set by a Syncer, holds up reading the results while the Syncer is paused
+	pause *pauseGate
+	// failAt, set by tests, fails the sync with the error it returns for a stage, as it gets to that stage's failure point
+	// (see injectedFailure)
+	failAt func(stage string) error
+}
+
+// injectedFailure returns the error failAt injects at stage, if any. The failure point of StageQuery is before the query
+// is run, of StageCreate once the sync transaction is open, of StageCopy once the results are loaded, of StageSwap before
+// they're swapped in and of StageCommit before the transaction is committed
+func (options *SyncOptions) injectedFailure(stage string) error {
+	if options.failAt == nil {
+		return nil
+	}
+	return options.failAt(stage)
+}
+
+// now returns the current time, of options.Clock if it's set
+func (options *SyncOptions) now() time.Time {
+	if options.Clock != nil {
+		return options.Clock()
+	}
+	return time.Now()
+}
+
+// applicationName returns the application_name of the sync transaction, see ApplicationName
+func (options *SyncOptions) applicationName() string {
+	switch {
+	case options.ApplicationName != "":
+		return options.ApplicationName
+	case options.RunID != "":
+		return fmt.Sprintf("askgit-pgsync/%s/%s", options.TableName, options.RunID)
+	default:
+		return fmt.Sprintf("askgit-pgsync/%s", options.TableName)
+	}
+}
+
+// loadsInPlace returns whether the results are loaded straight into the table, rather than into a staging table
+func (options *SyncOptions) loadsInPlace() bool {
+	return options.Temporary || options.Mode == ModeReplaceInPlace || (options.Mode == ModeEnsureAndAppend && !options.SkipDuplicateContent && !options.CreatePartitions && options.OnConflict == ConflictError)
+}
+
+// loadedTable returns the table the results are in once the sync commits
+func (options *SyncOptions) loadedTable() string {
+	if options.ShadowTable != "" {
+		return options.ShadowTable
+	}
+	return options.TableName
+}
+
+// contentHashColumn returns the name of the content hash column (see AddContentHashColumn)
+func (options *SyncOptions) contentHashColumn() string {
+	if options.ContentHashColumn == "" {
+		return "content_hash"
+	}
+	return options.ContentHashColumn
+}
+
+// SyncResult describes the outcome of moving the results of an askgit query somewhere else
+type SyncResult struct {
+	// Columns are the names of the columns produced by the query, in order
+	Columns []string
+	// Rows is the number of rows written
+	Rows int64
+	// Inserted, Updated and Deleted are the number of rows changed in the target by a merge.
+	// Inserted is also the number of rows appended by ModeAppendWindow, or appended and updated by OnConflict.
+	// Updated includes soft deleted rows that reappeared
+	Inserted, Updated, Deleted int64
+	// Deduplicated is the number of rows of the results dropped for having the same ConflictColumns as another
+	// (see SyncOptions.DuplicateKeys)
+	Deduplicated int64
+	// CommitLSN is the write-ahead log position just after the sync was committed, if captured (see SyncOptions.CaptureCommitLSN)
+	CommitLSN string
+	// Skipped is set when nothing was written because the query produced no rows (see EmptySkip)
+	Skipped bool
+	// DeadLettered is the number of rows Postgres rejected, which were written to the dead letter table instead (see SyncOptions.DeadLetterTable)
+	DeadLettered int64
+	// Types are how the Postgres type of each column of the query's results was decided, in order
+	Types []TypeDecision
+	// QueryPlan is SQLite's plan for the query (see SyncOptions.ExplainQuery), the plans of each of several queries separated by blank lines
+	QueryPlan string
+	// RollupRows is the number of rows in the rebuilt rollup table, if there is one (see SyncOptions.RollupTable)
+	RollupRows int64
+	// EstimatedRows is the number of rows the query was expected to produce, from SyncOptions.EstimatedRows or
+	// SyncOptions.CountRows. It can differ from Rows if the repository changed in between, or if rows were left out
+	EstimatedRows int64
+	// ColumnStats are the statistics of each column of the table, if collected (see SyncOptions.CollectColumnStats)
+	ColumnStats []ColumnStats
+	// NullColumns has whether each of the query's columns had a NULL in any of the rows copied, if reported
+	// (see SyncOptions.ReportNulls)
+	NullColumns map[string]bool
+	// Partitions are the partitions rebuilt by ModeReplacePartitions, or created for SyncOptions.CreatePartitions, in order
+	Partitions []string
+	// Routed is the number of rows that went to each of the tables of a ModeRoute sync, by table
+	Routed map[string]int64
+	// SchemaChanges are the columns added, removed or changed since the last sync, see SyncOptions.TrackSchemaChanges
+	SchemaChanges []SchemaChange
+	// Checksum is the checksum of the rows copied, if computed (see SyncOptions.Checksum)
+	Checksum string
+	// BytesCopied is roughly how many bytes the COPY sent to Postgres: the size of the rows copied, by the text form
+	// of their values as SyncOptions.MaxRowBytes measures them, without the COPY's own framing
+	BytesCopied int64
+	// OversizedRows is the number of rows left out for being larger than SyncOptions.MaxRowBytes
+	OversizedRows int64
+	// MixedTypes are the first values found not to be of their column's type, up to 100 of them (see SyncOptions.MixedTypes)
+	MixedTypes []MixedTypeValue
+	// Warnings are the columns whose type may not be what was expected of them, because the built-in mapping lost
+	// something of their SQLite type (see typeWarning)
+	Warnings []string
+}
+
+// TypeDecision is how the Postgres type of a column was decided
+type TypeDecision struct {
+	// Column is the name of the column
+	Column string
+	// DatabaseType is the SQLite type name of the column, empty for expressions with no type affinity
+	DatabaseType string
+	// PostgresType is the type the column is created with
+	PostgresType string
+	// Overridden is set when that's not the type of the built-in mapping (SQLiteTypeToPostgresType),
+	// because of SyncOptions.TypeMapper, DefaultColumnType or one of the per-column options such as EpochColumns
+	Overridden bool
 }
 
 // Sync imports the results of an askgit query into a postgres table.
-// CAUTION: will overwrite (DROP!) the specified table and replace it.
-func Sync(ctx context.Context, options *SyncOptions) error {
+// CAUTION: by default (ModeReplace) will overwrite (DROP!) the specified table and replace it.
+func Sync(ctx context.Context, options *SyncOptions) (result *SyncResult, err error) {
+	if options.OnComplete != nil {
+		defer func() { options.OnComplete(result, err) }()
+	}
+
+	if options.Retry != nil && options.Mode == ModeReplace {
+		// every attempt is a sync of its own, with a span of its own
+		return retrySync(ctx, options)
+	}
+
+	ctx, span := startSpan(ctx, options.Tracer, "pgsync.sync")
+	span.set("pgsync.table", options.TableName)
+	defer func() {
+		if result != nil {
+			span.set("pgsync.rows", result.Rows)
+		}
+		span.end(err)
+	}()
+
+	stage := StageOptions
+	if result, err = runSync(ctx, options, &stage); err != nil {
+		err = &StageError{Stage: stage, Err: err}
+	}
+	return result, err
+}
+
+// runSync does the work of Sync, keeping stage up to date with the stage it's in
+func runSync(ctx context.Context, options *SyncOptions, stage *string) (*SyncResult, error) {
+	if err := validateOptions(options); err != nil {
+		return nil, err
+	}
+	if err := CheckPool(options.Postgres, options, 1); err != nil {
+		return nil, err
+	}
+	*stage = StageQuery
+	if err := options.injectedFailure(StageQuery); err != nil {
+		return nil, err
+	}
+
 	l := options.Logger.Sugar().With(zap.String("pgTable", options.TableName))
 
+	if options.IdempotencyKey != "" && !options.ForceRerun {
+		completed, err := completedRun(ctx, options, options.loadedTable())
+		if err != nil {
+			return nil, fmt.Errorf("could not read state table %s: %w", stateTable(options), err)
+		}
+		if completed != nil {
+			l.Infof("already synced with idempotency key %q, returning that sync's result", options.IdempotencyKey)
+			return completed, nil
+		}
+	}
+
 	select {
 	default:
 	case <-ctx.Done():
-		return ctx.Err()
+		return nil, ctx.Err()
+	}
+
+	queries, err := sourceQueries(options)
+	if err != nil {
+		return nil, err
+	}
+	ranged := options.SourceOffset > 0 || options.SourceLimit > 0
+	if ranged {
+		queries = []string{rangeQuery(queries[0], options.SourceOffset, options.SourceLimit)}
+	}
+
+	var askgit queryer = options.AskGit
+	if options.Preamble != "" || options.ReadOnlySource || options.SourceBusyTimeout > 0 || options.AcquireTimeout > 0 || len(options.AttachDatabases) > 0 {
+		// temporary objects and pragmas only apply to the connection that made them, so the queries share it
+		conn, err := acquireConn(ctx, options.AskGit, options.AcquireTimeout, "askgit")
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		if options.SourceBusyTimeout > 0 {
+			if _, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA busy_timeout = %d", options.SourceBusyTimeout.Milliseconds())); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(options.AttachDatabases) > 0 {
+			detach, err := attachDatabases(ctx, conn, l, options.AttachDatabases)
+			defer detach()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if options.Preamble != "" {
+			if _, err := conn.ExecContext(ctx, options.Preamble); err != nil {
+				return nil, fmt.Errorf("could not run the preamble: %w", err)
+			}
+		}
+
+		if options.ReadOnlySource {
+			if _, err := conn.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+				return nil, err
+			}
+			defer func() {
+				// the connection goes back to the pool, where it would stay read only
+				if _, err := conn.ExecContext(context.Background(), "PRAGMA query_only = OFF"); err != nil {
+					l.Errorf("could not turn off query_only: %v", err)
+				}
+			}()
+		}
+		askgit = conn
+	}
+
+	var plans []string
+	if options.ExplainQuery {
+		for _, query := range queries {
+			plan, err := explainQuery(ctx, askgit, query, options.Args)
+			if err != nil {
+				return nil, err
+			}
+			plans = append(plans, plan)
+		}
+	}
+
+	estimated := options.EstimatedRows
+	if options.CountRows {
+		if estimated, err = countRows(ctx, askgit, queries, options.Args); err != nil {
+			return nil, err
+		}
 	}
 
-	rows, err := options.AskGit.QueryContext(ctx, options.Query)
+	firstQuery := queries[0]
+	if options.Paginate != nil {
+		firstQuery = pageQuery(firstQuery, options.Paginate, false)
+	}
+	queryCtx, querySpan := startSpan(ctx, options.Tracer, "pgsync.query")
+	defer querySpan.end(nil)
+	rows, err := querySource(queryCtx, askgit, l, options.SourceRetry, firstQuery, options.Args)
 	if err != nil {
-		return err
+		querySpan.end(err)
+		if ranged {
+			err = fmt.Errorf("could not run the query limited to a range of rows: %w", err)
+		}
+		return nil, err
 	}
 	defer rows.Close()
 
 	colTypes, err := rows.ColumnTypes()
+	querySpan.end(err)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	mapType := options.TypeMapper
+	if mapType == nil {
+		mapType = builtinTypeMapper(options.DefaultColumnType)
+	}
+
+	// rows of any further queries follow on from those of the first
+	chained := &chainedRows{ctx: ctx, db: askgit, args: options.Args, queries: queries, types: colTypes, mapType: mapType, rows: rows}
+	defer chained.Close()
+	var source rowSource = chained
+	if options.Paginate != nil {
+		key := -1
+		for c, col := range colTypes {
+			if col.Name() == options.Paginate.Key {
+				key = c
+			}
+		}
+		if key < 0 {
+			return nil, invalidOptions("page key is not one of the query's columns: %s", options.Paginate.Key)
+		}
+
+		paged := &pagedRows{ctx: ctx, db: askgit, query: queries[0], args: options.Args, page: options.Paginate, key: key, rows: rows}
+		defer paged.Close()
+		source = paged
+	}
+	if options.pause != nil {
+		source = &pausableRows{rowSource: source, ctx: ctx, gate: options.pause}
+	}
+
+	var sizeGuard *rowSizeGuard
+	if options.MaxRowBytes > 0 {
+		sizeGuard = newRowSizeGuard(source, len(colTypes), options.MaxRowBytes, options.SkipOversizedRows)
+		source = sizeGuard
 	}
 
 	colNames := make([]string, len(colTypes))
@@ -49,152 +814,976 @@ func Sync(ctx context.Context, options *SyncOptions) error {
 		colNames[c] = colTypes[c].Name()
 	}
 
+	if len(colNames) == 0 {
+		return nil, ErrNoColumns
+	}
+
+	var hinted map[string]string
+	if options.TypeHints {
+		if colNames, hinted, err = stripTypeHints(colNames); err != nil {
+			return nil, err
+		}
+	}
+
+	if colNames, err = fitIdentifiers(colNames, options.LongIdentifiers); err != nil {
+		return nil, err
+	}
+
+	var inferred map[string]string
+	if options.InferFromData {
+		if source, inferred, err = inferTypes(source, colTypes); err != nil {
+			return nil, err
+		}
+	}
+
+	var transforms []rowTransform
+	if len(options.ColumnOrder) > 0 {
+		positions, err := columnOrder(colNames, options.ColumnOrder)
+		if err != nil {
+			return nil, err
+		}
+		colTypes, colNames = reorderColumns(colTypes, colNames, positions)
+		transforms = append(transforms, reorderValues(positions))
+	}
+
+	if options.Mode == ModeMerge || options.Mode == ModeAppendWindow || options.OnConflict == ConflictUpdate {
+		if err := validateConflictColumns(options.ConflictColumns, colNames); err != nil {
+			return nil, err
+		}
+		if err := validateUpdateColumns(options.UpdateColumns, options.ConflictColumns, colNames); err != nil {
+			return nil, err
+		}
+		for _, col := range []string{options.CreatedAtColumn, options.UpdatedAtColumn} {
+			if col != "" && contains(colNames, col) {
+				return nil, invalidOptions("timestamp column %s is set by the merge, it can't be one of the query's columns", pq.QuoteIdentifier(col))
+			}
+		}
+	}
+	if err := validateColumnExpressions(options.ColumnExpressions, colNames); err != nil {
+		return nil, err
+	}
+	if (options.Mode == ModeReplacePartitions || options.CreatePartitions) && !contains(colNames, options.PartitionKey) {
+		return nil, invalidOptions("partition key %s is not one of the query's columns", pq.QuoteIdentifier(options.PartitionKey))
+	}
+	if options.Mode == ModeAppendWindow && !contains(colNames, options.WindowColumn) {
+		return nil, invalidOptions("window column %s is not one of the query's columns", pq.QuoteIdentifier(options.WindowColumn))
+	}
+	if options.Mode == ModeRoute && (!contains(colNames, options.RouteColumn) || len(colNames) == 1) {
+		return nil, invalidOptions("route column %s must be one of the query's columns, and not the only one", pq.QuoteIdentifier(options.RouteColumn))
+	}
+
 	select {
 	default:
 	case <-ctx.Done():
-		return ctx.Err()
+		return nil, ctx.Err()
 	}
 
-	tx, err := options.Postgres.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	*stage = StageCreate
+	var tx *sql.Tx
+	txOptions := &sql.TxOptions{Isolation: sql.LevelRepeatableRead}
+	if options.CopyParallelism > 1 {
+		// the rows are committed by other connections part way through, which a snapshot taken before then would hide
+		txOptions.Isolation = sql.LevelReadCommitted
+	}
+	if options.AcquireTimeout > 0 {
+		// the transaction's context lasts until it's committed, so only the wait for its connection can be timed out
+		var conn *sql.Conn
+		if conn, err = acquireConn(ctx, options.Postgres, options.AcquireTimeout, "postgres"); err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		tx, err = conn.BeginTx(ctx, txOptions)
+	} else {
+		tx, err = options.Postgres.BeginTx(ctx, txOptions)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	// handleErr logs err and rolls back the transaction, the caller must still return
 	handleErr := func(err error) {
-		if err == nil {
-			return
-		}
 		l.Error(err)
 		if err := tx.Rollback(); err != nil {
 			l.Error(err)
 		}
 	}
 
+	if err := options.injectedFailure(StageCreate); err != nil {
+		handleErr(err)
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL application_name = %s", pq.QuoteLiteral(options.applicationName())))
+	if err != nil {
+		handleErr(err)
+		return nil, err
+	}
+
+	searchPath := options.SearchPath
+	if options.Schema != "" {
+		// nothing the sync creates, renames or drops without qualifying it may resolve to a table in another schema
+		searchPath = []string{options.Schema}
+	}
+	if err := applySearchPath(ctx, tx, searchPath); err != nil {
+		handleErr(err)
+		return nil, err
+	}
+
+	if err := applySessionSettings(ctx, tx, options.SessionSettings); err != nil {
+		handleErr(err)
+		return nil, err
+	}
+
+	if options.BypassRowSecurity {
+		if _, err := tx.ExecContext(ctx, "SET LOCAL row_security = off"); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
+
+	if options.DeferConstraints {
+		if _, err := tx.ExecContext(ctx, "SET CONSTRAINTS ALL DEFERRED"); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
+
+	if options.SerializeSyncs {
+		if err := lockTable(ctx, tx, options.Schema, options.TableName); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
+
+	if options.Require != RequireNothing {
+		if err := checkPrecondition(ctx, tx, options.TableName, options.Require); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
+
+	if options.SpaceCheck != nil {
+		if err := checkSpace(ctx, tx, options.TableName, options.SpaceCheck); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
+
 	tempNameNew := fmt.Sprintf("%s_temp", options.TableName)
+	if options.loadsInPlace() {
+		// the table is loaded in place, which nothing outside this transaction can see part way through
+		tempNameNew = options.TableName
+	}
 	tempNameDrop := fmt.Sprintf("%s_drop", options.TableName)
+	// loaded is the table the results are in once the sync commits
+	loaded := options.loadedTable()
+	if options.ShadowTable != "" {
+		tempNameNew = options.ShadowTable
+	}
+
+	defs := make([]columnDef, len(colTypes))
+	for c, col := range colTypes {
+		pgType, err := mapType(col)
+		if err != nil {
+			handleErr(err)
+			return nil, fmt.Errorf("could not map the type of column %s: %w", col.Name(), err)
+		}
+		if t, ok := inferred[col.Name()]; ok {
+			pgType = t
+		}
+		if t, ok := hinted[colNames[c]]; ok {
+			pgType = t
+		}
+		if pgType == timeType && options.TimesWithTimeZone {
+			pgType = timeTZType
+		}
+		defs[c] = columnDef{Name: colNames[c], Type: pgType}
+		if nullable, ok := col.Nullable(); options.InferNotNull && ok && !nullable {
+			defs[c].NotNull = true
+		}
+	}
+
+	if len(options.EpochColumns) > 0 {
+		epochs, err := epochTransform(colNames, options.EpochColumns)
+		if err != nil {
+			handleErr(err)
+			return nil, err
+		}
+		for c, name := range colNames {
+			if unit, ok := options.EpochColumns[name]; ok {
+				defs[c].Type = unit.postgresType()
+			}
+		}
+		transforms = append(transforms, epochs)
+	}
+
+	if len(options.SpatialColumns) > 0 {
+		spatial, err := spatialTransform(colNames, options.SpatialColumns)
+		if err == nil {
+			err = checkPostGIS(ctx, tx)
+		}
+		if err != nil {
+			handleErr(err)
+			return nil, err
+		}
+		for c, name := range colNames {
+			if column, ok := options.SpatialColumns[name]; ok {
+				defs[c].Type = column.postgresType()
+			}
+		}
+		transforms = append(transforms, spatial)
+	}
+
+	if len(options.ByteaColumns) > 0 {
+		decode, err := byteaTransform(colNames, options.ByteaColumns)
+		if err != nil {
+			handleErr(err)
+			return nil, err
+		}
+		for c, name := range colNames {
+			if _, ok := options.ByteaColumns[name]; ok {
+				defs[c].Type = "bytea"
+			}
+		}
+		transforms = append(transforms, decode)
+	}
+
+	if options.ControlCharacters != ControlCharactersKeep {
+		if control := controlCharactersTransform(colNames, defs, options.ControlCharacters); control != nil {
+			transforms = append(transforms, control)
+		}
+	}
+
+	if len(options.VarcharColumns) > 0 {
+		bound, err := varcharTransform(colNames, options.VarcharColumns)
+		if err != nil {
+			handleErr(err)
+			return nil, err
+		}
+		for c, name := range colNames {
+			if column, ok := options.VarcharColumns[name]; ok {
+				defs[c].Type = column.postgresType()
+			}
+		}
+		transforms = append(transforms, bound)
+	}
+
+	if times := timeOfDayTransform(defs, len(colNames)); times != nil {
+		transforms = append(transforms, times)
+	}
+
+	if options.NumberFormat != NumberFormatPlain {
+		if numbers := numberFormatTransform(colNames, defs, options.NumberFormat); numbers != nil {
+			transforms = append(transforms, numbers)
+		}
+	}
+
+	var mixedTypes []MixedTypeValue
+	if options.MixedTypes != MixedTypesIgnore {
+		transforms = append(transforms, mixedTypesTransform(colNames, defs, options.MixedTypes, &mixedTypes))
+	}
+	if booleans := booleanTransform(colNames, defs); booleans != nil {
+		transforms = append(transforms, booleans)
+	}
+
+	if options.MaxValueSize > 0 {
+		transforms = append(transforms, maxValueSizeTransform(colNames, options.MaxValueSize, options.TruncateOversizedValues))
+	}
+	transforms = append(transforms, formatFloats)
+
+	var checksum *rowChecksum
+	if options.Checksum {
+		checksum = newRowChecksum()
+		transforms = append(transforms, checksum.add)
+	}
+
+	var nulls *nullTracker
+	if options.ReportNulls {
+		nulls = newNullTracker(len(colNames))
+		transforms = append(transforms, nulls.add)
+	}
+
+	copyColumns := colNames
+	if options.AddContentHashColumn {
+		hashColumn := options.contentHashColumn()
+		defs = append(defs, columnDef{Name: hashColumn, Type: "text"})
+		copyColumns = append(colNames[:len(colNames):len(colNames)], hashColumn)
+		transforms = append(transforms, appendContentHash(len(colNames)))
+	}
+	var copied *copyRecorder
+	if options.DebugCopy {
+		copied = &copyRecorder{}
+		transforms = append(transforms, copied.record)
+	}
+	var sent byteCounter
+	transforms = append(transforms, sent.add)
+	transform := chainTransforms(transforms...)
+
+	types := make([]TypeDecision, len(colTypes))
+	for c, col := range colTypes {
+		types[c] = TypeDecision{
+			Column:       colNames[c],
+			DatabaseType: col.DatabaseTypeName(),
+			PostgresType: defs[c].Type,
+			Overridden:   defs[c].Type != SQLiteTypeToPostgresType(col),
+		}
+	}
+
+	if err := applyDefaults(defs, options.Defaults); err != nil {
+		handleErr(err)
+		return nil, err
+	}
+
+	if err := applyCollations(ctx, tx, defs, options.Collations); err != nil {
+		handleErr(err)
+		return nil, err
+	}
+
+	if err := applyStorage(ctx, tx, defs, options.ColumnStorage, options.ColumnCompression); err != nil {
+		handleErr(err)
+		return nil, err
+	}
 
 	// create a new temp table
-	createSQL, err := createTableFromSQLiteTypes(tempNameNew, colTypes)
-	handleErr(err)
+	createSQL, err := createTable(options.Schema, tempNameNew, options.Temporary, defs, options.StorageParameters, options.QuoteStrategy)
+	if err != nil {
+		handleErr(err)
+		return nil, err
+	}
+
+	if options.RewriteDDL != nil {
+		rewritten, err := options.RewriteDDL(createSQL)
+		if err != nil {
+			handleErr(err)
+			return nil, fmt.Errorf("could not rewrite the CREATE TABLE statement: %w", err)
+		}
+		l.Infow("rewrote the CREATE TABLE statement", "original", createSQL, "rewritten", rewritten)
+		createSQL = rewritten
+	}
 
 	select {
 	default:
 	case <-ctx.Done():
-		return ctx.Err()
+		return nil, ctx.Err()
 	}
 
-	_, err = tx.ExecContext(ctx, createSQL)
-	handleErr(err)
+	if options.Mode == ModeMerge || options.Mode == ModeReplaceInPlace || options.Mode == ModeReplacePartitions || options.Mode == ModeEnsureAndAppend ||
+		options.Mode == ModeAppendWindow {
+		if options.AutoWiden {
+			widened, err := widenColumns(ctx, tx, options.Schema, options.TableName, defs)
+			if len(widened) > 0 {
+				l.Infow("widened columns of the table to fit the results", "columns", widened)
+			}
+			if err != nil {
+				handleErr(err)
+				return nil, err
+			}
+		} else if err := checkSchema(ctx, tx, options.Schema, options.TableName, defs); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
+	if options.Mode == ModeEnsureAndAppend || options.Mode == ModeAppendWindow {
+		if err := checkGeneratedColumns(ctx, tx, options.Schema, options.TableName, defs); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
+	if options.StrictColumns {
+		if err := checkStrictColumns(ctx, tx, options.Schema, options.TableName, defs); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
 
-	select {
-	default:
-	case <-ctx.Done():
-		return ctx.Err()
+	*stage = StageCopy
+	result := &SyncResult{Columns: colNames, Types: types, QueryPlan: strings.Join(plans, "\n"), EstimatedRows: estimated}
+	for _, d := range types {
+		if w := typeWarning(d); w != "" {
+			l.Warn(w)
+			result.Warnings = append(result.Warnings, w)
+		}
 	}
+	_, copySpan := startSpan(ctx, options.Tracer, "pgsync.copy")
+	defer copySpan.end(nil)
+	if options.CopyParallelism > 1 {
+		// a shadow table is meant to outlive the sync, so it's not marked for CleanupStaging
+		var created time.Time
+		if options.ShadowTable == "" {
+			created = options.now()
+		}
+		result.Rows, err = copyParallel(ctx, options.Postgres, options.Schema, tempNameNew, createSQL, copyColumns, source,
+			len(colTypes), transform, options.CopyParallelism, options.CopyBufferRows, created)
+		if err != nil {
+			handleErr(err)
+			return nil, err
+		}
+
+		if options.Mode == ModeReplace {
+			// the staging table is about to become the target, which shouldn't be lost in a crash
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s SET LOGGED", pq.QuoteIdentifier(tempNameNew)))
+			if err != nil {
+				handleErr(err)
+				return nil, err
+			}
+			if !created.IsZero() {
+				// nor be taken for a staging table left behind
+				_, err = tx.ExecContext(ctx, fmt.Sprintf("COMMENT ON TABLE %s IS NULL", pq.QuoteIdentifier(tempNameNew)))
+				if err != nil {
+					handleErr(err)
+					return nil, err
+				}
+			}
+		}
+	} else {
+		if options.Temporary {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS pg_temp.%s", pq.QuoteIdentifier(tempNameNew)))
+			if err != nil {
+				handleErr(err)
+				return nil, err
+			}
+		}
+
+		if options.ShadowTable != "" {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", pq.QuoteIdentifier(tempNameNew)))
+			if err != nil {
+				handleErr(err)
+				return nil, err
+			}
+		}
 
-	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(tempNameNew, colNames...))
-	handleErr(err)
+		switch {
+		case options.Mode == ModeReplaceInPlace:
+			err = truncateOrCreate(ctx, tx, tempNameNew, createSQL)
+		case options.Mode == ModeEnsureAndAppend && options.loadsInPlace():
+			err = createIfMissing(ctx, tx, tempNameNew, createSQL)
+		default:
+			_, err = tx.ExecContext(ctx, createSQL)
+		}
+		if err != nil {
+			handleErr(err)
+			return nil, err
+		}
 
-	for rows.Next() {
 		select {
 		default:
 		case <-ctx.Done():
-			return ctx.Err()
+			return nil, ctx.Err()
 		}
 
-		values := make([]interface{}, len(colTypes))
-		pointers := make([]interface{}, len(colTypes))
+		if options.DebugCopy {
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT "+copySavepoint); err != nil {
+				handleErr(err)
+				return nil, err
+			}
+		}
 
-		for i := 0; i < len(values); i++ {
-			pointers[i] = &values[i]
+		var stmt *sql.Stmt
+		if options.StageAsText {
+			result.Rows, result.DeadLettered, err = copyAsText(ctx, tx, source, tempNameNew, copyColumns, defs, len(colTypes), transform, options.DeadLetterTable, options.TableName)
+		} else if options.DeadLetterTable != "" {
+			result.Rows, result.DeadLettered, err = copyDeadLetter(ctx, tx, source, tempNameNew, copyColumns, len(colTypes), transform, options.DeadLetterTable, options.TableName)
+		} else if options.HeartbeatInterval > 0 {
+			// the COPY is split into as many statements as it takes to keep the connection busy
+			result.Rows, err = copyRowsHeartbeat(ctx, tx, source, tempNameNew, copyColumns, len(colTypes), transform, options.HeartbeatInterval)
+		} else {
+			copyStmt := copyIn(options.Schema, tempNameNew, copyColumns)
+			if options.CopyFreeze {
+				copyStmt += " WITH (FREEZE)"
+			}
+			if options.BulkInsertFallback {
+				if _, err := tx.ExecContext(ctx, "SAVEPOINT "+bulkInsertSavepoint); err != nil {
+					handleErr(err)
+					return nil, err
+				}
+			}
+			stmt, err = tx.PrepareContext(ctx, copyStmt)
+			switch {
+			case err != nil && options.BulkInsertFallback && copyUnavailable(err):
+				w := fmt.Sprintf("could not COPY (%v), loaded the results with INSERTs instead", err)
+				l.Warn(w)
+				result.Warnings = append(result.Warnings, w)
+				stmt = nil
+				if _, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+bulkInsertSavepoint); err == nil {
+					result.Rows, err = insertRows(ctx, tx, source, options.Schema, tempNameNew, copyColumns, len(colTypes), transform)
+				}
+			case err != nil:
+				handleErr(err)
+				return nil, err
+			default:
+				result.Rows, err = copyRows(ctx, source, stmt, len(colTypes), transform)
+			}
+		}
+		if err != nil {
+			// a cancelled transaction is rolled back by database/sql itself, once the COPY lets go of its connection
+			if ctx.Err() == nil {
+				if options.DebugCopy {
+					if stmt != nil {
+						_ = stmt.Close()
+					}
+					err = diagnoseCopy(ctx, tx, tempNameNew, copyColumns, copied.rows, err)
+				}
+				handleErr(err)
+			}
+			return nil, err
 		}
 
-		err := rows.Scan(pointers...)
-		handleErr(err)
+		if stmt != nil {
+			if err := stmt.Close(); err != nil {
+				handleErr(err)
+				return nil, err
+			}
+		}
+	}
+	result.BytesCopied = sent.n
+	if nulls != nil {
+		result.NullColumns = nulls.columns(colNames)
+	}
+	if checksum != nil {
+		result.Checksum = checksum.sum()
+	}
+	if sizeGuard != nil && len(sizeGuard.skipped) > 0 {
+		result.OversizedRows = int64(len(sizeGuard.skipped))
+		l.Infof("skipped %d rows larger than %d bytes", result.OversizedRows, options.MaxRowBytes)
+		if options.DeadLetterTable != "" {
+			if err := deadLetterOversizedRows(ctx, tx, sizeGuard.skipped, options.MaxRowBytes, options.DeadLetterTable, options.TableName); err != nil {
+				handleErr(err)
+				return nil, err
+			}
+			result.DeadLettered += result.OversizedRows
+		}
+	}
+	result.MixedTypes = mixedTypes
+	copySpan.set("pgsync.rows", result.Rows)
+	copySpan.end(nil)
 
-		_, err = stmt.ExecContext(ctx, values...)
-		handleErr(err)
+	if result.Rows == 0 && options.OnEmpty != EmptyReplace {
+		if err := tx.Rollback(); err != nil {
+			l.Error(err)
+		}
+		if options.OnEmpty == EmptyError {
+			return nil, ErrEmptyResults
+		}
+		l.Info("query produced no rows, leaving the table as it is")
+		result.Skipped = true
+		return result, nil
+	}
+
+	if len(options.ColumnExpressions) > 0 {
+		if err := applyColumnExpressions(ctx, tx, options.Schema, tempNameNew, options.ColumnExpressions); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
+
+	if options.CollectColumnStats {
+		if result.ColumnStats, err = collectColumnStats(ctx, tx, tempNameNew, defs); err != nil {
+			handleErr(err)
+			return nil, fmt.Errorf("could not collect column statistics: %w", err)
+		}
+
+		statsTable := options.ColumnStatsTable
+		if statsTable == "" {
+			statsTable = DefaultColumnStatsTable
+		}
+		if err := recordColumnStats(ctx, tx, statsTable, options.TableName, options.now(), result.ColumnStats); err != nil {
+			handleErr(err)
+			return nil, fmt.Errorf("could not record column statistics: %w", err)
+		}
 	}
 
 	select {
 	default:
 	case <-ctx.Done():
-		return ctx.Err()
+		return nil, ctx.Err()
 	}
 
-	_, err = stmt.ExecContext(ctx)
-	handleErr(err)
+	if options.ValidationQuery != "" {
+		if err := validateStaging(ctx, tx, options, tempNameNew); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
 
-	err = stmt.Close()
-	handleErr(err)
+	if options.IndexesBeforeSwap {
+		if err := createStagingIndexes(ctx, tx, options.TableName, tempNameNew, options.Indexes); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
 
-	select {
+	if err := options.injectedFailure(StageCopy); err != nil {
+		handleErr(err)
+		return nil, err
+	}
+
+	*stage = StageSwap
+	if err := options.injectedFailure(StageSwap); err != nil {
+		handleErr(err)
+		return nil, err
+	}
+	_, swapSpan := startSpan(ctx, options.Tracer, "pgsync.swap")
+	defer swapSpan.end(nil)
+	switch {
+	case options.ShadowTable != "":
+		l.Infof("loaded shadow table %s, leaving it to be promoted", options.ShadowTable)
+	case options.loadsInPlace():
+		// the results were loaded straight into the table, there's nothing to swap or merge
+	case options.Mode == ModeMerge:
+		err = merge(ctx, tx, options, tempNameNew, copyColumns, result)
+	case options.Mode == ModeAppendWindow:
+		err = appendWindow(ctx, tx, options, tempNameNew, copyColumns, result)
+	case options.OnConflict != ConflictError:
+		err = appendOnConflict(ctx, tx, options, tempNameNew, copyColumns, result)
+	case options.SkipDuplicateContent:
+		err = appendDistinct(ctx, tx, options.TableName, tempNameNew, copyColumns, options.contentHashColumn(), result)
+	case options.CreatePartitions:
+		result.Partitions, err = appendPartitions(ctx, tx, options.TableName, tempNameNew, copyColumns, options.PartitionKey, options.PartitionInterval, result)
+	case options.Mode == ModeReplacePartitions:
+		result.Partitions, err = replacePartitions(ctx, tx, options.TableName, tempNameNew, copyColumns, options.PartitionKey, options.PartitionInterval)
+	case options.Mode == ModeRoute:
+		result.Routed, err = routeRows(ctx, tx, tempNameNew, copyColumns, options.RouteColumn, options.Routes, options.RouteFunc)
 	default:
-	case <-ctx.Done():
-		return ctx.Err()
+		err = swap(ctx, tx, l, options, tempNameNew, tempNameDrop, copyColumns)
+	}
+	swapSpan.end(err)
+	if err != nil {
+		handleErr(err)
+		return nil, err
 	}
 
-	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
-		ALTER TABLE IF EXISTS "%s" RENAME to %s;
-		ALTER TABLE IF EXISTS "%s" RENAME TO "%s";
-		DROP TABLE IF EXISTS "%s";
-	`, options.TableName, tempNameDrop, tempNameNew, options.TableName, tempNameDrop))
-	handleErr(err)
+	if options.IndexesBeforeSwap {
+		if err := renameStagingIndexes(ctx, tx, options.TableName, options.Indexes); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	} else if !options.IndexesConcurrent {
+		for _, index := range options.Indexes {
+			if _, err := tx.ExecContext(ctx, createIndex("", options.TableName, index, false)); err != nil {
+				handleErr(err)
+				return nil, err
+			}
+		}
+	}
+
+	if options.RollupTable != "" {
+		if result.RollupRows, err = rebuildRollup(ctx, tx, options); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
+
+	if options.StatisticsTarget > 0 {
+		if err := analyzeTable(ctx, tx, options.Schema, loaded, options.StatisticsTarget); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
+
+	if !options.SkipProvenance && !options.Temporary {
+		stamped := []string{loaded}
+		if options.Mode == ModeRoute {
+			stamped = make([]string, 0, len(result.Routed))
+			for table := range result.Routed {
+				stamped = append(stamped, table)
+			}
+			sort.Strings(stamped)
+		}
+		for _, table := range stamped {
+			if err := stampProvenance(ctx, tx, table, strings.Join(queries, ";\n")); err != nil {
+				handleErr(err)
+				return nil, err
+			}
+		}
+	}
+
+	if options.StateTable != "" {
+		if err := recordState(ctx, tx, options, loaded, strings.Join(queries, ";\n"), result.Rows); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+		if options.TrackSchemaChanges {
+			if result.SchemaChanges, err = trackSchemaChanges(ctx, tx, options, loaded, defs); err != nil {
+				handleErr(err)
+				return nil, err
+			}
+		}
+		if options.IdempotencyKey != "" {
+			if err := recordRun(ctx, tx, options, loaded, result); errors.Is(err, errAlreadyRun) {
+				if err := tx.Rollback(); err != nil {
+					return nil, err
+				}
+				l.Infof("synced with idempotency key %q by another sync meanwhile, returning that sync's result", options.IdempotencyKey)
+				return completedRun(ctx, options, loaded)
+			} else if err != nil {
+				handleErr(err)
+				return nil, err
+			}
+		}
+	}
+
+	if options.NotifyChannel != "" {
+		if err := notifySync(ctx, tx, l, options, loaded, result); err != nil {
+			handleErr(err)
+			return nil, err
+		}
+	}
 
 	select {
 	default:
 	case <-ctx.Done():
-		return ctx.Err()
+		return nil, ctx.Err()
+	}
+
+	*stage = StageCommit
+	if options.DryRunValidate || options.PreviewChanges {
+		if err := tx.Rollback(); err != nil {
+			return nil, err
+		}
+		if options.PreviewChanges {
+			l.Infof("previewed the merge (%d inserts, %d updates and %d deletes), rolled back without changing the table", result.Inserted, result.Updated, result.Deleted)
+		} else {
+			l.Info("dry run succeeded, rolled back without changing the table")
+		}
+		return result, nil
 	}
 
+	if err := options.injectedFailure(StageCommit); err != nil {
+		handleErr(err)
+		return nil, err
+	}
 	err = tx.Commit()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	if options.CaptureCommitLSN || options.OnCommit != nil {
+		if err := options.Postgres.QueryRowContext(ctx, "SELECT pg_current_wal_lsn()").Scan(&result.CommitLSN); err != nil {
+			l.Errorf("could not capture the commit LSN: %v", err)
+		} else if options.OnCommit != nil {
+			options.OnCommit(result.CommitLSN)
+		}
+	}
+
+	if options.VerifySchema {
+		if err := verifySchema(ctx, options.Postgres, options.Schema, loaded, defs); err != nil {
+			return result, err
+		}
+	}
+
+	if options.IndexesConcurrent && len(options.Indexes) > 0 {
+		if err := createIndexesConcurrently(ctx, options.Postgres, options.Schema, options.TableName, options.Indexes); err != nil {
+			l.Error(err)
+			return result, err
+		}
+	}
+
+	if options.Manifest != nil {
+		if err := writeManifest(options.Manifest, options, strings.Join(queries, ";\n"), defs, result); err != nil {
+			return result, fmt.Errorf("could not write the manifest: %w", err)
+		}
+	}
+
+	return result, nil
 }
 
-// sqliteTypeToPostgresType maps SQLite column types to Postgres column types
-func sqliteTypeToPostgresType(col *sql.ColumnType) string {
+// sourceQueries returns the askgit queries to sync from, out of one of options.Query, options.QueryReader or options.Queries
+func sourceQueries(options *SyncOptions) ([]string, error) {
+	set := 0
+	for _, isSet := range []bool{options.Query != "", options.QueryReader != nil, len(options.Queries) > 0} {
+		if isSet {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, invalidOptions("only one of Query, QueryReader and Queries may be set")
+	}
+
+	switch {
+	case len(options.Queries) > 0:
+		return options.Queries, nil
+	case options.QueryReader != nil:
+		query, err := ioutil.ReadAll(options.QueryReader)
+		if err != nil {
+			return nil, err
+		}
+		return []string{string(query)}, nil
+	default:
+		return []string{options.Query}, nil
+	}
+}
+
+// TypeMapper returns the Postgres type of the column for a column of askgit results
+type TypeMapper func(col *sql.ColumnType) (string, error)
+
+// builtinTypeMapper returns the TypeMapper used when SyncOptions.TypeMapper isn't set, which gives columns of types
+// SQLiteTypeToPostgresType doesn't know the fallback type, if it's not empty
+func builtinTypeMapper(fallback string) TypeMapper {
+	return func(col *sql.ColumnType) (string, error) {
+		pgType, known := mapSQLiteType(col)
+		if !known && fallback != "" {
+			return fallback, nil
+		}
+		return pgType, nil
+	}
+}
+
+// SQLiteTypeToPostgresType maps SQLite column types to Postgres column types.
+// It's the mapping used unless SyncOptions.TypeMapper is set, for custom mappers to fall back on
+func SQLiteTypeToPostgresType(col *sql.ColumnType) string {
+	pgType, _ := mapSQLiteType(col)
+	return pgType
+}
+
+// mapSQLiteType returns the Postgres type SQLiteTypeToPostgresType maps col to, and whether it knew the SQLite type,
+// rather than falling back to text
+func mapSQLiteType(col *sql.ColumnType) (string, bool) {
 	// TODO(patrickdevivo) expressions do not have a type-affinity in SQLite (unless explicitly cast)
 	// which means something like `datetime('now')` will not have a type-affinity and be rendered into postgres
 	// as text. Even `CAST(datetime('now') AS "DATETIME")` won't work because "DATETIME" is not a known affinity (becomes numeric).
 	// All this means that there's not a way, using a SQL query alone, to coerce a column into a specific postgres type.
 	// This matters mainly when there are expressions in a query (column name references will use the declared column type)
-	switch col.DatabaseTypeName() {
+	typeName := sqliteTypeName(col)
+	switch typeName {
 	case "TEXT":
-		return "text"
+		return "text", true
 	case "INT":
 		fallthrough
 	case "INTEGER":
-		return "integer"
+		return "integer", true
+	case "REAL", "FLOAT", "DOUBLE", "DOUBLE PRECISION":
+		return "double precision", true
 	case "DATETIME":
-		return "timestamp with time zone"
+		return "timestamp with time zone", true
+	case "TIME":
+		return timeType, true
 	case "BOOLEAN":
-		return "boolean"
+		return "boolean", true
+	case "BLOB":
+		// as askgit declares the contents of files
+		return "bytea", true
 	default:
-		return "text"
+		// a declared (or CAST) type like DECIMAL(10,2) keeps its precision
+		if m := decimalType.FindStringSubmatch(typeName); m != nil {
+			if m[2] != "" {
+				return fmt.Sprintf("numeric(%s,%s)", m[1], m[2]), true
+			}
+			return fmt.Sprintf("numeric(%s)", m[1]), true
+		}
+		// as do character types with a length, named as format_type names them so they compare equal to an existing table's
+		if m := characterType.FindStringSubmatch(typeName); m != nil {
+			if m[1] == "" {
+				return fmt.Sprintf("character(%s)", m[2]), true
+			}
+			return fmt.Sprintf("character varying(%s)", m[2]), true
+		}
+		// other declared types, such as those of the columns of a view, keep their SQLite affinity where it's a number
+		switch {
+		case integerTypes[typeName]:
+			return "bigint", true
+		case realAffinity(typeName):
+			return "double precision", true
+		}
+		if strings.Contains(typeName, "CHAR") || strings.Contains(typeName, "CLOB") || strings.Contains(typeName, "TEXT") {
+			return "text", true
+		}
+		return "text", false
 	}
 }
 
-// createTableFromSQLiteTypes produces a postgres CREATE TABLE statement from a set of SQLite columns
-func createTableFromSQLiteTypes(tableName string, columns []*sql.ColumnType) (string, error) {
-	const declare = `CREATE TABLE {{ .TableName }} (
+// typeWarning returns a warning if the built-in mapping decided the type of a column in a way that loses something of
+// its SQLite type: one that falls back to text without having SQLite's TEXT affinity (as an expression with no type
+// does), or an INTEGER, which SQLite stores in up to 64 bits, created as a 32 bit integer
+func typeWarning(d TypeDecision) string {
+	if d.Overridden {
+		return ""
+	}
+
+	typeName := strings.ToUpper(d.DatabaseType)
+	switch {
+	case d.PostgresType == "text" && typeName == "":
+		return fmt.Sprintf("column %s has no SQLite type (it may be an expression), it's loaded as text", pq.QuoteIdentifier(d.Column))
+	case d.PostgresType == "text" && !strings.Contains(typeName, "CHAR") && !strings.Contains(typeName, "CLOB") && !strings.Contains(typeName, "TEXT"):
+		return fmt.Sprintf("column %s of SQLite type %s is loaded as text", pq.QuoteIdentifier(d.Column), d.DatabaseType)
+	case d.PostgresType == "integer":
+		return fmt.Sprintf("column %s of SQLite type %s is loaded as integer, values that don't fit in 32 bits fail the sync", pq.QuoteIdentifier(d.Column), d.DatabaseType)
+	}
+	return ""
+}
+
+// sqliteTypeName returns the SQLite type name of col in upper case, as SQLite reports it as it was declared
+func sqliteTypeName(col *sql.ColumnType) string {
+	return strings.ToUpper(col.DatabaseTypeName())
+}
+
+// characterType matches SQLite character type names with a length, capturing whether they're varying and the length
+var characterType = regexp.MustCompile(`^(?:(VARCHAR|NVARCHAR|VARYING CHARACTER)|CHARACTER|NCHAR|NATIVE CHARACTER)\s*\(\s*(\d+)\s*\)$`)
+
+// integerTypes are the SQLite type names other than INT and INTEGER declared for integer columns, of up to 64 bits
+var integerTypes = map[string]bool{"BIGINT": true, "INT8": true, "INT2": true, "SMALLINT": true, "MEDIUMINT": true, "TINYINT": true, "UNSIGNED BIG INT": true}
+
+// realAffinity reports whether SQLite gives columns of type typeName REAL affinity, by the first of its rules that applies
+func realAffinity(typeName string) bool {
+	for _, s := range []string{"INT", "CHAR", "CLOB", "TEXT"} {
+		if strings.Contains(typeName, s) {
+			return false
+		}
+	}
+	return strings.Contains(typeName, "REAL") || strings.Contains(typeName, "FLOA") || strings.Contains(typeName, "DOUB")
+}
+
+// decimalType matches SQLite numeric type names with a precision (and optionally a scale), capturing them
+var decimalType = regexp.MustCompile(`^(?:NUM|NUMERIC|DECIMAL)\s*\(\s*(\d+)\s*(?:,\s*(\d+)\s*)?\)$`)
+
+// columnDef is a column of a table created by pgsync
+type columnDef struct {
+	Name      string
+	Type      string
+	Default   string
+	Collation string
+	NotNull   bool
+	// Storage and Compression are set on the column once the table is created, see alterStorage
+	Storage     ColumnStorage
+	Compression string
+}
+
+// applyDefaults sets the default expression of each of defs named in defaults
+func applyDefaults(defs []columnDef, defaults map[string]string) error {
+	for name, expression := range defaults {
+		found := false
+		for i := range defs {
+			if defs[i].Name == name {
+				defs[i].Default = expression
+				found = true
+			}
+		}
+		if !found {
+			return invalidOptions("column with a default is not in the table: %s", name)
+		}
+	}
+	return nil
+}
+
+// createTable produces a postgres CREATE TABLE (or CREATE TEMP TABLE, if temporary) statement for a set of columns,
+// with the table in schema (if set), the storage parameters given (see withParameters) and identifiers quoted according to quote
+func createTable(schema, tableName string, temporary bool, defs []columnDef, parameters map[string]string, quote QuoteStrategy) (string, error) {
+	with, err := withParameters(parameters)
+	if err != nil {
+		return "", err
+	}
+
+	const declare = `CREATE {{ if .Temporary }}TEMP {{ end }}TABLE {{ .TableName }} (
 		{{- range $c, $col := .Columns }}
-			{{ quoteIdentifier .Name }} {{ colType $c }}{{ if columnComma $c }},{{ end }}
+			{{ quoteIdentifier .Name }} {{ .Type }}{{ if .Collation }} COLLATE {{ quoteIdentifier .Collation }}{{ end }}{{ if .NotNull }} NOT NULL{{ end }}{{ if .Default }} DEFAULT {{ .Default }}{{ end }}{{ if columnComma $c }},{{ end }}
 		{{- end }}
-	  )`
+	  ){{ .With }}`
 
 	// helper to determine whether we're on the last column (and therefore should avoid a comma ",") in the range
 	fns := template.FuncMap{
 		"columnComma": func(c int) bool {
-			return c < len(columns)-1
-		},
-		"colType": func(colIndex int) string {
-			return sqliteTypeToPostgresType(columns[colIndex])
+			return c < len(defs)-1
 		},
-		"quoteIdentifier": pq.QuoteIdentifier,
+		"quoteIdentifier": quote.quote,
 	}
 
 	tmpl, err := template.New(fmt.Sprintf("declare_table_func_%s", tableName)).Funcs(fns).Parse(declare)
@@ -205,14 +1794,24 @@ func createTableFromSQLiteTypes(tableName string, columns []*sql.ColumnType) (st
 	buf := new(bytes.Buffer)
 	err = tmpl.Execute(buf, struct {
 		TableName string
-		Columns   []*sql.ColumnType
+		Temporary bool
+		Columns   []columnDef
+		With      string
 	}{
-		pq.QuoteIdentifier(tableName),
-		columns,
+		quote.qualify(schema, tableName),
+		temporary,
+		defs,
+		with,
 	})
 	if err != nil {
 		return "", err
 	}
 
+	// the storage of a column can't be declared in CREATE TABLE before Postgres 16, so it's set straight after
+	if alter := alterStorage(quote.qualify(schema, tableName), defs, quote); alter != "" {
+		buf.WriteString(";\n")
+		buf.WriteString(alter)
+	}
+
 	return buf.String(), nil
 }
@@ -0,0 +1,301 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+// newSource returns a mock askgit database that responds to any query with rows
+func newSource(t *testing.T, rows *sqlmock.Rows) *sql.DB {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(".").WillReturnRows(rows)
+	return db
+}
+
+// commitRows returns a small set of mock source rows
+func commitRows() *sqlmock.Rows {
+	return sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+	).
+		AddRow("abc", int64(1)).
+		AddRow("def", int64(2))
+}
+
+// expectCopy sets up the expectations for a COPY of rows into table
+func expectCopy(mock sqlmock.Sqlmock, table string, rows ...[]driver.Value) {
+	prep := mock.ExpectPrepare(regexp.QuoteMeta("COPY " + table))
+	for _, row := range rows {
+		prep.ExpectExec().WithArgs(row...).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	prep.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(0, int64(len(rows))))
+}
+
+// expectSwap sets up the expectations for swapping the staging table into place when nothing depends on the old table
+func expectSwap(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	mock.ExpectQuery("pg_rewrite").WillReturnRows(sqlmock.NewRows([]string{"name", "relkind", "definition"}))
+	mock.ExpectQuery("pg_constraint").WillReturnRows(sqlmock.NewRows([]string{"constraint"}))
+	mock.ExpectExec("ALTER TABLE IF EXISTS").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+// expectTableColumns sets up the expectations for looking up the columns of the existing table, given as pairs of
+// names and types (none for a table that doesn't exist)
+func expectTableColumns(mock sqlmock.Sqlmock, columns ...string) {
+	rows := sqlmock.NewRows([]string{"attname", "format_type"})
+	for i := 0; i < len(columns); i += 2 {
+		rows.AddRow(columns[i], columns[i+1])
+	}
+	mock.ExpectQuery("FROM pg_attribute").WillReturnRows(rows)
+}
+
+// expectGeneratedColumns sets up the expectations for looking up the identity and generated columns of the table
+// appended to, given as pairs of names and whether they're generated (none for a table that has none or doesn't exist)
+func expectGeneratedColumns(mock sqlmock.Sqlmock, columns ...interface{}) {
+	rows := sqlmock.NewRows([]string{"attname", "generated"})
+	for i := 0; i < len(columns); i += 2 {
+		rows.AddRow(columns[i], columns[i+1])
+	}
+	mock.ExpectQuery("attidentity = 'a'").WillReturnRows(rows)
+}
+
+// expectNoDuplicateKeys sets up the expectation for checking the staging table of a merge for repeated conflict keys
+func expectNoDuplicateKeys(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("HAVING count").WillReturnRows(sqlmock.NewRows([]string{"hash"}))
+}
+
+// expectProvenance sets up the expectations for stamping the provenance comment on a (regular) table
+func expectProvenance(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	mock.ExpectExec("COMMENT ON TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestSyncApplicationName(t *testing.T) {
+	cases := []struct {
+		applicationName string
+		runID           string
+		expected        string
+	}{
+		{"", "", "askgit-pgsync/commits"},
+		{"", "run-7", "askgit-pgsync/commits/run-7"},
+		{"nightly-load", "run-7", "nightly-load"},
+	}
+
+	for _, c := range cases {
+		pg, mock, _ := sqlmock.New()
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("SET LOCAL application_name = '" + c.expected + "'")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+		// the swap is labelled with it too
+		mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+		mock.ExpectQuery("pg_rewrite").WillReturnRows(sqlmock.NewRows([]string{"name", "relkind", "definition"}))
+		mock.ExpectQuery("pg_constraint").WillReturnRows(sqlmock.NewRows([]string{"constraint"}))
+		mock.ExpectExec(regexp.QuoteMeta("/* " + c.expected + " swap */")).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectProvenance(mock)
+		mock.ExpectCommit()
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:        pg,
+			AskGit:          newSource(t, commitRows()),
+			TableName:       "commits",
+			Query:           "SELECT hash, additions FROM commits",
+			Logger:          zap.NewNop(),
+			ApplicationName: c.applicationName,
+			RunID:           c.runID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncReusesScanBuffers(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	rows := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+	)
+	expected := make([][]driver.Value, 0, 3)
+	for _, row := range [][]driver.Value{{"abc", int64(1)}, {nil, int64(2)}, {"ghi", nil}} {
+		rows.AddRow(row...)
+		expected = append(expected, row)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, expected...)
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	// a value from a previous row must never leak into a NULL in the next one
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, rows),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rows != 3 {
+		t.Fatalf("expected 3 rows, got: %d", result.Rows)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkSync(b *testing.B) {
+	const n = 1000
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		pg, mock, _ := sqlmock.New()
+		askgit, source, _ := sqlmock.New()
+
+		rows := sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("hash").OfType("TEXT", ""),
+			sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+		)
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		prep := mock.ExpectPrepare("COPY")
+		for r := 0; r < n; r++ {
+			rows.AddRow("abc", int64(r))
+			prep.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+		prep.ExpectExec().WillReturnResult(sqlmock.NewResult(0, n))
+		expectSwap(mock)
+		expectProvenance(mock)
+		mock.ExpectCommit()
+		source.ExpectQuery(".").WillReturnRows(rows)
+		b.StartTimer()
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:  pg,
+			AskGit:    askgit,
+			TableName: "commits",
+			Query:     "SELECT hash, additions FROM commits",
+			Logger:    zap.NewNop(),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSyncQueryReader(t *testing.T) {
+	const query = "SELECT hash, additions FROM commits"
+
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+
+	source.ExpectQuery(query).WillReturnRows(commitRows())
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:    pg,
+		AskGit:      askgit,
+		TableName:   "commits",
+		QueryReader: strings.NewReader(query),
+		Logger:      zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rows != 2 {
+		t.Fatalf("expected 2 rows, got: %d", result.Rows)
+	}
+
+	if err := source.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncQueryAndQueryReader(t *testing.T) {
+	_, err := Sync(context.Background(), &SyncOptions{
+		TableName:   "commits",
+		Query:       "SELECT hash FROM commits",
+		QueryReader: strings.NewReader("SELECT hash FROM commits"),
+		Logger:      zap.NewNop(),
+	})
+	if err == nil {
+		t.Fatal("expected an error when both Query and QueryReader are set")
+	}
+}
+
+func TestSyncQueryArgs(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	rows := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+	).AddRow("def", int64(2))
+
+	source.ExpectQuery(regexp.QuoteMeta("SELECT hash, additions FROM commits WHERE additions > ?")).WithArgs(int64(1)).WillReturnRows(rows)
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    askgit,
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits WHERE additions > ?",
+		Args:      []interface{}{1},
+		Logger:    zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rows != 1 {
+		t.Fatalf("expected 1 row, got: %d", result.Rows)
+	}
+
+	if err := source.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
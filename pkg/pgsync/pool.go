@@ -0,0 +1,32 @@
+package pgsync
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// ConnectionsNeeded returns how many connections of options.Postgres a sync with options holds at once: that of its
+// transaction and, if it loads in parallel, one more for each of CopyParallelism
+func ConnectionsNeeded(options *SyncOptions) int {
+	if options.CopyParallelism > 1 {
+		return 1 + options.CopyParallelism
+	}
+	return 1
+}
+
+// CheckPool returns an ErrPoolTooSmall error if the pool of db is limited (by SetMaxOpenConns) to fewer connections
+// than concurrency syncs with options hold at once. Such syncs can deadlock, each holding some connections while it
+// waits for one that another holds, so callers running syncs concurrently (from a Syncer, say) should check their pool
+// up front. Sync checks it for a single sync
+func CheckPool(db *sql.DB, options *SyncOptions, concurrency int) error {
+	max := db.Stats().MaxOpenConnections
+	if max <= 0 {
+		return nil
+	}
+
+	if needed := concurrency * ConnectionsNeeded(options); needed > max {
+		return fmt.Errorf("%w: %d concurrent syncs hold up to %d connections at once, but the pool is limited to %d",
+			ErrPoolTooSmall, concurrency, needed, max)
+	}
+	return nil
+}
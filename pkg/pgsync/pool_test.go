@@ -0,0 +1,56 @@
+package pgsync
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestCheckPool(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	options := &SyncOptions{CopyParallelism: 2}
+
+	// an unlimited pool has room for any number of syncs
+	if err := CheckPool(pg, options, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// each parallel sync holds its transaction's connection and 2 more
+	pg.SetMaxOpenConns(6)
+	if err := CheckPool(pg, options, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckPool(pg, options, 3); !errors.Is(err, ErrPoolTooSmall) {
+		t.Fatalf("expected ErrPoolTooSmall for 3 concurrent syncs, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncPoolTooSmall(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	pg.SetMaxOpenConns(2)
+
+	// the sync fails before taking any connection, instead of its parallel load waiting on the transaction's
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, commitRows()),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		CopyParallelism: 2,
+	})
+	var stageErr *StageError
+	if !errors.Is(err, ErrPoolTooSmall) || !errors.As(err, &stageErr) || stageErr.Stage != StageOptions {
+		t.Fatalf("expected ErrPoolTooSmall in the options stage, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
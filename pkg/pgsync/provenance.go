@@ -0,0 +1,66 @@
+package pgsync
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// ProvenanceVersion is the version of pgsync recorded in the comment of every table it syncs.
+// It changes whenever the way pgsync lays out a table changes
+const ProvenanceVersion = 1
+
+// provenanceFormat is the format of the comment pgsync stamps on synced tables
+const provenanceFormat = "askgit-pgsync version=%d query_sha256=%s"
+
+// Provenance describes the sync that produced a table
+type Provenance struct {
+	// Version is the ProvenanceVersion of the pgsync that synced the table
+	Version int
+	// QueryHash is the hex encoded SHA-256 of the query the table was synced from
+	QueryHash string
+}
+
+// queryHash returns the hex encoded SHA-256 of query
+func queryHash(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// stampProvenance sets the comment of table to record the current ProvenanceVersion and the hash of query
+func stampProvenance(ctx context.Context, tx *sql.Tx, table, query string) error {
+	kind, err := relationKind(ctx, tx, table)
+	if err != nil {
+		return err
+	}
+
+	objectType := "TABLE"
+	if kind == "f" {
+		objectType = "FOREIGN TABLE"
+	}
+
+	comment := fmt.Sprintf(provenanceFormat, ProvenanceVersion, queryHash(query))
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("COMMENT ON %s %s IS %s", objectType, pq.QuoteIdentifier(table), pq.QuoteLiteral(comment)))
+	return err
+}
+
+// ReadProvenance returns the provenance pgsync recorded in the comment of table,
+// or nil if the table has no such comment (because it wasn't synced, or was synced with SkipProvenance)
+func ReadProvenance(ctx context.Context, db *sql.DB, table string) (*Provenance, error) {
+	var comment sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT obj_description(to_regclass($1), 'pg_class')", pq.QuoteIdentifier(table)).Scan(&comment)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Provenance
+	if _, err := fmt.Sscanf(comment.String, provenanceFormat, &p.Version, &p.QueryHash); err != nil {
+		return nil, nil
+	}
+
+	return &p, nil
+}
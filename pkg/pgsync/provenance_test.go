@@ -0,0 +1,81 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncProvenance(t *testing.T) {
+	hashes := make(map[string]bool)
+
+	for _, query := range []string{"SELECT hash, additions FROM commits", "SELECT hash, additions FROM commits LIMIT 10"} {
+		pg, mock, _ := sqlmock.New()
+
+		comment := fmt.Sprintf("askgit-pgsync version=%d query_sha256=%s", ProvenanceVersion, queryHash(query))
+		hashes[queryHash(query)] = true
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+		expectSwap(mock)
+		mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+		mock.ExpectExec(regexp.QuoteMeta(`COMMENT ON TABLE "commits" IS '` + comment + `'`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:  pg,
+			AskGit:    newSource(t, commitRows()),
+			TableName: "commits",
+			Query:     query,
+			Logger:    zap.NewNop(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT obj_description")).WithArgs(`"commits"`).
+			WillReturnRows(sqlmock.NewRows([]string{"obj_description"}).AddRow(comment))
+
+		p, err := ReadProvenance(context.Background(), pg, "commits")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p == nil || p.Version != ProvenanceVersion || p.QueryHash != queryHash(query) {
+			t.Fatalf("unexpected provenance: %+v", p)
+		}
+	}
+
+	if len(hashes) != 2 {
+		t.Fatal("expected a change to the query to change its hash")
+	}
+}
+
+func TestReadProvenanceWithoutComment(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT obj_description")).
+		WillReturnRows(sqlmock.NewRows([]string{"obj_description"}).AddRow(nil))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT obj_description")).
+		WillReturnRows(sqlmock.NewRows([]string{"obj_description"}).AddRow("commits imported by hand"))
+
+	for i := 0; i < 2; i++ {
+		p, err := ReadProvenance(context.Background(), pg, "commits")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != nil {
+			t.Fatalf("expected no provenance, got: %+v", p)
+		}
+	}
+}
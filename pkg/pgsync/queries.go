@@ -0,0 +1,113 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// rangeQuery returns query limited to limit of its rows (or all of them, if limit is 0) after the first offset,
+// see SyncOptions.SourceOffset and SourceLimit
+func rangeQuery(query string, offset, limit int) string {
+	// SQLite only takes an OFFSET with a LIMIT, of which a negative one is no limit
+	if limit == 0 {
+		limit = -1
+	}
+	query = strings.TrimRight(strings.TrimSpace(query), "; \t\n")
+	// the query is closed on a line of its own, in case it ends with a comment
+	return fmt.Sprintf("SELECT * FROM (%s\n) LIMIT %d OFFSET %d", query, limit, offset)
+}
+
+// rowSource is what rows are copied from, a *sql.Rows or a chainedRows
+type rowSource interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+}
+
+// chainedRows reads the rows of each of a set of queries in turn, as if they were the results of a single query.
+// The first query has already been run (producing rows), the rest are run as the rows before them run out,
+// and must produce columns of the same names and types as the first
+type chainedRows struct {
+	ctx     context.Context
+	db      queryer
+	args    []interface{}
+	queries []string
+	types   []*sql.ColumnType
+	mapType TypeMapper
+
+	rows    *sql.Rows
+	current int
+	err     error
+}
+
+func (c *chainedRows) Next() bool {
+	for {
+		if c.rows.Next() {
+			return true
+		}
+		if c.err = c.rows.Err(); c.err != nil {
+			return false
+		}
+		if c.current == len(c.queries)-1 {
+			return false
+		}
+		if c.err = c.rows.Close(); c.err != nil {
+			return false
+		}
+
+		// a query that fails to start leaves rows the (closed) query before it, for Close
+		c.current++
+		rows, err := c.db.QueryContext(c.ctx, c.queries[c.current], c.args...)
+		if err != nil {
+			c.err = err
+			return false
+		}
+		c.rows = rows
+		if c.err = c.checkShape(); c.err != nil {
+			return false
+		}
+	}
+}
+
+func (c *chainedRows) Scan(dest ...interface{}) error { return c.rows.Scan(dest...) }
+
+func (c *chainedRows) Err() error { return c.err }
+
+func (c *chainedRows) Close() error { return c.rows.Close() }
+
+// checkShape returns an error if the current query doesn't produce the same columns as the first
+func (c *chainedRows) checkShape() error {
+	types, err := c.rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+
+	shape, err := columnShape(types, c.mapType)
+	if err != nil {
+		return err
+	}
+	expected, err := columnShape(c.types, c.mapType)
+	if err != nil {
+		return err
+	}
+
+	if shape != expected {
+		return fmt.Errorf("%w: query %d produces columns (%s), but query 1 produces (%s)", ErrSchemaMismatch, c.current+1, shape, expected)
+	}
+	return nil
+}
+
+// columnShape describes the names and Postgres types of columns
+func columnShape(types []*sql.ColumnType, mapType TypeMapper) (string, error) {
+	columns := make([]string, len(types))
+	for i, t := range types {
+		pgType, err := mapType(t)
+		if err != nil {
+			return "", err
+		}
+		columns[i] = fmt.Sprintf("%s %s", t.Name(), pgType)
+	}
+	return strings.Join(columns, ", "), nil
+}
@@ -0,0 +1,290 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncQueries(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	repos := []string{"askgit", "mergestat", "go-git"}
+	var queries []string
+	var expected [][]driver.Value
+	for i, repo := range repos {
+		queries = append(queries, "SELECT hash, additions FROM commits('"+repo+"')")
+		source.ExpectQuery(repo).WillReturnRows(sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("hash").OfType("TEXT", ""),
+			sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+		).AddRow(repo, int64(i)))
+		expected = append(expected, []driver.Value{repo, int64(i)})
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, expected...)
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    askgit,
+		TableName: "commits",
+		Queries:   queries,
+		Logger:    zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rows != 3 {
+		t.Fatalf("expected 3 rows, got %d", result.Rows)
+	}
+
+	for _, m := range []sqlmock.Sqlmock{mock, source} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncQueriesShapeMismatch(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	source.ExpectQuery("commits").WillReturnRows(commitRows())
+	source.ExpectQuery("commits").WillReturnRows(sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("deletions").OfType("INTEGER", int64(0)),
+	).AddRow("ghi", int64(3)))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	prep := mock.ExpectPrepare("COPY")
+	prep.ExpectExec().WithArgs("abc", int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs("def", int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    askgit,
+		TableName: "commits",
+		Queries:   []string{"SELECT hash, additions FROM commits", "SELECT hash, deletions FROM commits"},
+		Logger:    zap.NewNop(),
+	})
+	if !errors.Is(err, ErrSchemaMismatch) || !strings.Contains(err.Error(), "query 2 produces columns (hash text, deletions integer)") {
+		t.Fatalf("expected an error describing the mismatched query, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncQueriesStartError(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	// the second query fails to start once the first's rows have been copied
+	busy := errors.New("database is locked")
+	source.ExpectQuery("FROM one").WillReturnRows(commitRows())
+	source.ExpectQuery("FROM two").WillReturnError(busy)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	prep := mock.ExpectPrepare("COPY")
+	prep.ExpectExec().WithArgs("abc", int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs("def", int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    askgit,
+		TableName: "commits",
+		Queries:   []string{"SELECT hash, additions FROM one", "SELECT hash, additions FROM two"},
+		Logger:    zap.NewNop(),
+	})
+	if !errors.Is(err, busy) {
+		t.Fatalf("expected the second query's error, got: %v", err)
+	}
+
+	for _, m := range []sqlmock.Sqlmock{mock, source} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncPreamble(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	preamble := `
+		CREATE TEMP VIEW recent AS SELECT hash, additions FROM commits WHERE author_when > date('now', '-7 days');
+		CREATE TEMP TABLE excluded (hash TEXT);`
+
+	source.ExpectExec(regexp.QuoteMeta(preamble)).WillReturnResult(sqlmock.NewResult(0, 0))
+	source.ExpectQuery("FROM recent").WillReturnRows(commitRows())
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	options := &SyncOptions{
+		Postgres:  pg,
+		AskGit:    askgit,
+		TableName: "commits",
+		Preamble:  preamble,
+		Query:     "SELECT hash, additions FROM recent WHERE hash NOT IN (SELECT hash FROM excluded)",
+		Logger:    zap.NewNop(),
+	}
+	if _, err := Sync(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failing preamble stops the sync before anything is written
+	source.ExpectExec(".").WillReturnError(errors.New("no such table: commits"))
+	if _, err := Sync(context.Background(), options); err == nil || !strings.Contains(err.Error(), "preamble") {
+		t.Fatalf("expected the preamble's error, got: %v", err)
+	}
+
+	for _, m := range []sqlmock.Sqlmock{mock, source} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncAttachDatabases(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	query := "SELECT c.hash, c.additions FROM commits c JOIN mirror.commits m ON m.hash = c.hash"
+
+	source.ExpectExec(regexp.QuoteMeta(`ATTACH DATABASE ? AS "archive"`)).WithArgs("/var/lib/askgit/archive.db").WillReturnResult(sqlmock.NewResult(0, 0))
+	source.ExpectExec(regexp.QuoteMeta(`ATTACH DATABASE ? AS "mirror"`)).WithArgs("/var/lib/askgit/mirror.db").WillReturnResult(sqlmock.NewResult(0, 0))
+	source.ExpectQuery(regexp.QuoteMeta(query)).WillReturnRows(commitRows())
+	source.ExpectExec(regexp.QuoteMeta(`DETACH DATABASE "archive"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	source.ExpectExec(regexp.QuoteMeta(`DETACH DATABASE "mirror"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    askgit,
+		TableName: "commits",
+		Query:     query,
+		Logger:    zap.NewNop(),
+		AttachDatabases: map[string]string{
+			"mirror":  "/var/lib/askgit/mirror.db",
+			"archive": "/var/lib/askgit/archive.db",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []sqlmock.Sqlmock{mock, source} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncReadOnlySource(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	// SQLite refuses to run the INSERT smuggled in with the query once the connection is query_only
+	source.ExpectExec(regexp.QuoteMeta("PRAGMA query_only = ON")).WillReturnResult(sqlmock.NewResult(0, 0))
+	source.ExpectQuery("INSERT INTO").WillReturnError(errors.New("attempt to write a readonly database"))
+	source.ExpectExec(regexp.QuoteMeta("PRAGMA query_only = OFF")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:       pg,
+		AskGit:         askgit,
+		TableName:      "commits",
+		Query:          "INSERT INTO commits (hash) VALUES ('abc') RETURNING hash",
+		Logger:         zap.NewNop(),
+		ReadOnlySource: true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "readonly") {
+		t.Fatalf("expected the query to be rejected, got: %v", err)
+	}
+
+	for _, m := range []sqlmock.Sqlmock{mock, source} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncSourceRange(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	// only the second row of the query is loaded
+	source.ExpectQuery(regexp.QuoteMeta("SELECT * FROM (SELECT hash, additions FROM commits\n) LIMIT 1 OFFSET 1")).
+		WillReturnRows(sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("hash").OfType("TEXT", ""),
+			sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+		).AddRow("def", int64(2)))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:     pg,
+		AskGit:       askgit,
+		TableName:    "commits",
+		Query:        "SELECT hash, additions FROM commits;",
+		Logger:       zap.NewNop(),
+		SourceOffset: 1,
+		SourceLimit:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 1 {
+		t.Fatalf("expected 1 row, got: %d", result.Rows)
+	}
+
+	if err := source.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an offset alone takes every row after it
+	if q := rangeQuery("SELECT hash FROM commits -- all of them", 10, 0); q != "SELECT * FROM (SELECT hash FROM commits -- all of them\n) LIMIT -1 OFFSET 10" {
+		t.Fatalf("unexpected query: %s", q)
+	}
+}
@@ -0,0 +1,58 @@
+package pgsync
+
+import (
+	"regexp"
+
+	"github.com/lib/pq"
+)
+
+// QuoteStrategy is how identifiers are quoted in the CREATE TABLE statements pgsync generates
+type QuoteStrategy int
+
+const (
+	// QuoteAlways quotes every identifier (the default)
+	QuoteAlways QuoteStrategy = iota
+	// QuoteWhenNecessary only quotes identifiers that would otherwise be read differently: those that are reserved words,
+	// or that contain upper case or special characters. Either way, the identifiers name the same table and columns
+	QuoteWhenNecessary
+)
+
+// plainIdentifier matches identifiers that Postgres reads unchanged without quotes, unless they're reserved words
+var plainIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+// reservedWords are the Postgres key words that can't be used as the name of a table or column without quoting,
+// the reserved and the type and function name categories of https://www.postgresql.org/docs/current/sql-keywords-appendix.html
+var reservedWords = map[string]bool{
+	"all": true, "analyse": true, "analyze": true, "and": true, "any": true, "array": true, "as": true, "asc": true,
+	"asymmetric": true, "authorization": true, "binary": true, "both": true, "case": true, "cast": true, "check": true,
+	"collate": true, "collation": true, "column": true, "concurrently": true, "constraint": true, "create": true,
+	"cross": true, "current_catalog": true, "current_date": true, "current_role": true, "current_schema": true,
+	"current_time": true, "current_timestamp": true, "current_user": true, "default": true, "deferrable": true,
+	"desc": true, "distinct": true, "do": true, "else": true, "end": true, "except": true, "false": true, "fetch": true,
+	"for": true, "foreign": true, "freeze": true, "from": true, "full": true, "grant": true, "group": true,
+	"having": true, "ilike": true, "in": true, "initially": true, "inner": true, "intersect": true, "into": true,
+	"is": true, "isnull": true, "join": true, "lateral": true, "leading": true, "left": true, "like": true,
+	"limit": true, "localtime": true, "localtimestamp": true, "natural": true, "not": true, "notnull": true,
+	"null": true, "offset": true, "on": true, "only": true, "or": true, "order": true, "outer": true,
+	"overlaps": true, "placing": true, "primary": true, "references": true, "returning": true, "right": true,
+	"select": true, "session_user": true, "similar": true, "some": true, "symmetric": true, "table": true,
+	"tablesample": true, "then": true, "to": true, "trailing": true, "true": true, "union": true, "unique": true,
+	"user": true, "using": true, "variadic": true, "verbose": true, "when": true, "where": true, "window": true,
+	"with": true,
+}
+
+// quote returns name quoted (or not) as an identifier according to s
+func (s QuoteStrategy) quote(name string) string {
+	if s == QuoteWhenNecessary && plainIdentifier.MatchString(name) && !reservedWords[name] {
+		return name
+	}
+	return pq.QuoteIdentifier(name)
+}
+
+// qualify returns name, qualified with schema if one is given, quoted (or not) according to s
+func (s QuoteStrategy) qualify(schema, name string) string {
+	if schema == "" {
+		return s.quote(name)
+	}
+	return s.quote(schema) + "." + s.quote(name)
+}
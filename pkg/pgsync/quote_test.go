@@ -0,0 +1,41 @@
+package pgsync
+
+import (
+	"testing"
+)
+
+func TestQuoteStrategy(t *testing.T) {
+	cases := []struct {
+		name     string
+		always   string
+		whenNeed string
+	}{
+		{"author_name", `"author_name"`, `author_name`},
+		{"select", `"select"`, `"select"`},
+		{"user", `"user"`, `"user"`},
+		{"AuthorName", `"AuthorName"`, `"AuthorName"`},
+		{"author name", `"author name"`, `"author name"`},
+		{"2fa", `"2fa"`, `"2fa"`},
+	}
+
+	for _, c := range cases {
+		if got := QuoteAlways.quote(c.name); got != c.always {
+			t.Fatalf("%s: expected %s always quoted, got %s", c.name, c.always, got)
+		}
+		if got := QuoteWhenNecessary.quote(c.name); got != c.whenNeed {
+			t.Fatalf("%s: expected %s when necessary, got %s", c.name, c.whenNeed, got)
+		}
+	}
+}
+
+func TestCreateTableQuoteWhenNecessary(t *testing.T) {
+	sql, err := createTable("", "commits", false, []columnDef{{Name: "author_name", Type: "text"}, {Name: "select", Type: "integer"}}, nil, QuoteWhenNecessary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "CREATE TABLE commits (\n\t\t\tauthor_name text,\n\t\t\t\"select\" integer\n\t  )"
+	if sql != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, sql)
+	}
+}
@@ -0,0 +1,267 @@
+//go:build redshift
+// +build redshift
+
+package pgsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// Uploader stores objects in S3, for instance by wrapping the AWS SDK's s3manager.Uploader
+type Uploader interface {
+	// Upload stores body in bucket under key
+	Upload(ctx context.Context, bucket, key string, body io.Reader) error
+}
+
+// RedshiftOptions are the options of a sync into Amazon Redshift
+type RedshiftOptions struct {
+	Redshift  *sql.DB
+	AskGit    *sql.DB
+	TableName string
+	Query     string
+	// Args are bound to placeholders (such as ?) in the query
+	Args   []interface{}
+	Logger *zap.Logger
+	// Uploader stages the results in S3, from where Redshift loads them
+	Uploader Uploader
+	// Bucket and Prefix are where in S3 the results are staged
+	Bucket, Prefix string
+	// IAMRole is the ARN of the role Redshift assumes to read the staged results
+	IAMRole string
+	// RowsPerFile is the number of rows in each staged file, so that Redshift can load them in parallel. Defaults to 1,000,000
+	RowsPerFile int
+}
+
+// redshiftNull is written for NULL values in the staged CSV files
+const redshiftNull = `\N`
+
+// SQLiteTypeToRedshiftType maps SQLite column types to Redshift column types
+func SQLiteTypeToRedshiftType(col *sql.ColumnType) string {
+	switch sqliteTypeName(col) {
+	case "INT", "INTEGER":
+		return "BIGINT"
+	case "REAL":
+		return "DOUBLE PRECISION"
+	case "DATETIME":
+		return "TIMESTAMPTZ"
+	case "BOOLEAN":
+		return "BOOLEAN"
+	default:
+		// Redshift has no unbounded text type
+		return "VARCHAR(65535)"
+	}
+}
+
+// redshiftText returns the CSV field for a (non-NULL) value
+func redshiftText(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999Z07:00")
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// redshiftManifest returns the manifest listing the staged files at keys, for a Redshift COPY ... MANIFEST
+func redshiftManifest(bucket string, keys []string) ([]byte, error) {
+	type entry struct {
+		URL       string `json:"url"`
+		Mandatory bool   `json:"mandatory"`
+	}
+
+	manifest := struct {
+		Entries []entry `json:"entries"`
+	}{Entries: make([]entry, len(keys))}
+
+	for i, key := range keys {
+		manifest.Entries[i] = entry{URL: fmt.Sprintf("s3://%s/%s", bucket, key), Mandatory: true}
+	}
+
+	return json.Marshal(manifest)
+}
+
+// stageRedshiftFiles writes rows to S3 as gzipped CSV files of up to rowsPerFile rows each, under prefix,
+// and returns their keys along with the number of rows written
+func stageRedshiftFiles(ctx context.Context, uploader Uploader, bucket, prefix string, rows *sql.Rows, numColumns, rowsPerFile int) ([]string, int64, error) {
+	values := make([]interface{}, numColumns)
+	pointers := make([]interface{}, numColumns)
+	for i := 0; i < len(values); i++ {
+		pointers[i] = &values[i]
+	}
+	record := make([]string, numColumns)
+
+	var keys []string
+	var n int64
+	for more := true; more; {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		w := csv.NewWriter(gz)
+
+		inFile := 0
+		for inFile < rowsPerFile {
+			if more = rows.Next(); !more {
+				break
+			}
+			if err := rows.Scan(pointers...); err != nil {
+				return nil, n, err
+			}
+			for i, value := range values {
+				if value == nil {
+					record[i] = redshiftNull
+				} else {
+					record[i] = redshiftText(value)
+				}
+			}
+			if err := w.Write(record); err != nil {
+				return nil, n, err
+			}
+			inFile++
+			n++
+		}
+		if err := rows.Err(); err != nil {
+			return nil, n, err
+		}
+		if inFile == 0 && len(keys) > 0 {
+			break
+		}
+
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, n, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, n, err
+		}
+
+		key := fmt.Sprintf("%s/part-%05d.csv.gz", prefix, len(keys))
+		if err := uploader.Upload(ctx, bucket, key, &buf); err != nil {
+			return nil, n, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, n, nil
+}
+
+// SyncRedshift imports the results of an askgit query into a Redshift table, by staging them in S3
+// and loading them with a Redshift COPY. Like Sync, it replaces the table with a new one.
+// The staged files are left in S3, under a prefix unique to the sync.
+func SyncRedshift(ctx context.Context, options *RedshiftOptions) (*SyncResult, error) {
+	l := options.Logger.Sugar().With(zap.String("redshiftTable", options.TableName))
+
+	rowsPerFile := options.RowsPerFile
+	if rowsPerFile <= 0 {
+		rowsPerFile = 1000000
+	}
+
+	rows, err := options.AskGit.QueryContext(ctx, options.Query, options.Args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SyncResult{Columns: make([]string, len(colTypes))}
+	defs := make([]columnDef, len(colTypes))
+	for c, col := range colTypes {
+		result.Columns[c] = col.Name()
+		defs[c] = columnDef{Name: col.Name(), Type: SQLiteTypeToRedshiftType(col)}
+	}
+
+	prefix := fmt.Sprintf("%s/%s/%s", options.Prefix, options.TableName, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	keys, n, err := stageRedshiftFiles(ctx, options.Uploader, options.Bucket, prefix, rows, len(colTypes), rowsPerFile)
+	if err != nil {
+		return nil, err
+	}
+	result.Rows = n
+
+	manifest, err := redshiftManifest(options.Bucket, keys)
+	if err != nil {
+		return nil, err
+	}
+	manifestKey := prefix + "/manifest.json"
+	if err := options.Uploader.Upload(ctx, options.Bucket, manifestKey, bytes.NewReader(manifest)); err != nil {
+		return nil, err
+	}
+	l.Infof("staged %d rows in %d files under s3://%s/%s", n, len(keys), options.Bucket, prefix)
+
+	tempName := fmt.Sprintf("%s_temp", options.TableName)
+	dropName := fmt.Sprintf("%s_drop", options.TableName)
+
+	createSQL, err := createTable("", tempName, false, defs, nil, QuoteAlways)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := options.Redshift.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // a no-op once committed
+
+	statements := []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %s", pq.QuoteIdentifier(tempName)),
+		createSQL,
+		fmt.Sprintf("COPY %s FROM %s IAM_ROLE %s CSV GZIP MANIFEST NULL AS %s TIMEFORMAT 'auto'",
+			pq.QuoteIdentifier(tempName), pq.QuoteLiteral(fmt.Sprintf("s3://%s/%s", options.Bucket, manifestKey)),
+			pq.QuoteLiteral(options.IAMRole), pq.QuoteLiteral(redshiftNull)),
+	}
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	// Redshift's ALTER TABLE has no IF EXISTS, so the old table is only renamed out of the way if there is one
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT count(*) > 0 FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1", options.TableName).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+
+	statements = nil
+	if exists {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s RENAME TO %s", pq.QuoteIdentifier(options.TableName), pq.QuoteIdentifier(dropName)))
+	}
+	statements = append(statements, fmt.Sprintf("ALTER TABLE %s RENAME TO %s", pq.QuoteIdentifier(tempName), pq.QuoteIdentifier(options.TableName)))
+	if exists {
+		statements = append(statements, fmt.Sprintf("DROP TABLE %s", pq.QuoteIdentifier(dropName)))
+	}
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
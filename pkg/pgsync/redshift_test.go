@@ -0,0 +1,151 @@
+//go:build redshift
+// +build redshift
+
+package pgsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+// memoryUploader is an Uploader that keeps uploaded objects in memory
+type memoryUploader struct {
+	objects map[string][]byte
+	keys    []string
+}
+
+func (u *memoryUploader) Upload(_ context.Context, bucket, key string, body io.Reader) error {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if u.objects == nil {
+		u.objects = make(map[string][]byte)
+	}
+	u.objects[bucket+"/"+key] = b
+	u.keys = append(u.keys, key)
+	return nil
+}
+
+func TestSQLiteTypeToRedshiftType(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	mock.ExpectQuery(".").WillReturnRows(sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("a").OfType("TEXT", ""),
+		sqlmock.NewColumn("b").OfType("INTEGER", int64(0)),
+		sqlmock.NewColumn("c").OfType("REAL", float64(0)),
+		sqlmock.NewColumn("d").OfType("DATETIME", ""),
+		sqlmock.NewColumn("e").OfType("BOOLEAN", false),
+		sqlmock.NewColumn("f").OfType("", ""),
+	))
+
+	rows, err := db.Query("SELECT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"VARCHAR(65535)", "BIGINT", "DOUBLE PRECISION", "TIMESTAMPTZ", "BOOLEAN", "VARCHAR(65535)"}
+	for i, col := range colTypes {
+		if got := SQLiteTypeToRedshiftType(col); got != expected[i] {
+			t.Fatalf("%s: expected %s, got %s", col.Name(), expected[i], got)
+		}
+	}
+}
+
+func TestRedshiftManifest(t *testing.T) {
+	manifest, err := redshiftManifest("lake", []string{"askgit/part-00000.csv.gz", "askgit/part-00001.csv.gz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"entries":[{"url":"s3://lake/askgit/part-00000.csv.gz","mandatory":true},{"url":"s3://lake/askgit/part-00001.csv.gz","mandatory":true}]}`
+	if string(manifest) != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, manifest)
+	}
+}
+
+func TestSyncRedshift(t *testing.T) {
+	rs, mock, _ := sqlmock.New()
+	uploader := &memoryUploader{}
+
+	source := commitRows().AddRow("ghi", nil)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE IF EXISTS "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"hash" VARCHAR\(65535\),\s*"additions" BIGINT`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`COPY "commits_temp" FROM 's3://lake/askgit/commits/.*/manifest.json' IAM_ROLE 'arn:aws:iam::123456789012:role/loader' CSV GZIP MANIFEST`).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectQuery("information_schema.tables").WithArgs("commits").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits" RENAME TO "commits_drop"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits_temp" RENAME TO "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_drop"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	result, err := SyncRedshift(context.Background(), &RedshiftOptions{
+		Redshift:    rs,
+		AskGit:      newSource(t, source),
+		TableName:   "commits",
+		Query:       "SELECT hash, additions FROM commits",
+		Logger:      zap.NewNop(),
+		Uploader:    uploader,
+		Bucket:      "lake",
+		Prefix:      "askgit",
+		IAMRole:     "arn:aws:iam::123456789012:role/loader",
+		RowsPerFile: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rows != 3 {
+		t.Fatalf("expected 3 rows, got %d", result.Rows)
+	}
+
+	// two files of (up to) two rows, then the manifest listing them
+	if len(uploader.keys) != 3 || !strings.HasSuffix(uploader.keys[2], "/manifest.json") {
+		t.Fatalf("unexpected uploads: %v", uploader.keys)
+	}
+
+	var manifest struct {
+		Entries []struct{ URL string }
+	}
+	if err := json.Unmarshal(uploader.objects["lake/"+uploader.keys[2]], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Entries) != 2 {
+		t.Fatalf("expected the manifest to list 2 files, got: %+v", manifest)
+	}
+
+	var csv []string
+	for _, key := range uploader.keys[:2] {
+		gz, err := gzip.NewReader(bytes.NewReader(uploader.objects["lake/"+key]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csv = append(csv, string(b))
+	}
+	if expected := []string{"abc,1\ndef,2\n", "ghi,\\N\n"}; csv[0] != expected[0] || csv[1] != expected[1] {
+		t.Fatalf("expected files %q, got %q", expected, csv)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
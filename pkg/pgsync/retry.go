@@ -0,0 +1,138 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// SourceRetry is how the askgit query is retried when it fails to start (see SyncOptions.SourceRetry).
+// Only running the query is retried, before anything is done in Postgres; an error while reading its results isn't
+type SourceRetry struct {
+	// Attempts is the most times the query is run. Defaults to 3
+	Attempts int
+	// Backoff is how long to wait before the first retry, doubling for each one after it. Defaults to 100ms
+	Backoff time.Duration
+	// Retryable returns whether an error of the query is worth retrying. Defaults to retrying SQLite's
+	// "database is locked" and "database table is locked" errors (SQLITE_BUSY and SQLITE_LOCKED)
+	Retryable func(err error) bool
+}
+
+// retryableSourceError is the default SourceRetry.Retryable
+func retryableSourceError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
+}
+
+// querySource runs query against askgit, retrying as retry says if it's set
+func querySource(ctx context.Context, askgit queryer, l *zap.SugaredLogger, retry *SourceRetry, query string, args []interface{}) (*sql.Rows, error) {
+	if retry == nil {
+		return askgit.QueryContext(ctx, query, args...)
+	}
+
+	attempts, backoff, retryable := retry.Attempts, retry.Backoff, retry.Retryable
+	if attempts <= 0 {
+		attempts = 3
+	}
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	if retryable == nil {
+		retryable = retryableSourceError
+	}
+
+	for attempt := 1; ; attempt++ {
+		rows, err := askgit.QueryContext(ctx, query, args...)
+		if err == nil || attempt == attempts || !retryable(err) {
+			return rows, err
+		}
+
+		l.Infof("askgit query failed (attempt %d of %d), retrying in %s: %v", attempt, attempts, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// RetryPolicy is how a replace is run again when Postgres aborts it with a serialization failure (see SyncOptions.Retry).
+// Every attempt re-runs the query and loads a new staging table in a fresh transaction. The staging table of a failed
+// attempt is created in its transaction, so it's gone once that's rolled back (and one loaded with CopyParallelism is
+// dropped before it's loaded again)
+type RetryPolicy struct {
+	// MaxAttempts is the most times the sync is run. Defaults to 3
+	MaxAttempts int
+	// BaseDelay is how long to wait before the first retry, doubling for each one after it. Defaults to 100ms
+	BaseDelay time.Duration
+	// MaxDelay, if set, is the longest wait before a retry, however many there have been
+	MaxDelay time.Duration
+	// Jitter waits a random time from none to the delay instead, so that syncs that failed together
+	// (against the same database) don't all retry together
+	Jitter bool
+	// Rand, if set, is where the jitter comes from, rather than the math/rand default source
+	Rand *rand.Rand
+}
+
+// delay returns how long to wait before the nth retry
+func (p *RetryPolicy) delay(n int) time.Duration {
+	d := p.BaseDelay
+	if d <= 0 {
+		d = 100 * time.Millisecond
+	}
+	for i := 1; i < n && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	if !p.Jitter {
+		return d
+	}
+	if p.Rand != nil {
+		return time.Duration(p.Rand.Int63n(int64(d) + 1))
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// serializationFailure returns whether err is Postgres aborting a transaction that couldn't be serialized (40001)
+func serializationFailure(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "40001"
+}
+
+// retrySync runs the sync in options as options.Retry says, reading a QueryReader only once for every attempt
+func retrySync(ctx context.Context, options *SyncOptions) (*SyncResult, error) {
+	attempts := options.Retry.MaxAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+
+	once := *options
+	once.Retry, once.OnComplete = nil, nil
+	syncer := NewSyncer(&once)
+
+	l := options.Logger.Sugar().With(zap.String("pgTable", options.TableName))
+	for attempt := 1; ; attempt++ {
+		result, err := syncer.Run(ctx)
+		if err == nil || attempt == attempts || !serializationFailure(err) {
+			return result, err
+		}
+
+		delay := options.Retry.delay(attempt)
+		l.Warnf("sync transaction aborted by a serialization failure (attempt %d of %d), retrying in %s: %v", attempt, attempts, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
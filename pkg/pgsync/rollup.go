@@ -0,0 +1,22 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// rebuildRollup replaces the rollup table of options with the results of options.RollupQuery, in tx, so that it's
+// consistent with the table it's derived from. It returns the number of rows in the rollup
+func rebuildRollup(ctx context.Context, tx *sql.Tx, options *SyncOptions) (int64, error) {
+	rollup := QuoteAlways.qualify(options.Schema, options.RollupTable)
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", rollup)); err != nil {
+		return 0, fmt.Errorf("could not drop rollup table %s: %w", rollup, err)
+	}
+
+	res, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s AS %s", rollup, options.RollupQuery))
+	if err != nil {
+		return 0, fmt.Errorf("could not create rollup table %s: %w", rollup, err)
+	}
+	return res.RowsAffected()
+}
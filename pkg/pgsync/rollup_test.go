@@ -0,0 +1,56 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncRollup(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the rollup is rebuilt from the swapped in table before the sync commits, so both change together
+	const rollupQuery = "SELECT count(*) AS commits, sum(additions) AS additions FROM git.commits"
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SET LOCAL search_path").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"git"."commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE IF EXISTS "git"."commit_totals"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "git"."commit_totals" AS ` + rollupQuery)).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	options := &SyncOptions{
+		Postgres:    pg,
+		AskGit:      newSource(t, commitRows()),
+		TableName:   "commits",
+		Schema:      "git",
+		Query:       "SELECT hash, additions FROM commits",
+		Logger:      zap.NewNop(),
+		RollupTable: "commit_totals",
+		RollupQuery: rollupQuery,
+	}
+	result, err := Sync(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 2 || result.RollupRows != 1 {
+		t.Fatalf("expected 2 rows rolled up into 1, got %d and %d", result.Rows, result.RollupRows)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	options.RollupQuery = ""
+	if _, err := Sync(context.Background(), options); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected ErrInvalidOptions for a rollup table without a query, got: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// routeTable returns the table rows with value in the route column go to (see ModeRoute), from routes or else route,
+// or an error if neither has one
+func routeTable(column, value string, routes map[string]string, route func(value string) string) (string, error) {
+	table := routes[value]
+	if table == "" && route != nil {
+		table = route(value)
+	}
+	if table == "" {
+		return "", fmt.Errorf("there's no table to route rows to with %s %q", pq.QuoteIdentifier(column), value)
+	}
+	return table, nil
+}
+
+// routeValues returns the values of column in the rows of staging, as text, in order
+func routeValues(ctx context.Context, tx *sql.Tx, staging, column string) ([]string, error) {
+	col := pq.QuoteIdentifier(column)
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT DISTINCT %s::text FROM %s ORDER BY 1", col, pq.QuoteIdentifier(staging)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value sql.NullString
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		if !value.Valid {
+			return nil, fmt.Errorf("route column %s is NULL in some rows, which go to no table", col)
+		}
+		values = append(values, value.String)
+	}
+	return values, rows.Err()
+}
+
+// routeRows replaces each of the tables the rows of staging are routed to, by their value in the route column,
+// with a table of those rows and the other columns of staging, and drops staging. It returns the number of rows
+// that went to each table
+func routeRows(ctx context.Context, tx *sql.Tx, staging string, columns []string, column string, routes map[string]string, route func(value string) string) (map[string]int64, error) {
+	values, err := routeValues(ctx, tx, staging, column)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []string
+	for _, col := range columns {
+		if col != column {
+			kept = append(kept, col)
+		}
+	}
+
+	s, cols := pq.QuoteIdentifier(staging), quoteAll("", kept)
+	routed := make(map[string]int64)
+	for _, value := range values {
+		table, err := routeTable(column, value, routes, route)
+		if err != nil {
+			return nil, err
+		}
+		t := pq.QuoteIdentifier(table)
+
+		// several values can go to the same table, which is only replaced the first time
+		if _, ok := routed[table]; !ok {
+			statements := []string{
+				fmt.Sprintf("DROP TABLE IF EXISTS %s", t),
+				fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS)", t, s),
+				fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", t, pq.QuoteIdentifier(column)),
+			}
+			for _, stmt := range statements {
+				if _, err := tx.ExecContext(ctx, stmt); err != nil {
+					return nil, fmt.Errorf("could not replace routed table %s: %w", t, err)
+				}
+			}
+		}
+
+		res, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s WHERE %s::text = $1",
+			t, cols, cols, s, pq.QuoteIdentifier(column)), value)
+		if err != nil {
+			return nil, fmt.Errorf("could not route rows to %s: %w", t, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		routed[table] += n
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", s))
+	return routed, err
+}
@@ -0,0 +1,84 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncRoute(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("repo").OfType("TEXT", ""),
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+	).
+		AddRow("askgit", "abc").
+		AddRow("mergestat", "def").
+		AddRow("askgit", "ghi")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"askgit", "abc"}, []driver.Value{"mergestat", "def"}, []driver.Value{"askgit", "ghi"})
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT DISTINCT "repo"::text FROM "commits_temp" ORDER BY 1`)).
+		WillReturnRows(sqlmock.NewRows([]string{"repo"}).AddRow("askgit").AddRow("mergestat"))
+	for _, route := range []struct {
+		table, value string
+		rows         int64
+	}{{"askgit_commits", "askgit", 2}, {"mergestat_commits", "mergestat", 1}} {
+		mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE IF EXISTS "` + route.table + `"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "` + route.table + `" (LIKE "commits_temp" INCLUDING DEFAULTS)`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "` + route.table + `" DROP COLUMN "repo"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "` + route.table + `" ("hash") SELECT "hash" FROM "commits_temp" WHERE "repo"::text = $1`)).
+			WithArgs(route.value).
+			WillReturnResult(sqlmock.NewResult(0, route.rows))
+	}
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:    pg,
+		AskGit:      newSource(t, source),
+		TableName:   "commits",
+		Query:       "SELECT repo, hash FROM commits",
+		Logger:      zap.NewNop(),
+		Mode:        ModeRoute,
+		RouteColumn: "repo",
+		Routes:      map[string]string{"askgit": "askgit_commits"},
+		RouteFunc:   func(value string) string { return value + "_commits" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Routed["askgit_commits"] != 2 || result.Routed["mergestat_commits"] != 1 {
+		t.Fatalf("unexpected routed rows: %v", result.Routed)
+	}
+	var routed int64
+	for _, n := range result.Routed {
+		routed += n
+	}
+	if routed != result.Rows {
+		t.Fatalf("expected the %d rows loaded to all be routed, %d were", result.Rows, routed)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRouteTable(t *testing.T) {
+	routes := map[string]string{"askgit": "askgit_commits"}
+	if table, err := routeTable("repo", "askgit", routes, nil); err != nil || table != "askgit_commits" {
+		t.Fatalf("expected askgit_commits, got: %q, %v", table, err)
+	}
+	if _, err := routeTable("repo", "mergestat", routes, func(string) string { return "" }); err == nil {
+		t.Fatal("expected a value with no table to be an error")
+	}
+}
@@ -0,0 +1,127 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// oversizedRow is a row skipped by a rowSizeGuard
+type oversizedRow struct {
+	row  int64
+	size int
+}
+
+// rowSizeGuard is a rowSource that fails on (or, if skip, leaves out) rows of the rowSource it reads from that are
+// larger than max bytes (see SyncOptions.MaxRowBytes), measured by the text form of their values as contentHash writes them
+type rowSizeGuard struct {
+	rowSource
+	max  int
+	skip bool
+
+	values   []interface{}
+	pointers []interface{}
+	read     int64
+	scanErr  error
+	err      error
+	skipped  []oversizedRow
+}
+
+func newRowSizeGuard(rows rowSource, numColumns, max int, skip bool) *rowSizeGuard {
+	g := &rowSizeGuard{rowSource: rows, max: max, skip: skip, values: make([]interface{}, numColumns), pointers: make([]interface{}, numColumns)}
+	for i := range g.values {
+		g.pointers[i] = &g.values[i]
+	}
+	return g
+}
+
+func (g *rowSizeGuard) Next() bool {
+	for g.rowSource.Next() {
+		g.read++
+		if g.scanErr = g.rowSource.Scan(g.pointers...); g.scanErr != nil {
+			return true
+		}
+
+		size := rowBytes(g.values)
+		if size <= g.max {
+			return true
+		}
+		if !g.skip {
+			g.err = fmt.Errorf("row %d of %d bytes is larger than the maximum of %d", g.read, size, g.max)
+			return false
+		}
+		g.skipped = append(g.skipped, oversizedRow{row: g.read, size: size})
+	}
+	return false
+}
+
+func (g *rowSizeGuard) Scan(dest ...interface{}) error {
+	if g.scanErr != nil {
+		return g.scanErr
+	}
+	if len(dest) != len(g.values) {
+		return fmt.Errorf("expected %d destination arguments in Scan, not %d", len(g.values), len(dest))
+	}
+	for i, d := range dest {
+		p, ok := d.(*interface{})
+		if !ok {
+			return fmt.Errorf("cannot scan a guarded value into %T", d)
+		}
+		*p = g.values[i]
+	}
+	return nil
+}
+
+func (g *rowSizeGuard) Err() error {
+	if g.err != nil {
+		return g.err
+	}
+	return g.rowSource.Err()
+}
+
+// rowBytes returns the size of a row's values, as measured by a rowSizeGuard
+func rowBytes(values []interface{}) int {
+	var size int
+	for _, value := range values {
+		switch v := value.(type) {
+		case nil:
+		case string:
+			size += len(v)
+		case []byte:
+			size += len(v)
+		default:
+			size += len(hashText(v))
+		}
+	}
+	return size
+}
+
+// byteCounter adds up the size of the rows copied (see SyncResult.BytesCopied)
+type byteCounter struct {
+	n int64
+}
+
+// add is a rowTransform that adds a row's size to the count, leaving its values as they are
+func (c *byteCounter) add(values []interface{}) ([]interface{}, error) {
+	c.n += int64(rowBytes(values))
+	return values, nil
+}
+
+// deadLetterOversizedRows records the rows skipped by a rowSizeGuard in the deadLetters table, against target.
+// Their values, which are what made them too large, aren't recorded
+func deadLetterOversizedRows(ctx context.Context, tx *sql.Tx, skipped []oversizedRow, max int, deadLetters, target string) error {
+	if err := createDeadLetterTable(ctx, tx, deadLetters); err != nil {
+		return err
+	}
+
+	insert := fmt.Sprintf("INSERT INTO %s (table_name, row_number, error) VALUES ($1, $2, $3)", pq.QuoteIdentifier(deadLetters))
+	for _, r := range skipped {
+		msg := fmt.Sprintf("row of %d bytes is larger than the maximum of %d", r.size, max)
+		if _, err := tx.ExecContext(ctx, insert, target, r.row, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
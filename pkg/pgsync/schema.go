@@ -0,0 +1,173 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ColumnMismatch is a difference between a column of the query's results and the same column of an existing table
+type ColumnMismatch struct {
+	// Column is the name of the column
+	Column string
+	// Expected is the type pgsync would give the column, or empty if the query doesn't produce the column
+	// (see SyncOptions.StrictColumns)
+	Expected string
+	// Actual is the type of the column in the table, or empty if the table doesn't have the column
+	Actual string
+}
+
+// queryer is what tableColumns needs of a *sql.DB or *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// tableColumns returns the types of the columns of table (in schema, if set) by name, or nil if there's no such table
+func tableColumns(ctx context.Context, q queryer, schema, table string) (map[string]string, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod)
+		FROM pg_attribute a
+		WHERE a.attrelid = to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped
+	`, QuoteAlways.qualify(schema, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns map[string]string
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		if columns == nil {
+			columns = make(map[string]string)
+		}
+		columns[name] = typ
+	}
+
+	return columns, rows.Err()
+}
+
+// checkSchema compares the columns the results of the query will be loaded as with those of the existing table,
+// returning a *SchemaMismatchError listing every column that's missing from the table or has a different type.
+// Columns only the table has are fine, as is a table that doesn't exist yet
+func checkSchema(ctx context.Context, tx *sql.Tx, schema, table string, defs []columnDef) error {
+	columns, err := tableColumns(ctx, tx, schema, table)
+	if err != nil || columns == nil {
+		return err
+	}
+	return compareColumns(table, defs, columns)
+}
+
+// checkStrictColumns returns a *SchemaMismatchError listing every column of the existing table, in schema if set,
+// that has no default (an identity or generated column has one) and isn't one of the columns of defs, as loading
+// the results would leave it NULL (see SyncOptions.StrictColumns)
+func checkStrictColumns(ctx context.Context, tx *sql.Tx, schema, table string, defs []columnDef) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod)
+		FROM pg_attribute a
+		WHERE a.attrelid = to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped
+			AND NOT a.atthasdef AND a.attidentity = '' AND a.attgenerated = ''
+		ORDER BY a.attnum
+	`, QuoteAlways.qualify(schema, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var mismatches []ColumnMismatch
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return err
+		}
+		if !hasColumn(defs, name) {
+			mismatches = append(mismatches, ColumnMismatch{Column: name, Actual: typ})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(mismatches) > 0 {
+		return &SchemaMismatchError{Table: table, Columns: mismatches}
+	}
+	return nil
+}
+
+// checkGeneratedColumns returns a *SchemaMismatchError if one of the columns of defs is an identity column of the
+// existing table, in schema if set, that's GENERATED ALWAYS, or a generated column. Postgres fills those in itself, but
+// a COPY with an identity column in its column list writes the values it's given, and one with a generated column fails.
+// Columns the query doesn't produce are left out of the load, and filled in by Postgres as usual
+func checkGeneratedColumns(ctx context.Context, tx *sql.Tx, schema, table string, defs []columnDef) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT a.attname, a.attgenerated <> ''
+		FROM pg_attribute a
+		WHERE a.attrelid = to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped
+			AND (a.attidentity = 'a' OR a.attgenerated <> '')
+		ORDER BY a.attnum
+	`, QuoteAlways.qualify(schema, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var generated bool
+		if err := rows.Scan(&name, &generated); err != nil {
+			return err
+		}
+		if !hasColumn(defs, name) {
+			continue
+		}
+
+		kind := "an identity column GENERATED ALWAYS"
+		if generated {
+			kind = "a generated column"
+		}
+		return &SchemaMismatchError{Table: table, Err: fmt.Errorf("column %s is %s, which Postgres fills in, "+
+			"it must be left out of the query", pq.QuoteIdentifier(name), kind)}
+	}
+	return rows.Err()
+}
+
+// hasColumn reports whether one of defs is named name
+func hasColumn(defs []columnDef, name string) bool {
+	for _, def := range defs {
+		if def.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySchema checks that table, once the sync has committed, has the columns pgsync created it with (see SyncOptions.VerifySchema).
+// Unlike checkSchema, a table that doesn't exist is a mismatch of every column
+func verifySchema(ctx context.Context, db *sql.DB, schema, table string, defs []columnDef) error {
+	columns, err := tableColumns(ctx, db, schema, table)
+	if err != nil {
+		return err
+	}
+	return compareColumns(table, defs, columns)
+}
+
+// compareColumns returns a *SchemaMismatchError listing every column of defs that's missing from columns or has a different type
+func compareColumns(table string, defs []columnDef, columns map[string]string) error {
+	var mismatches []ColumnMismatch
+	for _, def := range defs {
+		actual, ok := columns[def.Name]
+		if !ok || !strings.EqualFold(actual, def.Type) {
+			mismatches = append(mismatches, ColumnMismatch{Column: def.Name, Expected: def.Type, Actual: actual})
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return &SchemaMismatchError{Table: table, Columns: mismatches}
+	}
+	return nil
+}
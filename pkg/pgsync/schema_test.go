@@ -0,0 +1,104 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncSchemaMismatch(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the table has hash as a bigint and no additions column at all
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "bigint", "deletions", "integer")
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		Mode:      ModeReplaceInPlace,
+	})
+
+	var mismatch *SchemaMismatchError
+	if !errors.As(err, &mismatch) || !errors.Is(err, ErrSchemaMismatch) {
+		t.Fatalf("expected a SchemaMismatchError, got: %v", err)
+	}
+
+	expected := []ColumnMismatch{
+		{Column: "hash", Expected: "text", Actual: "bigint"},
+		{Column: "additions", Expected: "integer", Actual: ""},
+	}
+	if len(mismatch.Columns) != len(expected) {
+		t.Fatalf("expected %d mismatched columns, got: %+v", len(expected), mismatch.Columns)
+	}
+	for i, c := range expected {
+		if mismatch.Columns[i] != c {
+			t.Fatalf("expected %+v, got %+v", c, mismatch.Columns[i])
+		}
+	}
+
+	for _, s := range []string{`column "hash" is bigint, expected text`, `column "additions" (integer) is missing`} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("expected error to mention %q, got: %v", s, err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncVerifySchema(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	sync := func(columns ...string) (*SyncResult, error) {
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+		expectSwap(mock)
+		expectProvenance(mock)
+		mock.ExpectCommit()
+		expectTableColumns(mock, columns...)
+
+		return Sync(context.Background(), &SyncOptions{
+			Postgres:     pg,
+			AskGit:       newSource(t, commitRows()),
+			TableName:    "commits",
+			Query:        "SELECT hash, additions FROM commits",
+			Logger:       zap.NewNop(),
+			VerifySchema: true,
+		})
+	}
+
+	if _, err := sync("hash", "text", "additions", "integer"); err != nil {
+		t.Fatal(err)
+	}
+
+	// someone changed the type of additions between the table being created and the check
+	result, err := sync("hash", "text", "additions", "bigint")
+	var mismatch *SchemaMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a SchemaMismatchError, got: %v", err)
+	}
+	if len(mismatch.Columns) != 1 || mismatch.Columns[0] != (ColumnMismatch{Column: "additions", Expected: "integer", Actual: "bigint"}) {
+		t.Fatalf("unexpected mismatched columns: %+v", mismatch.Columns)
+	}
+	if result == nil || result.Rows != 2 {
+		t.Fatalf("expected the result of the committed sync along with the error, got: %+v", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
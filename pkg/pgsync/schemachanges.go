@@ -0,0 +1,123 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// SchemaChange is a difference between the columns of a table and those recorded in the state table at its last sync
+// (see SyncOptions.TrackSchemaChanges)
+type SchemaChange struct {
+	// Column is the name of the column
+	Column string
+	// Previous is the type of the column at the last sync, or empty if it's been added since
+	Previous string
+	// Current is the type of the column now, or empty if it's been removed
+	Current string
+}
+
+// breaking reports whether the change can break readers of the table, which is any change but an added column
+func (c SchemaChange) breaking() bool {
+	return c.Previous != ""
+}
+
+// String describes the change
+func (c SchemaChange) String() string {
+	col := pq.QuoteIdentifier(c.Column)
+	switch {
+	case c.Previous == "":
+		return fmt.Sprintf("column %s was added as %s", col, c.Current)
+	case c.Current == "":
+		return fmt.Sprintf("column %s (%s) was removed", col, c.Previous)
+	default:
+		return fmt.Sprintf("column %s changed from %s to %s", col, c.Previous, c.Current)
+	}
+}
+
+// stateColumn is a column as recorded in the column_types of the state table
+type stateColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// schemaChanges returns the changes from the columns previous to those of defs: added and changed columns in the order
+// of defs, then removed ones in their previous order
+func schemaChanges(previous []stateColumn, defs []columnDef) []SchemaChange {
+	types := make(map[string]string, len(previous))
+	for _, col := range previous {
+		types[col.Name] = col.Type
+	}
+
+	var changes []SchemaChange
+	current := make(map[string]bool, len(defs))
+	for _, def := range defs {
+		current[def.Name] = true
+		if typ := types[def.Name]; typ != def.Type {
+			changes = append(changes, SchemaChange{Column: def.Name, Previous: typ, Current: def.Type})
+		}
+	}
+	for _, col := range previous {
+		if !current[col.Name] {
+			changes = append(changes, SchemaChange{Column: col.Name, Previous: col.Type})
+		}
+	}
+	return changes
+}
+
+// trackSchemaChanges returns the changes to the columns of table since they were last recorded in the state table of
+// options, and records its columns, defs, in their place. The sync's state must already have been recorded. The first
+// sync a table's columns are recorded by has no changes. With options.RejectBreakingSchemaChanges, breaking changes
+// fail with ErrBreakingSchemaChange
+func trackSchemaChanges(ctx context.Context, tx *sql.Tx, options *SyncOptions, table string, defs []columnDef) ([]SchemaChange, error) {
+	state, key := stateTable(options), QuoteAlways.qualify(options.Schema, table)
+	if !options.SkipCreateStateTable {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS column_types jsonb", state)); err != nil {
+			return nil, fmt.Errorf("could not add column_types to state table %s: %w", state, err)
+		}
+	}
+
+	var recorded []byte
+	err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT column_types FROM %s WHERE table_name = $1", state), key).Scan(&recorded)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []SchemaChange
+	if recorded != nil {
+		var previous []stateColumn
+		if err := json.Unmarshal(recorded, &previous); err != nil {
+			return nil, fmt.Errorf("could not read the column types recorded in state table %s: %w", state, err)
+		}
+		changes = schemaChanges(previous, defs)
+	}
+
+	if options.RejectBreakingSchemaChanges {
+		var breaking []string
+		for _, c := range changes {
+			if c.breaking() {
+				breaking = append(breaking, c.String())
+			}
+		}
+		if len(breaking) > 0 {
+			return changes, fmt.Errorf("%w: %s", ErrBreakingSchemaChange, strings.Join(breaking, ", "))
+		}
+	}
+
+	columns := make([]stateColumn, len(defs))
+	for i, def := range defs {
+		columns[i] = stateColumn{Name: def.Name, Type: def.Type}
+	}
+	b, err := json.Marshal(columns)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET column_types = $2 WHERE table_name = $1", state), key, string(b)); err != nil {
+		return nil, fmt.Errorf("could not record the column types in state table %s: %w", state, err)
+	}
+	return changes, nil
+}
@@ -0,0 +1,50 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// settingName matches the names of Postgres run-time parameters, including custom (dotted) ones
+var settingName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*(\.[A-Za-z_][A-Za-z0-9_$]*)*$`)
+
+// applySessionSettings sets each of settings for the remainder of tx, in order of name
+func applySessionSettings(ctx context.Context, tx *sql.Tx, settings map[string]string) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		if !settingName.MatchString(name) {
+			return invalidOptions("invalid session setting name: %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL %s = %s", name, pq.QuoteLiteral(settings[name]))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applySearchPath sets the search_path for the remainder of tx to the schemas of path, in order
+func applySearchPath(ctx context.Context, tx *sql.Tx, path []string) error {
+	if len(path) == 0 {
+		return nil
+	}
+
+	schemas := make([]string, len(path))
+	for i, schema := range path {
+		schemas[i] = pq.QuoteIdentifier(schema)
+	}
+
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL search_path = %s", strings.Join(schemas, ", ")))
+	return err
+}
@@ -0,0 +1,70 @@
+package pgsync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// Promote swaps the shadow table loaded by a sync with SyncOptions.ShadowTable in place of the table, as a sync
+// without a shadow table would have at the end of its load, once the caller has checked the shadow table's contents.
+// It takes the same options as the sync, of which it uses Postgres, TableName, ShadowTable, Schema, CascadeDependents,
+// SerializeSyncs and Logger. A shadow table that doesn't exist (because it was never loaded, or was promoted already)
+// fails with ErrPreconditionFailed
+func Promote(ctx context.Context, options *SyncOptions) error {
+	switch {
+	case options.Postgres == nil:
+		return invalidOptions("a postgres database is required")
+	case options.TableName == "" || options.ShadowTable == "":
+		return invalidOptions("a table name and a shadow table are required to promote")
+	}
+
+	l := options.Logger.Sugar().With(zap.String("pgTable", options.TableName))
+
+	tx, err := options.Postgres.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // a no-op once committed
+
+	if options.Schema != "" {
+		if err := applySearchPath(ctx, tx, []string{options.Schema}); err != nil {
+			return err
+		}
+	}
+
+	if options.SerializeSyncs {
+		if err := lockTable(ctx, tx, options.Schema, options.TableName); err != nil {
+			return err
+		}
+	}
+
+	shadow, err := tableColumns(ctx, tx, options.Schema, options.ShadowTable)
+	if err != nil {
+		return err
+	}
+	if shadow == nil {
+		return fmt.Errorf("%w: shadow table %s does not exist", ErrPreconditionFailed, pq.QuoteIdentifier(options.ShadowTable))
+	}
+
+	// only a foreign table needs the columns, which it's given in the same order on both sides of an INSERT ... SELECT
+	columns := make([]string, 0, len(shadow))
+	for name := range shadow {
+		columns = append(columns, name)
+	}
+	sort.Strings(columns)
+
+	if err := swap(ctx, tx, l, options, options.ShadowTable, fmt.Sprintf("%s_drop", options.TableName), columns); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	l.Infof("promoted shadow table %s", options.ShadowTable)
+	return nil
+}
@@ -0,0 +1,90 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncShadowTable(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the sync loads the shadow table and commits it as it is
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE IF EXISTS "commits_shadow"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_shadow"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_shadow"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits_shadow"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	mock.ExpectExec(regexp.QuoteMeta(`COMMENT ON TABLE "commits_shadow"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	// which the caller validates
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "commits_shadow"`)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	// before promoting it
+	mock.ExpectBegin()
+	expectTableColumns(mock, "hash", "text", "additions", "integer")
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	mock.ExpectQuery("pg_rewrite").WillReturnRows(sqlmock.NewRows([]string{"name", "relkind", "definition"}))
+	mock.ExpectQuery("pg_constraint").WillReturnRows(sqlmock.NewRows([]string{"constraint"}))
+	mock.ExpectExec(`ALTER TABLE IF EXISTS "commits" RENAME TO "commits_drop";\s*ALTER TABLE IF EXISTS "commits_shadow" RENAME TO "commits";\s*DROP TABLE IF EXISTS "commits_drop"`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	options := &SyncOptions{
+		Postgres:    pg,
+		AskGit:      newSource(t, commitRows()),
+		TableName:   "commits",
+		Query:       "SELECT hash, additions FROM commits",
+		Logger:      zap.NewNop(),
+		ShadowTable: "commits_shadow",
+	}
+	result, err := Sync(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int64
+	if err := pg.QueryRow(`SELECT count(*) FROM "commits_shadow"`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != result.Rows {
+		t.Fatalf("expected the shadow table to have the %d rows synced, it has %d", result.Rows, count)
+	}
+
+	if err := Promote(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPromoteMissingShadowTable(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	expectTableColumns(mock)
+	mock.ExpectRollback()
+
+	err := Promote(context.Background(), &SyncOptions{
+		Postgres:    pg,
+		TableName:   "commits",
+		Logger:      zap.NewNop(),
+		ShadowTable: "commits_shadow",
+	})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("expected ErrPreconditionFailed, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,53 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// SpaceCheck is a check, before anything is loaded, that the table's tablespace has room for it (see SyncOptions.SpaceCheck).
+// It's best effort: it can't account for anything else writing to the same disk during the load
+type SpaceCheck struct {
+	// RequiredBytes is how much space the load is expected to take. Defaults to the current size of the table
+	// (with its indexes and TOAST), which the new table shouldn't be far off, so 0 for a table that doesn't exist yet
+	RequiredBytes int64
+	// Available returns the free space, in bytes, of the disk holding tablespace. Postgres doesn't report this itself,
+	// for instance it could be looked up from the monitoring of the database server. Required
+	Available func(ctx context.Context, tablespace string) (int64, error)
+}
+
+// checkSpace returns ErrInsufficientSpace if the tablespace of table doesn't have the space check requires
+func checkSpace(ctx context.Context, tx *sql.Tx, table string, check *SpaceCheck) error {
+	var size int64
+	var tablespace string
+	err := tx.QueryRowContext(ctx, `
+		SELECT
+			coalesce(pg_total_relation_size(to_regclass($1)), 0),
+			coalesce(
+				(SELECT t.spcname FROM pg_class c JOIN pg_tablespace t ON t.oid = c.reltablespace WHERE c.oid = to_regclass($1)),
+				nullif(current_setting('default_tablespace'), ''),
+				'pg_default'
+			)
+	`, pq.QuoteIdentifier(table)).Scan(&size, &tablespace)
+	if err != nil {
+		return err
+	}
+
+	required := check.RequiredBytes
+	if required == 0 {
+		required = size
+	}
+
+	available, err := check.Available(ctx, tablespace)
+	if err != nil {
+		return fmt.Errorf("could not find the free space of tablespace %s: %w", tablespace, err)
+	}
+
+	if available < required {
+		return fmt.Errorf("%w: loading %s needs about %d bytes, tablespace %s has %d free", ErrInsufficientSpace, pq.QuoteIdentifier(table), required, tablespace, available)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncSpaceCheck(t *testing.T) {
+	for _, free := range []int64{1 << 30, 1024} {
+		pg, mock, _ := sqlmock.New()
+
+		// the table takes up 8MB now, which is what the new one is expected to need
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("pg_total_relation_size").WithArgs(`"commits"`).
+			WillReturnRows(sqlmock.NewRows([]string{"size", "spcname"}).AddRow(int64(8<<20), "fast_ssd"))
+		if free > 8<<20 {
+			mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+			expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+			expectSwap(mock)
+			expectProvenance(mock)
+			mock.ExpectCommit()
+		} else {
+			mock.ExpectRollback()
+		}
+
+		var checked string
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:  pg,
+			AskGit:    newSource(t, commitRows()),
+			TableName: "commits",
+			Query:     "SELECT hash, additions FROM commits",
+			Logger:    zap.NewNop(),
+			SpaceCheck: &SpaceCheck{
+				Available: func(_ context.Context, tablespace string) (int64, error) {
+					checked = tablespace
+					return free, nil
+				},
+			},
+		})
+		if free > 8<<20 && err != nil {
+			t.Fatal(err)
+		}
+		if free < 8<<20 && !errors.Is(err, ErrInsufficientSpace) {
+			t.Fatalf("expected ErrInsufficientSpace, got: %v", err)
+		}
+		if checked != "fast_ssd" {
+			t.Fatalf("expected the free space of the table's tablespace to be checked, got: %q", checked)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// SpatialColumn describes a text column of WKT (well-known text) geometries that's loaded as a PostGIS column
+type SpatialColumn struct {
+	// Type is the PostGIS type of the column, geometry or geography
+	Type string
+	// SRID is the spatial reference system the geometries are in. Zero leaves it unspecified
+	SRID int
+}
+
+// postgresType returns the type of the column in Postgres
+func (c SpatialColumn) postgresType() string {
+	if c.SRID == 0 {
+		return c.Type
+	}
+	subtype := "Geometry"
+	if c.Type == "geography" {
+		subtype = "Geography"
+	}
+	return fmt.Sprintf("%s(%s,%d)", c.Type, subtype, c.SRID)
+}
+
+// errNoPostGIS is returned when there are spatial columns to load but PostGIS isn't installed
+var errNoPostGIS = errors.New("spatial columns require the PostGIS extension, which is not installed in the target database")
+
+// checkPostGIS returns errNoPostGIS if the PostGIS extension isn't installed
+func checkPostGIS(ctx context.Context, tx *sql.Tx) error {
+	var installed bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'postgis')").Scan(&installed); err != nil {
+		return err
+	}
+	if !installed {
+		return errNoPostGIS
+	}
+	return nil
+}
+
+// spatialTransform returns a rowTransform that readies the values of the named spatial columns for COPY. PostGIS parses
+// WKT given as the text of a geometry or geography, so the values only need the column's SRID adding, to make them EWKT
+func spatialTransform(colNames []string, spatial map[string]SpatialColumn) (rowTransform, error) {
+	srids := make(map[int]int)
+	for name, column := range spatial {
+		if column.Type != "geometry" && column.Type != "geography" {
+			return nil, invalidOptions("spatial column %s must be a geometry or geography, not %q", name, column.Type)
+		}
+
+		i := columnIndex(colNames, name)
+		if i < 0 {
+			return nil, invalidOptions("spatial column is not in the query results: %s", name)
+		}
+
+		if column.SRID != 0 {
+			srids[i] = column.SRID
+		}
+	}
+
+	return func(values []interface{}) ([]interface{}, error) {
+		for i, srid := range srids {
+			switch v := values[i].(type) {
+			case nil:
+			case string:
+				values[i] = fmt.Sprintf("SRID=%d;%s", srid, v)
+			case []byte:
+				values[i] = fmt.Sprintf("SRID=%d;%s", srid, v)
+			default:
+				return nil, fmt.Errorf("column %s: cannot load %T as a geometry", colNames[i], v)
+			}
+		}
+		return values, nil
+	}, nil
+}
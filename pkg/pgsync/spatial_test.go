@@ -0,0 +1,90 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+// locationRows returns mock source rows with a WKT location column
+func locationRows() *sqlmock.Rows {
+	return sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("name").OfType("TEXT", ""),
+		sqlmock.NewColumn("location").OfType("TEXT", ""),
+	).
+		AddRow("askgit", "POINT(-73.98 40.74)").
+		AddRow("unknown", nil)
+}
+
+func TestSyncSpatialColumns(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("pg_extension").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec(regexp.QuoteMeta(`"location" geometry(Geometry,4326)`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"repos_temp"`, []driver.Value{"askgit", "SRID=4326;POINT(-73.98 40.74)"}, []driver.Value{"unknown", nil})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:       pg,
+		AskGit:         newSource(t, locationRows()),
+		TableName:      "repos",
+		Query:          "SELECT name, location FROM repos",
+		Logger:         zap.NewNop(),
+		SpatialColumns: map[string]SpatialColumn{"location": {Type: "geometry", SRID: 4326}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncSpatialColumnsWithoutPostGIS(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("pg_extension").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:       pg,
+		AskGit:         newSource(t, locationRows()),
+		TableName:      "repos",
+		Query:          "SELECT name, location FROM repos",
+		Logger:         zap.NewNop(),
+		SpatialColumns: map[string]SpatialColumn{"location": {Type: "geography"}},
+	})
+	if !errors.Is(err, errNoPostGIS) {
+		t.Fatalf("expected an error about PostGIS, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpatialColumnPostgresType(t *testing.T) {
+	cases := map[SpatialColumn]string{
+		{Type: "geometry"}:              "geometry",
+		{Type: "geometry", SRID: 3857}:  "geometry(Geometry,3857)",
+		{Type: "geography", SRID: 4326}: "geography(Geography,4326)",
+	}
+
+	for column, expected := range cases {
+		if got := column.postgresType(); got != expected {
+			t.Fatalf("%+v: expected %s, got %s", column, expected, got)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// SQLiteMode is what SyncToSQLite does when the target table already exists
+type SQLiteMode int
+
+const (
+	// SQLiteReplace drops the table and creates it again (the default)
+	SQLiteReplace SQLiteMode = iota
+	// SQLiteAppend inserts the results into the table as it is
+	SQLiteAppend
+	// SQLiteFail fails without writing anything
+	SQLiteFail
+)
+
+// SyncToSQLite writes the results of an askgit query into tableName in the SQLite database file at targetPath,
+// creating the file if it doesn't exist, so that they can be shipped around as a standalone snapshot.
+// The table is created with the declared types of the query's columns, so that its columns have the same affinities.
+// Everything is written in a single transaction
+func SyncToSQLite(ctx context.Context, askgit *sql.DB, targetPath, query, tableName string, mode SQLiteMode) (*SyncResult, error) {
+	target, err := sql.Open("sqlite3", targetPath)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+
+	return syncToSQLite(ctx, askgit, target, query, tableName, mode)
+}
+
+// syncToSQLite does the work of SyncToSQLite, into the target database
+func syncToSQLite(ctx context.Context, askgit, target *sql.DB, query, tableName string, mode SQLiteMode) (*SyncResult, error) {
+	if tableName == "" {
+		return nil, invalidOptions("a table name is required")
+	}
+
+	rows, err := askgit.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	if len(colTypes) == 0 {
+		return nil, ErrNoColumns
+	}
+
+	result := &SyncResult{Columns: make([]string, len(colTypes))}
+	columns := make([]string, len(colTypes))
+	placeholders := make([]string, len(colTypes))
+	for c, col := range colTypes {
+		result.Columns[c] = col.Name()
+		// SQLite quotes identifiers as Postgres does, and a column without a type takes any value as it is
+		columns[c] = strings.TrimSpace(pq.QuoteIdentifier(col.Name()) + " " + col.DatabaseTypeName())
+		placeholders[c] = "?"
+	}
+	table := pq.QuoteIdentifier(tableName)
+
+	tx, err := target.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // a no-op once committed
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT count(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = ?", tableName).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []string
+	switch {
+	case exists && mode == SQLiteFail:
+		return nil, fmt.Errorf("%w: table %s already exists", ErrPreconditionFailed, table)
+	case exists && mode == SQLiteReplace:
+		statements = append(statements, fmt.Sprintf("DROP TABLE %s", table))
+		fallthrough
+	case !exists:
+		statements = append(statements, fmt.Sprintf("CREATE TABLE %s (%s)", table, strings.Join(columns, ", ")))
+	}
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	insert, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s VALUES (%s)", table, strings.Join(placeholders, ", ")))
+	if err != nil {
+		return nil, err
+	}
+	defer insert.Close()
+
+	values := make([]interface{}, len(colTypes))
+	pointers := make([]interface{}, len(colTypes))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("could not read row %d of the query results: %w", result.Rows+1, err)
+		}
+		if _, err := insert.ExecContext(ctx, values...); err != nil {
+			return nil, err
+		}
+		result.Rows++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read the query results after %d rows: %w", result.Rows, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,68 @@
+package pgsync
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSyncToSQLite(t *testing.T) {
+	for _, c := range []struct {
+		mode   SQLiteMode
+		exists bool
+	}{
+		{SQLiteReplace, false},
+		{SQLiteReplace, true},
+		{SQLiteAppend, true},
+		{SQLiteFail, true},
+	} {
+		target, mock, _ := sqlmock.New()
+
+		source := sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("hash").OfType("TEXT", ""),
+			sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+			sqlmock.NewColumn("summary").OfType("", ""),
+		).
+			AddRow("abc", int64(1), "first").
+			AddRow("def", int64(2), nil)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("FROM sqlite_master").WithArgs("commits").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(c.exists))
+		if c.mode == SQLiteFail {
+			mock.ExpectRollback()
+		} else {
+			if c.exists && c.mode == SQLiteReplace {
+				mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			if !c.exists || c.mode == SQLiteReplace {
+				// columns keep their declared types, and so their affinities
+				mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits" ("hash" TEXT, "additions" INTEGER, "summary")`)).WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			insert := mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO "commits" VALUES (?, ?, ?)`))
+			insert.ExpectExec().WithArgs("abc", int64(1), "first").WillReturnResult(sqlmock.NewResult(1, 1))
+			insert.ExpectExec().WithArgs("def", int64(2), nil).WillReturnResult(sqlmock.NewResult(2, 1))
+			mock.ExpectCommit()
+		}
+
+		result, err := syncToSQLite(context.Background(), newSource(t, source), target, "SELECT hash, additions, summary FROM commits", "commits", c.mode)
+		if c.mode == SQLiteFail {
+			if !errors.Is(err, ErrPreconditionFailed) {
+				t.Fatalf("%+v: expected ErrPreconditionFailed, got: %v", c, err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("%+v: %v", c, err)
+			}
+			if result.Rows != 2 {
+				t.Fatalf("%+v: expected 2 rows, got %d", c, result.Rows)
+			}
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("%+v: %v", c, err)
+		}
+	}
+}
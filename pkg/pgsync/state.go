@@ -0,0 +1,83 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// SyncState is what the state table records about the last sync of a table (see SyncOptions.StateTable)
+type SyncState struct {
+	// Table is the table that was synced, quoted and qualified with its schema if it was synced into one
+	Table string
+	// SyncedAt is when the table was synced, by SyncOptions.Clock
+	SyncedAt time.Time
+	// Rows is the number of rows that were synced
+	Rows int64
+	// QueryHash is the hex encoded SHA-256 of the query the table was synced from
+	QueryHash string
+}
+
+// stateTable returns the quoted and qualified name of the state table of options
+func stateTable(options *SyncOptions) string {
+	return QuoteAlways.qualify(options.StateSchema, options.StateTable)
+}
+
+// createStateTable creates the state table of options, and its schema, if they don't exist
+func createStateTable(ctx context.Context, tx *sql.Tx, options *SyncOptions) error {
+	if options.StateSchema != "" {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", pq.QuoteIdentifier(options.StateSchema))); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		table_name text PRIMARY KEY,
+		synced_at timestamp with time zone NOT NULL,
+		row_count bigint NOT NULL,
+		query_sha256 text NOT NULL
+	)`, stateTable(options)))
+	return err
+}
+
+// recordState records the sync of table, of query, in the state table of options, replacing whatever was recorded
+// about its last sync
+func recordState(ctx context.Context, tx *sql.Tx, options *SyncOptions, table, query string, rows int64) error {
+	if !options.SkipCreateStateTable {
+		if err := createStateTable(ctx, tx, options); err != nil {
+			return fmt.Errorf("could not create state table %s: %w", stateTable(options), err)
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (table_name, synced_at, row_count, query_sha256) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (table_name) DO UPDATE SET synced_at = EXCLUDED.synced_at, row_count = EXCLUDED.row_count, query_sha256 = EXCLUDED.query_sha256`,
+		stateTable(options)), QuoteAlways.qualify(options.Schema, table), options.now(), rows, queryHash(query))
+	if err != nil {
+		return fmt.Errorf("could not record the sync in state table %s: %w", stateTable(options), err)
+	}
+	return nil
+}
+
+// ReadState returns what the state table of options records about the last sync of its table,
+// or nil if it hasn't been synced with that state table
+func ReadState(ctx context.Context, options *SyncOptions) (*SyncState, error) {
+	if options.Postgres == nil || options.StateTable == "" {
+		return nil, invalidOptions("a postgres database and a state table are required to read the state of a sync")
+	}
+
+	s := SyncState{Table: QuoteAlways.qualify(options.Schema, options.TableName)}
+	err := options.Postgres.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT synced_at, row_count, query_sha256 FROM %s WHERE table_name = $1", stateTable(options)), s.Table).
+		Scan(&s.SyncedAt, &s.Rows, &s.QueryHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
@@ -0,0 +1,318 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+func TestSyncStateTable(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	query := "SELECT hash, additions FROM commits"
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SET LOCAL search_path").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"git"."commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE SCHEMA IF NOT EXISTS "ops"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "ops"."pgsync_state"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "ops"."pgsync_state"`)).
+		WithArgs(`"git"."commits"`, sqlmock.AnyArg(), int64(2), queryHash(query)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	options := &SyncOptions{
+		Postgres:    pg,
+		AskGit:      newSource(t, commitRows()),
+		TableName:   "commits",
+		Schema:      "git",
+		Query:       query,
+		Logger:      zap.NewNop(),
+		StateTable:  "pgsync_state",
+		StateSchema: "ops",
+	}
+	if _, err := Sync(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+
+	synced := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT synced_at, row_count, query_sha256 FROM "ops"."pgsync_state" WHERE table_name = $1`)).
+		WithArgs(`"git"."commits"`).
+		WillReturnRows(sqlmock.NewRows([]string{"synced_at", "row_count", "query_sha256"}).AddRow(synced, int64(2), queryHash(query)))
+
+	state, err := ReadState(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil || state.Rows != 2 || !state.SyncedAt.Equal(synced) || state.QueryHash != queryHash(query) {
+		t.Fatalf("unexpected state: %+v", state)
+	}
+
+	// a table that was never synced has no state
+	mock.ExpectQuery("FROM \"ops\".\"pgsync_state\"").WillReturnRows(sqlmock.NewRows([]string{"synced_at", "row_count", "query_sha256"}))
+	if state, err := ReadState(context.Background(), options); err != nil || state != nil {
+		t.Fatalf("expected no state, got: %+v, %v", state, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncStateTableNotCreated(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "ops"."pgsync_state"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:             pg,
+		AskGit:               newSource(t, commitRows()),
+		TableName:            "commits",
+		Query:                "SELECT hash, additions FROM commits",
+		Logger:               zap.NewNop(),
+		StateTable:           "pgsync_state",
+		StateSchema:          "ops",
+		SkipCreateStateTable: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncStateClock(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// a backfill records the sync as of when the data was, not when it was loaded
+	synced := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	query := "SELECT hash, additions FROM commits"
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "pgsync_state" (table_name, synced_at, row_count, query_sha256) VALUES ($1, $2, $3, $4)`)).
+		WithArgs(`"commits"`, synced, int64(2), queryHash(query)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:             pg,
+		AskGit:               newSource(t, commitRows()),
+		TableName:            "commits",
+		Query:                query,
+		Logger:               zap.NewNop(),
+		StateTable:           "pgsync_state",
+		SkipCreateStateTable: true,
+		Clock:                func() time.Time { return synced },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncTrackSchemaChanges(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the last sync recorded hash as an integer, and no additions
+	recorded := `[{"name":"hash","type":"integer"}]`
+	expectSync := func() {
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+		expectSwap(mock)
+		expectProvenance(mock)
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "pgsync_state"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "pgsync_state"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "pgsync_state" ADD COLUMN IF NOT EXISTS column_types jsonb`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT column_types FROM "pgsync_state" WHERE table_name = $1`)).WithArgs(`"commits"`).
+			WillReturnRows(sqlmock.NewRows([]string{"column_types"}).AddRow([]byte(recorded)))
+	}
+
+	expectSync()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "pgsync_state" SET column_types = $2 WHERE table_name = $1`)).
+		WithArgs(`"commits"`, `[{"name":"hash","type":"text"},{"name":"additions","type":"integer"}]`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	options := &SyncOptions{
+		Postgres:           pg,
+		AskGit:             newSource(t, commitRows()),
+		TableName:          "commits",
+		Query:              "SELECT hash, additions FROM commits",
+		Logger:             zap.NewNop(),
+		StateTable:         "pgsync_state",
+		TrackSchemaChanges: true,
+	}
+	result, err := Sync(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []SchemaChange{
+		{Column: "hash", Previous: "integer", Current: "text"},
+		{Column: "additions", Current: "integer"},
+	}
+	if len(result.SchemaChanges) != len(expected) {
+		t.Fatalf("expected %d schema changes, got: %+v", len(expected), result.SchemaChanges)
+	}
+	for i, c := range expected {
+		if result.SchemaChanges[i] != c {
+			t.Fatalf("expected %+v, got %+v", c, result.SchemaChanges[i])
+		}
+	}
+
+	// the changed type is a breaking change, the added column isn't
+	expectSync()
+	mock.ExpectRollback()
+
+	options.AskGit = newSource(t, commitRows())
+	options.RejectBreakingSchemaChanges = true
+	_, err = Sync(context.Background(), options)
+	if !errors.Is(err, ErrBreakingSchemaChange) || !strings.Contains(err.Error(), `column "hash" changed from integer to text`) ||
+		strings.Contains(err.Error(), "additions") {
+		t.Fatalf("expected only the changed type to be rejected, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncIdempotencyKey(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	lookup := regexp.QuoteMeta(`SELECT idempotency_key, sync_result FROM "pgsync_state" WHERE table_name = $1`)
+	var recorded recordText
+	expectSync := func() {
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+		expectSwap(mock)
+		expectProvenance(mock)
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "pgsync_state"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "pgsync_state"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "pgsync_state" ADD COLUMN IF NOT EXISTS idempotency_key text, ADD COLUMN IF NOT EXISTS sync_result jsonb`)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE "pgsync_state" SET idempotency_key = $2, sync_result = $3 WHERE table_name = $1 AND idempotency_key IS DISTINCT FROM $2`)).
+			WithArgs(`"commits"`, sqlmock.AnyArg(), &recorded).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+
+	// the first sync of the step finds no state table to look its key up in
+	mock.ExpectQuery(lookup).WithArgs(`"commits"`).WillReturnError(&pq.Error{Code: "42P01", Message: `relation "pgsync_state" does not exist`})
+	expectSync()
+
+	options := &SyncOptions{
+		Postgres:       pg,
+		AskGit:         newSource(t, commitRows()),
+		TableName:      "commits",
+		Query:          "SELECT hash, additions FROM commits",
+		Logger:         zap.NewNop(),
+		StateTable:     "pgsync_state",
+		IdempotencyKey: "run-1",
+	}
+	first, err := Sync(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 1 {
+		t.Fatalf("expected the sync's result to be recorded, got: %v", recorded)
+	}
+
+	// running the step again returns the recorded result, without running the query or touching the table
+	mock.ExpectQuery(lookup).WithArgs(`"commits"`).
+		WillReturnRows(sqlmock.NewRows([]string{"idempotency_key", "sync_result"}).AddRow("run-1", []byte(recorded[0])))
+
+	options.AskGit = newSource(t, commitRows())
+	again, err := Sync(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Rows != first.Rows || len(again.Columns) != 2 || again.Columns[1] != "additions" {
+		t.Fatalf("expected the recorded result %+v, got: %+v", first, again)
+	}
+
+	// a new run of the step syncs as usual
+	mock.ExpectQuery(lookup).WithArgs(`"commits"`).
+		WillReturnRows(sqlmock.NewRows([]string{"idempotency_key", "sync_result"}).AddRow("run-1", []byte(recorded[0])))
+	expectSync()
+
+	options.IdempotencyKey = "run-2"
+	if _, err := Sync(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncIdempotencyKeyConcurrent(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// another sync with the key commits after this one has looked it up, and before it records it
+	lookup := regexp.QuoteMeta(`SELECT idempotency_key, sync_result FROM "pgsync_state" WHERE table_name = $1`)
+	mock.ExpectQuery(lookup).WithArgs(`"commits"`).WillReturnRows(sqlmock.NewRows([]string{"idempotency_key", "sync_result"}))
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "pgsync_state"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "pgsync_state"`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "pgsync_state" ADD COLUMN`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "pgsync_state" SET idempotency_key = $2`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	mock.ExpectQuery(lookup).WithArgs(`"commits"`).
+		WillReturnRows(sqlmock.NewRows([]string{"idempotency_key", "sync_result"}).AddRow("run-1", []byte(`{"Rows":5}`)))
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:       pg,
+		AskGit:         newSource(t, commitRows()),
+		TableName:      "commits",
+		Query:          "SELECT hash, additions FROM commits",
+		Logger:         zap.NewNop(),
+		StateTable:     "pgsync_state",
+		IdempotencyKey: "run-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 5 {
+		t.Fatalf("expected the other sync's result, got: %+v", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
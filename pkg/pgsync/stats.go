@@ -0,0 +1,117 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DefaultColumnStatsTable is the table column statistics are recorded in, unless SyncOptions.ColumnStatsTable is set
+const DefaultColumnStatsTable = "pgsync_column_stats"
+
+// ColumnStats are statistics of the values loaded into a column (see SyncOptions.CollectColumnStats)
+type ColumnStats struct {
+	// Column is the name of the column
+	Column string
+	// Nulls is the number of rows with no value in the column
+	Nulls int64
+	// Min and Max are the smallest and largest values of numeric and time columns, as text.
+	// They're empty for columns of other types, and for columns with no values
+	Min, Max string
+}
+
+// rangedType returns whether min and max are collected for columns of the Postgres type t
+func rangedType(t string) bool {
+	switch t {
+	case "smallint", "integer", "bigint", "real", "double precision", "date":
+		return true
+	}
+	return strings.HasPrefix(t, "numeric") || strings.HasPrefix(t, "timestamp")
+}
+
+// collectColumnStats computes the statistics of each of defs from the (loaded) staging table, in a single scan of it
+func collectColumnStats(ctx context.Context, tx *sql.Tx, staging string, defs []columnDef) ([]ColumnStats, error) {
+	stats := make([]ColumnStats, len(defs))
+	ranges := make([]sql.NullString, 2*len(defs))
+
+	var selects []string
+	var dest []interface{}
+	for i, def := range defs {
+		c := pq.QuoteIdentifier(def.Name)
+		stats[i].Column = def.Name
+
+		selects = append(selects, fmt.Sprintf("count(*) - count(%s)", c))
+		dest = append(dest, &stats[i].Nulls)
+		if rangedType(def.Type) {
+			selects = append(selects, fmt.Sprintf("min(%s)::text", c), fmt.Sprintf("max(%s)::text", c))
+			dest = append(dest, &ranges[2*i], &ranges[2*i+1])
+		}
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(selects, ", "), pq.QuoteIdentifier(staging))
+	if err := tx.QueryRowContext(ctx, query).Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	for i := range stats {
+		stats[i].Min, stats[i].Max = ranges[2*i].String, ranges[2*i+1].String
+	}
+	return stats, nil
+}
+
+// recordColumnStats adds stats, of a sync of target collected at collectedAt, to the statistics table (creating it if it doesn't already exist)
+func recordColumnStats(ctx context.Context, tx *sql.Tx, table, target string, collectedAt time.Time, stats []ColumnStats) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		table_name text NOT NULL,
+		column_name text NOT NULL,
+		null_count bigint NOT NULL,
+		min_value text,
+		max_value text,
+		collected_at timestamp with time zone NOT NULL DEFAULT now()
+	)`, pq.QuoteIdentifier(table)))
+	if err != nil {
+		return err
+	}
+
+	insert := fmt.Sprintf("INSERT INTO %s (table_name, column_name, null_count, min_value, max_value, collected_at) VALUES ($1, $2, $3, $4, $5, $6)", pq.QuoteIdentifier(table))
+	for _, s := range stats {
+		min := sql.NullString{String: s.Min, Valid: s.Min != ""}
+		max := sql.NullString{String: s.Max, Valid: s.Max != ""}
+		if _, err := tx.ExecContext(ctx, insert, target, s.Column, s.Nulls, min, max, collectedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nullTracker notes which columns had a NULL in any of the rows copied (see SyncOptions.ReportNulls)
+type nullTracker struct {
+	seen []bool
+}
+
+func newNullTracker(numColumns int) *nullTracker {
+	return &nullTracker{seen: make([]bool, numColumns)}
+}
+
+// add is a rowTransform that notes the columns a row has NULLs in, leaving its values as they are
+func (n *nullTracker) add(values []interface{}) ([]interface{}, error) {
+	for i, seen := range n.seen {
+		if !seen && values[i] == nil {
+			n.seen[i] = true
+		}
+	}
+	return values, nil
+}
+
+// columns returns whether each of columns had a NULL, by name
+func (n *nullTracker) columns(columns []string) map[string]bool {
+	nulls := make(map[string]bool, len(columns))
+	for i, col := range columns {
+		nulls[col] = n.seen[i]
+	}
+	return nulls
+}
@@ -0,0 +1,151 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncCollectColumnStats(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+	).
+		AddRow("abc", int64(1)).
+		AddRow("def", nil).
+		AddRow("ghi", int64(7))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", nil}, []driver.Value{"ghi", int64(7)})
+	// only the integer column has a range
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) - count("hash"), count(*) - count("additions"), min("additions")::text, max("additions")::text FROM "commits_temp"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "additions", "min", "max"}).AddRow(int64(0), int64(1), "1", "7"))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "pgsync_column_stats"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "pgsync_column_stats"`)).WithArgs("commits", "hash", int64(0), nil, nil, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "pgsync_column_stats"`)).WithArgs("commits", "additions", int64(1), "1", "7", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:           pg,
+		AskGit:             newSource(t, source),
+		TableName:          "commits",
+		Query:              "SELECT hash, additions FROM commits",
+		Logger:             zap.NewNop(),
+		CollectColumnStats: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ColumnStats{
+		{Column: "hash", Nulls: 0},
+		{Column: "additions", Nulls: 1, Min: "1", Max: "7"},
+	}
+	if len(result.ColumnStats) != len(expected) {
+		t.Fatalf("expected stats of %d columns, got: %+v", len(expected), result.ColumnStats)
+	}
+	for i, s := range expected {
+		if result.ColumnStats[i] != s {
+			t.Fatalf("expected %+v, got %+v", s, result.ColumnStats[i])
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncStatisticsTarget(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the target is set for the ANALYZE of the swapped in table, in the sync's transaction
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	mock.ExpectExec(regexp.QuoteMeta("SET LOCAL default_statistics_target = 10")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`ANALYZE "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	options := &SyncOptions{
+		Postgres:         pg,
+		AskGit:           newSource(t, commitRows()),
+		TableName:        "commits",
+		Query:            "SELECT hash, additions FROM commits",
+		Logger:           zap.NewNop(),
+		StatisticsTarget: 10,
+	}
+	if _, err := Sync(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	options.StatisticsTarget = 10001
+	if _, err := Sync(context.Background(), options); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected ErrInvalidOptions for a statistics target out of range, got: %v", err)
+	}
+}
+
+func TestSyncReportNulls(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+		sqlmock.NewColumn("message").OfType("TEXT", ""),
+	).
+		AddRow("abc", int64(1), "initial commit").
+		AddRow("def", nil, "").
+		AddRow("ghi", int64(7), nil)
+
+	// an empty string isn't a NULL
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1), "initial commit"}, []driver.Value{"def", nil, ""}, []driver.Value{"ghi", int64(7), nil})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:    pg,
+		AskGit:      newSource(t, source),
+		TableName:   "commits",
+		Query:       "SELECT hash, additions, message FROM commits",
+		Logger:      zap.NewNop(),
+		ReportNulls: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{"hash": false, "additions": true, "message": true}
+	if len(result.NullColumns) != len(expected) {
+		t.Fatalf("expected nulls reported for %d columns, got: %v", len(expected), result.NullColumns)
+	}
+	for col, nulls := range expected {
+		if has, ok := result.NullColumns[col]; !ok || has != nulls {
+			t.Fatalf("expected %s to have NULLs: %t, got: %v", col, nulls, result.NullColumns)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
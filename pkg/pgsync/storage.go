@@ -0,0 +1,141 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ColumnStorage is how Postgres stores (and TOASTs) the values of a column, see ALTER TABLE ... SET STORAGE
+type ColumnStorage string
+
+const (
+	// StoragePlain keeps values inline and uncompressed
+	StoragePlain ColumnStorage = "PLAIN"
+	// StorageMain keeps values inline, compressed, unless they can't fit
+	StorageMain ColumnStorage = "MAIN"
+	// StorageExternal moves large values out of line, uncompressed, which makes substring operations on them faster
+	StorageExternal ColumnStorage = "EXTERNAL"
+	// StorageExtended compresses large values and moves them out of line if they're still too large (the default for text)
+	StorageExtended ColumnStorage = "EXTENDED"
+)
+
+// applyStorage sets the storage and compression method of each of defs named in storage and compression,
+// checking that the storage strategies are valid and that Postgres supports the compression methods
+func applyStorage(ctx context.Context, tx *sql.Tx, defs []columnDef, storage map[string]ColumnStorage, compression map[string]string) error {
+	for name, s := range storage {
+		switch s {
+		case StoragePlain, StorageMain, StorageExternal, StorageExtended:
+		default:
+			return invalidOptions("unknown storage for column %s: %s", name, s)
+		}
+		if !setColumn(defs, name, func(def *columnDef) { def.Storage = s }) {
+			return invalidOptions("column with a storage is not in the table: %s", name)
+		}
+	}
+
+	if len(compression) == 0 {
+		return nil
+	}
+
+	for name, method := range compression {
+		if !setColumn(defs, name, func(def *columnDef) { def.Compression = method }) {
+			return invalidOptions("column with a compression method is not in the table: %s", name)
+		}
+	}
+
+	// the methods the server was built with are the values default_toast_compression can take, which only exists from Postgres 14
+	rows, err := tx.QueryContext(ctx, "SELECT unnest(enumvals) FROM pg_settings WHERE name = 'default_toast_compression'")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	supported := make(map[string]bool)
+	for rows.Next() {
+		var method string
+		if err := rows.Scan(&method); err != nil {
+			return err
+		}
+		supported[method] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(supported) == 0 {
+		return invalidOptions("column compression methods need Postgres 14 or later")
+	}
+
+	var unsupported []string
+	for _, method := range compression {
+		if !supported[method] {
+			unsupported = append(unsupported, method)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return invalidOptions("compression methods are not supported by the target database: %s", strings.Join(unsupported, ", "))
+	}
+
+	return nil
+}
+
+// setColumn calls set with the column of defs named name, reporting whether there is one
+func setColumn(defs []columnDef, name string, set func(def *columnDef)) bool {
+	found := false
+	for i := range defs {
+		if defs[i].Name == name {
+			set(&defs[i])
+			found = true
+		}
+	}
+	return found
+}
+
+// alterStorage returns the ALTER TABLE statement that sets the storage and compression of the columns of defs
+// that have them, or an empty string if none do. table is the (quoted) name of the table
+func alterStorage(table string, defs []columnDef, quote QuoteStrategy) string {
+	var actions []string
+	for _, def := range defs {
+		if def.Storage != "" {
+			actions = append(actions, fmt.Sprintf("ALTER COLUMN %s SET STORAGE %s", quote.quote(def.Name), def.Storage))
+		}
+		if def.Compression != "" {
+			actions = append(actions, fmt.Sprintf("ALTER COLUMN %s SET COMPRESSION %s", quote.quote(def.Name), quote.quote(def.Compression)))
+		}
+	}
+
+	if len(actions) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("ALTER TABLE %s %s", table, strings.Join(actions, ", "))
+}
+
+// withParameters returns the WITH clause that sets the storage parameters of a created table (such as fillfactor or
+// toast.autovacuum_enabled), in order of name, or an empty string if there are none. Names must look like parameter
+// names and values are quoted, but neither is otherwise checked, Postgres rejects any it doesn't know
+func withParameters(parameters map[string]string) (string, error) {
+	if len(parameters) == 0 {
+		return "", nil
+	}
+
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		if !settingName.MatchString(name) {
+			return "", invalidOptions("invalid storage parameter name: %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	set := make([]string, len(names))
+	for i, name := range names {
+		set[i] = fmt.Sprintf("%s = %s", name, pq.QuoteLiteral(parameters[name]))
+	}
+	return fmt.Sprintf(" WITH (%s)", strings.Join(set, ", ")), nil
+}
@@ -0,0 +1,122 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncColumnStorage(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("FROM pg_settings").WillReturnRows(sqlmock.NewRows([]string{"enumvals"}).AddRow("pglz").AddRow("lz4"))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits_temp" ALTER COLUMN "hash" SET STORAGE EXTERNAL, ALTER COLUMN "hash" SET COMPRESSION "lz4"`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:          pg,
+		AskGit:            newSource(t, commitRows()),
+		TableName:         "commits",
+		Query:             "SELECT hash, additions FROM commits",
+		Logger:            zap.NewNop(),
+		ColumnStorage:     map[string]ColumnStorage{"hash": StorageExternal},
+		ColumnCompression: map[string]string{"hash": "lz4"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncStorageParameters(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`) WITH (fillfactor = '70', toast.autovacuum_enabled = 'false')`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	options := &SyncOptions{
+		Postgres:          pg,
+		AskGit:            newSource(t, commitRows()),
+		TableName:         "commits",
+		Query:             "SELECT hash, additions FROM commits",
+		Logger:            zap.NewNop(),
+		StorageParameters: map[string]string{"toast.autovacuum_enabled": "false", "fillfactor": "70"},
+	}
+	if _, err := Sync(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := withParameters(map[string]string{"fillfactor = 10) --": "70"}); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected ErrInvalidOptions for an invalid parameter name, got: %v", err)
+	}
+}
+
+func TestSyncColumnStorageInvalid(t *testing.T) {
+	cases := map[string]struct {
+		storage     map[string]ColumnStorage
+		compression map[string]string
+		supported   []string
+		mentions    string
+	}{
+		"unknown storage":    {map[string]ColumnStorage{"hash": "COMPRESSED"}, nil, nil, "COMPRESSED"},
+		"unknown column":     {map[string]ColumnStorage{"author": StorageMain}, nil, nil, "author"},
+		"before postgres 14": {nil, map[string]string{"hash": "pglz"}, []string{}, "Postgres 14"},
+		"without lz4":        {nil, map[string]string{"hash": "lz4"}, []string{"pglz"}, "lz4"},
+	}
+
+	for name, c := range cases {
+		pg, mock, _ := sqlmock.New()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		if c.supported != nil {
+			rows := sqlmock.NewRows([]string{"enumvals"})
+			for _, method := range c.supported {
+				rows.AddRow(method)
+			}
+			mock.ExpectQuery("FROM pg_settings").WillReturnRows(rows)
+		}
+		mock.ExpectRollback()
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:          pg,
+			AskGit:            newSource(t, commitRows()),
+			TableName:         "commits",
+			Query:             "SELECT hash, additions FROM commits",
+			Logger:            zap.NewNop(),
+			ColumnStorage:     c.storage,
+			ColumnCompression: c.compression,
+		})
+		if !errors.Is(err, ErrInvalidOptions) || !strings.Contains(err.Error(), c.mentions) {
+			t.Fatalf("%s: expected an invalid options error mentioning %q, got: %v", name, c.mentions, err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
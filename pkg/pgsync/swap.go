@@ -0,0 +1,130 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// swap replaces the target table with the freshly loaded staging table tempNameNew, renaming the old one to tempNameDrop
+// and dropping it (or keeping it as a backup, see SyncOptions.KeepBackups), or just renames the staging table if there's
+// no target yet. Views that depend on the old table are recreated when options.CascadeDependents is set.
+// Foreign tables can't be renamed in place of, so their contents are replaced instead (see replaceForeignTable).
+func swap(ctx context.Context, tx *sql.Tx, l *zap.SugaredLogger, options *SyncOptions, tempNameNew, tempNameDrop string, columns []string) error {
+	kind, err := relationKind(ctx, tx, options.TableName)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case "f":
+		l.Infof("%s is a foreign table, replacing its contents instead of swapping it", options.TableName)
+		return replaceForeignTable(ctx, tx, options.TableName, tempNameNew, columns)
+	case "":
+		// the first sync of the table, there's nothing to swap out (or to drop, whatever else may be named tempNameDrop)
+		l.Infof("%s does not exist yet, renaming the staging table to it", options.TableName)
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s RENAME TO %s", QuoteAlways.qualify(options.Schema, tempNameNew), pq.QuoteIdentifier(options.TableName)))
+		return err
+	}
+
+	views, err := checkDependents(ctx, tx, options.TableName, options.CascadeDependents)
+	if err != nil {
+		return err
+	}
+
+	dropSQL := fmt.Sprintf(`DROP TABLE IF EXISTS %s`, QuoteAlways.qualify(options.Schema, tempNameDrop))
+	if len(views) > 0 {
+		dropSQL += " CASCADE"
+	}
+	if options.KeepBackups > 0 {
+		backup, err := nextBackupTable(ctx, tx, options.TableName, options.now())
+		if err != nil {
+			return err
+		}
+		dropSQL = fmt.Sprintf("ALTER TABLE %s RENAME TO %s", QuoteAlways.qualify(options.Schema, tempNameDrop), pq.QuoteIdentifier(backup))
+	}
+
+	// the comment labels the swap in pg_stat_activity, for finding it if it's stuck waiting on a lock
+	label := strings.Replace(options.applicationName(), "*/", "* /", -1)
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`/* %s swap */
+		ALTER TABLE IF EXISTS %s RENAME TO %s;
+		ALTER TABLE IF EXISTS %s RENAME TO %s;
+		%s;
+	`, label,
+		QuoteAlways.qualify(options.Schema, options.TableName), pq.QuoteIdentifier(tempNameDrop),
+		QuoteAlways.qualify(options.Schema, tempNameNew), pq.QuoteIdentifier(options.TableName),
+		dropSQL))
+	if err != nil {
+		return err
+	}
+
+	for _, v := range views {
+		l.Infof("recreating dependent view %s", v.name)
+		if _, err := tx.ExecContext(ctx, v.create()); err != nil {
+			return err
+		}
+	}
+
+	if options.KeepBackups > 0 {
+		pruned, err := pruneBackups(ctx, tx, options.Schema, options.TableName, options.KeepBackups)
+		if err != nil {
+			return err
+		}
+		for _, name := range pruned {
+			l.Infof("dropped backup %s, keeping the %d most recent", name, options.KeepBackups)
+		}
+	}
+
+	return nil
+}
+
+// relationKind returns the pg_class relkind of the relation named name, or an empty string if there's no such relation
+func relationKind(ctx context.Context, tx *sql.Tx, name string) (string, error) {
+	var kind string
+	err := tx.QueryRowContext(ctx, "SELECT relkind FROM pg_class WHERE oid = to_regclass($1)", pq.QuoteIdentifier(name)).Scan(&kind)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return kind, err
+}
+
+// checkPrecondition returns ErrPreconditionFailed if whether table exists contradicts require
+func checkPrecondition(ctx context.Context, tx *sql.Tx, table string, require TablePrecondition) error {
+	kind, err := relationKind(ctx, tx, table)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case require == RequireExisting && kind == "":
+		return fmt.Errorf("%w: table %s does not exist", ErrPreconditionFailed, pq.QuoteIdentifier(table))
+	case require == RequireAbsent && kind != "":
+		return fmt.Errorf("%w: table %s already exists", ErrPreconditionFailed, pq.QuoteIdentifier(table))
+	}
+	return nil
+}
+
+// replaceForeignTable replaces the contents of the foreign table with those of the staging table,
+// by truncating it and inserting every staged row. This requires a foreign data wrapper that supports
+// both TRUNCATE and INSERT (postgres_fdw does from PostgreSQL 14).
+func replaceForeignTable(ctx context.Context, tx *sql.Tx, table, staging string, columns []string) error {
+	t := pq.QuoteIdentifier(table)
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("TRUNCATE %s", t)); err != nil {
+		return fmt.Errorf("could not truncate foreign table %s, its foreign data wrapper may not support TRUNCATE: %w", t, err)
+	}
+
+	cols := quoteAll("", columns)
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", t, cols, cols, pq.QuoteIdentifier(staging)))
+	if err != nil {
+		return fmt.Errorf("could not insert into foreign table %s, its foreign data wrapper may not support INSERT: %w", t, schemaMismatch(table, err))
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", pq.QuoteIdentifier(staging)))
+	return err
+}
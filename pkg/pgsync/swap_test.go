@@ -0,0 +1,450 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+func TestSyncForeignTable(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("f"))
+	mock.ExpectExec(regexp.QuoteMeta(`TRUNCATE "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits" ("hash", "additions") SELECT "hash", "additions" FROM "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("f"))
+	mock.ExpectExec(regexp.QuoteMeta(`COMMENT ON FOREIGN TABLE "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncForeignTableWithoutTruncate(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	unsupported := &pq.Error{Code: "0A000", Message: `cannot truncate foreign table "commits"`}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("f"))
+	mock.ExpectExec("TRUNCATE").WillReturnError(unsupported)
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+	})
+	if !errors.Is(err, unsupported) || !strings.Contains(err.Error(), "foreign data wrapper") {
+		t.Fatalf("expected a foreign data wrapper error, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncFirstSync(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// with no table yet, the staging table is renamed to it, and nothing named commits_drop is touched
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}))
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits_temp" RENAME TO "commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 2 {
+		t.Fatalf("expected 2 rows, got: %d", result.Rows)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncSwapMixedCase(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the old table is renamed to the very name that's dropped, case and all
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SET LOCAL search_path").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE "git"."Commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"git"."Commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	mock.ExpectQuery("pg_rewrite").WillReturnRows(sqlmock.NewRows([]string{"name", "relkind", "definition"}))
+	mock.ExpectQuery("pg_constraint").WillReturnRows(sqlmock.NewRows([]string{"constraint"}))
+	mock.ExpectExec(`ALTER TABLE IF EXISTS "git"\."Commits" RENAME TO "Commits_drop";\s+` +
+		`ALTER TABLE IF EXISTS "git"\."Commits_temp" RENAME TO "Commits";\s+` +
+		`DROP TABLE IF EXISTS "git"\."Commits_drop";`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "Commits",
+		Schema:    "git",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncRequire(t *testing.T) {
+	for _, c := range []struct {
+		require TablePrecondition
+		exists  bool
+		ok      bool
+	}{
+		{RequireExisting, true, true},
+		{RequireExisting, false, false},
+		{RequireAbsent, true, false},
+		{RequireAbsent, false, true},
+	} {
+		pg, mock, _ := sqlmock.New()
+
+		relkind := sqlmock.NewRows([]string{"relkind"})
+		if c.exists {
+			relkind.AddRow("r")
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(relkind)
+		if c.ok {
+			mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+			expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+			expectSwap(mock)
+			expectProvenance(mock)
+			mock.ExpectCommit()
+		} else {
+			mock.ExpectRollback()
+		}
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:  pg,
+			AskGit:    newSource(t, commitRows()),
+			TableName: "commits",
+			Query:     "SELECT hash, additions FROM commits",
+			Logger:    zap.NewNop(),
+			Require:   c.require,
+		})
+		if c.ok && err != nil {
+			t.Fatalf("%+v: %v", c, err)
+		}
+		if !c.ok && !errors.Is(err, ErrPreconditionFailed) {
+			t.Fatalf("%+v: expected ErrPreconditionFailed, got: %v", c, err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("%+v: %v", c, err)
+		}
+	}
+}
+
+func TestSyncSerializeSyncs(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the lock is held before the staging table is created, so a concurrent sync of the table waits to create its own
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SET LOCAL search_path").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_xact_lock(hashtext($1))")).WithArgs(`"git"."commits"`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"git"."commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:       pg,
+		AskGit:         newSource(t, commitRows()),
+		TableName:      "commits",
+		Schema:         "git",
+		Query:          "SELECT hash, additions FROM commits",
+		Logger:         zap.NewNop(),
+		SerializeSyncs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncSerializeSyncsTimeout(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	timeout := &pq.Error{Code: "55P03", Message: "canceling statement due to lock timeout"}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SET LOCAL lock_timeout").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("pg_advisory_xact_lock").WithArgs(`"commits"`).WillReturnError(timeout)
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, commitRows()),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		SessionSettings: map[string]string{"lock_timeout": "5s"},
+		SerializeSyncs:  true,
+	})
+	if !errors.Is(err, timeout) {
+		t.Fatalf("expected the lock timeout, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncRetry(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	source.ExpectQuery("FROM commits").WillReturnRows(commitRows())
+	source.ExpectQuery("FROM commits").WillReturnRows(commitRows())
+
+	// a concurrent transaction makes the first swap fail, rolling back its staging table with it
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+	mock.ExpectQuery("pg_rewrite").WillReturnRows(sqlmock.NewRows([]string{"name", "relkind", "definition"}))
+	mock.ExpectQuery("pg_constraint").WillReturnRows(sqlmock.NewRows([]string{"constraint"}))
+	mock.ExpectExec("ALTER TABLE IF EXISTS").WillReturnError(&pq.Error{Code: "40001", Message: "could not serialize access due to concurrent update"})
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	completed := 0
+	tracer := &memoryTracer{}
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:   pg,
+		AskGit:     askgit,
+		TableName:  "commits",
+		Query:      "SELECT hash, additions FROM commits",
+		Logger:     zap.NewNop(),
+		Retry:      &RetryPolicy{BaseDelay: time.Millisecond},
+		OnComplete: func(*SyncResult, error) { completed++ },
+		Tracer:     tracer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 2 || completed != 1 {
+		t.Fatalf("expected a single completed sync of 2 rows, got %d rows and %d completions", result.Rows, completed)
+	}
+
+	// each attempt has a span of its own, neither inside the other
+	var attempts []*memorySpan
+	for _, span := range tracer.spans {
+		if span.name == "pgsync.sync" {
+			attempts = append(attempts, span)
+		}
+	}
+	if len(attempts) != 2 || attempts[0].parent != nil || attempts[1].parent != nil {
+		t.Fatalf("expected a span with no parent for each of the 2 attempts, got %d spans", len(attempts))
+	}
+	if attempts[0].err == nil || attempts[1].err != nil {
+		t.Fatalf("expected only the first attempt's span to record an error, got %v and %v", attempts[0].err, attempts[1].err)
+	}
+
+	for _, m := range []sqlmock.Sqlmock{mock, source} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := &RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for n, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		if d := policy.delay(n + 1); d != expected {
+			t.Fatalf("expected retry %d to wait %s, got %s", n+1, expected, d)
+		}
+	}
+
+	// with jitter, each wait is drawn from the fixed source, up to the delay without it
+	policy.Jitter, policy.Rand = true, rand.New(rand.NewSource(1))
+	expected := rand.New(rand.NewSource(1))
+	for n, limit := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second} {
+		d := policy.delay(n + 1)
+		if d != time.Duration(expected.Int63n(int64(limit)+1)) || d > limit || d < 0 {
+			t.Fatalf("unexpected jittered wait before retry %d: %s", n+1, d)
+		}
+	}
+}
+
+func TestSyncKeepBackups(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	first := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	second := first.Add(24 * time.Hour)
+
+	// backups is what's left of the table's backups by the time each sync prunes them, newest first,
+	// and taken the names of the backups that already exist with the name the swap would give its own
+	expectSync := func(backup string, taken []string, backups ...string) {
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+		mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+		mock.ExpectQuery("pg_rewrite").WillReturnRows(sqlmock.NewRows([]string{"name", "relkind", "definition"}))
+		mock.ExpectQuery("pg_constraint").WillReturnRows(sqlmock.NewRows([]string{"constraint"}))
+		for _, name := range taken {
+			mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"` + name + `"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+		}
+		mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"` + backup + `"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}))
+		mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits_drop" RENAME TO "` + backup + `"`)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		rows := sqlmock.NewRows([]string{"relname"})
+		for _, name := range backups {
+			rows.AddRow(name)
+		}
+		// commits_bak_up is some other table, whose name only looks like a backup's
+		rows.AddRow("commits_bak_up")
+		mock.ExpectQuery("SELECT c.relname FROM pg_class").WithArgs("", `commits\_bak\_%`).WillReturnRows(rows)
+	}
+
+	expectSync("commits_bak_20210801120000000000", nil, "commits_bak_20210801120000000000")
+	expectProvenance(mock)
+	mock.ExpectCommit()
+	expectSync("commits_bak_20210802120000000000", nil, "commits_bak_20210802120000000000", "commits_bak_20210801120000000000")
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_bak_20210801120000000000"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+	// a sync swapped out at the same time as the last doesn't take its backup's name
+	expectSync("commits_bak_20210802120000000001", []string{"commits_bak_20210802120000000000"},
+		"commits_bak_20210802120000000001", "commits_bak_20210802120000000000")
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_bak_20210802120000000000"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	now := first
+	options := &SyncOptions{
+		Postgres:    pg,
+		TableName:   "commits",
+		Query:       "SELECT hash, additions FROM commits",
+		Logger:      zap.NewNop(),
+		KeepBackups: 1,
+		Clock:       func() time.Time { return now },
+	}
+	for _, now = range []time.Time{first, second, second} {
+		options.AskGit = newSource(t, commitRows())
+		if _, err := Sync(context.Background(), options); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the oldest backup was named to the second, before backups were named to the microsecond
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT c.relname FROM pg_class").WithArgs("git", `commits\_bak\_%`).WillReturnRows(sqlmock.NewRows([]string{"relname"}).
+		AddRow("commits_bak_20210803120000000000").
+		AddRow("commits_bak_20210802120000000001").
+		AddRow("commits_bak_20210802120000000000").
+		AddRow("commits_bak_up").
+		AddRow("commits_bak_20210801120000"))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "git"."commits_bak_20210802120000000000"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "git"."commits_bak_20210801120000"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	tx, err := pg.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := pruneBackups(context.Background(), tx, "git", "commits", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pruned) != 2 || pruned[0] != "commits_bak_20210802120000000000" || pruned[1] != "commits_bak_20210801120000" {
+		t.Fatalf("expected the 2 most recent backups to be kept, dropped: %v", pruned)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupTable(t *testing.T) {
+	swapped := time.Date(2021, 8, 1, 14, 0, 0, 123456789, time.FixedZone("CEST", 2*60*60))
+	if name := backupTable("commits", swapped); name != "commits_bak_20210801120000123456" {
+		t.Fatalf("expected the backup to be named by the time of the swap in UTC, to the microsecond, got: %s", name)
+	}
+}
@@ -0,0 +1,127 @@
+package pgsync
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// Syncer runs the same sync repeatedly (for instance on a timer) and keeps track of how the most recent runs went,
+// so that long-lived processes can report on the health of their syncs.
+// It's safe to Run (or RunTable) from several goroutines at once, each run syncs with a copy of the options of its own.
+type Syncer struct {
+	options *SyncOptions
+
+	// a QueryReader can only be read once, so it's read on the first run and its query reused from then on
+	readQuery sync.Once
+	query     string
+	queryErr  error
+
+	pause pauseGate
+
+	mu          sync.RWMutex
+	lastSuccess time.Time
+	lastError   error
+	lastResult  *SyncResult
+}
+
+// NewSyncer returns a Syncer that syncs using options on every Run
+func NewSyncer(options *SyncOptions) *Syncer {
+	return &Syncer{options: options}
+}
+
+// Run performs a sync and records its outcome
+func (s *Syncer) Run(ctx context.Context) (*SyncResult, error) {
+	return s.RunTable(ctx, s.options.TableName, "")
+}
+
+// RunTable performs a sync into table rather than the table of the Syncer's options, of query if it's not empty,
+// and records its outcome
+func (s *Syncer) RunTable(ctx context.Context, table, query string) (*SyncResult, error) {
+	options, err := s.runOptions(table, query)
+	if err != nil {
+		s.record(nil, err)
+		return nil, err
+	}
+
+	result, err := Sync(ctx, options)
+	s.record(result, err)
+	return result, err
+}
+
+// record records the outcome of a run, timing a successful one by the Clock of the Syncer's options
+func (s *Syncer) record(result *SyncResult, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastError = err
+	if err == nil {
+		s.lastSuccess = s.options.now()
+		s.lastResult = result
+	}
+}
+
+// runOptions returns a copy of the Syncer's options for a run into table, of query if it's not empty
+func (s *Syncer) runOptions(table, query string) (*SyncOptions, error) {
+	options := *s.options
+	options.TableName = table
+	if options.pause == nil {
+		// a run retried by retrySync is held up by the Syncer that started it
+		options.pause = &s.pause
+	}
+
+	if query != "" {
+		options.Query, options.QueryReader, options.Queries = query, nil, nil
+	} else if options.QueryReader != nil && options.Query == "" && len(options.Queries) == 0 {
+		s.readQuery.Do(func() {
+			var b []byte
+			b, s.queryErr = ioutil.ReadAll(options.QueryReader)
+			s.query = string(b)
+		})
+		if s.queryErr != nil {
+			return nil, s.queryErr
+		}
+		options.Query, options.QueryReader = s.query, nil
+	}
+
+	return &options, nil
+}
+
+// Pause holds up the runs in progress, and any started after, between one row of the query's results and the next,
+// until Resume. Their transactions are held open in the meantime, so nothing loaded so far is lost, but neither is
+// anything committed, and the locks they've taken are held until they resume
+func (s *Syncer) Pause() {
+	s.pause.pause()
+}
+
+// Resume lets paused runs carry on from where they were held up
+func (s *Syncer) Resume() {
+	s.pause.resume()
+}
+
+// Paused reports whether the Syncer is paused
+func (s *Syncer) Paused() bool {
+	return s.pause.paused()
+}
+
+// LastSuccess returns the time the most recent successful run completed, or the zero time if there hasn't been one
+func (s *Syncer) LastSuccess() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastSuccess
+}
+
+// LastError returns the error of the most recent run, which is nil if that run succeeded
+func (s *Syncer) LastError() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastError
+}
+
+// LastResult returns the result of the most recent successful run
+func (s *Syncer) LastResult() *SyncResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastResult
+}
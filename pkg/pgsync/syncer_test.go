@@ -0,0 +1,271 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncerHealth(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+	askgit, source, _ := sqlmock.New()
+
+	synced := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	options := &SyncOptions{
+		Postgres:  pg,
+		AskGit:    askgit,
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		Clock:     func() time.Time { return synced },
+	}
+	syncer := NewSyncer(options)
+
+	if !syncer.LastSuccess().IsZero() || syncer.LastError() != nil || syncer.LastResult() != nil {
+		t.Fatal("expected a fresh syncer to have no recorded state")
+	}
+
+	source.ExpectQuery(".").WillReturnRows(commitRows())
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	if _, err := syncer.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	success := syncer.LastSuccess()
+	if !success.Equal(synced) {
+		t.Fatalf("expected last success to be recorded at %v by the clock, got %v", synced, success)
+	}
+	if syncer.LastError() != nil {
+		t.Fatalf("unexpected last error: %v", syncer.LastError())
+	}
+	if syncer.LastResult() == nil || syncer.LastResult().Rows != 2 {
+		t.Fatalf("unexpected last result: %+v", syncer.LastResult())
+	}
+
+	queryErr := errors.New("could not open repository")
+	source.ExpectQuery(".").WillReturnError(queryErr)
+
+	if _, err := syncer.Run(context.Background()); !errors.Is(err, queryErr) {
+		t.Fatalf("expected run to fail with %v, got: %v", queryErr, err)
+	}
+
+	if !errors.Is(syncer.LastError(), queryErr) {
+		t.Fatalf("expected last error to be %v, got: %v", queryErr, syncer.LastError())
+	}
+	if !syncer.LastSuccess().Equal(success) {
+		t.Fatal("expected last success to be unchanged by a failed run")
+	}
+	if syncer.LastResult() == nil || syncer.LastResult().Rows != 2 {
+		t.Fatalf("expected last result to be unchanged by a failed run: %+v", syncer.LastResult())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingReader is a QueryReader that can't be read
+type failingReader struct {
+	err error
+}
+
+func (r failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func TestSyncerQueryReaderError(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	readErr := errors.New("could not read query file")
+	syncer := NewSyncer(&SyncOptions{
+		Postgres:    pg,
+		AskGit:      newSource(t, commitRows()),
+		TableName:   "commits",
+		QueryReader: failingReader{readErr},
+		Logger:      zap.NewNop(),
+	})
+
+	// failing to read the query fails the run before it syncs, which is recorded all the same
+	if _, err := syncer.Run(context.Background()); !errors.Is(err, readErr) {
+		t.Fatalf("expected run to fail with %v, got: %v", readErr, err)
+	}
+	if !errors.Is(syncer.LastError(), readErr) {
+		t.Fatalf("expected last error to be %v, got: %v", readErr, syncer.LastError())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncerConcurrentRuns(t *testing.T) {
+	d := newRecordingDriver()
+	sql.Register("pgsync-recording-syncer", d)
+	pg, err := sql.Open("pgsync-recording-syncer", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const runs = 16
+	askgit, source, _ := sqlmock.New()
+	source.MatchExpectationsInOrder(false)
+	for i := 0; i < runs; i++ {
+		source.ExpectQuery(".").WillReturnRows(manyCommitRows(i + 1))
+	}
+
+	syncer := NewSyncer(&SyncOptions{
+		Postgres:    pg,
+		AskGit:      askgit,
+		TableName:   "commits",
+		QueryReader: strings.NewReader("SELECT hash, additions FROM commits"),
+		Logger:      zap.NewNop(),
+	})
+
+	var wg sync.WaitGroup
+	results := make([]*SyncResult, runs)
+	errs := make([]error, runs)
+	for i := 0; i < runs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = syncer.RunTable(context.Background(), fmt.Sprintf("commits_%d", i), "")
+			syncer.LastSuccess()
+			syncer.LastResult()
+		}(i)
+	}
+	wg.Wait()
+
+	// each source query produced a different number of rows, so every run must have had one of its own
+	seen := make(map[int64]bool)
+	for i := 0; i < runs; i++ {
+		if errs[i] != nil {
+			t.Fatalf("run %d: %v", i, errs[i])
+		}
+		if seen[results[i].Rows] {
+			t.Fatalf("run %d: another run also copied %d rows", i, results[i].Rows)
+		}
+		seen[results[i].Rows] = true
+	}
+
+	var total int
+	for _, count := range d.copied {
+		total += count
+	}
+	if expected := runs * (runs + 1) / 2; total != expected {
+		t.Fatalf("expected %d rows to be copied in all, got %d", expected, total)
+	}
+
+	if syncer.LastError() != nil || syncer.LastResult() == nil {
+		t.Fatalf("expected the last run to be recorded as a success, got: %v", syncer.LastError())
+	}
+}
+
+// countingRows is a rowSource of n rows, each the number of the row
+type countingRows struct{ n, read int }
+
+func (r *countingRows) Next() bool {
+	r.read++
+	return r.read <= r.n
+}
+func (r *countingRows) Scan(dest ...interface{}) error {
+	*dest[0].(*interface{}) = r.read
+	return nil
+}
+func (r *countingRows) Err() error { return nil }
+
+func TestPausableRows(t *testing.T) {
+	gate := &pauseGate{}
+	rows := &pausableRows{rowSource: &countingRows{n: 3}, ctx: context.Background(), gate: gate}
+
+	var value interface{}
+	if !rows.Next() || rows.Scan(&value) != nil || value != 1 {
+		t.Fatalf("expected the first row, got %v", value)
+	}
+
+	gate.pause()
+	next := make(chan bool)
+	go func() { next <- rows.Next() }()
+	select {
+	case <-next:
+		t.Fatal("expected the next row to be held up while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// the row after the one read before the pause, nothing skipped or read twice
+	gate.resume()
+	if !<-next || rows.Scan(&value) != nil || value != 2 {
+		t.Fatalf("expected the second row once resumed, got %v", value)
+	}
+
+	// a paused sync that's cancelled stops with the context's error
+	gate.pause()
+	ctx, cancel := context.WithCancel(context.Background())
+	rows.ctx = ctx
+	cancel()
+	if rows.Next() || !errors.Is(rows.Err(), context.Canceled) {
+		t.Fatalf("expected the cancellation, got: %v", rows.Err())
+	}
+}
+
+func TestSyncerPause(t *testing.T) {
+	d := newRecordingDriver()
+	sql.Register("pgsync-recording-pause", d)
+	pg, err := sql.Open("pgsync-recording-pause", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syncer := NewSyncer(&SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, manyCommitRows(10)),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+	})
+	syncer.Pause()
+	if !syncer.Paused() {
+		t.Fatal("expected the syncer to be paused")
+	}
+
+	done := make(chan *SyncResult)
+	go func() {
+		result, err := syncer.Run(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		done <- result
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected the run to be held up while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+	d.mu.Lock()
+	copied := len(d.copied)
+	d.mu.Unlock()
+	if copied != 0 {
+		t.Fatalf("expected no rows to be copied while paused, %d were", copied)
+	}
+
+	syncer.Resume()
+	if result := <-done; result == nil || result.Rows != 10 {
+		t.Fatalf("expected all 10 rows once resumed, got: %+v", result)
+	}
+}
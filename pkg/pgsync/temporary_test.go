@@ -0,0 +1,43 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncTemporary(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the table is loaded in place, with no rename, and nothing is expected after the COPY but the commit
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE IF EXISTS pg_temp."commits"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TEMP TABLE "commits" (`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		Temporary: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rows != 2 {
+		t.Fatalf("expected 2 rows, got %d", result.Rows)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,104 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// rawRowColumn is the column of the raw table of a load with SyncOptions.StageAsText that numbers its rows
+const rawRowColumn = "pgsync_row"
+
+// castColumns returns the expression each of columns is inserted into the staging table with, cast from text to
+// its type in defs, along with the condition that a row's values can be cast and the error message of each that can't
+// be, for the columns that aren't text
+func castColumns(columns []string, defs []columnDef) (casts, valid, errs []string) {
+	types := make(map[string]string, len(defs))
+	for _, def := range defs {
+		types[def.Name] = def.Type
+	}
+
+	casts = make([]string, len(columns))
+	for i, col := range columns {
+		c, typ := pq.QuoteIdentifier(col), types[col]
+		if typ == "" || typ == "text" {
+			casts[i] = c
+			continue
+		}
+		casts[i] = fmt.Sprintf("%s::%s", c, typ)
+
+		cond := fmt.Sprintf("(%s IS NULL OR pg_input_is_valid(%s, %s))", c, c, pq.QuoteLiteral(typ))
+		valid = append(valid, cond)
+		errs = append(errs, fmt.Sprintf("CASE WHEN NOT %s THEN %s || (pg_input_error_info(%s, %s)).message END",
+			cond, pq.QuoteLiteral(fmt.Sprintf("column %s: ", col)), c, pq.QuoteLiteral(typ)))
+	}
+	return casts, valid, errs
+}
+
+// copyAsText is copyRows for loads that check the types of values in Postgres rather than in the COPY. The rows are
+// copied into a temporary table of text columns (named after table), which rejects next to nothing, then inserted into
+// table with every value cast to the type of its column. Rows with a value that can't be are recorded in the deadLetters
+// table (against target, the table being synced) with the errors casting them, rather than failing the load.
+// Returns the number of rows loaded and the number dead lettered. Needs Postgres 16 or later, for pg_input_is_valid
+func copyAsText(ctx context.Context, tx *sql.Tx, rows rowSource, table string, columns []string, defs []columnDef, numColumns int, transform rowTransform, deadLetters, target string) (int64, int64, error) {
+	if err := createDeadLetterTable(ctx, tx, deadLetters); err != nil {
+		return 0, 0, err
+	}
+
+	raw := table + "_raw"
+	r := pq.QuoteIdentifier(raw)
+	texts := make([]string, len(columns))
+	for i, col := range columns {
+		texts[i] = pq.QuoteIdentifier(col) + " text"
+	}
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TEMP TABLE %s (%s bigint GENERATED ALWAYS AS IDENTITY, %s) ON COMMIT DROP",
+		r, rawRowColumn, strings.Join(texts, ", ")))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(raw, columns...))
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := copyRows(ctx, rows, stmt, numColumns, transform); err != nil {
+		_ = stmt.Close()
+		return 0, 0, err
+	}
+	if err := stmt.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	casts, valid, errs := castColumns(columns, defs)
+	insert := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", pq.QuoteIdentifier(table), quoteAll("", columns), strings.Join(casts, ", "), r)
+	castable := strings.Join(valid, " AND ")
+	if castable != "" {
+		insert += " WHERE " + castable
+	}
+	res, err := tx.ExecContext(ctx, insert+" ORDER BY "+rawRowColumn)
+	if err != nil {
+		return 0, 0, schemaMismatch(target, err)
+	}
+	loaded, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var failed int64
+	if castable != "" {
+		res, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (table_name, row_number, row_values, error) SELECT $1, %s, to_jsonb(r) - %s, concat_ws('; ', %s) FROM %s AS r WHERE NOT (%s)`,
+			pq.QuoteIdentifier(deadLetters), rawRowColumn, pq.QuoteLiteral(rawRowColumn), strings.Join(errs, ", "), r, castable), target)
+		if err != nil {
+			return loaded, 0, err
+		}
+		if failed, err = res.RowsAffected(); err != nil {
+			return loaded, 0, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", r))
+	return loaded, failed, err
+}
@@ -0,0 +1,61 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncStageAsText(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+	).
+		AddRow("abc", int64(1)).
+		AddRow("def", "many")
+
+	castable := `("additions" IS NULL OR pg_input_is_valid("additions", 'integer'))`
+
+	// both rows are copied as text, the one that can't be cast is dead lettered with the error casting it
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "dead_letters"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TEMP TABLE "commits_temp_raw" (pgsync_row bigint GENERATED ALWAYS AS IDENTITY, "hash" text, "additions" text) ON COMMIT DROP`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp_raw"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", "many"})
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits_temp" ("hash", "additions") SELECT "hash", "additions"::integer FROM "commits_temp_raw" WHERE ` + castable + ` ORDER BY pgsync_row`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "dead_letters" (table_name, row_number, row_values, error) SELECT $1, pgsync_row, to_jsonb(r) - 'pgsync_row', concat_ws('; ', CASE WHEN NOT ` + castable + ` THEN 'column additions: ' || (pg_input_error_info("additions", 'integer')).message END) FROM "commits_temp_raw" AS r WHERE NOT (` + castable + `)`)).
+		WithArgs("commits").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp_raw"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, source),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		StageAsText:     true,
+		DeadLetterTable: "dead_letters",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 1 || result.DeadLettered != 1 {
+		t.Fatalf("expected 1 row loaded and 1 dead lettered, got %d and %d", result.Rows, result.DeadLettered)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,39 @@
+package pgsync
+
+import (
+	"time"
+)
+
+const (
+	// timeType and timeTZType are the Postgres types of SQLite TIME columns (see SyncOptions.TimesWithTimeZone),
+	// named as format_type names them
+	timeType   = "time without time zone"
+	timeTZType = "time with time zone"
+)
+
+// timeOfDayTransform returns a rowTransform that writes the time values of the time of day columns of defs as
+// the time of day alone, as a driver would otherwise write the whole timestamp, date (of year 0) and all.
+// It returns nil if there are no such columns
+func timeOfDayTransform(defs []columnDef, numColumns int) rowTransform {
+	layouts := make(map[int]string)
+	for c := 0; c < numColumns; c++ {
+		switch defs[c].Type {
+		case timeType:
+			layouts[c] = "15:04:05.999999"
+		case timeTZType:
+			layouts[c] = "15:04:05.999999-07:00"
+		}
+	}
+	if len(layouts) == 0 {
+		return nil
+	}
+
+	return func(values []interface{}) ([]interface{}, error) {
+		for c, layout := range layouts {
+			if t, ok := values[c].(time.Time); ok {
+				values[c] = t.Format(layout)
+			}
+		}
+		return values, nil
+	}
+}
@@ -0,0 +1,57 @@
+package pgsync
+
+import (
+	"context"
+)
+
+// Tracer starts the spans a sync is traced with (see SyncOptions.Tracer). It's small enough to be implemented by
+// wrapping an OpenTelemetry trace.Tracer, without pgsync depending on OpenTelemetry itself
+type Tracer interface {
+	// Start starts a span named name, as a child of the span in ctx if there is one, returning a context carrying the new span
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	// SetAttribute records an attribute of the span, such as the table name or the number of rows
+	SetAttribute(key string, value interface{})
+	// RecordError records that what the span traces failed with err
+	RecordError(err error)
+	// End ends the span
+	End()
+}
+
+// stageSpan is the span of a stage of a sync, which can be ended more than once with only the first counting, so that it
+// can be ended both where the stage finishes and, in case a failure means that's never reached, when the sync returns.
+// Its methods do nothing when the sync isn't traced
+type stageSpan struct {
+	span  Span
+	ended bool
+}
+
+// startSpan starts a span named name with tracer, if set
+func startSpan(ctx context.Context, tracer Tracer, name string) (context.Context, *stageSpan) {
+	if tracer == nil {
+		return ctx, &stageSpan{}
+	}
+	ctx, span := tracer.Start(ctx, name)
+	return ctx, &stageSpan{span: span}
+}
+
+func (s *stageSpan) set(key string, value interface{}) {
+	if s.span != nil {
+		s.span.SetAttribute(key, value)
+	}
+}
+
+// end ends the span, recording err if it's not nil
+func (s *stageSpan) end(err error) {
+	if s.span == nil || s.ended {
+		return
+	}
+	s.ended = true
+	if err != nil {
+		s.span.RecordError(err)
+	}
+	s.span.End()
+}
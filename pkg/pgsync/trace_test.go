@@ -0,0 +1,134 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+// memorySpan is a span recorded by a memoryTracer
+type memorySpan struct {
+	name       string
+	parent     *memorySpan
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (s *memorySpan) SetAttribute(key string, value interface{}) { s.attributes[key] = value }
+func (s *memorySpan) RecordError(err error)                      { s.err = err }
+func (s *memorySpan) End()                                       { s.ended = true }
+
+type spanKey struct{}
+
+// memoryTracer is a Tracer that keeps the spans it starts, in the order they're started
+type memoryTracer struct {
+	spans []*memorySpan
+}
+
+func (m *memoryTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*memorySpan)
+	span := &memorySpan{name: name, parent: parent, attributes: make(map[string]interface{})}
+	m.spans = append(m.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func TestSyncTracer(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	tracer := &memoryTracer{}
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		Tracer:    tracer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"pgsync.sync", "pgsync.query", "pgsync.copy", "pgsync.swap"}
+	if len(tracer.spans) != len(names) {
+		t.Fatalf("expected %d spans, got %d", len(names), len(tracer.spans))
+	}
+	root := tracer.spans[0]
+	for i, span := range tracer.spans {
+		if span.name != names[i] {
+			t.Fatalf("expected span %d to be %s, got %s", i, names[i], span.name)
+		}
+		if !span.ended {
+			t.Fatalf("expected span %s to have ended", span.name)
+		}
+		if i > 0 && span.parent != root {
+			t.Fatalf("expected span %s to be a child of the sync's span", span.name)
+		}
+	}
+	if root.parent != nil {
+		t.Fatal("expected the sync's span to have no parent")
+	}
+
+	if root.attributes["pgsync.table"] != "commits" || root.attributes["pgsync.rows"] != int64(2) {
+		t.Fatalf("unexpected attributes of the sync's span: %v", root.attributes)
+	}
+	if tracer.spans[2].attributes["pgsync.rows"] != int64(2) {
+		t.Fatalf("unexpected attributes of the copy's span: %v", tracer.spans[2].attributes)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncTracerError(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	failed := errors.New("relation is locked")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectQuery("SELECT relkind FROM pg_class").WillReturnError(failed)
+	mock.ExpectRollback()
+
+	tracer := &memoryTracer{}
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, commitRows()),
+		TableName: "commits",
+		Query:     "SELECT hash, additions FROM commits",
+		Logger:    zap.NewNop(),
+		Tracer:    tracer,
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("expected the swap's error, got: %v", err)
+	}
+
+	// the failing stage and the sync both record the error, every span is ended
+	for _, span := range tracer.spans {
+		if !span.ended {
+			t.Fatalf("expected span %s to have ended", span.name)
+		}
+		if recorded := span.name == "pgsync.sync" || span.name == "pgsync.swap"; recorded != errors.Is(span.err, failed) {
+			t.Fatalf("unexpected error recorded by span %s: %v", span.name, span.err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
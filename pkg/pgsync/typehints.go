@@ -0,0 +1,45 @@
+package pgsync
+
+import (
+	"regexp"
+	"strings"
+)
+
+// typeHintSeparator separates the name of a column from the Postgres type it's hinted to be (see SyncOptions.TypeHints)
+const typeHintSeparator = "__pgtype_"
+
+// hintedType matches the Postgres types a column can be hinted to be, a type name alone (such as jsonb or timestamptz)
+var hintedType = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// stripTypeHints returns names without the type hints of those that have one, and the hinted type of each of them
+// by the name it's left with
+func stripTypeHints(names []string) ([]string, map[string]string, error) {
+	stripped := make([]string, len(names))
+	hints := make(map[string]string)
+	for i, name := range names {
+		stripped[i] = name
+
+		at := strings.LastIndex(name, typeHintSeparator)
+		if at < 0 {
+			continue
+		}
+
+		stripped[i], hints[name[:at]] = name[:at], name[at+len(typeHintSeparator):]
+		switch {
+		case stripped[i] == "":
+			return nil, nil, invalidOptions("column %s is hinted to be a type but has no name", name)
+		case !hintedType.MatchString(hints[stripped[i]]):
+			return nil, nil, invalidOptions("column %s is hinted to be %q, which isn't the name of a type", name, hints[stripped[i]])
+		}
+	}
+
+	for i, name := range stripped {
+		for j := range stripped[:i] {
+			if stripped[j] == name && (names[i] != name || names[j] != name) {
+				return nil, nil, invalidOptions("columns %s and %s would both be named %s", names[j], names[i], name)
+			}
+		}
+	}
+
+	return stripped, hints, nil
+}
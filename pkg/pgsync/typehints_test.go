@@ -0,0 +1,67 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncTypeHints(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("authored__pgtype_timestamptz").OfType("", ""),
+	).AddRow("abc", "2021-03-01T12:00:00Z")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"hash" text,\s*"authored" timestamptz\s*\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp" ("hash", "authored")`, []driver.Value{"abc", "2021-03-01T12:00:00Z"})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, source),
+		TableName: "commits",
+		Query:     "SELECT hash, datetime(author_when) AS authored__pgtype_timestamptz FROM commits",
+		Logger:    zap.NewNop(),
+		TypeHints: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Columns[1] != "authored" || result.Types[1].PostgresType != "timestamptz" || !result.Types[1].Overridden {
+		t.Fatalf("expected authored to be hinted to be a timestamptz, got: %+v", result.Types[1])
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStripTypeHints(t *testing.T) {
+	names, hints, err := stripTypeHints([]string{"hash", "parents__pgtype_jsonb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names[0] != "hash" || names[1] != "parents" || len(hints) != 1 || hints["parents"] != "jsonb" {
+		t.Fatalf("unexpected names %q and hints %v", names, hints)
+	}
+
+	for _, invalid := range [][]string{
+		{"__pgtype_jsonb"},
+		{"parents__pgtype_jsonb; DROP TABLE commits"},
+		{"parents", "parents__pgtype_jsonb"},
+	} {
+		if _, _, err := stripTypeHints(invalid); !errors.Is(err, ErrInvalidOptions) {
+			t.Fatalf("expected ErrInvalidOptions for %q, got: %v", invalid, err)
+		}
+	}
+}
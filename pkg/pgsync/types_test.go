@@ -0,0 +1,561 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+func TestSyncTypeMapper(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+		sqlmock.NewColumn("parents").OfType("JSON", ""),
+	).AddRow("abc", int64(1), `["def"]`)
+
+	// known types go to the built-in mapping, anything else is assumed to be JSON
+	mapper := func(col *sql.ColumnType) (string, error) {
+		switch col.DatabaseTypeName() {
+		case "TEXT", "INT", "INTEGER", "DATETIME", "BOOLEAN":
+			return SQLiteTypeToPostgresType(col), nil
+		default:
+			return "jsonb", nil
+		}
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"hash" text,\s*"additions" integer,\s*"parents" jsonb`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1), `["def"]`})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:   pg,
+		AskGit:     newSource(t, source),
+		TableName:  "commits",
+		Query:      "SELECT hash, additions, parents FROM commits",
+		Logger:     zap.NewNop(),
+		TypeMapper: mapper,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncTypeMapperError(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	unmappable := errors.New("no mapping")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:   pg,
+		AskGit:     newSource(t, commitRows()),
+		TableName:  "commits",
+		Query:      "SELECT hash, additions FROM commits",
+		Logger:     zap.NewNop(),
+		TypeMapper: func(*sql.ColumnType) (string, error) { return "", unmappable },
+	})
+	if !errors.Is(err, unmappable) {
+		t.Fatalf("expected the mapper's error, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncDecimalPrecision(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// SELECT CAST(ratio AS DECIMAL(12,4)) AS ratio, CAST(total AS NUMERIC(8)) AS total
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("ratio").OfType("DECIMAL(12,4)", float64(0)),
+		sqlmock.NewColumn("total").OfType("NUMERIC(8)", int64(0)),
+		sqlmock.NewColumn("approx").OfType("DECIMAL", float64(0)),
+	).AddRow(0.1234, int64(10), 1.5)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"ratio" numeric\(12,4\),\s*"total" numeric\(8\),\s*"approx" text`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"0.1234", int64(10), "1.5"})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, source),
+		TableName: "commits",
+		Query:     "SELECT CAST(ratio AS DECIMAL(12,4)) AS ratio, CAST(total AS NUMERIC(8)) AS total, approx FROM stats",
+		Logger:    zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncCharacterLength(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("name").OfType("VARCHAR(50)", ""),
+		sqlmock.NewColumn("code").OfType("NCHAR(2)", ""),
+		sqlmock.NewColumn("body").OfType("CLOB", ""),
+	).AddRow("askgit", "go", "readme")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"name" character varying\(50\),\s*"code" character\(2\),\s*"body" text`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"askgit", "go", "readme"})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, source),
+		TableName: "commits",
+		Query:     "SELECT name, code, body FROM repos",
+		Logger:    zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncViewColumnTypes(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// CREATE VIEW commit_stats AS SELECT hash, total, ratio, additions + deletions AS churn FROM stats,
+	// where the view's columns have the types declared for the columns of stats, but churn is an expression
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("CHARACTER", ""),
+		sqlmock.NewColumn("total").OfType("BIGINT", int64(0)),
+		sqlmock.NewColumn("ratio").OfType("FLOAT8", float64(0)),
+		sqlmock.NewColumn("churn").OfType("", int64(0)),
+	).AddRow("abc", int64(10), float64(1), int64(7))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"hash" text,\s*"total" bigint,\s*"ratio" double precision,\s*"churn" text`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(10), sqlmock.AnyArg(), int64(7)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, source),
+		TableName: "commits",
+		Query:     "SELECT hash, total, ratio, churn FROM commit_stats",
+		Logger:    zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncAskGitColumnTypes(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// columns of askgit's tables, as their declared types come back from the driver
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("author_when").OfType("DATETIME", time.Time{}),
+		sqlmock.NewColumn("parents").OfType("INT", int64(0)),
+		sqlmock.NewColumn("executable").OfType("INT", int64(0)),
+		sqlmock.NewColumn("contents").OfType("BLOB", []byte(nil)),
+		sqlmock.NewColumn("is_fork").OfType("BOOLEAN", false),
+	).AddRow("abc", time.Date(2021, 8, 1, 12, 30, 0, 0, time.UTC), int64(1), int64(0), []byte("# askgit"), false)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"hash" text,\s*"author_when" timestamp with time zone,\s*"parents" integer,\s*"executable" integer,\s*"contents" bytea,\s*"is_fork" boolean`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"files_temp"`, []driver.Value{"abc", sqlmock.AnyArg(), int64(1), int64(0), []byte("# askgit"), false})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, source),
+		TableName: "files",
+		Query:     "SELECT hash, author_when, parents, executable, contents, is_fork FROM files",
+		Logger:    zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, w := range result.Warnings {
+		if strings.Contains(w, `"contents"`) {
+			t.Fatalf("expected the contents of files to have a mapping of their own, got: %s", w)
+		}
+	}
+	if d := result.Types[4]; d.PostgresType != "bytea" || d.Overridden {
+		t.Fatalf("expected the contents of files to be bytea by the built-in mapping, got: %+v", d)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncDefaultColumnType(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("parents").OfType("JSON", ""),
+		sqlmock.NewColumn("stats").OfType("", ""),
+		sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)),
+	).AddRow("abc", `["def"]`, `{"files": 2}`, int64(1))
+
+	// only the columns the built-in mapping doesn't know the type of are jsonb
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"hash" text,\s*"parents" jsonb,\s*"stats" jsonb,\s*"additions" integer`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", `["def"]`, `{"files": 2}`, int64(1)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:          pg,
+		AskGit:            newSource(t, source),
+		TableName:         "commits",
+		Query:             "SELECT hash, parents, json_object('files', files) AS stats, additions FROM commits",
+		Logger:            zap.NewNop(),
+		DefaultColumnType: "jsonb",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Warnings) != 1 {
+		t.Fatalf("expected only the integer column to be warned about, got: %v", result.Warnings)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTypeWarning(t *testing.T) {
+	cases := map[TypeDecision]bool{
+		{Column: "hash", DatabaseType: "TEXT", PostgresType: "text"}:                             false,
+		{Column: "hash", DatabaseType: "VARCHAR", PostgresType: "text"}:                          false,
+		{Column: "parents", DatabaseType: "JSON", PostgresType: "text"}:                          true,
+		{Column: "additions", DatabaseType: "INTEGER", PostgresType: "integer"}:                  true,
+		{Column: "additions", DatabaseType: "INTEGER", PostgresType: "bigint", Overridden: true}: false,
+		{Column: "ratio", DatabaseType: "REAL", PostgresType: "double precision"}:                false,
+	}
+	for d, warned := range cases {
+		if w := typeWarning(d); (w != "") != warned || warned && !strings.Contains(w, pq.QuoteIdentifier(d.Column)) {
+			t.Fatalf("unexpected warning for %+v: %q", d, w)
+		}
+	}
+}
+
+func TestSyncTypeDecisions(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("", ""),
+		sqlmock.NewColumn("author_when").OfType("INTEGER", int64(0)),
+	).AddRow("abc", int64(1600000000))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", sqlmock.AnyArg()})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:     pg,
+		AskGit:       newSource(t, source),
+		TableName:    "commits",
+		Query:        "SELECT hash, author_when FROM commits",
+		Logger:       zap.NewNop(),
+		EpochColumns: map[string]EpochUnit{"author_when": EpochSeconds},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the expression column falls through to text, the epoch column is overridden
+	expected := []TypeDecision{
+		{Column: "hash", DatabaseType: "", PostgresType: "text"},
+		{Column: "author_when", DatabaseType: "INTEGER", PostgresType: "timestamp with time zone", Overridden: true},
+	}
+	if len(result.Types) != len(expected) {
+		t.Fatalf("expected %d type decisions, got: %+v", len(expected), result.Types)
+	}
+	for i, d := range expected {
+		if result.Types[i] != d {
+			t.Fatalf("expected %+v, got %+v", d, result.Types[i])
+		}
+	}
+
+	// only the column that fell through to text is warned about, the epoch column is what was asked for
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], `"hash"`) {
+		t.Fatalf("expected a warning about hash, got: %q", result.Warnings)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncFloatPrecision(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	tricky := 0.1 + 0.2
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("ratio").OfType("REAL", float64(0)),
+		sqlmock.NewColumn("tiny").OfType("REAL", float64(0)),
+	).AddRow(tricky, 1e-300)
+
+	var copied recordText
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	prep := mock.ExpectPrepare(regexp.QuoteMeta(`COPY "commits_temp"`))
+	prep.ExpectExec().WithArgs(&copied, &copied).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(0, 1))
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, source),
+		TableName: "commits",
+		Query:     "SELECT ratio, tiny FROM stats",
+		Logger:    zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []float64{tricky, 1e-300} {
+		f, err := strconv.ParseFloat(copied[i], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Float64bits(f) != math.Float64bits(expected) {
+			t.Fatalf("expected %v to round-trip, got %s", expected, copied[i])
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordText is a sqlmock.Argument that matches text values, appending them to values
+type recordText []string
+
+func (r *recordText) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	if ok {
+		*r = append(*r, s)
+	}
+	return ok
+}
+
+func TestSyncTypeNameCase(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// SQLite reports types in the case they were declared in
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("ratio").OfType("real", float64(0)),
+		sqlmock.NewColumn("additions").OfType("Integer", int64(0)),
+		sqlmock.NewColumn("name").OfType("varchar(50)", ""),
+	).AddRow(0.5, int64(1), "askgit")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"ratio" double precision,\s*"additions" integer,\s*"name" character varying\(50\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"0.5", int64(1), "askgit"})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, source),
+		TableName: "commits",
+		Query:     "SELECT ratio, additions, name FROM stats",
+		Logger:    zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncTimeOfDay(t *testing.T) {
+	for _, withTimeZone := range []bool{false, true} {
+		pg, mock, _ := sqlmock.New()
+
+		source := sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("started").OfType("TIME", ""),
+			sqlmock.NewColumn("finished").OfType("TIME", time.Time{}),
+		).AddRow("09:30:00", time.Date(0, 1, 1, 17, 45, 30, 500000000, time.FixedZone("", 2*60*60)))
+
+		typ, finished := `time without time zone`, "17:45:30.5"
+		if withTimeZone {
+			typ, finished = `time with time zone`, "17:45:30.5+02:00"
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`"started" ` + typ + `,\s*"finished" ` + typ).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"09:30:00", finished})
+		expectSwap(mock)
+		expectProvenance(mock)
+		mock.ExpectCommit()
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:          pg,
+			AskGit:            newSource(t, source),
+			TableName:         "commits",
+			Query:             "SELECT started, finished FROM runs",
+			Logger:            zap.NewNop(),
+			TimesWithTimeZone: withTimeZone,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncInferNotNull(t *testing.T) {
+	for _, infer := range []bool{false, true} {
+		pg, mock, _ := sqlmock.New()
+
+		source := sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("hash").OfType("TEXT", "").Nullable(false),
+			sqlmock.NewColumn("additions").OfType("INTEGER", int64(0)).Nullable(true),
+		).AddRow("abc", int64(1))
+
+		hash := `"hash" text,`
+		if infer {
+			hash = `"hash" text NOT NULL,`
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(hash) + `\s*"additions" integer\s*\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)})
+		expectSwap(mock)
+		expectProvenance(mock)
+		mock.ExpectCommit()
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:     pg,
+			AskGit:       newSource(t, source),
+			TableName:    "commits",
+			Query:        "SELECT hash, additions FROM commits",
+			Logger:       zap.NewNop(),
+			InferNotNull: infer,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseBoolean(t *testing.T) {
+	for s, expected := range booleanStrings {
+		for _, v := range []string{s, strings.ToUpper(s), " " + s + " "} {
+			if b, ok := parseBoolean(v); !ok || b != expected {
+				t.Fatalf("expected %q to be read as %t", v, expected)
+			}
+		}
+	}
+	if _, ok := parseBoolean("maybe"); ok {
+		t.Fatal("expected maybe not to be read as a boolean")
+	}
+}
+
+func TestSyncTextBooleans(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("hash").OfType("TEXT", ""),
+		sqlmock.NewColumn("merged").OfType("BOOLEAN", ""),
+	).AddRow("abc", "Yes").AddRow("def", "f").AddRow("ghi", "maybe")
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"merged" boolean`).WillReturnResult(sqlmock.NewResult(0, 0))
+	prep := mock.ExpectPrepare(regexp.QuoteMeta(`COPY "commits_temp"`))
+	prep.ExpectExec().WithArgs("abc", true).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs("def", false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:  pg,
+		AskGit:    newSource(t, source),
+		TableName: "commits",
+		Query:     "SELECT hash, merged FROM commits",
+		Logger:    zap.NewNop(),
+	})
+	if err == nil || !strings.Contains(err.Error(), `column merged: "maybe" is not a boolean`) {
+		t.Fatalf("expected maybe to fail the sync, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
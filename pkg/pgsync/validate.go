@@ -0,0 +1,62 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// validationTable is replaced in SyncOptions.ValidationQuery with the name of the staging table
+const validationTable = "{{table}}"
+
+// validateStaging runs the validation query of options against the staging table, and checks its result with
+// options.ValidationCheck, or that it's a single true if there's no check. A failed check is an ErrValidationFailed
+func validateStaging(ctx context.Context, tx *sql.Tx, options *SyncOptions, staging string) error {
+	query := strings.ReplaceAll(options.ValidationQuery, validationTable, QuoteAlways.qualify(options.Schema, staging))
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("could not run the validation query: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	var values []interface{}
+	if rows.Next() {
+		values = make([]interface{}, len(columns))
+		dest := make([]interface{}, len(values))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	check := options.ValidationCheck
+	if check == nil {
+		check = validationPassed
+	}
+	if err := check(values); err != nil {
+		return fmt.Errorf("%w: %v", ErrValidationFailed, err)
+	}
+	return nil
+}
+
+// validationPassed is the check of a validation query with no ValidationCheck: that it produced a single true
+func validationPassed(values []interface{}) error {
+	if len(values) != 1 {
+		return errors.New("the validation query must produce a single value, or be given a check")
+	}
+	if passed, ok := values[0].(bool); !ok || !passed {
+		return fmt.Errorf("the validation query produced %v", values[0])
+	}
+	return nil
+}
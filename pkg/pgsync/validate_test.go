@@ -0,0 +1,86 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncValidationQuery(t *testing.T) {
+	for _, passes := range []bool{true, false} {
+		pg, mock, _ := sqlmock.New()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) = count(hash) FROM "commits_temp"`)).
+			WillReturnRows(sqlmock.NewRows([]string{"valid"}).AddRow(passes))
+		if passes {
+			expectSwap(mock)
+			expectProvenance(mock)
+			mock.ExpectCommit()
+		} else {
+			// the live table is never touched
+			mock.ExpectRollback()
+		}
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres:        pg,
+			AskGit:          newSource(t, commitRows()),
+			TableName:       "commits",
+			Query:           "SELECT hash, additions FROM commits",
+			Logger:          zap.NewNop(),
+			ValidationQuery: "SELECT count(*) = count(hash) FROM {{table}}",
+		})
+		if passes && err != nil {
+			t.Fatal(err)
+		}
+		if !passes && !errors.Is(err, ErrValidationFailed) {
+			t.Fatalf("expected ErrValidationFailed, got: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncValidationCheck(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "commits_temp"`)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(2)))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, commitRows()),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		ValidationQuery: "SELECT count(*) FROM {{table}}",
+		ValidationCheck: func(values []interface{}) error {
+			if n := values[0].(int64); n < 100 {
+				return fmt.Errorf("expected at least 100 rows, got %d", n)
+			}
+			return nil
+		},
+	})
+	if !errors.Is(err, ErrValidationFailed) {
+		t.Fatalf("expected ErrValidationFailed, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
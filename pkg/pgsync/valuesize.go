@@ -0,0 +1,50 @@
+package pgsync
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// maxValueSizeTransform returns a rowTransform that fails (or, if truncate, cuts down) text and binary values larger
+// than max bytes. Text is cut at a character boundary, so a truncated value may be a few bytes shorter than max
+func maxValueSizeTransform(colNames []string, max int, truncate bool) rowTransform {
+	return func(values []interface{}) ([]interface{}, error) {
+		for i, value := range values {
+			var size int
+			switch v := value.(type) {
+			case string:
+				size = len(v)
+			case []byte:
+				size = len(v)
+			default:
+				continue
+			}
+			if size <= max {
+				continue
+			}
+
+			if !truncate {
+				return nil, fmt.Errorf("column %s: value of %d bytes is larger than the maximum of %d", colNames[i], size, max)
+			}
+
+			switch v := value.(type) {
+			case string:
+				values[i] = truncateUTF8(v, max)
+			case []byte:
+				values[i] = v[:max]
+			}
+		}
+		return values, nil
+	}
+}
+
+// truncateUTF8 returns the longest prefix of s that's at most n bytes, without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
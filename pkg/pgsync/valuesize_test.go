@@ -0,0 +1,194 @@
+package pgsync
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncMaxValueSize(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	huge := bytes.Repeat([]byte{0xff}, 8<<20)
+	source := sqlmock.NewRowsWithColumnDefinition(
+		sqlmock.NewColumn("path").OfType("TEXT", ""),
+		sqlmock.NewColumn("contents").OfType("BLOB", []byte(nil)),
+	).AddRow("README.md", []byte("# askgit")).AddRow("testdata/large.bin", huge)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectPrepare("COPY")
+	mock.ExpectExec("COPY").WithArgs("README.md", []byte("# askgit")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:     pg,
+		AskGit:       newSource(t, source),
+		TableName:    "files",
+		Query:        "SELECT path, contents FROM files",
+		Logger:       zap.NewNop(),
+		MaxValueSize: 1 << 20,
+	})
+	if err == nil || !strings.Contains(err.Error(), "column contents: value of 8388608 bytes is larger than the maximum of 1048576") {
+		t.Fatalf("expected the oversized value to fail the sync, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxValueSizeTruncate(t *testing.T) {
+	truncate := maxValueSizeTransform([]string{"message", "contents", "additions"}, 2, true)
+
+	values, err := truncate([]interface{}{"héllo", []byte("abcdef"), int64(123456)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// é takes two bytes, so only the h fits in two
+	expected := []interface{}{"h", []byte("ab"), int64(123456)}
+	for i := range expected {
+		if !bytesOrEqual(values[i], expected[i]) {
+			t.Fatalf("expected %v, got %v", expected, values)
+		}
+	}
+}
+
+// bytesOrEqual reports whether a and b are equal, comparing byte slices by content
+func bytesOrEqual(a, b interface{}) bool {
+	if ab, ok := a.([]byte); ok {
+		bb, ok := b.([]byte)
+		return ok && bytes.Equal(ab, bb)
+	}
+	return a == b
+}
+
+func TestSyncMaxRowBytes(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		pg, mock, _ := sqlmock.New()
+
+		// neither value is too large on its own, but together they make for a wide row
+		wide := strings.Repeat("x", 600)
+		source := sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("path").OfType("TEXT", ""),
+			sqlmock.NewColumn("contents").OfType("TEXT", ""),
+		).
+			AddRow("README.md", "# askgit").
+			AddRow(wide, wide).
+			AddRow("LICENSE", "MIT")
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		if skip {
+			mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "pgsync_dead_letters"`).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("^SAVEPOINT " + deadLetterSavepoint + "$").WillReturnResult(sqlmock.NewResult(0, 0))
+			expectCopy(mock, `"files_temp"`, []driver.Value{"README.md", "# askgit"}, []driver.Value{"LICENSE", "MIT"})
+			mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "pgsync_dead_letters"`).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "pgsync_dead_letters" (table_name, row_number, error)`)).
+				WithArgs("files", int64(2), "row of 1200 bytes is larger than the maximum of 1024").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectSwap(mock)
+			expectProvenance(mock)
+			mock.ExpectCommit()
+		} else {
+			mock.ExpectPrepare("COPY")
+			mock.ExpectExec("COPY").WithArgs("README.md", "# askgit").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectRollback()
+		}
+
+		options := &SyncOptions{
+			Postgres:          pg,
+			AskGit:            newSource(t, source),
+			TableName:         "files",
+			Query:             "SELECT path, contents FROM files",
+			Logger:            zap.NewNop(),
+			MaxRowBytes:       1024,
+			SkipOversizedRows: skip,
+		}
+		if skip {
+			options.DeadLetterTable = "pgsync_dead_letters"
+		}
+		result, err := Sync(context.Background(), options)
+
+		if skip {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Rows != 2 || result.OversizedRows != 1 || result.DeadLettered != 1 {
+				t.Fatalf("expected 2 rows loaded and 1 dead lettered, got: %+v", result)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), "row 2 of 1200 bytes") {
+			t.Fatalf("expected the oversized row to fail the sync, got: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncBytesCopied(t *testing.T) {
+	sync := func(source *sqlmock.Rows, rows ...[]driver.Value) int64 {
+		pg, mock, _ := sqlmock.New()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectCopy(mock, `"files_temp"`, rows...)
+		expectSwap(mock)
+		expectProvenance(mock)
+		mock.ExpectCommit()
+
+		result, err := Sync(context.Background(), &SyncOptions{
+			Postgres:  pg,
+			AskGit:    newSource(t, source),
+			TableName: "files",
+			Query:     "SELECT path, contents FROM files",
+			Logger:    zap.NewNop(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+		return result.BytesCopied
+	}
+
+	files := func(contents ...string) (*sqlmock.Rows, [][]driver.Value) {
+		source := sqlmock.NewRowsWithColumnDefinition(
+			sqlmock.NewColumn("path").OfType("TEXT", ""),
+			sqlmock.NewColumn("contents").OfType("TEXT", ""),
+		)
+		var rows [][]driver.Value
+		for _, c := range contents {
+			source.AddRow("a.txt", c)
+			rows = append(rows, []driver.Value{"a.txt", c})
+		}
+		return source, rows
+	}
+
+	source, rows := files("abc", "de")
+	if n := sync(source, rows...); n != 15 {
+		t.Fatalf("expected 15 bytes copied, got %d", n)
+	}
+
+	// ten times the contents make for about ten times the bytes
+	small, large := strings.Repeat("x", 100), strings.Repeat("x", 1000)
+	source, rows = files(small, small)
+	smallBytes := sync(source, rows...)
+	source, rows = files(large, large)
+	largeBytes := sync(source, rows...)
+	if smallBytes != 210 || largeBytes != 2010 {
+		t.Fatalf("expected 210 and 2010 bytes copied, got %d and %d", smallBytes, largeBytes)
+	}
+}
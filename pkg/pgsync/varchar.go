@@ -0,0 +1,69 @@
+package pgsync
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// VarcharColumn describes a text column that's loaded as a varchar of bounded length
+type VarcharColumn struct {
+	// Length is the most characters a value can have
+	Length int
+	// TruncateOverflow cuts values that are too long down to Length characters, rather than failing the sync
+	TruncateOverflow bool
+}
+
+// postgresType returns the type of the column in Postgres, as format_type names it
+func (c VarcharColumn) postgresType() string {
+	return fmt.Sprintf("character varying(%d)", c.Length)
+}
+
+// varcharTransform returns a rowTransform that checks (or truncates) the values of the named varchar columns
+// against their length. Postgres counts the length of a varchar in characters, not bytes
+func varcharTransform(colNames []string, columns map[string]VarcharColumn) (rowTransform, error) {
+	bounded := make(map[int]VarcharColumn, len(columns))
+	for name, column := range columns {
+		if column.Length <= 0 {
+			return nil, invalidOptions("varchar column %s must have a positive length", name)
+		}
+
+		i := columnIndex(colNames, name)
+		if i < 0 {
+			return nil, invalidOptions("varchar column is not in the query results: %s", name)
+		}
+		bounded[i] = column
+	}
+
+	return func(values []interface{}) ([]interface{}, error) {
+		for i, column := range bounded {
+			var text string
+			switch v := values[i].(type) {
+			case string:
+				text = v
+			case []byte:
+				text = string(v)
+			default:
+				// NULLs, and numbers that Postgres converts itself
+				continue
+			}
+
+			if utf8.RuneCountInString(text) <= column.Length {
+				continue
+			}
+			if !column.TruncateOverflow {
+				return nil, fmt.Errorf("column %s: value of %d characters is too long for %s", colNames[i], utf8.RuneCountInString(text), column.postgresType())
+			}
+
+			runes := 0
+			for end := range text {
+				if runes == column.Length {
+					text = text[:end]
+					break
+				}
+				runes++
+			}
+			values[i] = text
+		}
+		return values, nil
+	}, nil
+}
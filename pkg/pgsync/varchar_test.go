@@ -0,0 +1,71 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestSyncVarcharTruncate(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := commitRows().AddRow("ghïjklmn", int64(3))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"hash" character varying\(4\),\s*"additions" integer`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)}, []driver.Value{"ghïj", int64(3)})
+	expectSwap(mock)
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:       pg,
+		AskGit:         newSource(t, source),
+		TableName:      "commits",
+		Query:          "SELECT hash, additions FROM commits",
+		Logger:         zap.NewNop(),
+		VarcharColumns: map[string]VarcharColumn{"hash": {Length: 4, TruncateOverflow: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncVarcharOverflow(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	source := commitRows().AddRow("ghïjklmn", int64(3))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`"hash" character varying\(4\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectPrepare("COPY")
+	mock.ExpectExec("COPY").WithArgs("abc", int64(1)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COPY").WithArgs("def", int64(2)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	_, err := Sync(context.Background(), &SyncOptions{
+		Postgres:       pg,
+		AskGit:         newSource(t, source),
+		TableName:      "commits",
+		Query:          "SELECT hash, additions FROM commits",
+		Logger:         zap.NewNop(),
+		VarcharColumns: map[string]VarcharColumn{"hash": {Length: 4}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "8 characters is too long for character varying(4)") {
+		t.Fatalf("expected an overflow error, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,80 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// integerRanks orders the integer types by the range of values they hold
+var integerRanks = map[string]int{"smallint": 1, "integer": 2, "bigint": 3}
+
+// varcharType matches a varchar type with a length, as format_type names it
+var varcharType = regexp.MustCompile(`^character varying\((\d+)\)$`)
+
+// widens reports whether a column of type from can be changed to type to without losing (or changing) any of its
+// values: to a wider integer type, from real to double precision, or from varchar to a longer varchar or text
+func widens(from, to string) bool {
+	from, to = strings.ToLower(from), strings.ToLower(to)
+
+	if f, ok := integerRanks[from]; ok {
+		t, ok := integerRanks[to]
+		return ok && t > f
+	}
+	if from == "real" {
+		return to == "double precision"
+	}
+	if from == "character varying" {
+		return to == "text"
+	}
+	if m := varcharType.FindStringSubmatch(from); m != nil {
+		if to == "text" || to == "character varying" {
+			return true
+		}
+		n := varcharType.FindStringSubmatch(to)
+		if n == nil {
+			return false
+		}
+		f, _ := strconv.Atoi(m[1])
+		t, _ := strconv.Atoi(n[1])
+		return t > f
+	}
+	return false
+}
+
+// widenColumns changes the type of every column of the existing table, in schema if set, that's narrower than the
+// column of defs it's loaded from to that column's type, where widens says it's safe (see SyncOptions.AutoWiden),
+// returning the columns it widened. A column that's already wider than its column of defs is left as it is, never narrowed.
+// Otherwise the columns are checked as checkSchema does
+func widenColumns(ctx context.Context, tx *sql.Tx, schema, table string, defs []columnDef) ([]string, error) {
+	columns, err := tableColumns(ctx, tx, schema, table)
+	if err != nil || columns == nil {
+		return nil, err
+	}
+
+	var widened []string
+	var checked []columnDef
+	for _, def := range defs {
+		actual, ok := columns[def.Name]
+		switch {
+		case ok && widens(actual, def.Type):
+			_, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s",
+				QuoteAlways.qualify(schema, table), pq.QuoteIdentifier(def.Name), def.Type))
+			if err != nil {
+				return widened, err
+			}
+			widened = append(widened, def.Name)
+		case ok && widens(def.Type, actual):
+			// the values fit the table's column as they are
+		default:
+			checked = append(checked, def)
+		}
+	}
+
+	return widened, compareColumns(table, checked, columns)
+}
@@ -0,0 +1,108 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestWidens(t *testing.T) {
+	cases := []struct {
+		from, to string
+		expected bool
+	}{
+		{"integer", "bigint", true},
+		{"smallint", "integer", true},
+		{"bigint", "integer", false},
+		{"integer", "integer", false},
+		{"real", "double precision", true},
+		{"double precision", "real", false},
+		{"character varying(10)", "text", true},
+		{"character varying(10)", "character varying(20)", true},
+		{"character varying(20)", "character varying(10)", false},
+		{"character varying", "text", true},
+		{"text", "character varying(10)", false},
+		{"integer", "text", false},
+	}
+
+	for _, c := range cases {
+		if widens(c.from, c.to) != c.expected {
+			t.Fatalf("expected widening %s to %s to be %v", c.from, c.to, c.expected)
+		}
+	}
+}
+
+func TestSyncAutoWiden(t *testing.T) {
+	// additions is an expression, which has no SQLite type, and its values have outgrown the table's integer column
+	sync := func(additionsType string, expect func(mock sqlmock.Sqlmock)) error {
+		pg, mock, _ := sqlmock.New()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+		expect(mock)
+
+		_, err := Sync(context.Background(), &SyncOptions{
+			Postgres: pg,
+			AskGit: newSource(t, sqlmock.NewRowsWithColumnDefinition(
+				sqlmock.NewColumn("hash").OfType("TEXT", ""),
+				sqlmock.NewColumn("additions").OfType(additionsType, int64(0)),
+			).AddRow("abc", int64(1)).AddRow("def", int64(5000000000))),
+			TableName:     "commits",
+			Query:         "SELECT hash, additions + 0 AS additions FROM commits",
+			Logger:        zap.NewNop(),
+			Mode:          ModeEnsureAndAppend,
+			InferFromData: true,
+			AutoWiden:     true,
+		})
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+		return err
+	}
+	appended := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery("SELECT relkind FROM pg_class").WithArgs(`"commits"`).WillReturnRows(sqlmock.NewRows([]string{"relkind"}).AddRow("r"))
+		expectCopy(mock, `"commits"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(5000000000)})
+		expectProvenance(mock)
+		mock.ExpectCommit()
+	}
+
+	// the integer column is widened to the bigint the values were inferred as
+	err := sync("", func(mock sqlmock.Sqlmock) {
+		expectTableColumns(mock, "hash", "text", "additions", "integer")
+		mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits" ALTER COLUMN "additions" TYPE bigint`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectGeneratedColumns(mock)
+		appended(mock)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a column that's already wide enough is left alone, and one that's wider than the results' isn't narrowed
+	for _, additionsType := range []string{"", "INTEGER"} {
+		err = sync(additionsType, func(mock sqlmock.Sqlmock) {
+			expectTableColumns(mock, "hash", "text", "additions", "bigint")
+			expectGeneratedColumns(mock)
+			appended(mock)
+		})
+		if err != nil {
+			t.Fatalf("%q: %v", additionsType, err)
+		}
+	}
+
+	// while a column that can't be widened safely still fails the sync
+	err = sync("", func(mock sqlmock.Sqlmock) {
+		expectTableColumns(mock, "hash", "integer", "additions", "integer")
+		mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "commits" ALTER COLUMN "additions" TYPE bigint`)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+	})
+	var mismatch *SchemaMismatchError
+	if !errors.As(err, &mismatch) || len(mismatch.Columns) != 1 || mismatch.Columns[0].Column != "hash" {
+		t.Fatalf("expected a schema mismatch on hash, got: %v", err)
+	}
+}
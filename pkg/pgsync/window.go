@@ -0,0 +1,41 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// appendWindowStatement returns the INSERT that appends the rows of staging to table, skipping those that have the same
+// keys as one of the rows of table in the overlap window, from the lowest value of window in staging up
+func appendWindowStatement(table, staging string, columns, keys []string, window string, nullSafe bool) string {
+	t, s, w := pq.QuoteIdentifier(table), pq.QuoteIdentifier(staging), pq.QuoteIdentifier(window)
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s AS s WHERE NOT EXISTS (SELECT 1 FROM %s AS t WHERE t.%s >= (SELECT min(%s) FROM %s) AND %s)",
+		t, quoteAll("", columns), quoteAll("s", columns), s, t, w, w, s, keysMatch("s", "t", keys, nullSafe))
+}
+
+// appendWindow appends the rows of the loaded staging table that aren't already in the table of options (see
+// ModeAppendWindow), creating the table if it doesn't exist yet, and records how many rows were inserted on result.
+// The staging table is dropped afterwards
+func appendWindow(ctx context.Context, tx *sql.Tx, options *SyncOptions, staging string, columns []string, result *SyncResult) error {
+	table := options.TableName
+
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (LIKE %s INCLUDING DEFAULTS)", pq.QuoteIdentifier(table), pq.QuoteIdentifier(staging)))
+	if err != nil {
+		return err
+	}
+
+	stmt := appendWindowStatement(table, staging, columns, options.ConflictColumns, options.WindowColumn, options.NullSafeConflictColumns)
+	res, err := tx.ExecContext(ctx, stmt)
+	if err != nil {
+		return schemaMismatch(table, err)
+	}
+	if result.Inserted, err = res.RowsAffected(); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE %s", pq.QuoteIdentifier(staging)))
+	return err
+}
@@ -0,0 +1,59 @@
+package pgsync
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.uber.org/zap"
+)
+
+func TestAppendWindowStatement(t *testing.T) {
+	insert := appendWindowStatement("events", "events_temp", []string{"id", "seen_at"}, []string{"id"}, "seen_at", false)
+
+	expected := `INSERT INTO "events" ("id", "seen_at") SELECT s."id", s."seen_at" FROM "events_temp" AS s WHERE NOT EXISTS (SELECT 1 FROM "events" AS t WHERE t."seen_at" >= (SELECT min("seen_at") FROM "events_temp") AND s."id" = t."id")`
+	if insert != expected {
+		t.Fatalf("unexpected insert:\n%s", insert)
+	}
+}
+
+func TestSyncAppendWindow(t *testing.T) {
+	pg, mock, _ := sqlmock.New()
+
+	// the second run overlaps the first by the row abc, which is already in the table and isn't appended again
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL application_name").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectTableColumns(mock, "hash", "text", "additions", "integer")
+	expectGeneratedColumns(mock)
+	mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCopy(mock, `"commits_temp"`, []driver.Value{"abc", int64(1)}, []driver.Value{"def", int64(2)})
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "commits" (LIKE "commits_temp" INCLUDING DEFAULTS)`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "commits" ("hash", "additions") SELECT s."hash", s."additions" FROM "commits_temp" AS s WHERE NOT EXISTS (SELECT 1 FROM "commits" AS t WHERE t."additions" >= (SELECT min("additions") FROM "commits_temp") AND s."hash" = t."hash")`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DROP TABLE "commits_temp"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectProvenance(mock)
+	mock.ExpectCommit()
+
+	result, err := Sync(context.Background(), &SyncOptions{
+		Postgres:        pg,
+		AskGit:          newSource(t, commitRows()),
+		TableName:       "commits",
+		Query:           "SELECT hash, additions FROM commits",
+		Logger:          zap.NewNop(),
+		Mode:            ModeAppendWindow,
+		ConflictColumns: []string{"hash"},
+		WindowColumn:    "additions",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 2 || result.Inserted != 1 {
+		t.Fatalf("expected 2 rows loaded and 1 appended, got %d and %d", result.Rows, result.Inserted)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}